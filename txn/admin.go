@@ -0,0 +1,234 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Privilege is a privilege name as shown by SHOW GRANTS
+type Privilege string
+
+const (
+	PrivilegeSelect               Privilege = "SELECT"
+	PrivilegeInsert               Privilege = "INSERT"
+	PrivilegeAlter                Privilege = "ALTER"
+	PrivilegeProcess              Privilege = "PROCESS"
+	PrivilegeSuper                Privilege = "SUPER"
+	PrivilegeConnectionAdmin      Privilege = "CONNECTION_ADMIN"
+	PrivilegeSystemVariablesAdmin Privilege = "SYSTEM_VARIABLES_ADMIN"
+)
+
+// gcPrivileges are the privileges of TriggerGC, either of them allows setting the global GC variables
+var gcPrivileges = []Privilege{PrivilegeSystemVariablesAdmin, PrivilegeSuper}
+
+// gcMinLifeTime is the shortest tidb_gc_life_time and tidb_gc_run_interval TiDB accepts
+const gcMinLifeTime = "10m"
+
+// gcSafePointPollInterval is how often TriggerGC polls the GC safe point
+const gcSafePointPollInterval = time.Second
+
+// TriggerGC shortens tidb_gc_life_time and tidb_gc_run_interval to the minimum TiDB allows (10m)
+// and waits for the GC safe point in `mysql`.`tidb` to advance, then restores both variables and
+// returns the new safe point. TiDB has no statement to run GC immediately, the GC leader applies them on its next run,
+// so it may wait for the old run interval and is bounded by ctx.
+//
+// Both variables are GLOBAL, they change the GC of the whole cluster, not only of this database: while TriggerGC waits,
+// the versions older than 10 minutes of every database may be collected, and a stale read, a snapshot read or
+// a transaction older than that fails. It needs the SYSTEM_VARIABLES_ADMIN or SUPER privilege
+func TriggerGC(ctx context.Context, db *sql.DB) (safePoint string, err error) {
+	lifeTime, runInterval := "", ""
+	if err = db.QueryRowContext(ctx, "SELECT @@GLOBAL.tidb_gc_life_time, @@GLOBAL.tidb_gc_run_interval").
+		Scan(&lifeTime, &runInterval); err != nil {
+		return "", fmt.Errorf("get GC variables: %w", err)
+	}
+	previous, err := gcSafePoint(ctx, db)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() {
+		restoreCtx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+		defer cancel()
+
+		if _, restoreErr := db.ExecContext(restoreCtx, "SET GLOBAL tidb_gc_life_time = ?", lifeTime); restoreErr != nil && err == nil {
+			err = fmt.Errorf("restore tidb_gc_life_time '%s': %w", lifeTime, restoreErr)
+		}
+		if _, restoreErr := db.ExecContext(restoreCtx, "SET GLOBAL tidb_gc_run_interval = ?", runInterval); restoreErr != nil && err == nil {
+			err = fmt.Errorf("restore tidb_gc_run_interval '%s': %w", runInterval, restoreErr)
+		}
+	}()
+
+	if _, err = db.ExecContext(ctx, "SET GLOBAL tidb_gc_life_time = '"+gcMinLifeTime+"'"); err != nil {
+		return "", err
+	}
+	if _, err = db.ExecContext(ctx, "SET GLOBAL tidb_gc_run_interval = '"+gcMinLifeTime+"'"); err != nil {
+		return "", err
+	}
+
+	ticker := time.NewTicker(gcSafePointPollInterval)
+	defer ticker.Stop()
+	for {
+		if safePoint, err = gcSafePoint(ctx, db); err != nil {
+			return "", err
+		}
+		if safePoint != previous {
+			return safePoint, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("GC safe point is still '%s': %w", previous, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// gcSafePoint reads the GC safe point from `mysql`.`tidb`, it's empty if GC has never run
+func gcSafePoint(ctx context.Context, db *sql.DB) (string, error) {
+	safePoint := ""
+	err := db.QueryRowContext(ctx, "SELECT `VARIABLE_VALUE` FROM `mysql`.`tidb` "+
+		"WHERE `VARIABLE_NAME` = 'tikv_gc_safe_point'").Scan(&safePoint)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get GC safe point: %w", err)
+	}
+	return safePoint, nil
+}
+
+// CheckPrivileges returns the privileges in needed which the current user isn't granted
+func CheckPrivileges(ctx context.Context, db *sql.DB, needed []Privilege) ([]Privilege, error) {
+	rows, err := db.QueryContext(ctx, "SHOW GRANTS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []string
+	for rows.Next() {
+		grant := ""
+		if err = rows.Scan(&grant); err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return missingPrivileges(parseGrants(grants), needed), nil
+}
+
+// requirePrivileges fails if the current user isn't granted all of needed, the error names the missing ones
+func requirePrivileges(ctx context.Context, db *sql.DB, needed ...Privilege) error {
+	missing, err := CheckPrivileges(ctx, db, needed)
+	if err != nil {
+		return fmt.Errorf("check privileges: %w", err)
+	}
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for _, privilege := range missing {
+			names = append(names, string(privilege))
+		}
+		return fmt.Errorf("missing the %s privilege", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// parseGrants collects the privileges from the SHOW GRANTS output, like "GRANT SELECT,INSERT ON *.* TO 'root'@'%'"
+func parseGrants(grants []string) map[Privilege]bool {
+	granted := make(map[Privilege]bool)
+	for _, grant := range grants {
+		upper := strings.ToUpper(grant)
+		if !strings.HasPrefix(upper, "GRANT ") {
+			continue
+		}
+
+		end := strings.Index(upper, " ON ")
+		if end < 0 {
+			continue
+		}
+
+		global := strings.HasPrefix(upper[end:], " ON *.* ")
+		for _, privilege := range strings.Split(upper[len("GRANT "):end], ",") {
+			privilege = strings.TrimSpace(privilege)
+			// ALL PRIVILEGES on a database doesn't include the global ones like SUPER
+			if privilege == "ALL PRIVILEGES" && !global {
+				continue
+			}
+			granted[Privilege(privilege)] = true
+		}
+	}
+
+	return granted
+}
+
+func missingPrivileges(granted map[Privilege]bool, needed []Privilege) []Privilege {
+	if granted["ALL PRIVILEGES"] {
+		return nil
+	}
+
+	var missing []Privilege
+	for _, privilege := range needed {
+		if !granted[privilege] {
+			missing = append(missing, privilege)
+		}
+	}
+
+	return missing
+}
+
+// AddBalanceCheckConstraint adds CHECK (balance >= 0) to `users` and CHECK (stock >= 0) to `books`,
+// so TiDB itself rejects an overdraft. CHECK constraints are enforced since TiDB v7.2.0,
+// and only when the global variable tidb_enable_check_constraint is ON, older versions parse and ignore them.
+// A constraint added before is kept, so it can run again. It needs the ALTER privilege on both tables, which is checked first
+func AddBalanceCheckConstraint(ctx context.Context, db *sql.DB) error {
+	if err := requirePrivileges(ctx, db, PrivilegeAlter); err != nil {
+		return fmt.Errorf("add check constraints: %w", err)
+	}
+
+	enabled := ""
+	err := db.QueryRowContext(ctx, "SELECT @@GLOBAL.tidb_enable_check_constraint").Scan(&enabled)
+	if err != nil {
+		return fmt.Errorf("check constraint requires TiDB v7.2.0 or later: %w", err)
+	}
+	if enabled != "1" && !strings.EqualFold(enabled, "ON") {
+		return fmt.Errorf("check constraint is disabled, run 'SET GLOBAL tidb_enable_check_constraint = ON' first")
+	}
+
+	for _, constraint := range []string{
+		"ALTER TABLE `users` ADD CONSTRAINT `users_balance_not_negative` CHECK ({balance} >= 0)",
+		"ALTER TABLE `books` ADD CONSTRAINT `books_stock_not_negative` CHECK ({stock} >= 0)",
+	} {
+		_, err = db.ExecContext(ctx, columnSQL(constraint))
+		mysqlErr := &mysql.MySQLError{}
+		if errors.As(err, &mysqlErr) && TiDBErrorCode(mysqlErr.Number) == ErrDupCheckConstraint {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+const gcSafePointSQL = "SELECT `VARIABLE_VALUE` FROM `mysql`.`tidb` WHERE `VARIABLE_NAME` = 'tikv_gc_safe_point'"
+
+// expectTriggerGC expects TriggerGC to read the GC variables of 24h and 10m and the safe point before, then set them
+func expectTriggerGC(mock sqlmock.Sqlmock, before string) {
+	mock.ExpectQuery("SELECT @@GLOBAL.tidb_gc_life_time, @@GLOBAL.tidb_gc_run_interval").
+		WillReturnRows(sqlmock.NewRows([]string{"life_time", "run_interval"}).AddRow("24h0m0s", "10m0s"))
+	mock.ExpectQuery(gcSafePointSQL).WillReturnRows(sqlmock.NewRows([]string{"VARIABLE_VALUE"}).AddRow(before))
+	mock.ExpectExec("SET GLOBAL tidb_gc_life_time = '10m'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET GLOBAL tidb_gc_run_interval = '10m'").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func expectGCRestore(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("SET GLOBAL tidb_gc_life_time = ?").WithArgs("24h0m0s").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET GLOBAL tidb_gc_run_interval = ?").WithArgs("10m0s").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestTriggerGCWaitsAndRestores(t *testing.T) {
+	db, mock := newMock(t)
+	before, after := "20261014-08:00:00.000 +0000", "20261014-08:50:00.000 +0000"
+	expectTriggerGC(mock, before)
+	mock.ExpectQuery(gcSafePointSQL).WillReturnRows(sqlmock.NewRows([]string{"VARIABLE_VALUE"}).AddRow(after))
+	expectGCRestore(mock)
+
+	safePoint, err := TriggerGC(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if safePoint != after {
+		t.Errorf("got the safe point '%s', want '%s'", safePoint, after)
+	}
+}
+
+// The variables are restored even if the safe point doesn't advance in time
+func TestTriggerGCRestoresOnTimeout(t *testing.T) {
+	db, mock := newMock(t)
+	before := "20261014-08:00:00.000 +0000"
+	expectTriggerGC(mock, before)
+	mock.ExpectQuery(gcSafePointSQL).WillReturnRows(sqlmock.NewRows([]string{"VARIABLE_VALUE"}).AddRow(before))
+	expectGCRestore(mock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := TriggerGC(ctx, db); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// The GC of a test cluster may not run within the timeout, the variables must be restored either way
+func TestTriggerGCOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	lifeTime, runInterval := "", ""
+	gcVariables := "SELECT @@GLOBAL.tidb_gc_life_time, @@GLOBAL.tidb_gc_run_interval"
+	if err := db.QueryRowContext(ctx, gcVariables).Scan(&lifeTime, &runInterval); err != nil {
+		t.Fatal(err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	if err := runGC(timeoutCtx, db, GCOptions{Timeout: 3 * time.Second}); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+
+	restoredLifeTime, restoredRunInterval := "", ""
+	if err := db.QueryRowContext(ctx, gcVariables).Scan(&restoredLifeTime, &restoredRunInterval); err != nil {
+		t.Fatal(err)
+	}
+	if restoredLifeTime != lifeTime || restoredRunInterval != runInterval {
+		t.Errorf("got the GC variables %s and %s, want %s and %s restored",
+			restoredLifeTime, restoredRunInterval, lifeTime, runInterval)
+	}
+}
+
+func TestParseGrants(t *testing.T) {
+	grants := []string{
+		"GRANT USAGE ON *.* TO 'app'@'%'",
+		"GRANT SELECT,INSERT ON `bookshop`.* TO 'app'@'%'",
+		"GRANT ALL PRIVILEGES ON `archive`.* TO 'app'@'%'",
+		"GRANT PROCESS ON *.* TO 'app'@'%'",
+		"GRANT SYSTEM_VARIABLES_ADMIN ON *.* TO 'app'@'%'",
+		"GRANT 'reader'@'%' TO 'app'@'%'",
+	}
+	want := map[Privilege]bool{"USAGE": true, PrivilegeSelect: true, PrivilegeInsert: true,
+		PrivilegeProcess: true, PrivilegeSystemVariablesAdmin: true}
+	if got := parseGrants(grants); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMissingPrivileges(t *testing.T) {
+	granted := parseGrants([]string{"GRANT SELECT,INSERT ON `bookshop`.* TO 'app'@'%'"})
+	needed := []Privilege{PrivilegeSelect, PrivilegeAlter, PrivilegeSuper}
+	if got, want := missingPrivileges(granted, needed), []Privilege{PrivilegeAlter, PrivilegeSuper}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	root := parseGrants([]string{"GRANT ALL PRIVILEGES ON *.* TO 'root'@'%' WITH GRANT OPTION"})
+	if got := missingPrivileges(root, needed); len(got) != 0 {
+		t.Errorf("root misses %v", got)
+	}
+}
+
+func TestRequirePrivileges(t *testing.T) {
+	db, mock := newMock(t)
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SHOW GRANTS").WillReturnRows(sqlmock.NewRows([]string{"Grants for app@%"}).
+			AddRow("GRANT USAGE ON *.* TO 'app'@'%'").
+			AddRow("GRANT SELECT,ALTER ON `bookshop`.* TO 'app'@'%'"))
+	}
+
+	ctx := context.Background()
+	if err := requirePrivileges(ctx, db, PrivilegeSelect, PrivilegeAlter); err != nil {
+		t.Error(err)
+	}
+	err := requirePrivileges(ctx, db, PrivilegeAlter, PrivilegeProcess, PrivilegeSuper)
+	if err == nil || err.Error() != "missing the PROCESS, SUPER privilege" {
+		t.Errorf("got %v, want the missing PROCESS and SUPER", err)
+	}
+}
+
+// A user granted nothing but SELECT on the database can't run the gc subcommand, it fails before setting anything
+func TestRunGCRequiresPrivilege(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery("SHOW GRANTS").WillReturnRows(sqlmock.NewRows([]string{"Grants for app@%"}).
+		AddRow("GRANT SELECT ON `bookshop`.* TO 'app'@'%'"))
+
+	err := runGC(context.Background(), db, GCOptions{Timeout: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "SYSTEM_VARIABLES_ADMIN or SUPER") {
+		t.Errorf("got %v, want the missing privilege", err)
+	}
+}
+
+func TestCheckPrivilegesOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	missing, err := CheckPrivileges(context.Background(), db, []Privilege{PrivilegeSelect, PrivilegeInsert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("the test user misses %v", missing)
+	}
+}
+
+const (
+	usersCheckConstraintSQL = "ALTER TABLE `users` ADD CONSTRAINT `users_balance_not_negative` CHECK (`balance` >= 0)"
+	booksCheckConstraintSQL = "ALTER TABLE `books` ADD CONSTRAINT `books_stock_not_negative` CHECK (`stock` >= 0)"
+)
+
+// A constraint added before is kept, so the prepare can run again
+func TestAddBalanceCheckConstraintKeepsExisting(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery("SHOW GRANTS").WillReturnRows(sqlmock.NewRows([]string{"Grants for app@%"}).
+		AddRow("GRANT ALTER ON `bookshop`.* TO 'app'@'%'"))
+	mock.ExpectQuery("SELECT @@GLOBAL.tidb_enable_check_constraint").WillReturnRows(sqlmock.NewRows([]string{"v"}).AddRow("1"))
+	mock.ExpectExec(usersCheckConstraintSQL).WillReturnError(&mysql.MySQLError{
+		Number: uint16(ErrDupCheckConstraint), Message: "Duplicate check constraint name 'users_balance_not_negative'."})
+	mock.ExpectExec(booksCheckConstraintSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := AddBalanceCheckConstraint(context.Background(), db); err != nil {
+		t.Error(err)
+	}
+}
+
+// Without tidb_enable_check_constraint the constraints would be ignored, so none is added
+func TestAddBalanceCheckConstraintRequiresEnabled(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery("SHOW GRANTS").WillReturnRows(sqlmock.NewRows([]string{"Grants for root@%"}).
+		AddRow("GRANT ALL PRIVILEGES ON *.* TO 'root'@'%'"))
+	mock.ExpectQuery("SELECT @@GLOBAL.tidb_enable_check_constraint").WillReturnRows(sqlmock.NewRows([]string{"v"}).AddRow("0"))
+
+	err := AddBalanceCheckConstraint(context.Background(), db)
+	if err == nil || !strings.Contains(err.Error(), "tidb_enable_check_constraint") {
+		t.Errorf("got %v, want the disabled check constraint", err)
+	}
+}
+
+// The prepare adds the constraints then TiDB rejects an overdraft. It turns tidb_enable_check_constraint on for the test
+func TestPrepareCheckConstraintsOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	enabled := ""
+	if err := db.QueryRowContext(ctx, "SELECT @@GLOBAL.tidb_enable_check_constraint").Scan(&enabled); err != nil {
+		t.Skipf("no check constraint: %v", err)
+	}
+	mustExec(t, db, "SET GLOBAL tidb_enable_check_constraint = ON")
+	t.Cleanup(func() {
+		mustExec(t, db, "ALTER TABLE `users` DROP CONSTRAINT `users_balance_not_negative`")
+		mustExec(t, db, "ALTER TABLE `books` DROP CONSTRAINT `books_stock_not_negative`")
+		mustExec(t, db, "SET GLOBAL tidb_enable_check_constraint = ?", enabled)
+	})
+
+	// twice, the second run keeps the constraints of the first one
+	for i := 0; i < 2; i++ {
+		if err := runPrepare(ctx, db, PrepareOptions{CheckConstraints: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, overdraft := range []string{
+		"UPDATE `users` SET `balance` = `balance` - 100000 WHERE `id` = 1",
+		"UPDATE `books` SET `stock` = -1 WHERE `id` = 1",
+	} {
+		_, err := db.ExecContext(ctx, overdraft)
+		mysqlErr := &mysql.MySQLError{}
+		if !errors.As(err, &mysqlErr) || TiDBErrorCode(mysqlErr.Number) != ErrCheckConstraint {
+			t.Errorf("got %v by %s, want the check constraint 3819", err, overdraft)
+		}
+	}
+}
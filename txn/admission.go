@@ -0,0 +1,109 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is returned when the admission controller sheds a request
+var ErrOverloaded = errors.New("overloaded, request shed by admission control")
+
+const latencyWindow = 100
+
+// latencyTTL is how long a latency counts for the p99, an older one expires. A controller shedding by the p99
+// recovers by it, the shed requests record no latency which could bring the p99 down
+const latencyTTL = 10 * time.Second
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// AdmissionController sheds the requests when too many are in flight
+// or the p99 latency of the recent transactions is too high, fed by Hooks
+type AdmissionController struct {
+	mu          sync.Mutex
+	maxInFlight int
+	maxP99      time.Duration
+	inFlight    int
+	latencies   []latencySample
+	next        int
+	now         func() time.Time
+}
+
+func newAdmissionController(maxInFlight int, maxP99 time.Duration) *AdmissionController {
+	return &AdmissionController{maxInFlight: maxInFlight, maxP99: maxP99, now: time.Now}
+}
+
+// Admit returns a *CancelError of ErrOverloaded or a done function which must be called when the request finishes
+func (a *AdmissionController) Admit() (func(), error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.inFlight >= a.maxInFlight || (a.maxP99 > 0 && a.p99() > a.maxP99) {
+		return nil, &CancelError{reason: CancelReasonAdmission, err: ErrOverloaded}
+	}
+
+	a.inFlight++
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.inFlight--
+	}, nil
+}
+
+// Hooks returns the hooks recording the latency of each committed transaction for the p99,
+// from the start of RunTxn to COMMIT with the retries
+func (a *AdmissionController) Hooks() TxnHooks {
+	return TxnHooks{
+		OnCommit: func(attempts int, elapsed time.Duration) {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.record(elapsed)
+		},
+	}
+}
+
+func (a *AdmissionController) record(latency time.Duration) {
+	sample := latencySample{at: a.now(), latency: latency}
+	if len(a.latencies) < latencyWindow {
+		a.latencies = append(a.latencies, sample)
+		return
+	}
+
+	a.latencies[a.next] = sample
+	a.next = (a.next + 1) % latencyWindow
+}
+
+// p99 is the p99 of the latencies recorded within latencyTTL, zero if there's none
+func (a *AdmissionController) p99() time.Duration {
+	now := a.now()
+	recent := make([]time.Duration, 0, len(a.latencies))
+	for _, sample := range a.latencies {
+		if now.Sub(sample.at) <= latencyTTL {
+			recent = append(recent, sample.latency)
+		}
+	}
+	if len(recent) == 0 {
+		return 0
+	}
+
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	return recent[(len(recent)*99-1)/100]
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAdmissionShedsInFlight(t *testing.T) {
+	admission := newAdmissionController(2, 0)
+	first, err := admission.Admit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := admission.Admit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := admission.Admit(); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("got %v with 2 in flight, want ErrOverloaded", err)
+	}
+	var cancelErr *CancelError
+	if _, err := admission.Admit(); !errors.As(err, &cancelErr) || cancelErr.Reason() != CancelReasonAdmission {
+		t.Errorf("got %v with 2 in flight, want a CancelError of the admission", err)
+	}
+
+	first()
+	done, err := admission.Admit()
+	if err != nil {
+		t.Errorf("got %v after one finished, want it admitted", err)
+	} else {
+		done()
+	}
+	second()
+}
+
+func TestAdmissionShedsHighP99(t *testing.T) {
+	admission := newAdmissionController(10, time.Millisecond)
+	for i := 0; i < latencyWindow; i++ {
+		admission.record(time.Microsecond)
+	}
+	if _, err := admission.Admit(); err != nil {
+		t.Fatalf("got %v with a low p99, want it admitted", err)
+	}
+
+	// 2 of 100 above the limit push the p99 above it
+	admission.record(10 * time.Millisecond)
+	admission.record(10 * time.Millisecond)
+	if _, err := admission.Admit(); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("got %v with a high p99, want ErrOverloaded", err)
+	}
+}
+
+// The latencies expire after latencyTTL, so a controller shedding by the p99 admits again
+// even though the shed requests record nothing
+func TestAdmissionRecoversFromHighP99(t *testing.T) {
+	admission := newAdmissionController(10, time.Millisecond)
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	admission.now = func() time.Time { return now }
+	for i := 0; i < latencyWindow; i++ {
+		admission.record(time.Second)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := admission.Admit(); !errors.Is(err, ErrOverloaded) {
+			t.Fatalf("got %v with a high p99, want ErrOverloaded", err)
+		}
+	}
+	now = now.Add(latencyTTL / 2)
+	if _, err := admission.Admit(); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("got %v before the latencies expire, want ErrOverloaded", err)
+	}
+
+	now = now.Add(latencyTTL)
+	done, err := admission.Admit()
+	if err != nil {
+		t.Fatalf("got %v after the latencies expired, want it admitted", err)
+	}
+	done()
+
+	// a fresh low latency keeps it admitting
+	admission.record(time.Microsecond)
+	if _, err := admission.Admit(); err != nil {
+		t.Errorf("got %v with a fresh low latency, want it admitted", err)
+	}
+}
+
+// The hooks record the latency of a committed transaction, a rolled back one records nothing
+func TestAdmissionHooks(t *testing.T) {
+	db, mock := newMock(t)
+	admission := newAdmissionController(10, time.Millisecond)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillDelayFor(5 * time.Millisecond).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	failed := errors.New("failed")
+	if _, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return failed
+	}, WithHooks(admission.Hooks())); !errors.Is(err, failed) {
+		t.Fatalf("got %v, want %v", err, failed)
+	}
+	if len(admission.latencies) != 0 {
+		t.Errorf("got the latencies %v of a rolled back transaction, want none", admission.latencies)
+	}
+
+	if _, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return nil
+	}, WithHooks(admission.Hooks())); err != nil {
+		t.Fatal(err)
+	}
+	if len(admission.latencies) != 1 || admission.latencies[0].latency < 5*time.Millisecond {
+		t.Errorf("got the latencies %v, want the one of the commit", admission.latencies)
+	}
+	if _, err := admission.Admit(); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("got %v after a slow commit, want ErrOverloaded", err)
+	}
+}
+
+// A shed buy returns ErrOverloaded without any SQL, the mock has no expectations
+func TestRouterBuyShedWithoutSQL(t *testing.T) {
+	db, _ := newMock(t)
+	admission := newAdmissionController(1, 0)
+	done, err := admission.Admit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	router := NewRouter(db, db).WithPurchaseOptions(noDelay()).WithAdmission(admission)
+	if _, err := router.Buy(context.Background(), true, 1, 0, 1, 2, 1); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("got %v, want ErrOverloaded", err)
+	}
+}
+
+// The buys of the router feed the admission by their transactions
+func TestRouterBuyFeedsAdmission(t *testing.T) {
+	db, mock := newMock(t)
+	admission := newAdmissionController(10, time.Hour)
+	expectBuy(mock)
+
+	router := NewRouter(db, db).WithPurchaseOptions(noDelay()).WithAdmission(admission)
+	if _, err := router.Buy(context.Background(), false, 1, 0, 1, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(admission.latencies) != 1 || admission.inFlight != 0 {
+		t.Errorf("got the latencies %v and %d in flight, want the buy recorded and done", admission.latencies, admission.inFlight)
+	}
+}
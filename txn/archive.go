@@ -0,0 +1,122 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// archiveTableSQL creates `orders_archive` with the columns of `orders`. The id is a plain bigint,
+// the archived ids are copied from `orders` rather than generated
+func archiveTableSQL() string {
+	return columnSQL("CREATE TABLE IF NOT EXISTS `orders_archive` (" +
+		"`id` bigint NOT NULL, " +
+		"`book_id` bigint NOT NULL, " +
+		"`user_id` bigint NOT NULL, " +
+		"{quality} tinyint NOT NULL, " +
+		"`ordered_at` datetime NOT NULL, " +
+		"`idempotency_key` varchar(64) DEFAULT NULL, " +
+		"PRIMARY KEY (`id`) CLUSTERED, " +
+		"KEY `orders_archive_ordered_at_idx` (`ordered_at`))")
+}
+
+// archiveColumns are the columns copied from `orders` into `orders_archive`
+func archiveColumns() string {
+	return columnSQL("`id`, `book_id`, `user_id`, {quality}, `ordered_at`, `idempotency_key`")
+}
+
+// archiveOldOrders moves the orders ordered before the cutoff into `orders_archive` in batches,
+// each batch in its own transaction, and returns the number of archived orders
+func archiveOldOrders(ctx context.Context, db *sql.DB, before time.Time, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+
+	exist := 0
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM `INFORMATION_SCHEMA`.`TABLES` "+
+		"WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = 'orders_archive'").Scan(&exist)
+	if err != nil {
+		return 0, err
+	}
+	if exist == 0 {
+		return 0, fmt.Errorf("table `orders_archive` not exist, create it by 'txn archive -create-table' first")
+	}
+
+	total := 0
+	for {
+		archived, err := archiveOrdersBatch(ctx, db, before, batchSize)
+		total += archived
+		if err != nil {
+			return total, err
+		}
+
+		if archived < batchSize {
+			return total, nil
+		}
+	}
+}
+
+func archiveOrdersBatch(ctx context.Context, db *sql.DB, before time.Time, batchSize int) (int, error) {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+
+	rows, err := txn.QueryContext(ctx, "SELECT `id` FROM `orders` WHERE `ordered_at` < ? "+
+		"ORDER BY `id` LIMIT ? FOR UPDATE", before, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	columns := archiveColumns()
+	if _, err = txn.ExecContext(ctx, "INSERT INTO `orders_archive` ("+columns+") SELECT "+columns+" FROM `orders` "+
+		"WHERE `id` IN ("+placeholders+")", ids...); err != nil {
+		return 0, err
+	}
+
+	if _, err = txn.ExecContext(ctx, "DELETE FROM `orders` WHERE `id` IN ("+placeholders+")", ids...); err != nil {
+		return 0, err
+	}
+
+	if err = txn.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(ids), nil
+}
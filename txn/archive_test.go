@@ -0,0 +1,79 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestArchiveOldOrdersRequiresArchiveTable(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery("SELECT COUNT(*) FROM `INFORMATION_SCHEMA`.`TABLES` " +
+		"WHERE `TABLE_SCHEMA` = DATABASE() AND `TABLE_NAME` = 'orders_archive'").
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(0))
+
+	archived, err := archiveOldOrders(context.Background(), db, time.Now(), 10)
+	if err == nil || !strings.Contains(err.Error(), "-create-table") {
+		t.Errorf("got %v, want the missing table error", err)
+	}
+	if archived != 0 {
+		t.Errorf("archived %d orders, want 0", archived)
+	}
+}
+
+// Five old orders are moved in batches of two, the two recent ones stay in `orders`
+func TestArchiveOldOrdersOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	mustExec(t, db, "DROP TABLE IF EXISTS `orders_archive`")
+	t.Cleanup(func() {
+		mustExec(t, db, "DROP TABLE IF EXISTS `orders_archive`")
+	})
+
+	if _, err := archiveOldOrders(ctx, db, time.Now(), 2); err == nil {
+		t.Fatal("archive without orders_archive succeeded")
+	}
+
+	mustExec(t, db, "INSERT INTO `orders` (`book_id`, `user_id`, `quality`, `ordered_at`) VALUES "+
+		"(1, 1, 1, '2020-01-01 00:00:00'), (1, 1, 1, '2020-01-02 00:00:00'), (1, 1, 1, '2020-01-03 00:00:00'), "+
+		"(1, 1, 1, '2020-01-04 00:00:00'), (1, 1, 1, '2020-01-05 00:00:00'), "+
+		"(1, 1, 1, '2030-01-01 00:00:00'), (1, 1, 1, '2030-01-02 00:00:00')")
+	if err := runArchive(ctx, db, ArchiveOptions{OlderThan: 0, BatchSize: 2, CreateTable: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for table, want := range map[string]int{"orders": 2, "orders_archive": 5} {
+		count := 0
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+quoteIdentifier(table)).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != want {
+			t.Errorf("%s has %d orders, want %d", table, count, want)
+		}
+	}
+
+	var latest time.Time
+	if err := db.QueryRowContext(ctx, "SELECT MAX(`ordered_at`) FROM `orders_archive`").Scan(&latest); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC); !latest.Equal(want) {
+		t.Errorf("latest archived order at %s, want %s", latest, want)
+	}
+}
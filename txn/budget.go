@@ -0,0 +1,63 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// WithBudget bounds the whole transaction by budget, its attempts as well as the backoff between them.
+// Each attempt runs under the deadline of the rest of the budget and is rolled back when it passes,
+// a retry whose backoff doesn't fit the rest of the budget isn't run. Either fails with a *TxnError of ErrBudgetExhausted
+func WithBudget(budget time.Duration) TxnOption {
+	return func(o *txnOptions) {
+		o.budget = budget
+	}
+}
+
+// budgetContext returns ctx bounded by the budget of the transaction and its deadline, or ctx itself without a budget
+func (o *txnOptions) budgetContext(ctx context.Context) (context.Context, time.Time, context.CancelFunc) {
+	if o.budget <= 0 {
+		return ctx, time.Time{}, func() {}
+	}
+	deadline := time.Now().Add(o.budget)
+	budgetCtx, cancel := context.WithDeadline(ctx, deadline)
+	return budgetCtx, deadline, cancel
+}
+
+// BuyWithinBudget buys like buyPessimistic or buyOptimistic within budget, for a caller with a latency SLA.
+// The whole buy, the steps before the transaction included, runs under the deadline of the budget,
+// and the transaction is run by WithBudget with the rest of it, a retry which can't finish in time isn't started.
+// An exhausted budget rolls back the buy and returns a *TxnError of ErrBudgetExhausted
+func BuyWithinBudget(ctx context.Context, db *sql.DB, options PurchaseOptions, budget time.Duration, optimistic bool,
+	orderID, bookID, userID, amount int) error {
+	buyFunc := buyOptimistic
+	if !optimistic {
+		buyFunc = buyPessimistic
+	}
+
+	budgetCtx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	options.Txn = append(options.Txn[:len(options.Txn):len(options.Txn)], WithBudget(budget))
+
+	_, err := buyFunc(budgetCtx, db, options, 1, orderID, bookID, userID, amount)
+	if err != nil && !errors.Is(err, ErrBudgetExhausted) && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return &TxnError{Kind: ErrBudgetExhausted, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+// An attempt still running when the budget runs out is rolled back, the transaction isn't retried
+func TestRunTxnBudgetExhaustedInAttempt(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SELECT SLEEP(1)").WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	start := time.Now()
+	result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "SELECT SLEEP(1)")
+		return err
+	}, WithBudget(20*time.Millisecond))
+	if !errors.Is(err, ErrBudgetExhausted) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want an exhausted budget", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the transaction took %s, over its budget", elapsed)
+	}
+	if result.Attempts != 1 {
+		t.Errorf("got %d attempts, want 1", result.Attempts)
+	}
+}
+
+// A retry whose backoff doesn't fit the rest of the budget isn't run, and the backoff isn't slept
+func TestRunTxnBudgetStopsRetrying(t *testing.T) {
+	db, mock := newMock(t)
+	delays := noSleep(t)
+	deadlock := &mysql.MySQLError{Number: uint16(ErrLockDeadlock), Message: "deadlock"}
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return deadlock
+	}, WithBackoff(time.Second, time.Second), WithBudget(100*time.Millisecond))
+	if !errors.Is(err, ErrBudgetExhausted) || !errors.As(err, &deadlock) {
+		t.Errorf("got %v, want an exhausted budget after the deadlock", err)
+	}
+	if result.Attempts != 1 || len(*delays) != 0 {
+		t.Errorf("got %d attempts and the backoff %v, want a single attempt", result.Attempts, *delays)
+	}
+}
+
+// Retries which fit the budget run as usual
+func TestRunTxnBudgetRetries(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	deadlock := &mysql.MySQLError{Number: uint16(ErrLockDeadlock), Message: "deadlock"}
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	attempts := 0
+	result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		attempts++
+		if attempts == 1 {
+			return deadlock
+		}
+		return nil
+	}, WithBackoff(time.Millisecond, time.Millisecond), WithBudget(time.Minute))
+	if err != nil || result.Attempts != 2 {
+		t.Errorf("got %d attempts, %v, want the retry to commit", result.Attempts, err)
+	}
+}
+
+// A tight budget ends the buy while it waits on the stock, the buy is rolled back before the order and the debit
+func TestBuyWithinBudgetTight(t *testing.T) {
+	db, mock := newMock(t)
+	publishedAt := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(bookSQL(true)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(1, "Book 1", "Novel", publishedAt, "100", 10))
+	mock.ExpectExec(updateStockSQL()).WithArgs(2, 1, 2).WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	start := time.Now()
+	err := BuyWithinBudget(context.Background(), db, noDelay(), 30*time.Millisecond, false, 0, 1, 1, 2)
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("got %v, want an exhausted budget", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the buy took %s, over its budget", elapsed)
+	}
+}
+
+// The caller's own deadline isn't reported as the budget
+func TestBuyWithinBudgetCallerDeadline(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(bookSQL(true)).WithArgs(1).WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := BuyWithinBudget(ctx, db, noDelay(), time.Minute, false, 0, 1, 1, 2)
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("got %v, want the deadline of the caller", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// maxPlaceholders is the most placeholders a prepared statement of TiDB takes
+const maxPlaceholders = 65535
+
+// seedBookIDBase is the id before the first book seeded by -seed-books, the demo books stay below it
+const seedBookIDBase = 10000
+
+// placeholderRows returns rows groups of columns placeholders, like (?, ?), (?, ?)
+func placeholderRows(columns, rows int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", columns), ", ") + ")"
+	return strings.TrimSuffix(strings.Repeat(row+", ", rows), ", ")
+}
+
+// bulkBatches splits n rows of columns placeholders each into batches of at most batchSize rows,
+// a batch is capped by maxPlaceholders too. It returns the bounds of the batches
+func bulkBatches(n, columns, batchSize int) ([][2]int, error) {
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+	if limit := maxPlaceholders / columns; batchSize > limit {
+		batchSize = limit
+	}
+
+	var batches [][2]int
+	for start := 0; start < n; start += batchSize {
+		end := start + batchSize
+		if end > n {
+			end = n
+		}
+		batches = append(batches, [2]int{start, end})
+	}
+	return batches, nil
+}
+
+// BulkResult is the outcome of a bulk write. Rows counts the rows written, Affected the rows affected
+// as the server reports them, in total and by each batch in order. An upsert affects a new row once,
+// an updated one twice and an unchanged one not at all, so its Affected isn't the rows inserted
+type BulkResult struct {
+	Rows     int
+	Affected int
+	Batches  []int
+}
+
+// execBatch runs a batch of rows rows of a bulk write and records the rows it affected
+func (r *BulkResult) execBatch(ctx context.Context, conn *sql.Conn, rows int, query string, args ...interface{}) error {
+	res, err := conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	r.Rows += rows
+	r.Affected += int(affected)
+	r.Batches = append(r.Batches, int(affected))
+	return nil
+}
+
+// createBooksBulk writes books batchSize rows per multi-row INSERT ... ON DUPLICATE KEY UPDATE,
+// a book which exists is reset to the given one, so a seed can run again.
+// Every statement commits on its own unless conn is in a transaction, which bounds the transaction size.
+// A failure is returned with the index of its batch, the batches before it are written and in the result
+func createBooksBulk(ctx context.Context, conn *sql.Conn, books []Book, batchSize int) (BulkResult, error) {
+	result := BulkResult{}
+	batches, err := bulkBatches(len(books), 6, batchSize)
+	if err != nil {
+		return result, err
+	}
+
+	for i, batch := range batches {
+		rows := books[batch[0]:batch[1]]
+		args := make([]interface{}, 0, len(rows)*6)
+		for _, book := range rows {
+			args = append(args, book.ID, book.Title, book.Type, book.PublishedAt, book.Price, book.Stock)
+		}
+		if err = result.execBatch(ctx, conn, len(rows), createBooksSQL(len(rows)), args...); err != nil {
+			return result, fmt.Errorf("batch %d of books: %w", i, err)
+		}
+	}
+	return result, nil
+}
+
+// createUsersBulk is createBooksBulk of users
+func createUsersBulk(ctx context.Context, conn *sql.Conn, users []User, batchSize int) (BulkResult, error) {
+	result := BulkResult{}
+	batches, err := bulkBatches(len(users), 3, batchSize)
+	if err != nil {
+		return result, err
+	}
+
+	for i, batch := range batches {
+		rows := users[batch[0]:batch[1]]
+		args := make([]interface{}, 0, len(rows)*3)
+		for _, user := range rows {
+			args = append(args, user.ID, user.Nickname, user.Balance)
+		}
+		if err = result.execBatch(ctx, conn, len(rows), createUsersSQL(len(rows)), args...); err != nil {
+			return result, fmt.Errorf("batch %d of users: %w", i, err)
+		}
+	}
+	return result, nil
+}
+
+// createOrdersBulk is createBooksBulk of orders by a plain INSERT, they're inserted with generated ids
+// and without idempotency keys, so OrderedAt must be set
+func createOrdersBulk(ctx context.Context, conn *sql.Conn, orders []Order, batchSize int) (BulkResult, error) {
+	result := BulkResult{}
+	batches, err := bulkBatches(len(orders), 4, batchSize)
+	if err != nil {
+		return result, err
+	}
+
+	for i, batch := range batches {
+		rows := orders[batch[0]:batch[1]]
+		args := make([]interface{}, 0, len(rows)*4)
+		for _, order := range rows {
+			args = append(args, order.BookID, order.UserID, order.Quality, order.OrderedAt)
+		}
+		if err = result.execBatch(ctx, conn, len(rows), createOrdersSQL(len(rows)), args...); err != nil {
+			return result, fmt.Errorf("batch %d of orders: %w", i, err)
+		}
+	}
+	return result, nil
+}
+
+// seedCatalogue upserts n random books after seedBookIDBase, the same n always seeds the same books.
+// They're loaded by LOAD DATA LOCAL INFILE with seedLoadData, or by createBooksBulk if the server rejects it
+func seedCatalogue(ctx context.Context, db *sql.DB, n int) error {
+	random := rand.New(rand.NewSource(int64(n)))
+	books := make([]Book, 0, n)
+	for i := 1; i <= n; i++ {
+		books = append(books, randomBook(random, seedBookIDBase+i))
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if seedLoadData {
+		start := time.Now()
+		loaded, err := loadBooksLocalInfile(ctx, conn, books)
+		if !isLocalInfileRejected(err) {
+			if err == nil {
+				fmt.Printf("seeded %d books by LOAD DATA LOCAL INFILE, elapsed: %s\n", loaded, time.Since(start))
+			}
+			return err
+		}
+		logger.Errorf("LOAD DATA LOCAL INFILE is rejected by the server, seed by bulk insert: %v", err)
+	}
+
+	start := time.Now()
+	result, err := createBooksBulk(ctx, conn, books, 1000)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("seeded %d books by bulk insert, elapsed: %s\n", result.Rows, time.Since(start))
+	return nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+func TestPlaceholderRows(t *testing.T) {
+	if rows := placeholderRows(3, 2); rows != "(?, ?, ?), (?, ?, ?)" {
+		t.Errorf("got %s", rows)
+	}
+}
+
+func TestBulkBatches(t *testing.T) {
+	for _, test := range []struct {
+		name                string
+		n, columns, perStmt int
+		want                [][2]int
+	}{
+		{"empty", 0, 6, 10, nil},
+		{"batch larger than the rows", 3, 6, 10, [][2]int{{0, 3}}},
+		{"exact batches", 4, 6, 2, [][2]int{{0, 2}, {2, 4}}},
+		{"last batch shorter", 5, 6, 2, [][2]int{{0, 2}, {2, 4}, {4, 5}}},
+		{"capped by the placeholders", 20000, 6, 20000, [][2]int{{0, 10922}, {10922, 20000}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			batches, err := bulkBatches(test.n, test.columns, test.perStmt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(batches, test.want) {
+				t.Errorf("got %v, want %v", batches, test.want)
+			}
+		})
+	}
+
+	for _, batchSize := range []int{0, -1} {
+		if _, err := bulkBatches(10, 6, batchSize); err == nil {
+			t.Errorf("batch size %d is accepted", batchSize)
+		}
+	}
+}
+
+// No rows run no statement, rows fewer than the batch size go in a single statement
+func TestCreateBooksBulk(t *testing.T) {
+	conn, mock := newMockConn(t)
+	result, err := createBooksBulk(context.Background(), conn, nil, 10)
+	if err != nil || result.Rows != 0 || result.Affected != 0 || len(result.Batches) != 0 {
+		t.Errorf("got %+v, %v of no books, want nothing", result, err)
+	}
+
+	books := []Book{testBook(1, "Novel", "1", 1), testBook(2, "Novel", "2", 2), testBook(3, "Novel", "3", 3)}
+	args := []driver.Value{}
+	for _, book := range books {
+		args = append(args, book.ID, book.Title, book.Type, book.PublishedAt, book.Price, book.Stock)
+	}
+	mock.ExpectExec(createBooksSQL(3)).WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	if result, err = createBooksBulk(context.Background(), conn, books, 10); err != nil {
+		t.Fatal(err)
+	}
+	if want := (BulkResult{Rows: 3, Affected: 3, Batches: []int{3}}); !reflect.DeepEqual(result, want) {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+}
+
+// The first failed batch is returned with its index, the rows of the batches before it are counted
+func TestCreateUsersBulkFailedBatch(t *testing.T) {
+	conn, mock := newMockConn(t)
+	users := make([]User, 5)
+	for i := range users {
+		users[i] = User{ID: i + 1, Balance: decimal.NewFromInt(100), Nickname: string(rune('a' + i))}
+	}
+	failed := errors.New("failed")
+	mock.ExpectExec(createUsersSQL(2)).WithArgs(1, "a", users[0].Balance, 2, "b", users[1].Balance).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(createUsersSQL(2)).WithArgs(3, "c", users[2].Balance, 4, "d", users[3].Balance).
+		WillReturnError(failed)
+
+	result, err := createUsersBulk(context.Background(), conn, users, 2)
+	if !errors.Is(err, failed) || !strings.Contains(err.Error(), "batch 1 of users") {
+		t.Errorf("got %v, want the failure of batch 1", err)
+	}
+	if want := (BulkResult{Rows: 2, Affected: 2, Batches: []int{2}}); !reflect.DeepEqual(result, want) {
+		t.Errorf("got %+v, want the first batch %+v", result, want)
+	}
+}
+
+// Each batch of orders reports its rows, a short batch reporting fewer rows shows in its count
+func TestCreateOrdersBulk(t *testing.T) {
+	conn, mock := newMockConn(t)
+	orderedAt := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	orders := make([]Order, 5)
+	for i := range orders {
+		orders[i] = Order{BookID: 1, UserID: i + 1, Quality: 1, OrderedAt: orderedAt}
+	}
+	mock.ExpectExec(createOrdersSQL(2)).WithArgs(1, 1, 1, orderedAt, 1, 2, 1, orderedAt).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(createOrdersSQL(2)).WithArgs(1, 3, 1, orderedAt, 1, 4, 1, orderedAt).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(createOrdersSQL(1)).WithArgs(1, 5, 1, orderedAt).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	result, err := createOrdersBulk(context.Background(), conn, orders, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (BulkResult{Rows: 5, Affected: 4, Batches: []int{2, 2, 0}}); !reflect.DeepEqual(result, want) {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+}
+
+// The rows affected of every bulk helper add up to its input on TiDB, an upsert of the same books again
+// only affects the changed one, twice
+func TestBulkResultOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	const n, batchSize = 2500, 1000
+	books, users := randomRows(n, 7)
+	orders := make([]Order, n)
+	for i := range orders {
+		orders[i] = Order{BookID: books[i].ID, UserID: users[i].ID, Quality: 1, OrderedAt: time.Now()}
+	}
+	clean := func() {
+		for _, table := range []string{"orders", "books", "users"} {
+			column := "`id`"
+			if table == "orders" {
+				column = "`book_id`"
+			}
+			mustExec(t, db, "DELETE FROM "+quoteIdentifier(table)+" WHERE "+column+" BETWEEN ? AND ?",
+				randomSeedIDBase+1, randomSeedIDBase+n)
+		}
+	}
+	clean()
+	t.Cleanup(clean)
+
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		for name, create := range map[string]func() (BulkResult, error){
+			"books":  func() (BulkResult, error) { return createBooksBulk(ctx, conn, books, batchSize) },
+			"users":  func() (BulkResult, error) { return createUsersBulk(ctx, conn, users, batchSize) },
+			"orders": func() (BulkResult, error) { return createOrdersBulk(ctx, conn, orders, batchSize) },
+		} {
+			result, err := create()
+			if err != nil {
+				return err
+			}
+			if want := (BulkResult{Rows: n, Affected: n, Batches: []int{1000, 1000, 500}}); !reflect.DeepEqual(result, want) {
+				t.Errorf("got %+v of the %s, want %+v", result, name, want)
+			}
+		}
+
+		books[0].Stock++
+		result, err := createBooksBulk(ctx, conn, books, batchSize)
+		if err != nil {
+			return err
+		}
+		if want := (BulkResult{Rows: n, Affected: 2, Batches: []int{2, 0, 0}}); !reflect.DeepEqual(result, want) {
+			t.Errorf("got %+v of the upsert again, want %+v", result, want)
+		}
+		return nil
+	})
+}
+
+// SeedOptions.Books seeds the random books after seedBookIDBase and leaves the demo book alone
+func TestPrepareDataSeedBooksOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{Books: 2500}); err != nil {
+		t.Fatal(err)
+	}
+
+	seeded, minID, maxID := 0, 0, 0
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*), MIN(`id`), MAX(`id`) FROM `books` WHERE `id` > ?", seedBookIDBase).
+		Scan(&seeded, &minID, &maxID); err != nil {
+		t.Fatal(err)
+	}
+	if seeded != 2500 || minID != seedBookIDBase+1 || maxID != seedBookIDBase+2500 {
+		t.Errorf("got %d books from %d to %d, want 2500 from %d", seeded, minID, maxID, seedBookIDBase+1)
+	}
+
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		book, err := GetBook(ctx, conn, 1)
+		if err != nil {
+			return err
+		}
+		if book.Stock != initialBookStock {
+			t.Errorf("got the demo stock %d, want %d", book.Stock, initialBookStock)
+		}
+		return nil
+	})
+}
+
+// benchBulkRows is the number of books a bulk benchmark writes per op
+const benchBulkRows = 1000
+
+// benchmarkCreateBooks writes benchBulkRows random books by create per op and reports the rows written per second
+func benchmarkCreateBooks(b *testing.B, create func(ctx context.Context, conn *sql.Conn, books []Book) error) {
+	db := openTestDB(b)
+	ctx := context.Background()
+	random := rand.New(rand.NewSource(1))
+	books := make([]Book, 0, benchBulkRows)
+	for i := 1; i <= benchBulkRows; i++ {
+		books = append(books, randomBook(random, seedBookIDBase+i))
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if err := create(ctx, conn, books); err != nil {
+			b.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N*benchBulkRows)/elapsed.Seconds(), "rows/s")
+}
+
+func Benchmark_CreateBooks_SingleRow(b *testing.B) {
+	benchmarkCreateBooks(b, func(ctx context.Context, conn *sql.Conn, books []Book) error {
+		repo := NewBookRepo(conn)
+		for _, book := range books {
+			if err := repo.CreateBook(ctx, book); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func Benchmark_CreateBooks_Bulk(b *testing.B) {
+	benchmarkCreateBooks(b, func(ctx context.Context, conn *sql.Conn, books []Book) error {
+		_, err := createBooksBulk(ctx, conn, books, benchBulkRows)
+		return err
+	})
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// CartItem is a line of a cart
+type CartItem struct {
+	BookID int
+	Amount int
+}
+
+// normalizeCart merges the items of the same book and sorts them by book id,
+// the books are locked in this order so two concurrent carts never deadlock
+func normalizeCart(options PurchaseOptions, items []CartItem) ([]CartItem, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w, the cart is empty", ErrInvalidAmount)
+	}
+
+	amounts := make(map[int]int, len(items))
+	for _, item := range items {
+		if item.Amount <= 0 {
+			return nil, fmt.Errorf("%w, got %d of book %d", ErrInvalidAmount, item.Amount, item.BookID)
+		}
+		amounts[item.BookID] += item.Amount
+	}
+
+	cart := make([]CartItem, 0, len(amounts))
+	for bookID, amount := range amounts {
+		if err := options.checkQuantity(amount); err != nil {
+			return nil, err
+		}
+		cart = append(cart, CartItem{BookID: bookID, Amount: amount})
+	}
+	sort.Slice(cart, func(i, j int) bool {
+		return cart[i].BookID < cart[j].BookID
+	})
+
+	return cart, nil
+}
+
+// buyCart buys all the items for a user in one pessimistic transaction, the i-th item of the sorted cart
+// is ordered as orderID+i with PurchaseOptions.ExplicitOrderID, and the total cost is debited once. If any item can't be bought the whole cart is rolled back
+func buyCart(ctx context.Context, db *sql.DB, options PurchaseOptions, orderID, userID int, items []CartItem) error {
+	cart, err := normalizeCart(options, items)
+	if err != nil {
+		return err
+	}
+	if err = waitBuying(ctx); err != nil {
+		return err
+	}
+
+	logger.Infof("\nuser %d try to buy a cart of %d books", userID, len(cart))
+
+	return runTxn(ctx, db, false, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		books, users, orders := NewBookRepo(conn), NewUserRepo(conn), NewOrderRepo(conn)
+		txnComment := fmt.Sprintf("/* cart of user %d */ ", userID)
+
+		total := decimal.Zero
+		for i, item := range cart {
+			book, err := books.GetForUpdate(ctx, item.BookID)
+			if err != nil {
+				return err
+			}
+			logger.Infof("%s%s successful (id: %d)", txnComment, bookSQL(true), item.BookID)
+
+			updated, err := books.UpdateStock(ctx, item.BookID, item.Amount)
+			if err != nil {
+				return err
+			}
+			logger.Infof("%s%s successful (id: %d)", txnComment, updateStockSQL(), item.BookID)
+
+			if !updated {
+				return fmt.Errorf("book %d: %w", item.BookID, ErrStockInsufficient)
+			}
+
+			order := Order{ID: options.orderIDFor(orderID + i), BookID: item.BookID, UserID: userID, Quality: item.Amount,
+				UnitPrice: decimal.NewNullDecimal(book.Price)}
+			if order.ID, err = orders.CreateOrder(ctx, order); err != nil {
+				return err
+			}
+			logger.Infof("%s%s successful (id: %d)", txnComment, insertOrderSQL(), order.ID)
+
+			total = total.Add(book.Price.Mul(decimal.NewFromInt(int64(item.Amount))))
+		}
+
+		debited, err := users.DebitBalance(ctx, userID, total)
+		if err != nil {
+			return err
+		}
+		logger.Infof("%s%s successful", txnComment, debitBalanceSQL())
+
+		if !debited {
+			return ErrBalanceInsufficient
+		}
+		return nil
+	}, options.txnOptions()...)
+}
+
+// CartItemResult is the outcome of an item of a best-effort cart, Err is nil if it's ordered
+type CartItemResult struct {
+	Item    CartItem
+	OrderID int
+	Err     error
+}
+
+// buyCartBestEffort buys the items of a cart in one pessimistic transaction, each item behind a savepoint.
+// An item failing for the business, like the stock or the balance, is rolled back to its savepoint alone
+// and the other items still commit. Any other error rolls back the whole transaction, which may be retried.
+// It's invisible to the runner and its hooks, a ROLLBACK TO SAVEPOINT is neither a rollback nor a retry
+func buyCartBestEffort(ctx context.Context, db *sql.DB, options PurchaseOptions, userID int, items []CartItem) ([]CartItemResult, error) {
+	cart, err := normalizeCart(options, items)
+	if err != nil {
+		return nil, err
+	}
+	if err = waitBuying(ctx); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("\nuser %d try to buy a cart of %d books, best effort", userID, len(cart))
+
+	var results []CartItemResult
+	err = runTxn(ctx, db, false, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		books, users, orders := NewBookRepo(conn), NewUserRepo(conn), NewOrderRepo(conn)
+		txnComment := fmt.Sprintf("/* best-effort cart of user %d */ ", userID)
+
+		// a retry starts over
+		results = make([]CartItemResult, 0, len(cart))
+		for i, item := range cart {
+			savepoint := fmt.Sprintf("item_%d", i)
+			if err := Savepoint(ctx, conn, savepoint); err != nil {
+				return err
+			}
+
+			orderID, err := buyCartItem(ctx, books, users, orders, userID, item)
+			switch {
+			case err == nil:
+				logger.Infof("%sbook %d ordered (order id: %d)", txnComment, item.BookID, orderID)
+				if err = ReleaseSavepoint(ctx, conn, savepoint); err != nil {
+					return err
+				}
+			case isBusinessFailure(err):
+				logger.Infof("%sbook %d failed, rollback to savepoint %s: %v", txnComment, item.BookID, savepoint, err)
+				if rollbackErr := RollbackTo(ctx, conn, savepoint); rollbackErr != nil {
+					return rollbackErr
+				}
+			default:
+				return err
+			}
+			results = append(results, CartItemResult{Item: item, OrderID: orderID, Err: err})
+		}
+		return nil
+	}, options.txnOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// buyCartItem orders an item of a cart and debits its cost, it returns the id of the order
+func buyCartItem(ctx context.Context, books BookRepo, users UserRepo, orders OrderRepo, userID int, item CartItem) (int, error) {
+	book, err := books.GetForUpdate(ctx, item.BookID)
+	if err != nil {
+		return 0, err
+	}
+
+	updated, err := books.UpdateStock(ctx, item.BookID, item.Amount)
+	if err != nil {
+		return 0, err
+	}
+	if !updated {
+		return 0, fmt.Errorf("book %d: %w", item.BookID, ErrStockInsufficient)
+	}
+
+	orderID, err := orders.CreateOrder(ctx, Order{BookID: item.BookID, UserID: userID, Quality: item.Amount,
+		UnitPrice: decimal.NewNullDecimal(book.Price)})
+	if err != nil {
+		return 0, err
+	}
+
+	debited, err := users.DebitBalance(ctx, userID, book.Price.Mul(decimal.NewFromInt(int64(item.Amount))))
+	if err != nil {
+		return 0, err
+	}
+	if !debited {
+		return 0, ErrBalanceInsufficient
+	}
+	return orderID, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// The items of a book are merged and the cart is sorted by book id, the order the books are locked in
+func TestNormalizeCart(t *testing.T) {
+	cart, err := normalizeCart(noDelay(), []CartItem{{BookID: 3, Amount: 1}, {BookID: 1, Amount: 2}, {BookID: 3, Amount: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []CartItem{{BookID: 1, Amount: 2}, {BookID: 3, Amount: 5}}; !reflect.DeepEqual(cart, want) {
+		t.Errorf("got %v, want %v", cart, want)
+	}
+
+	for _, items := range [][]CartItem{nil, {{BookID: 1, Amount: 1}, {BookID: 2, Amount: 0}}} {
+		if _, err := normalizeCart(noDelay(), items); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("got %v for %v, want %v", err, items, ErrInvalidAmount)
+		}
+	}
+}
+
+// A cart which can't buy one of its items leaves no order, stock or balance change behind
+func TestBuyCartAllOrNothingOnTiDB(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		balance string
+		items   []CartItem
+		want    error
+	}{
+		{"stock insufficient", "10000", []CartItem{{BookID: 1, Amount: 2}, {BookID: 2, Amount: 4}}, ErrStockInsufficient},
+		{"balance insufficient", "250", []CartItem{{BookID: 1, Amount: 2}, {BookID: 2, Amount: 1}}, ErrBalanceInsufficient},
+		{"book not found", "10000", []CartItem{{BookID: 1, Amount: 2}, {BookID: 3, Amount: 1}}, ErrBookNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDB(t)
+			ctx := context.Background()
+			createTestBooks(t, db, testBook(1, "Novel", "100", 10), testBook(2, "Novel", "80", 3))
+			createTestUsers(t, db, User{ID: 1, Balance: decimal.RequireFromString(test.balance), Nickname: "Bob"})
+
+			if err := buyCart(ctx, db, noDelay(), 0, 1, test.items); !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+
+			withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+				orders, err := ListOrders(ctx, conn)
+				if err != nil {
+					return err
+				}
+				if len(orders) != 0 {
+					t.Errorf("got %d orders, want none", len(orders))
+				}
+				user, err := GetUser(ctx, conn, 1)
+				if err != nil {
+					return err
+				}
+				if !user.Balance.Equal(decimal.RequireFromString(test.balance)) {
+					t.Errorf("got the balance %s, want %s", user.Balance, test.balance)
+				}
+				return nil
+			})
+			if err := assertCommitted(ctx, db, 1, 10); err != nil {
+				t.Error(err)
+			}
+			if err := assertCommitted(ctx, db, 2, 3); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Two overlapping carts listing their books in opposite orders compete for the last copies of book 1:
+// they don't deadlock, one commits all its orders and the other leaves none
+func TestCompetingCartsOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := competingCarts(ctx, db, noDelay()); err != nil {
+		t.Fatal(err)
+	}
+
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		var ordered []int
+		for _, userID := range []int{1, 2} {
+			orders, err := ListOrdersByUser(ctx, conn, userID)
+			if err != nil {
+				return err
+			}
+			ordered = append(ordered, len(orders))
+		}
+		if !reflect.DeepEqual(ordered, []int{2, 0}) && !reflect.DeepEqual(ordered, []int{0, 2}) {
+			t.Errorf("got the orders %v of the users, want one cart of 2 orders and one of none", ordered)
+		}
+
+		book, err := GetBook(ctx, conn, 1)
+		if err != nil {
+			return err
+		}
+		if book.Stock != initialBookStock-6 && book.Stock != initialBookStock-5 {
+			t.Errorf("got the stock %d of book 1, want one cart bought", book.Stock)
+		}
+		return nil
+	})
+	if err := assertCommitted(ctx, db, 2, 9); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// CheckUserConsistency checks that the cost of the user's orders equals the amount debited from the balance.
+// The balance and the orders are read in one read-only transaction, so a buy committed in between can't
+// show up in one of them only
+func CheckUserConsistency(ctx context.Context, db *sql.DB, userID int) error {
+	balance, spent := decimal.NewFromInt(0), decimal.NewFromInt(0)
+	err := runReadOnlyTxn(ctx, db, func(ctx context.Context, conn *sql.Conn) error {
+		err := conn.QueryRowContext(ctx, columnSQL("SELECT {balance} FROM `users` WHERE `id` = ?"), userID).Scan(money(&balance))
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("user %d: %w", userID, ErrUserNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		var cost decimal.NullDecimal
+		err = conn.QueryRowContext(ctx, columnSQL("SELECT SUM(o.{quality} * COALESCE(o.`unit_price`, b.{price})) FROM `orders` o "+
+			"JOIN `books` b ON o.`book_id` = b.`id` WHERE o.`user_id` = ?"), userID).Scan(&cost)
+		if err != nil {
+			return err
+		}
+		if cost.Valid {
+			spent = cost.Decimal
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if debited := initialBalance.Sub(balance); !debited.Equal(spent) {
+		return fmt.Errorf("user %d inconsistent: orders cost %s, but balance debited %s",
+			userID, spent.StringFixed(2), debited.StringFixed(2))
+	}
+
+	return nil
+}
+
+// StockMismatch is a book whose stock differs from its initial stock minus the ordered quality
+type StockMismatch struct {
+	BookID   int
+	Expected int
+	Actual   int
+}
+
+// ReconcileStock recomputes the stock of each book in initialStock from the orders and returns the mismatches
+func ReconcileStock(ctx context.Context, db *sql.DB, initialStock map[int]int) ([]StockMismatch, error) {
+	var mismatches []StockMismatch
+	for bookID, initial := range initialStock {
+		stock, ordered := 0, 0
+		err := db.QueryRowContext(ctx, columnSQL("SELECT b.{stock}, COALESCE(SUM(o.{quality}), 0) FROM `books` b "+
+			"LEFT JOIN `orders` o ON o.`book_id` = b.`id` WHERE b.`id` = ? GROUP BY b.`id`, b.{stock}"),
+			bookID).Scan(&stock, &ordered)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("book %d: %w", bookID, ErrBookNotFound)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if expected := initial - ordered; expected != stock {
+			mismatches = append(mismatches, StockMismatch{BookID: bookID, Expected: expected, Actual: stock})
+		}
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].BookID < mismatches[j].BookID
+	})
+
+	return mismatches, nil
+}
+
+// verifyState checks the demo data after the buys: the stock of the demo book equals its initial stock
+// minus the ordered quality, and the balance debited from each demo user equals the cost of the user's orders.
+// All the violations are reported in the returned error
+func verifyState(ctx context.Context, db *sql.DB) error {
+	var violations []string
+
+	mismatches, err := ReconcileStock(ctx, db, map[int]int{1: initialBookStock})
+	if err != nil {
+		return err
+	}
+	for _, mismatch := range mismatches {
+		violations = append(violations, fmt.Sprintf("book %d stock is %d, expected %d",
+			mismatch.BookID, mismatch.Actual, mismatch.Expected))
+	}
+
+	for _, userID := range []int{1, 2} {
+		if err = CheckUserConsistency(ctx, db, userID); err != nil {
+			violations = append(violations, err.Error())
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("state verification failed: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// assertCommitted reads the stock of book on a connection of its own, out of any transaction,
+// so it only sees the committed data
+func assertCommitted(ctx context.Context, db *sql.DB, bookID, expectedStock int) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stock := 0
+	err = conn.QueryRowContext(ctx, columnSQL("SELECT {stock} FROM `books` WHERE `id` = ?"), bookID).Scan(&stock)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("book %d: %w", bookID, ErrBookNotFound)
+	}
+	if err != nil {
+		return err
+	}
+
+	if stock != expectedStock {
+		return fmt.Errorf("book %d committed stock is %d, expected %d", bookID, stock, expectedStock)
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCheckUserConsistencyFlagsCorruptedUser(t *testing.T) {
+	db, mock := newMock(t)
+	balanceSQL := columnSQL("SELECT {balance} FROM `users` WHERE `id` = ?")
+	costSQL := columnSQL("SELECT SUM(o.{quality} * COALESCE(o.`unit_price`, b.{price})) FROM `orders` o " +
+		"JOIN `books` b ON o.`book_id` = b.`id` WHERE o.`user_id` = ?")
+
+	// both bought 6 books of 100, but 1 is lost from the balance of user 2
+	for _, user := range []struct {
+		id      int
+		balance string
+	}{{1, "9400.00"}, {2, "9399.00"}} {
+		mock.ExpectExec(readOnlyTxnSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(balanceSQL).WithArgs(user.id).
+			WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(user.balance))
+		mock.ExpectQuery(costSQL).WithArgs(user.id).
+			WillReturnRows(sqlmock.NewRows([]string{"cost"}).AddRow("600.00"))
+		mock.ExpectQuery(txnWrittenKeysSQL).WillReturnRows(sqlmock.NewRows([]string{"MEM_BUFFER_KEYS"}).AddRow(0))
+		mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	ctx := context.Background()
+	if err := CheckUserConsistency(ctx, db, 1); err != nil {
+		t.Errorf("user 1 is flagged: %v", err)
+	}
+	err := CheckUserConsistency(ctx, db, 2)
+	if err == nil || !strings.Contains(err.Error(), "user 2 inconsistent") {
+		t.Errorf("user 2 is not flagged, got %v", err)
+	}
+}
+
+// A missing user fails the check and its read-only transaction is rolled back
+func TestCheckUserConsistencyUserNotFound(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec(readOnlyTxnSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(columnSQL("SELECT {balance} FROM `users` WHERE `id` = ?")).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := CheckUserConsistency(context.Background(), db, 3); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got %v, want ErrUserNotFound", err)
+	}
+}
+
+// The checks running while Bob keeps buying never see a buy in the balance but not in the orders, or the reverse
+func TestCheckUserConsistencyDuringBuysOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < initialBookStock; i++ {
+			if _, err := buyPessimistic(ctx, db, PurchaseOptions{}, 1, 0, 1, 1, 1); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = CheckUserConsistency(ctx, db, 1); err != nil {
+				t.Error(err)
+			}
+			return
+		default:
+		}
+		if err := CheckUserConsistency(ctx, db, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckUserConsistencyOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob buys 2 and Alice buys 3 of the demo book at 100, then 1 goes missing from the balance of Alice
+	mustExec(t, db, "INSERT INTO `orders` (`book_id`, `user_id`, `quality`) VALUES (1, 1, 2), (1, 2, 3)")
+	mustExec(t, db, "UPDATE `users` SET `balance` = `balance` - 200 WHERE `id` = 1")
+	mustExec(t, db, "UPDATE `users` SET `balance` = `balance` - 301 WHERE `id` = 2")
+
+	if err := CheckUserConsistency(ctx, db, 1); err != nil {
+		t.Errorf("Bob is flagged: %v", err)
+	}
+	if err := CheckUserConsistency(ctx, db, 2); err == nil {
+		t.Error("Alice is not flagged")
+	}
+}
+
+func TestReconcileStockReportsDiscrepancy(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery(columnSQL("SELECT b.{stock}, COALESCE(SUM(o.{quality}), 0) FROM `books` b " +
+		"LEFT JOIN `orders` o ON o.`book_id` = b.`id` WHERE b.`id` = ? GROUP BY b.`id`, b.{stock}")).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"stock", "ordered"}).AddRow(3, 6))
+
+	mismatches, err := ReconcileStock(context.Background(), db, map[int]int{1: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StockMismatch{BookID: 1, Expected: 4, Actual: 3}
+	if len(mismatches) != 1 || mismatches[0] != want {
+		t.Errorf("got the mismatches %+v, want %+v", mismatches, want)
+	}
+}
+
+// Both books sold 3 copies, then one copy of book 2 goes missing from its stock, only book 2 is reported
+func TestReconcileStockOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	createTestBooks(t, db, testBook(1, "Novel", "10.00", 7), testBook(2, "Arts", "10.00", 6))
+	createTestUsers(t, db, User{ID: 1, Nickname: "Bob", Balance: initialBalance})
+	mustExec(t, db, "INSERT INTO `orders` (`book_id`, `user_id`, `quality`) VALUES (1, 1, 1), (1, 1, 2), (2, 1, 3)")
+
+	mismatches, err := ReconcileStock(ctx, db, map[int]int{1: 10, 2: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StockMismatch{BookID: 2, Expected: 7, Actual: 6}
+	if len(mismatches) != 1 || mismatches[0] != want {
+		t.Errorf("got the mismatches %+v, want %+v", mismatches, want)
+	}
+
+	if _, err = ReconcileStock(ctx, db, map[int]int{3: 10}); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("got %v for a missing book, want ErrBookNotFound", err)
+	}
+}
+
+func TestAssertCommitted(t *testing.T) {
+	db, mock := newMock(t)
+	stockSQL := columnSQL("SELECT {stock} FROM `books` WHERE `id` = ?")
+	mock.ExpectQuery(stockSQL).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(4))
+	mock.ExpectQuery(stockSQL).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(4))
+	mock.ExpectQuery(stockSQL).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"stock"}))
+
+	ctx := context.Background()
+	if err := assertCommitted(ctx, db, 1, 4); err != nil {
+		t.Errorf("the committed stock is rejected: %v", err)
+	}
+	if err := assertCommitted(ctx, db, 1, 5); err == nil || !strings.Contains(err.Error(), "committed stock is 4, expected 5") {
+		t.Errorf("got %v, want the stock mismatch", err)
+	}
+	if err := assertCommitted(ctx, db, 2, 0); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("got %v, want ErrBookNotFound", err)
+	}
+}
+
+// The demo buys of Bob and Alice are visible on a new connection right after they return
+func TestBuyIsCommittedOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := buy(ctx, db, noDelay(), false, 4, 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertCommitted(ctx, db, 1, initialBookStock-10); err != nil {
+		t.Error(err)
+	}
+}
+
+// The concurrent buys of both modes conserve the stock and the money, a lost book or a lost cent is reported
+func TestVerifyStateAfterBuyOnTiDB(t *testing.T) {
+	for _, optimistic := range []bool{false, true} {
+		name := "pessimistic"
+		if optimistic {
+			name = "optimistic"
+		}
+		t.Run(name, func(t *testing.T) {
+			db := openTestDB(t)
+			ctx := context.Background()
+			if err := prepareData(ctx, db, optimistic, SeedOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := buy(ctx, db, noDelay(), optimistic, 4, 6); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyState(ctx, db); err != nil {
+				t.Fatal(err)
+			}
+
+			mustExec(t, db, "UPDATE `books` SET `stock` = `stock` - 1 WHERE `id` = 1")
+			mustExec(t, db, "UPDATE `users` SET `balance` = `balance` - 0.01 WHERE `id` = 2")
+			err := verifyState(ctx, db)
+			if err == nil {
+				t.Fatal("the lost book and cent are not reported")
+			}
+			for _, want := range []string{"book 1 stock is", "user 2 inconsistent"} {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("got %v, want it to report '%s'", err, want)
+				}
+			}
+			if strings.Contains(err.Error(), "user 1") {
+				t.Errorf("got %v, user 1 is consistent", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,531 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const commandUsage = `usage: txn [flags]                  run the purchase demo
+       txn prepare [flags]          create the schema and seed the demo data, see txn prepare -h
+       txn buy [flags]              buy books, -user is the buying user and -db-user the TiDB user, see txn buy -h
+       txn report [flags]           print the books, the users and the orders
+       txn purge [flags]            delete the old orders in batches, see txn purge -h
+       txn archive [flags]          move the old orders into orders_archive in batches, see txn archive -h
+       txn gc [flags]               advance the GC safe point of the cluster, see txn gc -h
+       txn cleanup [-drop] [flags]  delete all the rows, or drop the tables`
+
+// PrepareOptions are the options of the prepare subcommand
+type PrepareOptions struct {
+	Random int   // seed this many random books and users by SeedRandom after the demo data, zero disables it
+	Seed   int64 // seed of the random rows
+
+	CheckConstraints bool // add the CHECK constraints of AddBalanceCheckConstraint after seeding
+}
+
+// BuyOptions are the options of the buy subcommand
+type BuyOptions struct {
+	Optimistic  bool
+	BookID      int
+	UserID      int
+	Amount      int
+	Concurrency int
+
+	IdempotencyKey string // shared by all the purchases, so only one of them is charged
+
+	// ReadAddr is the host:port of a read-only endpoint, the buys run through a Router which reads the stock
+	// from it afterwards. Empty reads from the primary
+	ReadAddr       string
+	ReadYourWrites time.Duration // the Router reads from the primary for this long after a buy
+	// MaxInFlight sheds a purchase by the AdmissionController if this many are running, zero disables it
+	MaxInFlight int
+	MaxP99      time.Duration // also sheds a purchase while the p99 latency of the recent ones is above it
+
+	Purchase PurchaseOptions
+}
+
+// ReportOptions are the options of the report subcommand
+type ReportOptions struct {
+	ReplicaRead string // tidb_replica_read of the reads, empty for the session default
+	StartTS     uint64 // read the data as of this TSO by tidb_snapshot, zero for the latest
+	Details     int    // print this many orders by listOrderDetails, zero disables it
+}
+
+// PurgeOptions are the options of the purge subcommand
+type PurgeOptions struct {
+	OlderThanDays int // purge the orders ordered more than this many days ago
+	BatchSize     int
+	Pause         time.Duration // pause between the batches
+}
+
+// ArchiveOptions are the options of the archive subcommand
+type ArchiveOptions struct {
+	OlderThan   time.Duration // archive the orders ordered more than this long ago
+	BatchSize   int
+	CreateTable bool // create `orders_archive` if it doesn't exist
+}
+
+// GCOptions are the options of the gc subcommand
+type GCOptions struct {
+	Timeout time.Duration // give up waiting for the safe point to advance after this long
+}
+
+// CleanupOptions are the options of the cleanup subcommand
+type CleanupOptions struct {
+	Drop bool // drop the tables instead of deleting their rows
+}
+
+// runCommand parses the flags of a subcommand and runs it, it returns the exit code.
+// An unknown subcommand or a bad flag prints the usage and returns 2
+func runCommand(ctx context.Context, name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	registerSharedFlags(fs)
+	// the options of the shared transaction flags, set once the flags are parsed
+	var txnOpts []TxnOption
+	if name != "buy" {
+		// -user is the buying user of buy, elsewhere it's the TiDB user as in the demo
+		aliasFlag(fs, "user", "db-user")
+	}
+
+	var run func(db *sql.DB) error
+	switch name {
+	case "prepare":
+		options := PrepareOptions{}
+		fs.IntVar(&options.Random, "random", 0, "seed this many random books and users after the demo data, 0 disables it")
+		fs.Int64Var(&options.Seed, "seed", 1, "seed of the random books and users, the same seed writes the same rows")
+		fs.BoolVar(&options.CheckConstraints, "check-constraints", false,
+			"add CHECK constraints so TiDB rejects a negative balance or stock, requires TiDB v7.2.0 or later")
+		run = func(db *sql.DB) error {
+			return runPrepare(ctx, db, options, txnOpts...)
+		}
+	case "buy":
+		options := BuyOptions{Purchase: defaultPurchaseOptions()}
+		registerBuyFlags(fs, &options)
+		run = func(db *sql.DB) error {
+			options.Purchase.Txn = append(txnOpts, options.Purchase.Txn...)
+			return runBuy(ctx, db, options)
+		}
+	case "report":
+		options := ReportOptions{}
+		fs.StringVar(&options.ReplicaRead, "replica-read", "",
+			"tidb_replica_read of the report: leader, follower, leader-and-follower, closest-replicas or closest-adaptive")
+		fs.Uint64Var(&options.StartTS, "start-ts", 0, "print the report as of this TSO, like a commit ts logged by -commit-ts, 0 for the latest")
+		fs.IntVar(&options.Details, "details", 0,
+			fmt.Sprintf("also print this many orders with the nickname of the user and the title of the book, at most %d, 0 disables it", maxOrderDetailsLimit))
+		run = func(db *sql.DB) error {
+			if err := validateReplicaRead(options.ReplicaRead); err != nil {
+				return err
+			}
+			if options.Details != 0 {
+				if err := validateOrderDetailsLimit(options.Details); err != nil {
+					return fmt.Errorf("invalid -details: %w", err)
+				}
+			}
+			return runReport(ctx, db, options, os.Stdout)
+		}
+	case "purge":
+		options := PurgeOptions{}
+		fs.IntVar(&options.OlderThanDays, "older-than-days", 1, "purge the orders ordered more than this many days ago")
+		fs.IntVar(&options.BatchSize, "batch", 1000, "orders deleted per transaction")
+		fs.DurationVar(&options.Pause, "pause", 0, "pause between the batches to limit the write pressure")
+		run = func(db *sql.DB) error {
+			return runPurge(ctx, db, options, txnOpts...)
+		}
+	case "archive":
+		options := ArchiveOptions{}
+		fs.DurationVar(&options.OlderThan, "older-than", 30*24*time.Hour, "archive the orders ordered more than this long ago")
+		fs.IntVar(&options.BatchSize, "batch", 1000, "orders moved per transaction")
+		fs.BoolVar(&options.CreateTable, "create-table", false, "create the orders_archive table if it doesn't exist")
+		run = func(db *sql.DB) error {
+			return runArchive(ctx, db, options)
+		}
+	case "gc":
+		options := GCOptions{}
+		fs.DurationVar(&options.Timeout, "timeout", 15*time.Minute, "give up waiting for the GC safe point to advance after this long")
+		run = func(db *sql.DB) error {
+			return runGC(ctx, db, options)
+		}
+	case "cleanup":
+		options := CleanupOptions{}
+		fs.BoolVar(&options.Drop, "drop", false, "drop the tables instead of deleting their rows")
+		run = func(db *sql.DB) error {
+			return runCleanup(ctx, db, options)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown subcommand '%s'\n%s\n", name, commandUsage)
+		return 2
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := loadConfigFile(fs); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	txnOpts = flagTxnOptions()
+	if name == "cleanup" {
+		// there is nothing to clean up in a schema which doesn't exist
+		skipDDL = true
+	}
+
+	var err error
+	if code := connectBookshop(func(db *sql.DB) {
+		err = run(db)
+	}); code != 0 {
+		return code
+	}
+	if err != nil {
+		fmt.Printf("%s failed: %s\n", name, describeBuyError(err))
+		return 1
+	}
+	return 0
+}
+
+// registerBuyFlags registers the flags of the buy subcommand on fs, the values of options are the defaults
+func registerBuyFlags(fs *flag.FlagSet, options *BuyOptions) {
+	fs.Var(modeFlag{optimistic: &options.Optimistic}, "mode", "transaction mode, optimistic or pessimistic")
+	fs.IntVar(&options.BookID, "book", 1, "id of the book to buy")
+	fs.IntVar(&options.UserID, "user", 1, "id of the buying user, -db-user is the TiDB user")
+	fs.IntVar(&options.Amount, "amount", 1, "amount of books per purchase")
+	fs.IntVar(&options.Concurrency, "concurrency", 1, "number of concurrent purchases")
+	fs.StringVar(&options.IdempotencyKey, "idempotency-key", "",
+		"idempotency key of the purchases, a purchase with a committed key returns its order without a charge")
+	fs.StringVar(&options.ReadAddr, "read-addr", "", "host:port of a read-only endpoint to read the stock from after the buys")
+	fs.DurationVar(&options.ReadYourWrites, "read-your-writes", 0,
+		"read from the primary for this long after a buy, instead of the lagging -read-addr, 0 disables it")
+	fs.IntVar(&options.MaxInFlight, "max-in-flight", 0, "shed a purchase while this many are running, 0 disables the admission control")
+	fs.DurationVar(&options.MaxP99, "max-p99", 0, "with -max-in-flight, also shed a purchase while the p99 latency is above this, 0 disables it")
+	registerPurchaseFlags(fs, &options.Purchase)
+}
+
+// modeFlag is the -mode flag, optimistic or pessimistic
+type modeFlag struct {
+	optimistic *bool
+}
+
+func (m modeFlag) String() string {
+	if m.optimistic != nil && *m.optimistic {
+		return "optimistic"
+	}
+	return "pessimistic"
+}
+
+func (m modeFlag) Set(value string) error {
+	switch value {
+	case "optimistic":
+		*m.optimistic = true
+	case "pessimistic":
+		*m.optimistic = false
+	default:
+		return fmt.Errorf("mode must be optimistic or pessimistic, got '%s'", value)
+	}
+	return nil
+}
+
+// runPrepare seeds the demo data in a transaction of opts, then the random rows of options.Random.
+// The schema is created by connectBookshop
+func runPrepare(ctx context.Context, db *sql.DB, options PrepareOptions, opts ...TxnOption) error {
+	if options.Random < 0 {
+		return fmt.Errorf("random rows must not be negative, got %d", options.Random)
+	}
+	if err := prepareData(ctx, db, false, SeedOptions{Txn: opts}); err != nil {
+		return err
+	}
+	if options.CheckConstraints {
+		if err := AddBalanceCheckConstraint(ctx, db); err != nil {
+			return err
+		}
+		fmt.Println("added the check constraints, a negative balance or stock is rejected by TiDB")
+	}
+	if options.Random == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	if err := SeedRandom(ctx, db, options.Random, options.Seed); err != nil {
+		return err
+	}
+	fmt.Printf("seeded %d random books and users from seed %d after id %d, elapsed: %s\n",
+		options.Random, options.Seed, randomSeedIDBase, time.Since(start))
+	return nil
+}
+
+// runBuy runs options.Concurrency purchases at the same time, each with an order id of its own,
+// generated by TiDB or taken from the sequence seq_order_no with options.Purchase.ExplicitOrderID
+func runBuy(ctx context.Context, db *sql.DB, options BuyOptions) error {
+	if options.Concurrency <= 0 {
+		return fmt.Errorf("concurrency must be positive, got %d", options.Concurrency)
+	}
+	if err := options.Purchase.validate(); err != nil {
+		return err
+	}
+
+	readDB := db
+	if options.ReadAddr != "" {
+		var err error
+		if readDB, err = openReadDB(options.ReadAddr); err != nil {
+			return err
+		}
+		defer readDB.Close()
+	}
+	return runBuyOn(ctx, newBuyRouter(db, readDB, options), options)
+}
+
+// newBuyRouter creates the Router of the buy subcommand, which reads from readDB and consults
+// the AdmissionController of options.MaxInFlight
+func newBuyRouter(db, readDB *sql.DB, options BuyOptions) *Router {
+	router := NewRouter(db, readDB).WithPurchaseOptions(options.Purchase).WithReadYourWrites(options.ReadYourWrites)
+	if options.MaxInFlight > 0 {
+		router.WithAdmission(newAdmissionController(options.MaxInFlight, options.MaxP99))
+	}
+	return router
+}
+
+// openReadDB connects to the read-only endpoint addr with the user and the database of connConfig
+func openReadDB(addr string) (*sql.DB, error) {
+	config := connConfig
+	var err error
+	if config.Host, config.Port, err = net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid read endpoint '%s': %w", addr, err)
+	}
+
+	readDB, err := sql.Open("mysql", config.DSN())
+	if err != nil {
+		return nil, err
+	}
+	if err = readDB.Ping(); err != nil {
+		readDB.Close()
+		return nil, fmt.Errorf("failed to connect to the read endpoint %s: %w", addr, err)
+	}
+	return readDB, nil
+}
+
+// runBuyOn runs the purchases of options through router, a purchase shed by the admission control is reported
+// and doesn't fail the others. Then it reads the stock of the book by router
+func runBuyOn(ctx context.Context, router *Router, options BuyOptions) error {
+	// the explicit ids come from the sequence rather than after the largest id in use,
+	// so concurrent buy invocations never give the same ids
+	orderIDs := make([]int, options.Concurrency)
+	if options.Purchase.ExplicitOrderID {
+		for i := range orderIDs {
+			orderID, err := allocOrderID(ctx, router.writeDB, true, 0)
+			if err != nil {
+				return err
+			}
+			orderIDs[i] = orderID
+		}
+	}
+	if options.IdempotencyKey != "" {
+		ctx = WithIdempotencyKey(ctx, options.IdempotencyKey)
+	}
+
+	wg := sync.WaitGroup{}
+	results, errs := make([]PurchaseResult, options.Concurrency), make([]error, options.Concurrency)
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = router.Buy(ctx, options.Optimistic, i+1, orderIDs[i], options.BookID, options.UserID, options.Amount)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if errors.Is(err, ErrOverloaded) {
+			fmt.Printf("purchase %d: %s\n", i+1, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purchase %d: order %d, cost %s\n", i+1, results[i].OrderID, results[i].Cost.StringFixed(moneyScale))
+	}
+
+	stock := 0
+	if err := router.QueryRow(ctx, columnSQL("SELECT {stock} FROM `books` WHERE `id` = ?"), options.BookID).Scan(&stock); err != nil {
+		return err
+	}
+	fmt.Printf("stock of book %d read by the router: %d\n", options.BookID, stock)
+	return nil
+}
+
+// runReport prints the books, the users and the orders to w. They are read in one read-only transaction,
+// so the stocks and the balances sum up consistently even while the buys are running.
+// With options.StartTS, they are read at that snapshot instead
+func runReport(ctx context.Context, db *sql.DB, options ReportOptions, w io.Writer) (err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	restore, err := withReplicaRead(ctx, conn, options.ReplicaRead)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if restoreErr := restore(); err == nil {
+			err = restoreErr
+		}
+	}()
+
+	read := runReadOnlyTxnOn
+	if options.StartTS != 0 {
+		fmt.Fprintf(w, "as of start ts %d\n", options.StartTS)
+		read = func(ctx context.Context, conn *sql.Conn, readFunc TxnFunc) error {
+			return runSnapshotRead(ctx, conn, options.StartTS, readFunc)
+		}
+	}
+
+	return read(ctx, conn, func(ctx context.Context, conn *sql.Conn) error {
+		books, err := ListBooks(ctx, conn)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "books (%d):\n", len(books))
+		for _, book := range books {
+			fmt.Fprintf(w, "  %d\t%s\t%s\tprice %s\tstock %d\n",
+				book.ID, book.Title, book.Type, book.Price.StringFixed(moneyScale), book.Stock)
+		}
+
+		users, err := ListUsers(ctx, conn)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "users (%d):\n", len(users))
+		for _, user := range users {
+			fmt.Fprintf(w, "  %d\t%s\tbalance %s\n", user.ID, user.Nickname, user.Balance.StringFixed(moneyScale))
+		}
+
+		orders, err := ListOrders(ctx, conn)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "orders (%d):\n", len(orders))
+		for _, order := range orders {
+			fmt.Fprintf(w, "  %d\tbook %d\tuser %d\tquality %d\t%s\n",
+				order.ID, order.BookID, order.UserID, order.Quality, order.OrderedAt.Format("2006-01-02 15:04:05"))
+		}
+
+		if options.Details == 0 {
+			return nil
+		}
+		details, err := listOrderDetails(ctx, conn, options.Details)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "order details (%d):\n", len(details))
+		for _, detail := range details {
+			fmt.Fprintf(w, "  %d\t%s bought %d of %s\n", detail.OrderID, orDeleted(detail.Nickname, "user", detail.UserID),
+				detail.Quality, orDeleted(detail.Title, "book", detail.BookID))
+		}
+		return nil
+	})
+}
+
+// orDeleted returns name, or tells the row of id is gone if it's empty, a left join found no row
+func orDeleted(name, table string, id int64) string {
+	if name == "" {
+		return fmt.Sprintf("deleted %s %d", table, id)
+	}
+	return name
+}
+
+// runPurge deletes the orders older than options.OlderThanDays by the clock of TiDB by purgeOrders
+// in transactions of opts and prints the outcome
+func runPurge(ctx context.Context, db *sql.DB, options PurgeOptions, opts ...TxnOption) error {
+	before, err := purgeCutoff(ctx, db, options.OlderThanDays)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	result, err := purgeOrders(ctx, db, before, options.BatchSize, options.Pause, opts...)
+	fmt.Printf("purged %d orders in %d batches, elapsed: %s\n", result.Deleted, result.Batches, time.Since(start))
+	return err
+}
+
+// runArchive moves the orders older than options.OlderThan into `orders_archive` by archiveOldOrders
+// and prints the outcome
+func runArchive(ctx context.Context, db *sql.DB, options ArchiveOptions) error {
+	if options.CreateTable {
+		if _, err := db.ExecContext(ctx, archiveTableSQL()); err != nil {
+			return fmt.Errorf("create orders_archive: %w", err)
+		}
+	}
+
+	start := time.Now()
+	archived, err := archiveOldOrders(ctx, db, start.Add(-options.OlderThan), options.BatchSize)
+	fmt.Printf("archived %d orders, elapsed: %s\n", archived, time.Since(start))
+	return err
+}
+
+// runGC checks the privileges of TriggerGC, then advances the GC safe point by it and prints the new one
+func runGC(ctx context.Context, db *sql.DB, options GCOptions) error {
+	missing, err := CheckPrivileges(ctx, db, gcPrivileges)
+	if err != nil {
+		return fmt.Errorf("check privileges: %w", err)
+	}
+	if len(missing) == len(gcPrivileges) {
+		return fmt.Errorf("gc requires the %s or %s privilege to set the GC variables", gcPrivileges[0], gcPrivileges[1])
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, options.Timeout)
+	defer cancel()
+
+	fmt.Println("waiting for the GC safe point to advance, the GC of the whole cluster keeps only 10 minutes of history meanwhile")
+	start := time.Now()
+	safePoint, err := TriggerGC(ctx, db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("GC safe point advanced to %s, elapsed: %s\n", safePoint, time.Since(start))
+	return nil
+}
+
+// runCleanup deletes all the rows of the tables, or drops them
+func runCleanup(ctx context.Context, db *sql.DB, options CleanupOptions) error {
+	for _, table := range []string{"orders", "users", "books"} {
+		statement := "DELETE FROM " + quoteIdentifier(table)
+		if options.Drop {
+			statement = "DROP TABLE IF EXISTS " + quoteIdentifier(table)
+		}
+
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+		fmt.Println(statement + " successful")
+	}
+
+	if options.Drop {
+		statement := "DROP SEQUENCE IF EXISTS " + quoteIdentifier(orderNoSequence)
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+		fmt.Println(statement + " successful")
+	}
+
+	return nil
+}
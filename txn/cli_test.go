@@ -0,0 +1,178 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sharedFlagSet returns a flag set of a subcommand with the shared flags, the globals they set are restored after the test
+func sharedFlagSet(t *testing.T, name string) *flag.FlagSet {
+	defaultConnConfig, defaultConfigFile := connConfig, configFile
+	t.Cleanup(func() {
+		connConfig, configFile = defaultConnConfig, defaultConfigFile
+	})
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	registerSharedFlags(fs)
+	return fs
+}
+
+func TestBuyFlags(t *testing.T) {
+	fs := sharedFlagSet(t, "buy")
+	options := BuyOptions{Purchase: defaultPurchaseOptions()}
+	registerBuyFlags(fs, &options)
+
+	err := fs.Parse([]string{"-mode", "optimistic", "-book", "3", "-user", "2", "-db-user", "app", "-amount", "4",
+		"-concurrency", "5", "-delay", "0", "-explicit-order-id", "-retry-times", "7", "-max-quantity", "9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !options.Optimistic || options.BookID != 3 || options.UserID != 2 || options.Amount != 4 || options.Concurrency != 5 {
+		t.Errorf("unexpected options %+v", options)
+	}
+	purchase := options.Purchase
+	if purchase.Delay != 0 || !purchase.ExplicitOrderID || purchase.RetryTimes != 7 || purchase.MaxQuantity != 9 {
+		t.Errorf("unexpected purchase options %+v", purchase)
+	}
+	if connConfig.User != "app" {
+		t.Errorf("TiDB user is '%s', want 'app'", connConfig.User)
+	}
+}
+
+func TestBuyFlagsDefaults(t *testing.T) {
+	fs := sharedFlagSet(t, "buy")
+	options := BuyOptions{Purchase: defaultPurchaseOptions()}
+	registerBuyFlags(fs, &options)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if options.Optimistic || options.BookID != 1 || options.UserID != 1 || options.Amount != 1 || options.Concurrency != 1 {
+		t.Errorf("unexpected default options %+v", options)
+	}
+	if options.Purchase.Delay != time.Second || options.Purchase.RetryTimes != retryTimes {
+		t.Errorf("unexpected default purchase options %+v", options.Purchase)
+	}
+}
+
+func TestBuyFlagsRejectUnknownMode(t *testing.T) {
+	fs := sharedFlagSet(t, "buy")
+	options := BuyOptions{Purchase: defaultPurchaseOptions()}
+	registerBuyFlags(fs, &options)
+
+	if err := fs.Parse([]string{"-mode", "eventual"}); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+// -user is an alias of -db-user out of the buy subcommand, given on the command line it wins over the file
+func TestUserAliasWinsOverConfigFile(t *testing.T) {
+	fs := sharedFlagSet(t, "report")
+	aliasFlag(fs, "user", "db-user")
+
+	configFile = filepath.Join(t.TempDir(), "bookshop.toml")
+	content := "[database]\nuser = \"file-user\"\nhost = \"file-host\"\n"
+	if err := os.WriteFile(configFile, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Parse([]string{"-user", "cli-user"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if connConfig.User != "cli-user" || connConfig.Host != "file-host" {
+		t.Errorf("got user '%s' and host '%s', want 'cli-user' and 'file-host'", connConfig.User, connConfig.Host)
+	}
+}
+
+func TestRunCommandUnknownSubcommand(t *testing.T) {
+	if code := runCommand(context.Background(), "restore", nil); code != 2 {
+		t.Errorf("exit code %d, want 2", code)
+	}
+}
+
+func TestRunBuy(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	options := BuyOptions{BookID: 1, UserID: 2, Amount: 2, Concurrency: 3, Purchase: noDelay()}
+	if err := runBuy(ctx, db, options); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := assertCommitted(ctx, db, 1, initialBookStock-6); err != nil {
+		t.Error(err)
+	}
+	if err := CheckUserConsistency(ctx, db, 2); err != nil {
+		t.Error(err)
+	}
+}
+
+// Two buy invocations with -explicit-order-id at the same time take distinct ids from the sequence
+func TestRunBuyExplicitOrderIDConcurrentOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	purchase := noDelay()
+	purchase.ExplicitOrderID = true
+	wg, errs := sync.WaitGroup{}, make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = runBuy(ctx, db, BuyOptions{BookID: 1, UserID: i + 1, Amount: 1, Concurrency: 2, Purchase: purchase})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orders := 0
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(DISTINCT `id`) FROM `orders` WHERE `user_id` IN (1, 2)").Scan(&orders); err != nil {
+		t.Fatal(err)
+	}
+	if orders != 4 {
+		t.Errorf("got %d distinct orders, want 4", orders)
+	}
+}
+
+func TestRunBuyRejectsNonPositiveConcurrency(t *testing.T) {
+	db, _ := newMock(t)
+	if err := runBuy(context.Background(), db, BuyOptions{Concurrency: 0, Purchase: noDelay()}); err == nil {
+		t.Error("zero concurrency accepted")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ColumnNames maps the logical fields used by the helpers to the actual column names,
+// they're set by the [columns] section of the config file
+type ColumnNames struct {
+	Title       string `toml:"title"`
+	Type        string `toml:"type"`
+	PublishedAt string `toml:"published_at"`
+	Price       string `toml:"price"`
+	Stock       string `toml:"stock"`
+	Quality     string `toml:"quality"`
+	Balance     string `toml:"balance"`
+	Nickname    string `toml:"nickname"`
+}
+
+var identifierPattern = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_$]{0,63}$")
+
+var defaultColumnNames = ColumnNames{
+	Title:       "title",
+	Type:        "type",
+	PublishedAt: "published_at",
+	Price:       "price",
+	Stock:       "stock",
+	Quality:     "quality",
+	Balance:     "balance",
+	Nickname:    "nickname",
+}
+
+var columnNames = defaultColumnNames
+
+// setColumnNames validates names and uses them to build all the SQL afterwards
+func setColumnNames(names ColumnNames) error {
+	if err := names.Validate(); err != nil {
+		return err
+	}
+
+	columnNames = names
+	return nil
+}
+
+func (c ColumnNames) fields() map[string]string {
+	return map[string]string{
+		"title":        c.Title,
+		"type":         c.Type,
+		"published_at": c.PublishedAt,
+		"price":        c.Price,
+		"stock":        c.Stock,
+		"quality":      c.Quality,
+		"balance":      c.Balance,
+		"nickname":     c.Nickname,
+	}
+}
+
+// Validate checks that every column name is a plain identifier
+func (c ColumnNames) Validate() error {
+	for field, name := range c.fields() {
+		if !identifierPattern.MatchString(name) {
+			return fmt.Errorf("invalid column name %q for %s", name, field)
+		}
+	}
+
+	return nil
+}
+
+// Render replaces the {field} placeholders in query with the quoted column names
+func (c ColumnNames) Render(query string) string {
+	var oldNew []string
+	for field, name := range c.fields() {
+		oldNew = append(oldNew, "{"+field+"}", "`"+name+"`")
+	}
+
+	return strings.NewReplacer(oldNew...).Replace(query)
+}
+
+// columnSQL renders query with the column names in use
+func columnSQL(query string) string {
+	return columnNames.Render(query)
+}
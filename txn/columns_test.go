@@ -0,0 +1,157 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// useColumnNames sets the column names for the test, the defaults are restored after it
+func useColumnNames(tb testing.TB, names ColumnNames) {
+	tb.Helper()
+	if err := setColumnNames(names); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		columnNames = defaultColumnNames
+	})
+}
+
+func TestColumnNamesValidate(t *testing.T) {
+	for _, name := range []string{"", "1st", "quality; DROP TABLE books", "qu`ality", strings.Repeat("a", 65)} {
+		names := defaultColumnNames
+		names.Quality = name
+		if err := setColumnNames(names); err == nil {
+			columnNames = defaultColumnNames
+			t.Errorf("column name %q is accepted", name)
+		}
+	}
+	if columnNames != defaultColumnNames {
+		t.Errorf("a rejected mapping is in use: %+v", columnNames)
+	}
+}
+
+func TestColumnSQLUsesMappedNames(t *testing.T) {
+	names := defaultColumnNames
+	names.Quality, names.Stock, names.Balance = "quantity", "inventory", "credit"
+	useColumnNames(t, names)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{updateStockSQL(), "update `books` set `inventory` = `inventory` - ? where id = ? and `inventory` - ? >= 0"},
+		{debitBalanceSQL(), "`credit`"},
+		{insertOrderSQL(), "`quantity`"},
+		{userSQL(true), "SELECT `id`, `credit`, `nickname` FROM `users` WHERE `id` = ? FOR UPDATE"},
+	}
+	for _, test := range tests {
+		if !strings.Contains(test.query, test.want) {
+			t.Errorf("%s doesn't have %s", test.query, test.want)
+		}
+	}
+	for _, ddl := range schemaSQL("bookshop") {
+		if strings.Contains(ddl, "`quality`") || strings.Contains(ddl, "`stock`") || strings.Contains(ddl, "`balance`") {
+			t.Errorf("the schema has a demo column name: %s", ddl)
+		}
+	}
+}
+
+// The helpers read a book by the mapped names
+func TestGetBookByMappedNames(t *testing.T) {
+	names := defaultColumnNames
+	names.Stock, names.Price = "inventory", "list_price"
+	useColumnNames(t, names)
+
+	db, mock := newMock(t)
+	mock.ExpectQuery("SELECT `id`, `title`, `type`, `published_at`, `list_price`, `inventory` FROM `books` WHERE `id` = ?").
+		WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "list_price", "inventory"}).
+		AddRow(1, "Book 1", "Novel", "2020-01-01 00:00:00", "10.00", 3))
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	book, err := GetBook(ctx, conn, 1)
+	if err == nil && book.Stock != 3 {
+		t.Errorf("got the stock %d, want 3", book.Stock)
+	}
+}
+
+func TestConfigFileColumns(t *testing.T) {
+	defer func() {
+		columnNames = defaultColumnNames
+	}()
+	fs := sharedFlagSet(t, "report")
+	file := filepath.Join(t.TempDir(), "bookshop.toml")
+	if err := os.WriteFile(file, []byte("[columns]\nquality = \"quantity\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse([]string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaultColumnNames
+	want.Quality = "quantity"
+	if columnNames != want {
+		t.Errorf("got the column names %+v, want %+v", columnNames, want)
+	}
+
+	if err := os.WriteFile(file, []byte("[columns]\nstock = \"bad name\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(fs); err == nil {
+		t.Error("an invalid column name in the file is accepted")
+	}
+}
+
+// The schema is created with the mapped names, and a buy runs on it
+func TestBuyOnMappedSchema(t *testing.T) {
+	names := defaultColumnNames
+	names.Quality, names.Stock = "quantity", "inventory"
+	useColumnNames(t, names)
+	db := openTestDatabase(t, testDatabase+"_columns")
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := buyPessimistic(ctx, db, noDelay(), 1, 0, 1, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyState(ctx, db); err != nil {
+		t.Error(err)
+	}
+
+	quantity := 0
+	if err := db.QueryRowContext(ctx, "SELECT SUM(`quantity`) FROM `orders`").Scan(&quantity); err != nil {
+		t.Fatal(err)
+	}
+	if quantity != 3 {
+		t.Errorf("got the ordered quantity %d, want 3", quantity)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrPaymentFailed is the failure of the simulated payment of demoCompensation
+var ErrPaymentFailed = errors.New("payment declined")
+
+// CompensationError is a buy whose external call failed after the commit. The order is reversed by cancelOrder,
+// unless CompensateErr tells it couldn't be, then the order stays committed and must be reversed by hand
+type CompensationError struct {
+	OrderID       int
+	Err           error // the failure of the external call
+	CompensateErr error // the failure of cancelOrder, nil if the order is reversed
+}
+
+func (e *CompensationError) Error() string {
+	if e.CompensateErr != nil {
+		return fmt.Sprintf("order %d: external call failed: %v, and the compensation failed: %v",
+			e.OrderID, e.Err, e.CompensateErr)
+	}
+	return fmt.Sprintf("order %d: external call failed: %v, the order is reversed", e.OrderID, e.Err)
+}
+
+func (e *CompensationError) Unwrap() error {
+	return e.Err
+}
+
+// Compensated reports whether the order is reversed
+func (e *CompensationError) Compensated() bool {
+	return e.CompensateErr == nil
+}
+
+// BuyWithCompensation buys like buyPessimistic or buyOptimistic, then calls external, like a payment system,
+// after the commit. The buy can't be rolled back anymore at that point, so a failed external call is compensated
+// by cancelOrder, a saga of two local transactions. The buy's own failure is returned as it is,
+// external isn't called then
+func BuyWithCompensation(ctx context.Context, db *sql.DB, options PurchaseOptions, optimistic bool,
+	orderID, bookID, userID, amount int, external func() error) error {
+	buyFunc := buyOptimistic
+	if !optimistic {
+		buyFunc = buyPessimistic
+	}
+
+	result, err := buyFunc(ctx, db, options, 1, orderID, bookID, userID, amount)
+	if err != nil {
+		return err
+	}
+
+	externalErr := external()
+	if externalErr == nil {
+		return nil
+	}
+	logger.Errorf("external call of order %d failed, compensate by cancelling it: %+v", result.OrderID, externalErr)
+
+	compensationErr := &CompensationError{OrderID: result.OrderID, Err: externalErr}
+	// the order must be reversed even if ctx of the buy is done by now
+	compensationErr.CompensateErr = cancelOrder(context.Background(), db, result.OrderID, options.Txn...)
+	return compensationErr
+}
+
+// demoCompensation makes the demo buy by BuyWithCompensation with a payment which fails
+var demoCompensation = false
+
+// buyWithFailedPayment buys amount of the demo book for Bob by BuyWithCompensation, the payment fails
+// and the order is reversed, then it prints the stock and the balance which are the initial ones again
+func buyWithFailedPayment(ctx context.Context, db *sql.DB, options PurchaseOptions, optimistic bool, amount int) error {
+	err := BuyWithCompensation(ctx, db, options, optimistic, 1000, 1, 1, amount, func() error {
+		return ErrPaymentFailed
+	})
+	compensationErr := &CompensationError{}
+	if !errors.As(err, &compensationErr) {
+		return err
+	}
+	fmt.Println(compensationErr.Error())
+	if !compensationErr.Compensated() {
+		return compensationErr
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	book, err := GetBook(ctx, conn, 1)
+	if err != nil {
+		return err
+	}
+	user, err := GetUser(ctx, conn, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("after the compensation: book %d stock %d, user %d (%s) balance %s\n",
+		book.ID, book.Stock, user.ID, user.Nickname, user.Balance.StringFixed(moneyScale))
+	return nil
+}
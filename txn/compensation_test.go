@@ -0,0 +1,96 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompensationError(t *testing.T) {
+	reversed := &CompensationError{OrderID: 7, Err: ErrPaymentFailed}
+	if !reversed.Compensated() || !errors.Is(reversed, ErrPaymentFailed) ||
+		!strings.Contains(reversed.Error(), "the order is reversed") {
+		t.Errorf("got %v, want a reversed order", reversed)
+	}
+
+	stuck := &CompensationError{OrderID: 7, Err: ErrPaymentFailed, CompensateErr: ErrOrderNotFound}
+	if stuck.Compensated() || !strings.Contains(stuck.Error(), "the compensation failed") {
+		t.Errorf("got %v, want a failed compensation", stuck)
+	}
+}
+
+// A failed external call reverses the committed order, the stock and the balance are the initial ones again
+func TestBuyWithCompensationReversesOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	for _, optimistic := range []bool{false, true} {
+		if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		before := takeDataSnapshot(t, db)
+
+		err := BuyWithCompensation(ctx, db, PurchaseOptions{}, optimistic, 0, 1, 1, 3, func() error {
+			return ErrPaymentFailed
+		})
+		compensationErr := &CompensationError{}
+		if !errors.As(err, &compensationErr) || !compensationErr.Compensated() || !errors.Is(err, ErrPaymentFailed) {
+			t.Fatalf("optimistic %v: got %v, want a compensated payment failure", optimistic, err)
+		}
+
+		if after := takeDataSnapshot(t, db); !reflect.DeepEqual(after, before) {
+			t.Errorf("optimistic %v: got %+v after the compensation, want %+v", optimistic, after, before)
+		}
+		if err = verifyState(ctx, db); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// A successful external call keeps the order, a failed buy doesn't call it
+func TestBuyWithCompensationKeepsOrderOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	called := 0
+	external := func() error {
+		called++
+		return nil
+	}
+	if err := BuyWithCompensation(ctx, db, PurchaseOptions{}, false, 0, 1, 1, 3, external); err != nil {
+		t.Fatal(err)
+	}
+	err := BuyWithCompensation(ctx, db, PurchaseOptions{}, false, 0, 1, 1, initialBookStock, external)
+	if !errors.Is(err, ErrStockInsufficient) {
+		t.Errorf("got %v, want ErrStockInsufficient", err)
+	}
+	if called != 1 {
+		t.Errorf("the external call ran %d times, want once", called)
+	}
+
+	orders := 0
+	if err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM `orders`").Scan(&orders); err != nil {
+		t.Fatal(err)
+	}
+	if orders != 1 {
+		t.Errorf("got %d orders, want 1", orders)
+	}
+}
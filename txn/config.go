@@ -0,0 +1,154 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ConnConfig is where the example connects to, a flag overrides the environment variable which overrides the default
+type ConnConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Database string
+	TLS      string // empty or false, true, skip-verify or custom
+	SSLCA    string // the CA file, it implies custom
+}
+
+// tlsConfigName is the name the tls.Config is registered to the driver with
+const tlsConfigName = "tidb"
+
+// connConfig is filled by the flags in parseParams
+var connConfig ConnConfig
+
+// envOr returns the environment variable key, or def if it is unset or empty
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// Validate checks the fields which would otherwise fail as an obscure driver error
+func (c ConnConfig) Validate() error {
+	if c.Host == "" {
+		return fmt.Errorf("host must not be empty")
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("port must be a number in [1, 65535], got '%s'", c.Port)
+	}
+	if c.User == "" {
+		return fmt.Errorf("user must not be empty")
+	}
+	if c.Database == "" {
+		return fmt.Errorf("database must not be empty")
+	}
+	switch c.tlsMode() {
+	case "", "false", "true", "skip-verify":
+	case "custom":
+		if c.SSLCA == "" {
+			return fmt.Errorf("tls=custom needs the CA file given by -ssl-ca")
+		}
+	default:
+		return fmt.Errorf("tls must be one of false, true, skip-verify and custom, got '%s'", c.TLS)
+	}
+	return nil
+}
+
+// tlsMode returns the TLS mode, a CA file without a mode means custom
+func (c ConnConfig) tlsMode() string {
+	if c.TLS == "" && c.SSLCA != "" {
+		return "custom"
+	}
+	return c.TLS
+}
+
+func (c ConnConfig) tlsEnabled() bool {
+	mode := c.tlsMode()
+	return mode != "" && mode != "false"
+}
+
+// RegisterTLS registers the tls.Config used by DSN to the driver if TLS is enabled
+func (c ConnConfig) RegisterTLS() error {
+	if !c.tlsEnabled() {
+		return nil
+	}
+
+	config, err := buildTLSConfig(c.tlsMode(), c.SSLCA, c.Host)
+	if err != nil {
+		return err
+	}
+	return mysql.RegisterTLSConfig(tlsConfigName, config)
+}
+
+// buildTLSConfig builds the tls.Config of mode. TiDB Cloud Serverless needs TLS 1.2 or later
+// and routes by SNI, so the server name is always the host, even when the verification is skipped
+func buildTLSConfig(mode, caFile, host string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+	}
+
+	switch mode {
+	case "true":
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("load system cert pool: %w", err)
+		}
+		config.RootCAs = pool
+	case "skip-verify":
+		config.InsecureSkipVerify = true
+	case "custom":
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", caFile)
+		}
+		config.RootCAs = pool
+	default:
+		return nil, fmt.Errorf("unknown tls mode '%s'", mode)
+	}
+
+	return config, nil
+}
+
+// DSN formats the data source name, the example always scans DATETIME into time.Time and talks in utf8mb4
+func (c ConnConfig) DSN() string {
+	config := mysql.NewConfig()
+	config.Net = "tcp"
+	config.Addr = net.JoinHostPort(c.Host, c.Port)
+	config.User = c.User
+	config.Passwd = c.Password
+	config.DBName = c.Database
+	config.ParseTime = true
+	config.Params = map[string]string{"charset": "utf8mb4"}
+	if c.tlsEnabled() {
+		config.TLSConfig = tlsConfigName
+	}
+
+	return config.FormatDSN()
+}
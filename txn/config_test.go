@@ -0,0 +1,292 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// A flag overrides the environment variable, which overrides the default
+func TestConnConfigPrecedence(t *testing.T) {
+	for _, key := range []string{"TIDB_HOST", "TIDB_PORT", "TIDB_USER", "TIDB_PASSWORD", "TIDB_DB_NAME"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("TIDB_HOST", "tidb.env")
+	t.Setenv("TIDB_USER", "env_user")
+
+	fs := sharedFlagSet(t, "txn")
+	if err := fs.Parse([]string{"-db-user", "flag_user"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ConnConfig{Host: "tidb.env", Port: "4000", User: "flag_user", Password: "", Database: "bookshop"}
+	if connConfig != want {
+		t.Errorf("got %+v, want %+v", connConfig, want)
+	}
+}
+
+func TestConnConfigDefaults(t *testing.T) {
+	for _, key := range []string{"TIDB_HOST", "TIDB_PORT", "TIDB_USER", "TIDB_PASSWORD", "TIDB_DB_NAME", "TIDB_TLS", "TIDB_SSL_CA"} {
+		t.Setenv(key, "")
+	}
+
+	fs := sharedFlagSet(t, "txn")
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ConnConfig{Host: "127.0.0.1", Port: "4000", User: "root", Database: "bookshop"}
+	if connConfig != want {
+		t.Errorf("got %+v, want %+v", connConfig, want)
+	}
+}
+
+// DSN always scans DATETIME into time.Time and talks in utf8mb4
+func TestConnConfigDSN(t *testing.T) {
+	config := ConnConfig{Host: "::1", Port: "4000", User: "root", Password: "p@ss", Database: "bookshop"}
+	parsed, err := mysql.ParseDSN(config.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Addr != "[::1]:4000" || parsed.User != "root" || parsed.Passwd != "p@ss" || parsed.DBName != "bookshop" {
+		t.Errorf("unexpected config %+v", parsed)
+	}
+	if !parsed.ParseTime || parsed.Params["charset"] != "utf8mb4" {
+		t.Errorf("got parseTime %v and charset '%s', want true and utf8mb4", parsed.ParseTime, parsed.Params["charset"])
+	}
+	if parsed.TLSConfig != "" {
+		t.Errorf("got the tls config '%s', want none", parsed.TLSConfig)
+	}
+}
+
+func TestConnConfigValidate(t *testing.T) {
+	valid := ConnConfig{Host: "127.0.0.1", Port: "4000", User: "root", Database: "bookshop"}
+	for _, test := range []struct {
+		name   string
+		modify func(c *ConnConfig)
+		want   string
+	}{
+		{"valid", func(c *ConnConfig) {}, ""},
+		{"empty host", func(c *ConnConfig) { c.Host = "" }, "host"},
+		{"port not a number", func(c *ConnConfig) { c.Port = "tidb" }, "port"},
+		{"port out of range", func(c *ConnConfig) { c.Port = "65536" }, "port"},
+		{"empty user", func(c *ConnConfig) { c.User = "" }, "user"},
+		{"empty database", func(c *ConnConfig) { c.Database = "" }, "database"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := valid
+			test.modify(&config)
+			err := config.Validate()
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("got %v, want valid", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want an error about the %s", err, test.want)
+			}
+		})
+	}
+}
+
+// An unreachable TiDB fails connectBookshop with an exit code instead of a panic
+func TestConnectBookshopUnreachable(t *testing.T) {
+	defaultConfig, defaultSkipDDL := connConfig, skipDDL
+	t.Cleanup(func() { connConfig, skipDDL = defaultConfig, defaultSkipDDL })
+	connConfig = ConnConfig{Host: "127.0.0.1", Port: "1", User: "root", Database: "bookshop"}
+	skipDDL = true
+
+	ran := false
+	if code := connectBookshop(func(db *sql.DB) { ran = true }); code != 1 {
+		t.Errorf("got the exit code %d, want 1", code)
+	}
+	if ran {
+		t.Error("the runnable ran without a connection")
+	}
+
+	connConfig.Port = "0"
+	if code := connectBookshop(func(db *sql.DB) { ran = true }); code != 2 {
+		t.Errorf("got the exit code %d for an invalid port, want 2", code)
+	}
+}
+
+// writeTestCA writes a self-signed CA certificate in PEM to a file of the test and returns its path
+func writeTestCA(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Each mode needs TLS 1.2 and sends the host by SNI, only true and custom verify the server
+func TestBuildTLSConfig(t *testing.T) {
+	const host = "gateway01.us-west-2.prod.aws.tidbcloud.com"
+	for _, test := range []struct {
+		mode       string
+		caFile     string
+		insecure   bool
+		withRootCA bool
+	}{
+		{"true", "", false, true},
+		{"skip-verify", "", true, false},
+		{"custom", writeTestCA(t), false, true},
+	} {
+		t.Run(test.mode, func(t *testing.T) {
+			config, err := buildTLSConfig(test.mode, test.caFile, host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.MinVersion != tls.VersionTLS12 {
+				t.Errorf("got the min version %x, want TLS 1.2", config.MinVersion)
+			}
+			if config.ServerName != host {
+				t.Errorf("got the server name '%s', want '%s'", config.ServerName, host)
+			}
+			if config.InsecureSkipVerify != test.insecure {
+				t.Errorf("got InsecureSkipVerify %v, want %v", config.InsecureSkipVerify, test.insecure)
+			}
+			if (config.RootCAs != nil) != test.withRootCA {
+				t.Errorf("got the root CAs %v, want them set: %v", config.RootCAs, test.withRootCA)
+			}
+		})
+	}
+}
+
+func TestBuildTLSConfigCustomCAPool(t *testing.T) {
+	caFile := writeTestCA(t)
+	config, err := buildTLSConfig("custom", caFile, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemBytes, err := os.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.Verify(x509.VerifyOptions{Roots: config.RootCAs}); err != nil {
+		t.Errorf("the root CAs don't verify the certificate of the CA file: %v", err)
+	}
+}
+
+func TestBuildTLSConfigFailures(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name, mode, caFile, want string
+	}{
+		{"missing CA file", "custom", filepath.Join(t.TempDir(), "missing.pem"), "read CA file"},
+		{"no certificate", "custom", notPEM, "no certificate found"},
+		{"unknown mode", "verify-full", "", "unknown tls mode"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := buildTLSConfig(test.mode, test.caFile, "127.0.0.1")
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want '%s'", err, test.want)
+			}
+		})
+	}
+}
+
+// A CA file without a mode means custom, custom without a CA file is rejected before connecting
+func TestConnConfigTLSMode(t *testing.T) {
+	valid := ConnConfig{Host: "127.0.0.1", Port: "4000", User: "root", Database: "bookshop"}
+
+	withCA := valid
+	withCA.SSLCA = "ca.pem"
+	if mode := withCA.tlsMode(); mode != "custom" {
+		t.Errorf("got the mode '%s' of a CA file, want custom", mode)
+	}
+
+	customWithoutCA := valid
+	customWithoutCA.TLS = "custom"
+	if err := customWithoutCA.Validate(); err == nil || !strings.Contains(err.Error(), "-ssl-ca") {
+		t.Errorf("got %v, want custom without a CA file rejected", err)
+	}
+
+	unknown := valid
+	unknown.TLS = "yes"
+	if err := unknown.Validate(); err == nil {
+		t.Error("an unknown tls mode is valid")
+	}
+
+	for _, mode := range []string{"", "false"} {
+		disabled := valid
+		disabled.TLS = mode
+		if err := disabled.RegisterTLS(); err != nil {
+			t.Errorf("register the disabled tls '%s': %v", mode, err)
+		}
+		if parsed, err := mysql.ParseDSN(disabled.DSN()); err != nil || parsed.TLSConfig != "" {
+			t.Errorf("got the tls config '%s' for the mode '%s', want none: %v", parsed.TLSConfig, mode, err)
+		}
+	}
+}
+
+// An enabled TLS registers the tls.Config and names it in the DSN
+func TestConnConfigRegisterTLS(t *testing.T) {
+	config := ConnConfig{Host: "127.0.0.1", Port: "4000", User: "root", Database: "bookshop", SSLCA: writeTestCA(t)}
+	if err := config.RegisterTLS(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mysql.DeregisterTLSConfig(tlsConfigName) })
+
+	if !strings.Contains(config.DSN(), "tls="+tlsConfigName) {
+		t.Errorf("the DSN %s has no tls=%s", config.DSN(), tlsConfigName)
+	}
+}
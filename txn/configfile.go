@@ -0,0 +1,167 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configFile is the TOML file given by -config
+var configFile = ""
+
+// FileConfig is the content of the TOML config file, see bookshop.toml.
+// A zero value means the field is not given in the file
+type FileConfig struct {
+	Database struct {
+		Host     string `toml:"host"`
+		Port     int    `toml:"port"`
+		User     string `toml:"user"`
+		Password string `toml:"password"`
+		Name     string `toml:"name"`
+		TLS      string `toml:"tls"`
+		SSLCA    string `toml:"ssl_ca"`
+	} `toml:"database"`
+	Workload struct {
+		Mode       string `toml:"mode"`
+		Buyers     int    `toml:"buyers"`
+		Amount     int    `toml:"amount"`
+		RetryTimes int    `toml:"retryTimes"`
+		Backoff    string `toml:"backoff"`
+	} `toml:"workload"`
+	// Columns are the column names of an existing schema, a field not given keeps the demo name
+	Columns ColumnNames `toml:"columns"`
+}
+
+// flagValues maps the fields given in the file to the flags they set. The workload maps to the flags of the demo
+// or of the buy subcommand, whichever fs has, a field without a flag in fs is ignored
+func (c FileConfig) flagValues() map[string]string {
+	values := map[string]string{}
+	set := func(value string, names ...string) {
+		if value == "" {
+			return
+		}
+		for _, name := range names {
+			values[name] = value
+		}
+	}
+	setInt := func(value int, names ...string) {
+		if value != 0 {
+			set(strconv.Itoa(value), names...)
+		}
+	}
+
+	set(c.Database.Host, "host")
+	setInt(c.Database.Port, "port")
+	set(c.Database.User, "db-user")
+	set(c.Database.Password, "password")
+	set(c.Database.Name, "db")
+	set(c.Database.TLS, "tls")
+	set(c.Database.SSLCA, "ssl-ca")
+
+	set(c.Workload.Mode, "mode")
+	switch c.Workload.Mode {
+	case "optimistic":
+		set("true", "o")
+	case "pessimistic":
+		set("false", "o")
+	}
+	setInt(c.Workload.Buyers, "load-buyers", "concurrency")
+	setInt(c.Workload.Amount, "amount")
+	setInt(c.Workload.RetryTimes, "retry-times")
+	set(c.Workload.Backoff, "backoff")
+
+	return values
+}
+
+// loadConfigFile applies configFile to the flags of fs which are not given on the command line
+// and sets the column names of its [columns], then prints the effective config. It does nothing without -config
+func loadConfigFile(fs *flag.FlagSet) error {
+	if configFile == "" {
+		return nil
+	}
+
+	config := FileConfig{Columns: defaultColumnNames}
+	if _, err := toml.DecodeFile(configFile, &config); err != nil {
+		return fmt.Errorf("load config file %s: %w", configFile, err)
+	}
+	if err := setColumnNames(config.Columns); err != nil {
+		return fmt.Errorf("config file %s: %w", configFile, err)
+	}
+
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		if alias, ok := f.Value.(flagAlias); ok {
+			given[alias.target.Name] = true
+		}
+	})
+	for name, value := range config.flagValues() {
+		if given[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config file %s: invalid value '%s' for %s: %w", configFile, value, name, err)
+		}
+	}
+
+	fmt.Printf("effective config: %s\n", effectiveConfig(fs))
+	if columnNames != defaultColumnNames {
+		fmt.Printf("column names: %+v\n", columnNames)
+	}
+	return nil
+}
+
+// effectiveConfig renders the value of every flag of fs with the password redacted
+func effectiveConfig(fs *flag.FlagSet) string {
+	var values []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := f.Value.(flagAlias); ok {
+			return
+		}
+		value := f.Value.String()
+		if f.Name == "password" && value != "" {
+			value = "******"
+		}
+		values = append(values, f.Name+"="+value)
+	})
+	return strings.Join(values, " ")
+}
+
+// flagAlias is another name of a flag, see aliasFlag
+type flagAlias struct {
+	target *flag.Flag
+}
+
+func (a flagAlias) String() string {
+	if a.target == nil {
+		return ""
+	}
+	return a.target.Value.String()
+}
+
+func (a flagAlias) Set(value string) error {
+	return a.target.Value.Set(value)
+}
+
+// aliasFlag registers alias as another name of the flag name of fs. The config file treats them as one flag,
+// so the file doesn't override a flag given by its alias
+func aliasFlag(fs *flag.FlagSet, alias, name string) {
+	fs.Var(flagAlias{target: fs.Lookup(name)}, alias, "alias of -"+name)
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// writeConfigFile writes content to the config file of the test and points configFile at it
+func writeConfigFile(t *testing.T, content string) {
+	t.Helper()
+	configFile = filepath.Join(t.TempDir(), "bookshop.toml")
+	if err := os.WriteFile(configFile, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restoreBackoff restores the backoff flags the config file may set after the test
+func restoreBackoff(t *testing.T) {
+	defaultMin, defaultMax := backoffMin, backoffMax
+	t.Cleanup(func() {
+		backoffMin, backoffMax = defaultMin, defaultMax
+	})
+}
+
+// The sample config in the repo parses into the sections of FileConfig
+func TestSampleConfigFile(t *testing.T) {
+	config := FileConfig{Columns: defaultColumnNames}
+	meta, err := toml.DecodeFile("bookshop.toml", &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) != 0 {
+		t.Errorf("unknown keys %v", undecoded)
+	}
+
+	if config.Database.Host != "127.0.0.1" || config.Database.Port != 4000 || config.Database.User != "root" ||
+		config.Database.Name != "bookshop" {
+		t.Errorf("unexpected [database] %+v", config.Database)
+	}
+	if config.Workload.Mode != "pessimistic" || config.Workload.Buyers != 4 || config.Workload.Amount != 1 ||
+		config.Workload.RetryTimes != 5 || config.Workload.Backoff != "50ms" {
+		t.Errorf("unexpected [workload] %+v", config.Workload)
+	}
+	if config.Columns != defaultColumnNames {
+		t.Errorf("got the columns %+v, want the demo ones", config.Columns)
+	}
+}
+
+// A field not given in the file keeps the default of its flag
+func TestConfigFileDefaults(t *testing.T) {
+	fs := sharedFlagSet(t, "buy")
+	restoreBackoff(t)
+	options := BuyOptions{Purchase: defaultPurchaseOptions()}
+	registerBuyFlags(fs, &options)
+	writeConfigFile(t, "[database]\nhost = \"tidb.file\"\n")
+
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	defaultConfig := connConfig
+	if err := loadConfigFile(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaultConfig
+	want.Host = "tidb.file"
+	if connConfig != want {
+		t.Errorf("got %+v, want %+v", connConfig, want)
+	}
+	if options.Optimistic || options.Amount != 1 || options.Concurrency != 1 || options.Purchase.RetryTimes != retryTimes {
+		t.Errorf("unexpected options %+v", options)
+	}
+	if backoffMin != txnBackoff.Base {
+		t.Errorf("got the backoff %s, want the default %s", backoffMin, txnBackoff.Base)
+	}
+}
+
+// A flag on the command line overrides the file, which overrides the default
+func TestConfigFilePrecedence(t *testing.T) {
+	fs := sharedFlagSet(t, "buy")
+	restoreBackoff(t)
+	options := BuyOptions{Purchase: defaultPurchaseOptions()}
+	registerBuyFlags(fs, &options)
+	writeConfigFile(t, `[database]
+host = "tidb.file"
+port = 4001
+user = "file_user"
+
+[workload]
+mode = "optimistic"
+buyers = 5
+amount = 3
+retryTimes = 7
+backoff = "10ms"
+`)
+
+	if err := fs.Parse([]string{"-amount", "2", "-port", "4002"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if connConfig.Host != "tidb.file" || connConfig.Port != "4002" || connConfig.User != "file_user" {
+		t.Errorf("unexpected connection config %+v", connConfig)
+	}
+	if !options.Optimistic || options.Amount != 2 || options.Concurrency != 5 || options.BookID != 1 {
+		t.Errorf("unexpected options %+v", options)
+	}
+	if options.Purchase.RetryTimes != 7 || backoffMin != 10*time.Millisecond {
+		t.Errorf("got the retry times %d and the backoff %s, want 7 and 10ms", options.Purchase.RetryTimes, backoffMin)
+	}
+}
+
+func TestConfigFileFailures(t *testing.T) {
+	for _, test := range []struct {
+		name, content, want string
+	}{
+		{"not TOML", "[database\n", "load config file"},
+		{"invalid value", "[workload]\nbackoff = \"soon\"\n", "invalid value 'soon' for backoff"},
+		{"wrong type", "[database]\nport = \"4000\"\n", "load config file"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fs := sharedFlagSet(t, "buy")
+			restoreBackoff(t)
+			registerBuyFlags(fs, &BuyOptions{Purchase: defaultPurchaseOptions()})
+			writeConfigFile(t, test.content)
+			if err := fs.Parse(nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := loadConfigFile(fs); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want '%s'", err, test.want)
+			}
+		})
+	}
+
+	fs := sharedFlagSet(t, "buy")
+	configFile = filepath.Join(t.TempDir(), "missing.toml")
+	if err := loadConfigFile(fs); err == nil {
+		t.Error("a missing config file is loaded")
+	}
+}
+
+// The effective config printed at startup never shows the password
+func TestEffectiveConfigRedactsPassword(t *testing.T) {
+	fs := sharedFlagSet(t, "buy")
+	if err := fs.Parse([]string{"-password", "secret", "-host", "tidb.cli"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := effectiveConfig(fs)
+	if strings.Contains(config, "secret") || !strings.Contains(config, "password=******") {
+		t.Errorf("the password is not redacted: %s", config)
+	}
+	if !strings.Contains(config, "host=tidb.cli") {
+		t.Errorf("the host is missing: %s", config)
+	}
+}
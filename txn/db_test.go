@@ -0,0 +1,220 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/shopspring/decimal"
+)
+
+// testDSNEnv is the DSN of the TiDB the integration tests run against, they are skipped without it, e.g.
+// TIDB_TEST_DSN='root@tcp(127.0.0.1:4000)/' go test ./...
+const testDSNEnv = "TIDB_TEST_DSN"
+
+// testDatabase is the database of the integration tests, its tables are emptied before each test
+const testDatabase = "bookshop_test"
+
+// openTestDB connects to the TiDB of testDSNEnv, creates the schema in testDatabase and deletes all the rows.
+// It skips the test if testDSNEnv is not set
+func openTestDB(tb testing.TB) *sql.DB {
+	tb.Helper()
+	return openTestDatabase(tb, testDatabase)
+}
+
+// openTestDatabase is openTestDB on database
+func openTestDatabase(tb testing.TB, database string) *sql.DB {
+	tb.Helper()
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		tb.Skipf("%s is not set", testDSNEnv)
+	}
+
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		tb.Fatalf("invalid %s: %v", testDSNEnv, err)
+	}
+	config.ParseTime = true
+
+	ctx := context.Background()
+	config.DBName = ""
+	bootstrap, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = ensureSchema(ctx, bootstrap, database)
+	bootstrap.Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	config.DBName = database
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		db.Close()
+	})
+
+	for _, table := range []string{"orders", "users", "books"} {
+		if _, err = db.ExecContext(ctx, "DELETE FROM "+quoteIdentifier(table)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	quietLogger(tb)
+	return db
+}
+
+// newMock returns a database backed by sqlmock, the queries are matched as they are.
+// The expectations must be met by the end of the test
+func newMock(tb testing.TB) (*sql.DB, sqlmock.Sqlmock) {
+	tb.Helper()
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			tb.Error(err)
+		}
+		db.Close()
+	})
+
+	quietLogger(tb)
+	return db, mock
+}
+
+// newMockConn is newMock with a connection of the database, closed after the test
+func newMockConn(tb testing.TB) (*sql.Conn, sqlmock.Sqlmock) {
+	tb.Helper()
+	db, mock := newMock(tb)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+	})
+	return conn, mock
+}
+
+// quietLogger drops the output of the runner and the buys for the test
+func quietLogger(tb testing.TB) {
+	defaultLogger := logger
+	logger = NopLogger{}
+	tb.Cleanup(func() {
+		logger = defaultLogger
+	})
+}
+
+// bufferLogger keeps the lines logged during a test in order, Errorf lines are prefixed by "error: "
+type bufferLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *bufferLogger) Infof(format string, args ...interface{}) {
+	l.append(fmt.Sprintf(format, args...))
+}
+
+func (l *bufferLogger) Errorf(format string, args ...interface{}) {
+	l.append("error: " + fmt.Sprintf(format, args...))
+}
+
+func (l *bufferLogger) append(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, line)
+}
+
+func (l *bufferLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+// useBufferLogger makes the runner and the buys log to a bufferLogger for the test
+func useBufferLogger(tb testing.TB) *bufferLogger {
+	defaultLogger, buffer := logger, &bufferLogger{}
+	logger = buffer
+	tb.Cleanup(func() {
+		logger = defaultLogger
+	})
+	return buffer
+}
+
+// mustExec runs a statement of the test setup
+func mustExec(tb testing.TB, db *sql.DB, query string, args ...interface{}) {
+	tb.Helper()
+	if _, err := db.ExecContext(context.Background(), query, args...); err != nil {
+		tb.Fatalf("%s: %v", query, err)
+	}
+}
+
+// createTestBooks upserts books by BookRepo
+func createTestBooks(tb testing.TB, db *sql.DB, books ...Book) {
+	tb.Helper()
+	withTestConn(tb, db, func(ctx context.Context, conn *sql.Conn) error {
+		for _, book := range books {
+			if err := NewBookRepo(conn).CreateBook(ctx, book); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// createTestUsers upserts users by UserRepo
+func createTestUsers(tb testing.TB, db *sql.DB, users ...User) {
+	tb.Helper()
+	withTestConn(tb, db, func(ctx context.Context, conn *sql.Conn) error {
+		for _, user := range users {
+			if err := NewUserRepo(conn).CreateUser(ctx, user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// withTestConn runs fn on a connection of db and fails the test on its error
+func withTestConn(tb testing.TB, db *sql.DB, fn TxnFunc) {
+	tb.Helper()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err = fn(ctx, conn); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// testBook is a book of the test with the given id, price and stock
+func testBook(id int, bookType string, price string, stock int) Book {
+	return Book{ID: id, Title: fmt.Sprintf("Book %d", id), Type: bookType,
+		PublishedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Price: decimal.RequireFromString(price), Stock: stock}
+}
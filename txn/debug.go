@@ -0,0 +1,92 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// interpolateSQL renders the placeholders of query with args, so a failed statement can be pasted into a client.
+// It's for debug logging only, never execute the result, the statements always run with placeholders
+func interpolateSQL(query string, args ...interface{}) string {
+	var builder strings.Builder
+	argIndex, quote := 0, byte(0)
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' && i+1 < len(query) {
+				builder.WriteByte(c)
+				i++
+				c = query[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '?':
+			if argIndex < len(args) {
+				builder.WriteString(renderSQLArg(args[argIndex]))
+				argIndex++
+				continue
+			}
+		}
+		builder.WriteByte(c)
+	}
+
+	return builder.String()
+}
+
+func renderSQLArg(arg interface{}) string {
+	if valuer, ok := arg.(driver.Valuer); ok {
+		if _, isDecimal := arg.(decimal.Decimal); !isDecimal {
+			value, err := valuer.Value()
+			if err != nil {
+				return fmt.Sprintf("/* %v */ NULL", err)
+			}
+			arg = value
+		}
+	}
+
+	switch value := arg.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return quoteSQLString(value)
+	case []byte:
+		return quoteSQLString(string(value))
+	case decimal.Decimal:
+		return value.String()
+	case time.Time:
+		return "'" + value.Format("2006-01-02 15:04:05.999999") + "'"
+	case bool:
+		if value {
+			return "1"
+		}
+		return "0"
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
+
+func quoteSQLString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\x00", `\0`).Replace(s) + "'"
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+func TestInterpolateSQL(t *testing.T) {
+	orderedAt := time.Date(2022, 3, 4, 5, 6, 7, 890000000, time.UTC)
+	tests := []struct {
+		name  string
+		query string
+		args  []interface{}
+		want  string
+	}{
+		{"string", "SELECT * FROM `users` WHERE `nickname` = ?", []interface{}{"O'Brien \\ co"},
+			`SELECT * FROM ` + "`users`" + ` WHERE ` + "`nickname`" + ` = 'O\'Brien \\ co'`},
+		{"decimal", "UPDATE `users` SET `balance` = `balance` - ?", []interface{}{decimal.RequireFromString("12.50")},
+			"UPDATE `users` SET `balance` = `balance` - 12.5"},
+		{"time", "SELECT ? AS `ordered_at`", []interface{}{orderedAt}, "SELECT '2022-03-04 05:06:07.89' AS `ordered_at`"},
+		{"nil", "INSERT INTO `orders` (`id`, `idempotency_key`) VALUES (?, ?)", []interface{}{int64(7), nil},
+			"INSERT INTO `orders` (`id`, `idempotency_key`) VALUES (7, NULL)"},
+		{"bool and bytes", "SELECT ?, ?", []interface{}{true, []byte("a\nb")}, `SELECT 1, 'a\nb'`},
+		{"placeholder in a literal", "SELECT '?', `?`, ? FROM `books`", []interface{}{1}, "SELECT '?', `?`, 1 FROM `books`"},
+		{"escaped quote in a literal", `SELECT 'it\'s ?', ?`, []interface{}{2}, `SELECT 'it\'s ?', 2`},
+		{"missing args", "SELECT ?, ?", []interface{}{1}, "SELECT 1, ?"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := interpolateSQL(test.query, test.args...); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// A failed statement of a TxnConn is logged with its args inlined
+func TestTxnConnLogsFailedStatement(t *testing.T) {
+	db, mock := newMock(t)
+	buffer := useBufferLogger(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE `users` SET `balance` = ? WHERE `nickname` = ?").WillReturnError(errors.New("boom"))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, err := RunTxnConn(context.Background(), db, func(ctx context.Context, conn *TxnConn) error {
+		_, err := conn.Exec(ctx, "UPDATE `users` SET `balance` = ? WHERE `nickname` = ?", decimal.NewFromInt(-1), "Bob")
+		return err
+	})
+	if err == nil {
+		t.Fatal("the failed statement committed")
+	}
+
+	want := "UPDATE `users` SET `balance` = -1 WHERE `nickname` = 'Bob'"
+	for _, line := range buffer.Lines() {
+		if strings.Contains(line, "statement failed: boom") && strings.HasSuffix(line, want) {
+			return
+		}
+	}
+	t.Errorf("no log line of the failed statement ending with %s in %q", want, buffer.Lines())
+}
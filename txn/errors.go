@@ -0,0 +1,443 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TiDBErrorCode is the error number of a TiDB *mysql.MySQLError
+type TiDBErrorCode uint16
+
+const (
+	ErrWriteConflict      TiDBErrorCode = 9007 // Transactions in TiKV encounter write conflicts.
+	ErrInfoSchemaChanged  TiDBErrorCode = 8028 // table schema changes
+	ErrForUpdateCantRetry TiDBErrorCode = 8002 // "SELECT FOR UPDATE" commit conflict
+	ErrTxnRetryable       TiDBErrorCode = 8022 // The transaction commit fails and has been rolled back
+	ErrDupEntry           TiDBErrorCode = 1062 // Duplicate entry for a unique key
+	ErrLockDeadlock       TiDBErrorCode = 1213 // Deadlock found when trying to get lock
+	ErrLockWaitTimeout    TiDBErrorCode = 1205 // Lock wait timeout exceeded
+	ErrNoSuchTable        TiDBErrorCode = 1146 // Table or sequence doesn't exist
+	ErrCheckConstraint    TiDBErrorCode = 3819 // Check constraint is violated
+	ErrDupCheckConstraint TiDBErrorCode = 3822 // Duplicate check constraint name
+	ErrNoReferencedRow    TiDBErrorCode = 1452 // A foreign key constraint fails
+	ErrGCTooEarly         TiDBErrorCode = 9006 // GC life time is shorter than transaction duration
+	ErrUnknownSysVar      TiDBErrorCode = 1193 // Unknown system variable, like a TiDB one on MySQL
+	ErrReadOnlyTxn        TiDBErrorCode = 1792 // Cannot execute statement in a READ ONLY transaction
+	ErrLockNoWait         TiDBErrorCode = 3572 // Lock(s) could not be acquired immediately and NOWAIT is set
+	ErrMaxExecutionTime   TiDBErrorCode = 3024 // Maximum statement execution time exceeded
+	ErrNotAllowedCommand  TiDBErrorCode = 1148 // The used command is not allowed, like LOAD DATA LOCAL when it's disabled
+	ErrLocalFileDisabled  TiDBErrorCode = 3948 // Loading local data is disabled on the client or the server side
+)
+
+var retryErrorCodeSet = map[TiDBErrorCode]interface{}{
+	ErrWriteConflict:      nil,
+	ErrInfoSchemaChanged:  nil,
+	ErrForUpdateCantRetry: nil,
+	ErrTxnRetryable:       nil,
+}
+
+// pessimisticRetryErrorCodeSet are the errors a pessimistic transaction retries from the top,
+// so the FOR UPDATE read sees the fresh data
+var pessimisticRetryErrorCodeSet = map[TiDBErrorCode]interface{}{
+	ErrLockDeadlock:    nil,
+	ErrLockWaitTimeout: nil,
+}
+
+var errorCodeNames = map[TiDBErrorCode]string{
+	ErrWriteConflict:      "WriteConflict",
+	ErrInfoSchemaChanged:  "InfoSchemaChanged",
+	ErrForUpdateCantRetry: "ForUpdateCantRetry",
+	ErrTxnRetryable:       "TxnRetryable",
+	ErrDupEntry:           "DupEntry",
+	ErrLockDeadlock:       "LockDeadlock",
+	ErrLockWaitTimeout:    "LockWaitTimeout",
+	ErrNoSuchTable:        "NoSuchTable",
+	ErrCheckConstraint:    "CheckConstraint",
+	ErrDupCheckConstraint: "DupCheckConstraint",
+	ErrNoReferencedRow:    "NoReferencedRow",
+	ErrGCTooEarly:         "GCTooEarly",
+	ErrUnknownSysVar:      "UnknownSysVar",
+	ErrReadOnlyTxn:        "ReadOnlyTxn",
+	ErrLockNoWait:         "LockNoWait",
+	ErrMaxExecutionTime:   "MaxExecutionTime",
+	ErrNotAllowedCommand:  "NotAllowedCommand",
+	ErrLocalFileDisabled:  "LocalFileDisabled",
+}
+
+// constraintErrorCodeSet are the constraint violations, they are terminal in both modes,
+// the same statement violates the same constraint on every retry
+var constraintErrorCodeSet = map[TiDBErrorCode]interface{}{
+	ErrDupEntry:        nil,
+	ErrCheckConstraint: nil,
+	ErrNoReferencedRow: nil,
+}
+
+func (c TiDBErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return fmt.Sprintf("%s(%d)", name, uint16(c))
+	}
+
+	return fmt.Sprintf("TiDBErrorCode(%d)", uint16(c))
+}
+
+// Retryable reports whether an optimistic transaction failed with this code can be retried
+func (c TiDBErrorCode) Retryable() bool {
+	_, ok := retryErrorCodeSet[c]
+	return ok
+}
+
+// PessimisticRetryable reports whether a pessimistic transaction failed with this code can be retried
+func (c TiDBErrorCode) PessimisticRetryable() bool {
+	_, ok := pessimisticRetryErrorCodeSet[c]
+	return ok
+}
+
+// ErrDuplicate is a business conflict on a unique key, retrying the same transaction won't help
+var ErrDuplicate = errors.New("duplicate key")
+
+// ErrConstraintViolated is a violation of a unique key, a check constraint or a foreign key
+var ErrConstraintViolated = errors.New("constraint violated")
+
+// ConstraintError is a constraint violation of a statement, it's never retried.
+// errors.Is(err, ErrDuplicate) holds for a duplicate key, errors.Is(err, ErrConstraintViolated) for all of them
+type ConstraintError struct {
+	Code       TiDBErrorCode
+	Constraint string // the index or the constraint violated, empty if the message can't be parsed
+	err        *mysql.MySQLError
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Code == ErrDupEntry {
+		return fmt.Sprintf("%s: %s", ErrDuplicate.Error(), e.err.Message)
+	}
+	return fmt.Sprintf("%s: %s", ErrConstraintViolated.Error(), e.err.Message)
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.err
+}
+
+func (e *ConstraintError) Is(target error) bool {
+	return target == ErrConstraintViolated || (target == ErrDuplicate && e.Code == ErrDupEntry)
+}
+
+var (
+	// Duplicate entry '1000' for key 'orders.PRIMARY'
+	duplicateKeyPattern = regexp.MustCompile(`for key '([^']*)'`)
+	// Check constraint 'users_balance_not_negative' is violated.
+	checkConstraintPattern = regexp.MustCompile(`^Check constraint '([^']*)'`)
+	// Cannot add or update a child row: a foreign key constraint fails (`bookshop`.`orders`, CONSTRAINT `fk_orders_book_id` ...
+	foreignKeyPattern = regexp.MustCompile("CONSTRAINT `([^`]*)`")
+)
+
+// constraintName parses the name of the index or the constraint violated from the message of a constraint error
+func constraintName(code TiDBErrorCode, message string) string {
+	pattern := duplicateKeyPattern
+	switch code {
+	case ErrCheckConstraint:
+		pattern = checkConstraintPattern
+	case ErrNoReferencedRow:
+		pattern = foreignKeyPattern
+	}
+
+	if match := pattern.FindStringSubmatch(message); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// asConstraintError returns err as a *ConstraintError if it is a constraint violation
+func asConstraintError(err error) (*ConstraintError, bool) {
+	constraintErr := &ConstraintError{}
+	if errors.As(err, &constraintErr) {
+		return constraintErr, true
+	}
+
+	mysqlErr := &mysql.MySQLError{}
+	if !errors.As(err, &mysqlErr) {
+		return nil, false
+	}
+	code := TiDBErrorCode(mysqlErr.Number)
+	if _, ok := constraintErrorCodeSet[code]; !ok {
+		return nil, false
+	}
+	return &ConstraintError{Code: code, Constraint: constraintName(code, mysqlErr.Message), err: mysqlErr}, true
+}
+
+// classifyTxnError wraps a constraint violation in a *ConstraintError,
+// the *mysql.MySQLError is still reachable by errors.As
+func classifyTxnError(err error) error {
+	if constraintErr, ok := asConstraintError(err); ok {
+		return constraintErr
+	}
+
+	return err
+}
+
+// IsRetryableTxnError reports whether an optimistic transaction failed with err can be retried,
+// err may wrap a TiDB error in retryErrorCodeSet or a bad connection. A constraint violation is never retryable
+func IsRetryableTxnError(err error) bool {
+	if _, ok := asConstraintError(err); ok {
+		return false
+	}
+
+	mysqlErr := &mysql.MySQLError{}
+	if errors.As(err, &mysqlErr) {
+		return TiDBErrorCode(mysqlErr.Number).Retryable()
+	}
+
+	return isBadConn(err)
+}
+
+// ErrRowLocked is a row locked by another transaction beyond the wait of FOR UPDATE NOWAIT or FOR UPDATE WAIT n
+var ErrRowLocked = errors.New("row is locked by another transaction")
+
+type lockedError struct {
+	err *mysql.MySQLError
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrRowLocked.Error(), e.err.Message)
+}
+
+func (e *lockedError) Unwrap() error {
+	return e.err
+}
+
+func (e *lockedError) Is(target error) bool {
+	return target == ErrRowLocked
+}
+
+// rowLockedError wraps a NOWAIT denial or a lock wait timeout so that errors.Is(err, ErrRowLocked) holds
+func rowLockedError(err error) error {
+	mysqlErr := &mysql.MySQLError{}
+	if errors.As(err, &mysqlErr) {
+		if code := TiDBErrorCode(mysqlErr.Number); code == ErrLockNoWait || code == ErrLockWaitTimeout {
+			return &lockedError{err: mysqlErr}
+		}
+	}
+	return err
+}
+
+// ErrorClass is the kind of error a transaction failed with
+type ErrorClass int
+
+const (
+	ErrorClassOther     ErrorClass = iota // not any of the classes below
+	ErrorClassRetryable                   // a retryable TiDB error in either mode
+	ErrorClassConflict                    // a business conflict, see ConstraintError
+	ErrorClassBadConn                     // the connection is broken
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassRetryable:
+		return "retryable"
+	case ErrorClassConflict:
+		return "conflict"
+	case ErrorClassBadConn:
+		return "bad connection"
+	default:
+		return "other"
+	}
+}
+
+// ClassifyError returns the class of a non-nil transaction error
+func ClassifyError(err error) ErrorClass {
+	if isBadConn(err) {
+		return ErrorClassBadConn
+	}
+
+	if _, ok := asConstraintError(err); ok {
+		return ErrorClassConflict
+	}
+
+	mysqlErr := &mysql.MySQLError{}
+	if errors.As(err, &mysqlErr) {
+		if code := TiDBErrorCode(mysqlErr.Number); code.Retryable() || code.PessimisticRetryable() {
+			return ErrorClassRetryable
+		}
+	}
+
+	return ErrorClassOther
+}
+
+// ErrorSummary counts the errors by class, it's safe for concurrent use
+type ErrorSummary struct {
+	mu     sync.Mutex
+	counts map[ErrorClass]int
+}
+
+// Add counts err by its class, a nil err is ignored
+func (s *ErrorSummary) Add(err error) {
+	if err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts == nil {
+		s.counts = make(map[ErrorClass]int)
+	}
+	s.counts[ClassifyError(err)]++
+}
+
+// Report returns the number of errors of each class
+func (s *ErrorSummary) Report() map[ErrorClass]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := make(map[ErrorClass]int, len(s.counts))
+	for class, count := range s.counts {
+		report[class] = count
+	}
+
+	return report
+}
+
+// String renders the counts of Report by class, like "conflict: 1, retryable: 3", it's empty without errors
+func (s *ErrorSummary) String() string {
+	report := s.Report()
+	classes := make([]ErrorClass, 0, len(report))
+	for class := range report {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i].String() < classes[j].String() })
+
+	counts := make([]string, 0, len(classes))
+	for _, class := range classes {
+		counts = append(counts, fmt.Sprintf("%s: %d", class, report[class]))
+	}
+	return strings.Join(counts, ", ")
+}
+
+// PanicError is the failure of a TxnFunc which panicked, the transaction was rolled back
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("transaction function panicked: %v", e.Value)
+}
+
+// The business failures of a buy, they are never retried
+var (
+	ErrBookNotFound        = errors.New("book not exist")
+	ErrUserNotFound        = errors.New("user not exist")
+	ErrOrderNotFound       = errors.New("order not exist")
+	ErrStockInsufficient   = errors.New("stock not enough")
+	ErrBalanceInsufficient = errors.New("balance not enough")
+	ErrInvalidAmount       = errors.New("amount must be positive")
+)
+
+// QuantityExceededError rejects an order which buys more than PurchaseOptions.MaxQuantity
+type QuantityExceededError struct {
+	Amount int
+	Max    int
+}
+
+func (e *QuantityExceededError) Error() string {
+	return fmt.Sprintf("order quantity %d exceeds the max %d per order", e.Amount, e.Max)
+}
+
+var (
+	ErrTxnFuncFailed    = errors.New("transaction function failed")
+	ErrCommitFailed     = errors.New("commit failed")
+	ErrRetriesExhausted = errors.New("retries exhausted")
+	ErrBudgetExhausted  = errors.New("budget exhausted")
+)
+
+// TxnError is returned by runTxn, errors.Is tells its Kind, and errors.As reaches the underlying *mysql.MySQLError
+type TxnError struct {
+	Kind error // ErrTxnFuncFailed, ErrCommitFailed, ErrRetriesExhausted or ErrBudgetExhausted
+	Err  error
+
+	connBroken bool // the ROLLBACK found the connection broken, it must not be reused
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind.Error(), e.Err)
+}
+
+func (e *TxnError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TxnError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// CancelReason is why a transaction or a buy was cancelled
+type CancelReason int
+
+const (
+	CancelReasonTimeout   CancelReason = iota + 1 // the context deadline exceeded
+	CancelReasonShutdown                          // the context was cancelled, like the process shutting down
+	CancelReasonAdmission                         // shed by the admission controller
+	CancelReasonPaused                            // buying is paused
+)
+
+func (r CancelReason) String() string {
+	switch r {
+	case CancelReasonTimeout:
+		return "timeout"
+	case CancelReasonShutdown:
+		return "shutdown"
+	case CancelReasonAdmission:
+		return "admission control"
+	case CancelReasonPaused:
+		return "paused"
+	default:
+		return "unknown"
+	}
+}
+
+// CancelError is a cancellation with its reason, it unwraps to the error of the cancellation site
+type CancelError struct {
+	reason CancelReason
+	err    error
+}
+
+func (e *CancelError) Error() string {
+	return fmt.Sprintf("cancelled by %s: %v", e.reason.String(), e.err)
+}
+
+func (e *CancelError) Unwrap() error {
+	return e.err
+}
+
+func (e *CancelError) Reason() CancelReason {
+	return e.reason
+}
+
+// contextCancelError attaches the reason to the error of a done context
+func contextCancelError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &CancelError{reason: CancelReasonTimeout, err: err}
+	}
+
+	return &CancelError{reason: CancelReasonShutdown, err: err}
+}
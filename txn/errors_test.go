@@ -0,0 +1,320 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestTiDBErrorCodeString(t *testing.T) {
+	tests := []struct {
+		code TiDBErrorCode
+		want string
+	}{
+		{ErrWriteConflict, "WriteConflict(9007)"},
+		{ErrInfoSchemaChanged, "InfoSchemaChanged(8028)"},
+		{ErrLockDeadlock, "LockDeadlock(1213)"},
+		{TiDBErrorCode(1234), "TiDBErrorCode(1234)"},
+	}
+
+	for _, test := range tests {
+		if got := test.code.String(); got != test.want {
+			t.Errorf("TiDBErrorCode(%d).String() = %s, want %s", uint16(test.code), got, test.want)
+		}
+	}
+}
+
+func TestTiDBErrorCodeRetryable(t *testing.T) {
+	tests := []struct {
+		code                 TiDBErrorCode
+		retryable            bool
+		pessimisticRetryable bool
+	}{
+		{ErrWriteConflict, true, false},
+		{ErrInfoSchemaChanged, true, false},
+		{ErrForUpdateCantRetry, true, false},
+		{ErrTxnRetryable, true, false},
+		{ErrLockDeadlock, false, true},
+		{ErrLockWaitTimeout, false, true},
+		{ErrDupEntry, false, false},
+		{ErrGCTooEarly, false, false},
+		{TiDBErrorCode(1234), false, false},
+	}
+
+	for _, test := range tests {
+		if got := test.code.Retryable(); got != test.retryable {
+			t.Errorf("%s.Retryable() = %t, want %t", test.code, got, test.retryable)
+		}
+		if got := test.code.PessimisticRetryable(); got != test.pessimisticRetryable {
+			t.Errorf("%s.PessimisticRetryable() = %t, want %t", test.code, got, test.pessimisticRetryable)
+		}
+	}
+}
+
+func TestClassifyTxnErrorDuplicate(t *testing.T) {
+	err := classifyTxnError(&mysql.MySQLError{Number: uint16(ErrDupEntry),
+		Message: "Duplicate entry '1000' for key 'orders.PRIMARY'"})
+
+	constraintErr := &ConstraintError{}
+	if !errors.As(err, &constraintErr) || constraintErr.Code != ErrDupEntry || constraintErr.Constraint != "orders.PRIMARY" {
+		t.Fatalf("got %#v, want a duplicate on orders.PRIMARY", err)
+	}
+	if !errors.Is(err, ErrDuplicate) || !errors.Is(err, ErrConstraintViolated) {
+		t.Errorf("%v is not ErrDuplicate and ErrConstraintViolated", err)
+	}
+	if IsRetryableTxnError(err) {
+		t.Errorf("%v is retryable", err)
+	}
+}
+
+// A NOWAIT denial and a lock wait timeout are ErrRowLocked with the *mysql.MySQLError kept, other errors pass through
+func TestRowLockedError(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		locked bool
+	}{
+		{&mysql.MySQLError{Number: uint16(ErrLockNoWait), Message: "Lock(s) could not be acquired immediately and NOWAIT is set."}, true},
+		{&mysql.MySQLError{Number: uint16(ErrLockWaitTimeout), Message: "Lock wait timeout exceeded; try restarting transaction"}, true},
+		{fmt.Errorf("get book: %w", &mysql.MySQLError{Number: uint16(ErrLockNoWait), Message: "NOWAIT is set"}), true},
+		{&mysql.MySQLError{Number: uint16(ErrLockDeadlock), Message: "Deadlock found when trying to get lock"}, false},
+		{sql.ErrNoRows, false},
+	} {
+		err := rowLockedError(test.err)
+		if errors.Is(err, ErrRowLocked) != test.locked {
+			t.Errorf("%v: ErrRowLocked %v, want %v", test.err, !test.locked, test.locked)
+		}
+		if !test.locked && err != test.err {
+			t.Errorf("got %v, want %v as it is", err, test.err)
+		}
+		mysqlErr := &mysql.MySQLError{}
+		if test.locked && (!errors.As(err, &mysqlErr) || !strings.HasPrefix(err.Error(), ErrRowLocked.Error())) {
+			t.Errorf("got %v, want ErrRowLocked wrapping the *mysql.MySQLError", err)
+		}
+	}
+}
+
+// constraintErrors are crafted violations of each constraint code with the constraint they name
+var constraintErrors = []struct {
+	err        *mysql.MySQLError
+	constraint string
+	duplicate  bool
+}{
+	{&mysql.MySQLError{Number: uint16(ErrDupEntry), Message: "Duplicate entry 'k' for key 'orders.orders_idempotency_key'"},
+		"orders.orders_idempotency_key", true},
+	{&mysql.MySQLError{Number: uint16(ErrCheckConstraint), Message: "Check constraint 'users_balance_not_negative' is violated."},
+		"users_balance_not_negative", false},
+	{&mysql.MySQLError{Number: uint16(ErrNoReferencedRow), Message: "Cannot add or update a child row: " +
+		"a foreign key constraint fails (`bookshop`.`orders`, CONSTRAINT `fk_orders_book_id` FOREIGN KEY (`book_id`) " +
+		"REFERENCES `books` (`id`))"}, "fk_orders_book_id", false},
+}
+
+func TestClassifyTxnErrorConstraints(t *testing.T) {
+	for _, test := range constraintErrors {
+		code := TiDBErrorCode(test.err.Number)
+		t.Run(code.String(), func(t *testing.T) {
+			err := classifyTxnError(test.err)
+			constraintErr := &ConstraintError{}
+			if !errors.As(err, &constraintErr) || constraintErr.Code != code || constraintErr.Constraint != test.constraint {
+				t.Fatalf("got %#v, want a violation of %s", err, test.constraint)
+			}
+			if !errors.Is(err, ErrConstraintViolated) || errors.Is(err, ErrDuplicate) != test.duplicate {
+				t.Errorf("%v: ErrConstraintViolated %v, ErrDuplicate %v, want true and %v", err,
+					errors.Is(err, ErrConstraintViolated), errors.Is(err, ErrDuplicate), test.duplicate)
+			}
+			mysqlErr := &mysql.MySQLError{}
+			if !errors.As(err, &mysqlErr) || mysqlErr != test.err {
+				t.Errorf("the *mysql.MySQLError is not reachable from %v", err)
+			}
+			if IsRetryableTxnError(err) || IsRetryableTxnError(test.err) {
+				t.Errorf("%v is retryable", err)
+			}
+		})
+	}
+}
+
+// A constraint violation fails the transaction at once in both modes, with retries left
+func TestRunTxnConstraintViolationNotRetried(t *testing.T) {
+	for _, test := range constraintErrors {
+		for _, optimistic := range []bool{false, true} {
+			code := TiDBErrorCode(test.err.Number)
+			t.Run(fmt.Sprintf("%s optimistic %v", code, optimistic), func(t *testing.T) {
+				db, mock := newMock(t)
+				noSleep(t)
+				opts := []TxnOption{WithMaxRetries(5)}
+				if optimistic {
+					opts = append(opts, WithOptimistic())
+					mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+				} else {
+					mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+				mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+				result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+					return test.err
+				}, opts...)
+				if !errors.Is(err, ErrConstraintViolated) {
+					t.Errorf("got %v, want the constraint violation", err)
+				}
+				if result.Attempts != 1 {
+					t.Errorf("got %d attempts, want 1", result.Attempts)
+				}
+			})
+		}
+	}
+}
+
+// The second order with the same explicit id fails with ErrDuplicate at once, the conflict isn't retried
+func TestDuplicateOrderIDOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, true, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	insert := func(ctx context.Context, conn *sql.Conn) error {
+		attempts++
+		_, err := NewOrderRepo(conn).CreateOrder(ctx, Order{ID: 4242, BookID: 1, UserID: 1, Quality: 1})
+		return err
+	}
+	if _, err := RunTxn(ctx, db, insert, WithOptimistic()); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts = 0
+	_, err := RunTxn(ctx, db, insert, WithOptimistic())
+	if !errors.Is(err, ErrDuplicate) {
+		t.Errorf("got %v, want ErrDuplicate", err)
+	}
+	if attempts != 1 {
+		t.Errorf("the duplicate is attempted %d times, want 1", attempts)
+	}
+}
+
+func TestErrorSummaryTallies(t *testing.T) {
+	summary := &ErrorSummary{}
+	errs := []error{
+		&mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"},
+		&mysql.MySQLError{Number: uint16(ErrLockDeadlock), Message: "deadlock"},
+		classifyTxnError(&mysql.MySQLError{Number: uint16(ErrDupEntry), Message: "Duplicate entry '1' for key 'PRIMARY'"}),
+		driver.ErrBadConn,
+		errors.New("boom"),
+		nil,
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		for _, err := range errs {
+			wg.Add(1)
+			go func(err error) {
+				defer wg.Done()
+				summary.Add(err)
+			}(err)
+		}
+	}
+	wg.Wait()
+
+	want := map[ErrorClass]int{ErrorClassRetryable: 20, ErrorClassConflict: 10, ErrorClassBadConn: 10, ErrorClassOther: 10}
+	if got := summary.Report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := summary.String(), "bad connection: 10, conflict: 10, other: 10, retryable: 20"; got != want {
+		t.Errorf("got '%s', want '%s'", got, want)
+	}
+}
+
+// The write conflict of the first COMMIT is counted, the committed retry isn't
+func TestWithErrorSummary(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnError(&mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"})
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	summary := &ErrorSummary{}
+	_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return nil
+	}, WithOptimistic(), WithErrorSummary(summary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := summary.Report(), map[ErrorClass]int{ErrorClassRetryable: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestContextCancelError(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		reason CancelReason
+		text   string
+	}{
+		{context.DeadlineExceeded, CancelReasonTimeout, "cancelled by timeout: context deadline exceeded"},
+		{context.Canceled, CancelReasonShutdown, "cancelled by shutdown: context canceled"},
+	} {
+		err := contextCancelError(test.err)
+		cancelErr := &CancelError{}
+		if !errors.As(err, &cancelErr) || cancelErr.Reason() != test.reason || err.Error() != test.text {
+			t.Errorf("got %v of %v, want %s", err, test.err, test.text)
+		}
+	}
+}
+
+func TestIsRetryableTxnError(t *testing.T) {
+	tidbErr := func(code TiDBErrorCode) error {
+		return &mysql.MySQLError{Number: uint16(code), Message: code.String()}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"not a MySQL error", errors.New("boom"), false},
+		{"write conflict", tidbErr(ErrWriteConflict), true},
+		{"info schema changed", tidbErr(ErrInfoSchemaChanged), true},
+		{"for update can't retry", tidbErr(ErrForUpdateCantRetry), true},
+		{"txn retryable", tidbErr(ErrTxnRetryable), true},
+		{"wrapped", fmt.Errorf("update stock: %w", tidbErr(ErrWriteConflict)), true},
+		{"wrapped twice", fmt.Errorf("buy: %w", fmt.Errorf("update stock: %w", tidbErr(ErrTxnRetryable))), true},
+		{"in a TxnError", &TxnError{Kind: ErrCommitFailed, Err: tidbErr(ErrWriteConflict)}, true},
+		{"deadlock", tidbErr(ErrLockDeadlock), false},
+		{"other MySQL error", tidbErr(TiDBErrorCode(1105)), false},
+		{"duplicate entry", tidbErr(ErrDupEntry), false},
+		{"bad connection", driver.ErrBadConn, true},
+		{"wrapped bad connection", fmt.Errorf("query: %w", driver.ErrBadConn), true},
+		{"invalid connection", mysql.ErrInvalidConn, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsRetryableTxnError(test.err); got != test.want {
+				t.Errorf("IsRetryableTxnError(%v) = %t, want %t", test.err, got, test.want)
+			}
+		})
+	}
+}
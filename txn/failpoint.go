@@ -0,0 +1,101 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// The steps of a buy, a hook of WithStepHook sees all of them and a failure can be injected after the writes
+const (
+	StepBegin       = "begin"
+	StepUpdateStock = "update-stock"
+	StepInsertOrder = "insert-order"
+	StepUpdateUser  = "update-user"
+)
+
+// ErrInjected is the error returned by a failpoint
+var ErrInjected = errors.New("injected failure")
+
+// stepKey is the context key of the steps control of a TxnFunc
+type stepKey struct{}
+
+type failAfter struct {
+	step   string
+	panics bool
+}
+
+// WithFailAfter makes the TxnFunc fail right after step, to show that none of its writes survive the rollback.
+// The failure is ErrInjected, or a panic if panics is true. The TxnFunc must call reachStep after its steps
+func WithFailAfter(step string, panics bool) TxnOption {
+	return func(o *txnOptions) {
+		o.failAfter = &failAfter{step: step, panics: panics}
+	}
+}
+
+// WithStepHook calls hook each time the TxnFunc reaches a step. A blocking hook holds the transaction at the step,
+// so two transactions can be interleaved at the given points without relying on the sleeps
+func WithStepHook(hook func(step string)) TxnOption {
+	return func(o *txnOptions) {
+		o.stepHook = hook
+	}
+}
+
+// validateFailStep rejects a step that no buy can fail after
+func validateFailStep(step string) error {
+	switch step {
+	case "", StepUpdateStock, StepInsertOrder, StepUpdateUser:
+		return nil
+	default:
+		return fmt.Errorf("unknown step '%s', want %s, %s or %s", step, StepUpdateStock, StepInsertOrder, StepUpdateUser)
+	}
+}
+
+type stepControl struct {
+	failAfter *failAfter
+	hook      func(step string)
+}
+
+// withStepControl passes the failure and the step hook of options to the TxnFunc run with ctx
+func withStepControl(ctx context.Context, options *txnOptions) context.Context {
+	if options.failAfter == nil && options.stepHook == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, stepKey{}, &stepControl{failAfter: options.failAfter, hook: options.stepHook})
+}
+
+// reachStep tells the step hook the transaction of ctx reaches step,
+// then fails if the transaction is set to fail after step by WithFailAfter
+func reachStep(ctx context.Context, step string) error {
+	control, ok := ctx.Value(stepKey{}).(*stepControl)
+	if !ok {
+		return nil
+	}
+
+	if control.hook != nil {
+		control.hook(step)
+	}
+
+	fail := control.failAfter
+	if fail == nil || fail.step != step {
+		return nil
+	}
+	if fail.panics {
+		panic(fmt.Sprintf("injected panic after %s", step))
+	}
+	return fmt.Errorf("%w after %s", ErrInjected, step)
+}
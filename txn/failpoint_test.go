@@ -0,0 +1,115 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReachStep(t *testing.T) {
+	ctx := context.Background()
+	if err := reachStep(ctx, StepUpdateStock); err != nil {
+		t.Errorf("got %v without a failpoint, want nil", err)
+	}
+
+	var reached []string
+	options := newTxnOptions([]TxnOption{
+		WithFailAfter(StepInsertOrder, false),
+		WithStepHook(func(step string) { reached = append(reached, step) }),
+	})
+	ctx = withStepControl(ctx, options)
+	if err := reachStep(ctx, StepUpdateStock); err != nil {
+		t.Errorf("got %v before the failing step, want nil", err)
+	}
+	if err := reachStep(ctx, StepInsertOrder); !errors.Is(err, ErrInjected) {
+		t.Errorf("got %v at the failing step, want %v", err, ErrInjected)
+	}
+	if want := []string{StepUpdateStock, StepInsertOrder}; !reflect.DeepEqual(reached, want) {
+		t.Errorf("the hook reached %v, want %v", reached, want)
+	}
+}
+
+// dataSnapshot is everything a buy may write
+type dataSnapshot struct {
+	Books  []Book
+	Users  []User
+	Orders []Order
+}
+
+func takeDataSnapshot(t *testing.T, db *sql.DB) dataSnapshot {
+	t.Helper()
+	snapshot := dataSnapshot{}
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		var err error
+		if snapshot.Books, err = ListBooks(ctx, conn); err != nil {
+			return err
+		}
+		if snapshot.Users, err = ListUsers(ctx, conn); err != nil {
+			return err
+		}
+		snapshot.Orders, err = ListOrders(ctx, conn)
+		return err
+	})
+	return snapshot
+}
+
+// A failure injected after any step of either buy, as an error or a panic, leaves the database as it was
+func TestFailAfterLeavesDataUnchangedOnTiDB(t *testing.T) {
+	for _, step := range []string{StepUpdateStock, StepInsertOrder, StepUpdateUser} {
+		for _, panics := range []bool{false, true} {
+			for _, optimistic := range []bool{false, true} {
+				name := step + " error"
+				if panics {
+					name = step + " panic"
+				}
+				buyFunc := buyPessimistic
+				if optimistic {
+					name += " optimistic"
+					buyFunc = buyOptimistic
+				} else {
+					name += " pessimistic"
+				}
+
+				t.Run(name, func(t *testing.T) {
+					db := openTestDB(t)
+					ctx := context.Background()
+					if err := prepareData(ctx, db, optimistic, SeedOptions{}); err != nil {
+						t.Fatal(err)
+					}
+					before := takeDataSnapshot(t, db)
+
+					options := noDelay()
+					options.FailAfter, options.FailPanic = step, panics
+					_, err := buyFunc(ctx, db, options, 1, 0, 1, 1, 2)
+					if panics {
+						if !errors.As(err, new(*PanicError)) {
+							t.Fatalf("got %v, want a *PanicError", err)
+						}
+					} else if !errors.Is(err, ErrInjected) {
+						t.Fatalf("got %v, want %v", err, ErrInjected)
+					}
+
+					if after := takeDataSnapshot(t, db); !reflect.DeepEqual(after, before) {
+						t.Errorf("the data changed from %+v to %+v", before, after)
+					}
+				})
+			}
+		}
+	}
+}
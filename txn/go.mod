@@ -5,3 +5,7 @@ go 1.18
 require github.com/go-sql-driver/mysql v1.6.0
 
 require github.com/shopspring/decimal v1.3.1
+
+require github.com/BurntSushi/toml v1.3.2
+
+require github.com/DATA-DOG/go-sqlmock v1.5.0
@@ -17,253 +17,877 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"runtime/debug"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/shopspring/decimal"
 )
 
-type TxnFunc func(connection *sql.Conn) error
+type TxnFunc func(ctx context.Context, connection *sql.Conn) error
+
+// retryTimes is the default max retries of an optimistic transaction
+const retryTimes = 5
+
+const pessimisticRetryTimes = 3
+
+var initialBalance = decimal.NewFromInt(10000)
+
+// initialBookStock is the stock of the demo book
+const initialBookStock = 10
+
+// RetryEvent describes a retry of runTxn
+type RetryEvent struct {
+	Attempt   int           // the attempt which failed, starts from 1
+	Class     RetryClass    // why the attempt is retried
+	ErrorCode TiDBErrorCode // the retryable TiDB error code, zero for a bad connection
+	BookID    int           // the book of the buy given by WithPurchase, zero otherwise
+}
+
+// RetryClass is the reason of a retry in a RetryEvent
+type RetryClass int
 
 const (
-	ErrWriteConflict      = 9007 // Transactions in TiKV encounter write conflicts.
-	ErrInfoSchemaChanged  = 8028 // table schema changes
-	ErrForUpdateCantRetry = 8002 // "SELECT FOR UPDATE" commit conflict
-	ErrTxnRetryable       = 8022 // The transaction commit fails and has been rolled back
+	RetryConflict RetryClass = iota // a write conflict or another retryable error of the commit
+	RetryLock                       // a deadlock or a lock wait timeout
+	RetryBadConn                    // a bad connection before COMMIT, retried on a new one
+	RetryTimeout                    // a statement timeout retried by WithRetryOnTimeout
 )
 
-const retryTimes = 5
+func (c RetryClass) String() string {
+	switch c {
+	case RetryConflict:
+		return "conflict"
+	case RetryLock:
+		return "lock"
+	case RetryBadConn:
+		return "bad connection"
+	case RetryTimeout:
+		return "timeout"
+	default:
+		return fmt.Sprintf("RetryClass(%d)", int(c))
+	}
+}
 
-var retryErrorCodeSet = map[uint16]interface{}{
-	ErrWriteConflict:      nil,
-	ErrInfoSchemaChanged:  nil,
-	ErrForUpdateCantRetry: nil,
-	ErrTxnRetryable:       nil,
+// retryClassOf returns the class of a retryable TiDB error code
+func retryClassOf(code TiDBErrorCode) RetryClass {
+	switch code {
+	case ErrLockDeadlock, ErrLockWaitTimeout:
+		return RetryLock
+	case ErrMaxExecutionTime:
+		return RetryTimeout
+	default:
+		return RetryConflict
+	}
 }
 
-func runTxn(db *sql.DB, optimistic bool, optimisticRetryTimes int, txnFunc TxnFunc) {
-	conn, err := db.Conn(context.Background())
-	if err != nil {
-		panic(err)
+func (o *txnOptions) emitRetryEvent(event RetryEvent) {
+	if o.retryEvents == nil {
+		return
 	}
-	defer conn.Close()
+	event.BookID = o.purchase.bookID
 
-	startTxnSQL := "BEGIN PESSIMISTIC"
+	select {
+	case o.retryEvents <- event:
+	default:
+	}
+}
+
+// recordError counts err in the summary of WithErrorSummary, a nil err is ignored
+func (o *txnOptions) recordError(err error) {
+	if o.errorSummary != nil {
+		o.errorSummary.Add(err)
+	}
+}
+
+// disablePlanCache turns off the prepared plan cache of the session of conn, the returned restore reverts it
+// by restoreSession, which discards conn if it can't
+func disablePlanCache(ctx context.Context, conn *sql.Conn, options *txnOptions) (restore func(), err error) {
+	previous := ""
+	if err = conn.QueryRowContext(ctx, "SELECT @@SESSION.tidb_enable_prepared_plan_cache").Scan(&previous); err != nil {
+		return nil, fmt.Errorf("get tidb_enable_prepared_plan_cache: %w", err)
+	}
+
+	if _, err = conn.ExecContext(ctx, "SET @@SESSION.tidb_enable_prepared_plan_cache = OFF"); err != nil {
+		return nil, fmt.Errorf("disable the prepared plan cache: %w", err)
+	}
+	return func() {
+		restoreSession(conn, options.logger, "SET @@SESSION.tidb_enable_prepared_plan_cache = ?", previous)
+	}, nil
+}
+
+// Backoff is the delay before each retry of runTxn, it starts from Base and grows by Multiplier up to Cap,
+// then a random jitter picks the actual delay from its upper half, so the conflicting transactions spread out.
+// Base and Cap bound the delay after the jitter too, a delay is never out of [Base, Cap]
+type Backoff struct {
+	Base       time.Duration
+	Cap        time.Duration
+	Multiplier float64
+}
+
+var txnBackoff = Backoff{Base: 50 * time.Millisecond, Cap: 2 * time.Second, Multiplier: 2}
+
+// rollbackTimeout bounds the ROLLBACK and the statements restoring a session by restoreSession,
+// they run on a detached context since the transaction context may be done
+const rollbackTimeout = 5 * time.Second
+
+// sleep and jitter are replaceable to check the retry schedule
+var (
+	sleep  = sleepContext
+	jitter = rand.Int63n
+)
+
+// sleepContext sleeps for d, or returns the error of ctx once it's done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return contextCancelError(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// artificialDelay sleeps d inside a transaction, zero or a negative d doesn't sleep
+func artificialDelay(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	return sleepContext(ctx, d)
+}
+
+func rollback(conn *sql.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	_, err := conn.ExecContext(ctx, "ROLLBACK")
+	return err
+}
+
+// rollbackAttempt rolls back the transaction of an attempt and logs the failure,
+// it reports whether conn is broken and must not be reused
+func rollbackAttempt(conn *sql.Conn, options *txnOptions) bool {
+	err := rollback(conn)
+	if err == nil {
+		return false
+	}
+
+	options.logger.Errorf("[runTxn] rollback failed: %+v", err)
+	return isBadConn(err)
+}
+
+// connDone reports whether conn is closed, like by discardConn, so it can't run any statement
+func connDone(conn *sql.Conn) bool {
+	return conn.Raw(func(interface{}) error { return nil }) == sql.ErrConnDone
+}
+
+// discardConn closes conn and drops its driver connection instead of returning it to the pool
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+	conn.Close()
+}
+
+// restoreSession sets a session variable of conn back by query, on a detached context. If it fails,
+// conn is discarded instead of going back to the pool with the variable changed, the caller must not reuse it
+func restoreSession(conn *sql.Conn, l Logger, query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	if _, err := conn.ExecContext(ctx, query, args...); err != nil {
+		l.Errorf("'%s' failed, discard the connection: %+v", query, err)
+		discardConn(conn)
+		return err
+	}
+	return nil
+}
+
+// Delay returns the delay before the retry-th retry, retry starts from 0
+func (b Backoff) Delay(retry int) time.Duration {
+	delay := float64(b.Base) * math.Pow(b.Multiplier, float64(retry))
+	if delay > float64(b.Cap) {
+		delay = float64(b.Cap)
+	}
+
+	// the jitter stays within the clamped range, it may not go below Base
+	high := int64(delay)
+	low := high / 2
+	if low < int64(b.Base) {
+		low = int64(b.Base)
+	}
+	if high <= low {
+		return time.Duration(low)
+	}
+	return time.Duration(low + jitter(high-low+1))
+}
+
+// runTxn runs txnFunc in a transaction, it's RunTxn with the mode and the optimistic retry times.
+// A pessimistic transaction keeps retrying at most pessimisticRetryTimes. The runner logs by logMode,
+// as the buys do, the options of the command line flags are given by the caller in opts, see flagTxnOptions
+func runTxn(ctx context.Context, db *sql.DB, optimistic bool, optimisticRetryTimes int, txnFunc TxnFunc, opts ...TxnOption) error {
+	opts = append([]TxnOption{WithLogMode(logMode)}, opts...)
 	if optimistic {
+		opts = append([]TxnOption{WithOptimistic(), WithMaxRetries(optimisticRetryTimes)}, opts...)
+	}
+	_, err := RunTxn(ctx, db, txnFunc, opts...)
+	return err
+}
+
+// TxnResult is the outcome of RunTxn, it's also returned with the error of a failed transaction
+type TxnResult struct {
+	Attempts int      // attempts run, 1 if the first one committed
+	ConnIDs  []uint64 // TiDB connection id of each attempt in order, recorded with WithConnIDs
+	CommitTS uint64   // commit ts of the committed attempt, recorded with WithCommitTS
+}
+
+// RunTxn runs fn in a transaction on a connection of its own, configured by opts. A failed transaction returns a *TxnError,
+// it tells whether fn failed, the commit failed or the retries were exhausted.
+// An optimistic transaction retries on the errors in retryErrorCodeSet,
+// a pessimistic one retries on deadlock and lock wait timeout.
+// Every retry issues a new BEGIN, so it gets a fresh start ts and reads the latest committed data.
+// A retryable error keeps the connection to save the acquisition round-trip, but a bad connection is replaced
+func RunTxn(ctx context.Context, db *sql.DB, fn TxnFunc, opts ...TxnOption) (TxnResult, error) {
+	options := newTxnOptions(opts)
+	return retryTxn(ctx, db, options, func(ctx context.Context, conn *sql.Conn, result *TxnResult) error {
+		return runTxnOnce(ctx, conn, options, result, fn)
+	})
+}
+
+// retryTxn runs the attempts of a transaction with the retry semantics of RunTxn, an attempt runs in a transaction on conn
+// and records itself in result
+func retryTxn(ctx context.Context, db *sql.DB, options *txnOptions,
+	attemptTxn func(ctx context.Context, conn *sql.Conn, result *TxnResult) error,
+) (result TxnResult, err error) {
+	if err = options.validate(); err != nil {
+		return result, err
+	}
+	maxRetries := options.retries()
+	start := time.Now()
+	if options.logMode == LogSummary {
+		summaryLogger := options.logger
+		options.logger = NopLogger{}
+		defer func() {
+			logTxnSummary(summaryLogger, options, result, err, time.Since(start))
+		}()
+	}
+	attemptCtx, deadline, cancel := options.budgetContext(ctx)
+	defer cancel()
+	// the budget ran out if the attempt saw the deadline of attemptCtx but ctx of the caller is still live
+	budgetExhausted := func(err error) bool {
+		return !deadline.IsZero() && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+	}
+
+	var conn *sql.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		// a failed restore of the session of the last attempt discarded conn
+		if conn != nil && connDone(conn) {
+			conn = nil
+		}
+		if conn == nil {
+			if conn, err = db.Conn(attemptCtx); err != nil {
+				if budgetExhausted(err) {
+					return result, &TxnError{Kind: ErrBudgetExhausted, Err: err}
+				}
+				return result, fmt.Errorf("get connection: %w", err)
+			}
+		}
+
+		result.Attempts = attempt
+		err = attemptTxn(attemptCtx, conn, &result)
+		if err == nil {
+			options.hooks.commit(attempt, time.Since(start))
+			return result, nil
+		}
+		if budgetExhausted(err) {
+			options.logger.Errorf("[runTxn] budget %s exhausted, rollback: %+v", options.budget, err)
+			return result, &TxnError{Kind: ErrBudgetExhausted, Err: err}
+		}
+		txnErr := &TxnError{}
+		if !errors.As(err, &txnErr) {
+			return result, err
+		}
+		if txnErr.connBroken {
+			discardConn(conn)
+			conn = nil
+		}
+
+		// a bad connection is retried in both modes only before COMMIT, the transaction may have been committed otherwise
+		badConn := txnErr.Kind == ErrTxnFuncFailed && isBadConn(txnErr.Err)
+		mysqlErr := &mysql.MySQLError{}
+		isMySQLErr := errors.As(txnErr.Err, &mysqlErr)
+		retryable := false
+		if options.optimistic {
+			retryable = isMySQLErr && IsRetryableTxnError(mysqlErr)
+		} else {
+			retryable = isMySQLErr && TiDBErrorCode(mysqlErr.Number).PessimisticRetryable()
+		}
+		timedOut := options.retryOnTimeout && txnErr.Kind == ErrTxnFuncFailed && isStatementTimeout(txnErr.Err)
+
+		if !(retryable || badConn || timedOut) {
+			switch {
+			case txnErr.Kind == ErrCommitFailed:
+				options.logger.Errorf("[runTxn] commit failed: %+v", txnErr.Err)
+			case isStatementTimeout(txnErr.Err):
+				options.logger.Errorf("[runTxn] statement timed out, rollback: %+v", txnErr.Err)
+			case errors.Is(txnErr.Err, ErrConstraintViolated):
+				options.logger.Errorf("[runTxn] got a constraint violation, rollback: %+v", txnErr.Err)
+			default:
+				options.logger.Errorf("[runTxn] got an error, rollback: %+v", txnErr.Err)
+			}
+			return result, err
+		}
+
+		rest := maxRetries - attempt
+		if rest < 0 {
+			options.logger.Errorf("[runTxn] got a retryable error, but no retry left, rollback: %+v", txnErr.Err)
+			return result, &TxnError{Kind: ErrRetriesExhausted, Err: txnErr.Err}
+		}
+		delay := options.backoff.Delay(attempt - 1)
+		if !deadline.IsZero() && time.Until(deadline) <= delay {
+			options.logger.Errorf("[runTxn] got a retryable error, but the retry doesn't fit the budget %s, rollback: %+v",
+				options.budget, txnErr.Err)
+			return result, &TxnError{Kind: ErrBudgetExhausted, Err: txnErr.Err}
+		}
+
+		switch {
+		case badConn:
+			options.logger.Infof("[runTxn] got a bad connection, retry on a new one, rest time: %d", rest)
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			options.emitRetryEvent(RetryEvent{Attempt: attempt, Class: RetryBadConn})
+		case timedOut && !retryable:
+			options.logger.Infof("[runTxn] statement timed out, rest time: %d", rest)
+			event := RetryEvent{Attempt: attempt, Class: RetryTimeout}
+			if isMySQLErr {
+				event.ErrorCode = TiDBErrorCode(mysqlErr.Number)
+			}
+			options.emitRetryEvent(event)
+		default:
+			options.logger.Infof("[runTxn] got a retryable error, rest time: %d", rest)
+			code := TiDBErrorCode(mysqlErr.Number)
+			options.emitRetryEvent(RetryEvent{Attempt: attempt, Class: retryClassOf(code), ErrorCode: code})
+		}
+		options.hooks.retry(attempt, txnErr.Err)
+
+		if err = sleep(attemptCtx, delay); err != nil {
+			if budgetExhausted(err) {
+				return result, &TxnError{Kind: ErrBudgetExhausted, Err: txnErr.Err}
+			}
+			return result, err
+		}
+	}
+}
+
+// runTxnOnce runs txnFunc in a transaction on conn once and records the attempt in result, its failure is a *TxnError.
+// If ctx is done before COMMIT, the transaction is rolled back and the error of ctx is returned
+func runTxnOnce(ctx context.Context, conn *sql.Conn, options *txnOptions, result *TxnResult, txnFunc TxnFunc) error {
+	startTxnSQL := "BEGIN PESSIMISTIC"
+	if options.optimistic {
 		startTxnSQL = "BEGIN OPTIMISTIC"
 	}
+	if options.txnModeVariable {
+		restore, err := setTxnMode(ctx, conn, options)
+		if err != nil {
+			return err
+		}
+		defer restore()
+		startTxnSQL = "BEGIN"
+	}
+	if options.planCacheDisabled {
+		restore, err := disablePlanCache(ctx, conn, options)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
 
-	_, err = conn.ExecContext(context.Background(), startTxnSQL)
+	setIsolationSQL, err := isolationSQL(options.isolation)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if setIsolationSQL != "" {
+		if _, err = conn.ExecContext(ctx, setIsolationSQL); err != nil {
+			return fmt.Errorf("set isolation level: %w", err)
+		}
 	}
 
-	fmt.Printf("begin a txn with '%s'\n", startTxnSQL)
-
-	err = txnFunc(conn)
+	_, err = conn.ExecContext(ctx, startTxnSQL)
 	if err != nil {
-		conn.ExecContext(context.Background(), "ROLLBACK")
-		if mysqlErr, ok := err.(*mysql.MySQLError); ok && optimistic && optimisticRetryTimes != 0 {
-			if _, retryableError := retryErrorCodeSet[mysqlErr.Number]; retryableError {
-				fmt.Printf("[runTxn] got a retryable error, rest time: %d\n", optimisticRetryTimes-1)
-				runTxn(db, optimistic, optimisticRetryTimes-1, txnFunc)
-				return
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+
+	if options.connIDs {
+		connectionID := uint64(0)
+		if err = conn.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&connectionID); err != nil {
+			if rollbackAttempt(conn, options) {
+				discardConn(conn)
 			}
+			return fmt.Errorf("get connection id: %w", err)
 		}
-
-		fmt.Printf("[runTxn] got an error, rollback: %+v\n", err)
+		result.ConnIDs = append(result.ConnIDs, connectionID)
+		options.logger.Infof("begin a txn with '%s' on connection %d", startTxnSQL, connectionID)
 	} else {
-		_, err = conn.ExecContext(context.Background(), "COMMIT")
-		if mysqlErr, ok := err.(*mysql.MySQLError); ok && optimistic && optimisticRetryTimes != 0 {
-			if _, retryableError := retryErrorCodeSet[mysqlErr.Number]; retryableError {
-				fmt.Printf("[runTxn] got a retryable error, rest time: %d\n", optimisticRetryTimes-1)
-				runTxn(db, optimistic, optimisticRetryTimes-1, txnFunc)
-				return
-			}
+		options.logger.Infof("begin a txn with '%s'", startTxnSQL)
+	}
+
+	err = recoverTxnFunc(options, func() error {
+		txnCtx := txnFuncContext(ctx, options)
+		if err := txnFunc(txnCtx, conn); err != nil || options.preCommitCheck == nil {
+			return err
+		}
+		return options.preCommitCheck(txnCtx, conn)
+	})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if rollbackAttempt(conn, options) {
+			discardConn(conn)
+		}
+		if orderReplayGuard != nil {
+			orderReplayGuard.discard(conn)
+		}
+		options.logger.Errorf("[runTxn] context done, rollback: %+v", ctxErr)
+		options.hooks.rollback(ctxErr)
+		return contextCancelError(ctxErr)
+	}
+
+	if err != nil {
+		options.recordError(err)
+		connBroken := rollbackAttempt(conn, options)
+		if orderReplayGuard != nil {
+			orderReplayGuard.discard(conn)
 		}
+		options.hooks.rollback(err)
+		return &TxnError{Kind: ErrTxnFuncFailed, Err: classifyTxnError(err), connBroken: connBroken}
+	}
 
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	options.recordError(err)
+	if orderReplayGuard != nil {
 		if err == nil {
-			fmt.Println("[runTxn] commit success")
+			orderReplayGuard.commit(conn)
+		} else {
+			orderReplayGuard.discard(conn)
 		}
 	}
+	if err != nil {
+		options.hooks.rollback(err)
+		return &TxnError{Kind: ErrCommitFailed, Err: classifyTxnError(err)}
+	}
+
+	if options.commitTS {
+		commitTS, err := lastCommitTS(ctx, conn)
+		if err != nil {
+			options.logger.Errorf("[runTxn] commit success, but failed to read the commit ts: %+v", err)
+			return nil
+		}
+		result.CommitTS = commitTS
+		options.logger.Infof("[runTxn] commit success, commit ts: %d", commitTS)
+	} else {
+		options.logger.Infof("[runTxn] commit success")
+	}
+
+	return nil
+}
+
+// recoverTxnFunc calls fn and turns its panic into a *PanicError, so the caller rolls back instead of committing
+func recoverTxnFunc(options *txnOptions, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			options.logger.Errorf("[runTxn] transaction function panicked: %v\n%s", r, stack)
+			err = &PanicError{Value: r, Stack: stack}
+		}
+	}()
+
+	return fn()
+}
+
+// txnFuncContext is the context a TxnFunc runs with, it carries the step control and the statement limits of options
+func txnFuncContext(ctx context.Context, options *txnOptions) context.Context {
+	return withStatementLimits(withStepControl(ctx, options), options)
 }
 
-func prepareData(db *sql.DB, optimistic bool) {
-	runTxn(db, optimistic, retryTimes, func(conn *sql.Conn) error {
+// lastCommitTS reads the commit ts of the last transaction from @@tidb_last_txn_info,
+// it's only valid right after COMMIT on the same connection
+func lastCommitTS(ctx context.Context, conn *sql.Conn) (uint64, error) {
+	txnInfo := ""
+	if err := conn.QueryRowContext(ctx, "SELECT @@tidb_last_txn_info").Scan(&txnInfo); err != nil {
+		return 0, err
+	}
+
+	info := struct {
+		CommitTS uint64 `json:"commit_ts"`
+	}{}
+	if err := json.Unmarshal([]byte(txnInfo), &info); err != nil {
+		return 0, err
+	}
+
+	return info.CommitTS, nil
+}
+
+// isBadConn reports whether the connection is broken. It's not checked on COMMIT,
+// the transaction may have been committed before the connection broke
+func isBadConn(err error) bool {
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, io.EOF)
+}
+
+// SeedOptions are the options of prepareData, the zero value seeds the demo rows only
+type SeedOptions struct {
+	Reset bool // delete all the rows of books, users and orders before seeding, set by -reset
+	// Books is the number of random books seeded by seedCatalogue after the demo book, set by -seed-books
+	Books int
+
+	Txn []TxnOption // options of the seeding transaction
+}
+
+// prepareData seeds the book and the users of the demo. The seed rows are reset to their initial values
+// and the orders of the demo users are removed, so the demo can run again.
+// With options.Reset, all the rows of books, users and orders are deleted first.
+// With options.Books, the random books are upserted by seedCatalogue afterwards, outside the transaction
+func prepareData(ctx context.Context, db *sql.DB, optimistic bool, options SeedOptions) error {
+	err := runTxn(ctx, db, optimistic, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
 		publishedAt, err := time.Parse("2006-01-02 15:04:05", "2018-09-01 00:00:00")
 		if err != nil {
 			return err
 		}
 
-		if err = createBook(conn, 1, "Designing Data-Intensive Application",
-			"Science & Technology", publishedAt, decimal.NewFromInt(100), 10); err != nil {
+		if options.Reset {
+			for _, table := range []string{"orders", "users", "books"} {
+				if _, err = conn.ExecContext(ctx, "DELETE FROM "+quoteIdentifier(table)); err != nil {
+					return err
+				}
+			}
+		} else if _, err = conn.ExecContext(ctx, "DELETE FROM `orders` WHERE `user_id` IN (?, ?)", 1, 2); err != nil {
+			return err
+		}
+
+		if err = NewBookRepo(conn).CreateBook(ctx, Book{ID: 1, Title: "Designing Data-Intensive Application",
+			Type: "Science & Technology", PublishedAt: publishedAt, Price: decimal.NewFromInt(100), Stock: initialBookStock}); err != nil {
 			return err
 		}
 
-		if err = createUser(conn, 1, "Bob", decimal.NewFromInt(10000)); err != nil {
+		users := NewUserRepo(conn)
+		if err = users.CreateUser(ctx, User{ID: 1, Nickname: "Bob", Balance: initialBalance}); err != nil {
 			return err
 		}
 
-		if err = createUser(conn, 2, "Alice", decimal.NewFromInt(10000)); err != nil {
+		if err = users.CreateUser(ctx, User{ID: 2, Nickname: "Alice", Balance: initialBalance}); err != nil {
 			return err
 		}
 
 		return nil
-	})
+	}, options.Txn...)
+	if err != nil || options.Books == 0 {
+		return err
+	}
+	return seedCatalogue(ctx, db, options.Books)
 }
 
-func buyPessimistic(db *sql.DB, goroutineID, orderID, bookID, userID, amount int) {
+func buyPessimistic(ctx context.Context, db *sql.DB, options PurchaseOptions, goroutineID, orderID, bookID, userID, amount int) (PurchaseResult, error) {
 	txnComment := fmt.Sprintf("/* txn %d */ ", goroutineID)
 	if goroutineID != 1 {
 		txnComment = "\t" + txnComment
 	}
 
-	fmt.Printf("\nuser %d try to buy %d books(id: %d)\n", userID, amount, bookID)
+	statementLogger().Infof("\nuser %d try to buy %d books(id: %d)", userID, amount, bookID)
+	if err := options.checkQuantity(amount); err != nil {
+		logger.Errorf("reject the order: %+v", err)
+		return PurchaseResult{}, err
+	}
+	if err := waitBuying(ctx); err != nil {
+		logger.Errorf("reject the order: %+v", err)
+		return PurchaseResult{}, err
+	}
+	if replay, ok := skipReplay(options, orderID, bookID, userID, amount); ok {
+		return replay, nil
+	}
+	orderID = options.orderIDFor(orderID)
+
+	orderID, err := allocOrderID(ctx, db, options.SequenceOrderNo, orderID)
+	if err != nil {
+		logger.Errorf("reject the order: %+v", err)
+		return PurchaseResult{}, err
+	}
 
-	runTxn(db, false, retryTimes, func(conn *sql.Conn) error {
-		time.Sleep(time.Second)
+	result := PurchaseResult{BookID: bookID, UserID: userID, Amount: amount}
+	var replayed *Order
 
-		// read the price of book
-		selectBookForUpdate := "select `price` from books where id = ? for update"
-		bookRows, err := conn.QueryContext(context.Background(), selectBookForUpdate, bookID)
+	err = runTxn(ctx, db, false, options.RetryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		if err := reachStep(ctx, StepBegin); err != nil {
+			return err
+		}
+		// a replay returns the committed order before the checks, the order may have used up the stock or the balance
+		replayed = nil
+		committed, ok, err := committedOrder(ctx, conn)
 		if err != nil {
 			return err
 		}
-		fmt.Println(txnComment + selectBookForUpdate + " successful")
-		defer bookRows.Close()
-
-		price := decimal.NewFromInt(0)
-		if bookRows.Next() {
-			err = bookRows.Scan(&price)
-			if err != nil {
-				return err
-			}
-		} else {
-			return fmt.Errorf("book ID not exist")
+		if ok {
+			replayed = &committed
+			return nil
+		}
+		if err := artificialDelay(ctx, options.Delay); err != nil {
+			return err
 		}
-		bookRows.Close()
+		books, users := NewBookRepo(conn), NewUserRepo(conn)
 
-		// update book
-		updateStock := "update `books` set stock = stock - ? where id = ? and stock - ? >= 0"
-		result, err := conn.ExecContext(context.Background(), updateStock, amount, bookID, amount)
+		// read the price of book
+		book, err := books.GetForUpdate(ctx, bookID)
 		if err != nil {
 			return err
 		}
-		fmt.Println(txnComment + updateStock + " successful")
+		statementLogger().Infof("%s%s successful", txnComment, bookSQL(true))
+		price := book.Price
 
-		affected, err := result.RowsAffected()
+		// update book
+		updated, err := books.UpdateStock(ctx, bookID, amount)
 		if err != nil {
 			return err
 		}
+		statementLogger().Infof("%s%s successful", txnComment, updateStockSQL())
 
-		if affected == 0 {
-			return fmt.Errorf("stock not enough, rollback")
+		if !updated {
+			return ErrStockInsufficient
+		}
+		if err = reachStep(ctx, StepUpdateStock); err != nil {
+			return err
 		}
 
 		// insert order
-		insertOrder := "insert into `orders` (`id`, `book_id`, `user_id`, `quality`) values (?, ?, ?, ?)"
-		if _, err := conn.ExecContext(context.Background(), insertOrder,
-			orderID, bookID, userID, amount); err != nil {
+		order := Order{ID: orderID, BookID: bookID, UserID: userID, Quality: amount, UnitPrice: decimal.NewNullDecimal(price),
+			IdempotencyKey: idempotencyKeyFrom(ctx)}
+		result.OrderID, err = NewOrderRepo(conn).CreateOrder(ctx, order)
+		if err != nil {
+			return err
+		}
+		statementLogger().Infof("%s%s successful (id: %d)", txnComment, insertOrderSQL(), result.OrderID)
+		if err = reachStep(ctx, StepInsertOrder); err != nil {
 			return err
 		}
-		fmt.Println(txnComment + insertOrder + " successful")
 
 		// update user
-		updateUser := "update `users` set `balance` = `balance` - ? where id = ?"
-		if _, err := conn.ExecContext(context.Background(), updateUser,
-			price.Mul(decimal.NewFromInt(int64(amount))), userID); err != nil {
+		result.Cost = price.Mul(decimal.NewFromInt(int64(amount)))
+		debited, err := users.DebitBalance(ctx, userID, result.Cost)
+		if err != nil {
+			return err
+		}
+		statementLogger().Infof("%s%s successful", txnComment, debitBalanceSQL())
+
+		if !debited {
+			return ErrBalanceInsufficient
+		}
+		if err = reachStep(ctx, StepUpdateUser); err != nil {
 			return err
 		}
-		fmt.Println(txnComment + updateUser + " successful")
 
 		return nil
-	})
+	}, append([]TxnOption{WithPurchase(bookID, userID, amount)}, options.txnOptions()...)...)
+	if key := idempotencyKeyFrom(ctx); key != "" && orderExists(err) {
+		return completedPurchase(ctx, db, key)
+	}
+	if errors.Is(err, ErrOrderReplayed) {
+		logger.Infof("order %d was committed meanwhile, the replay is rolled back", orderID)
+		return PurchaseResult{OrderID: orderID, BookID: bookID, UserID: userID, Amount: amount}, nil
+	}
+	if err != nil {
+		return PurchaseResult{}, err
+	}
+	if replayed != nil {
+		return replayedPurchase(*replayed), nil
+	}
+	return result, nil
 }
 
-func buyOptimistic(db *sql.DB, goroutineID, orderID, bookID, userID, amount int) {
+func buyOptimistic(ctx context.Context, db *sql.DB, options PurchaseOptions, goroutineID, orderID, bookID, userID, amount int) (PurchaseResult, error) {
 	txnComment := fmt.Sprintf("/* txn %d */ ", goroutineID)
 	if goroutineID != 1 {
 		txnComment = "\t" + txnComment
 	}
 
-	fmt.Printf("\nuser %d try to buy %d books(id: %d)\n", userID, amount, bookID)
+	statementLogger().Infof("\nuser %d try to buy %d books(id: %d)", userID, amount, bookID)
+	if err := options.checkQuantity(amount); err != nil {
+		logger.Errorf("reject the order: %+v", err)
+		return PurchaseResult{}, err
+	}
+	if err := waitBuying(ctx); err != nil {
+		logger.Errorf("reject the order: %+v", err)
+		return PurchaseResult{}, err
+	}
+	if replay, ok := skipReplay(options, orderID, bookID, userID, amount); ok {
+		return replay, nil
+	}
+	orderID = options.orderIDFor(orderID)
 
-	runTxn(db, true, retryTimes, func(conn *sql.Conn) error {
-		time.Sleep(time.Second)
+	orderID, err := allocOrderID(ctx, db, options.SequenceOrderNo, orderID)
+	if err != nil {
+		logger.Errorf("reject the order: %+v", err)
+		return PurchaseResult{}, err
+	}
 
-		// read the price and stock of book
-		selectBookForUpdate := "select `price`, `stock` from books where id = ? for update"
-		bookRows, err := conn.QueryContext(context.Background(), selectBookForUpdate, bookID)
+	result := PurchaseResult{BookID: bookID, UserID: userID, Amount: amount}
+	var replayed *Order
+
+	err = runTxn(ctx, db, true, options.RetryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		if err := reachStep(ctx, StepBegin); err != nil {
+			return err
+		}
+		// a replay returns the committed order before the checks, the order may have used up the stock or the balance
+		replayed = nil
+		committed, ok, err := committedOrder(ctx, conn)
 		if err != nil {
 			return err
 		}
-		fmt.Println(txnComment + selectBookForUpdate + " successful")
-		defer bookRows.Close()
+		if ok {
+			replayed = &committed
+			return nil
+		}
+		if err := artificialDelay(ctx, options.Delay); err != nil {
+			return err
+		}
+		books, users := NewBookRepo(conn), NewUserRepo(conn)
 
-		price, stock := decimal.NewFromInt(0), 0
-		if bookRows.Next() {
-			err = bookRows.Scan(&price, &stock)
-			if err != nil {
-				return err
-			}
-		} else {
-			return fmt.Errorf("book ID not exist")
+		// read the price and stock of book
+		book, err := books.GetForUpdate(ctx, bookID)
+		if err != nil {
+			return err
 		}
-		bookRows.Close()
+		statementLogger().Infof("%s%s successful", txnComment, bookSQL(true))
+		price := book.Price
 
-		if stock < amount {
-			return fmt.Errorf("book not enough")
+		if book.Stock < amount {
+			return ErrStockInsufficient
 		}
 
-		// update book
-		updateStock := "update `books` set stock = stock - ? where id = ? and stock - ? >= 0"
-		result, err := conn.ExecContext(context.Background(), updateStock, amount, bookID, amount)
+		// read the balance of user, most of the failures end here before any write
+		user, err := users.Get(ctx, userID)
 		if err != nil {
 			return err
 		}
-		fmt.Println(txnComment + updateStock + " successful")
+		statementLogger().Infof("%s%s successful", txnComment, userSQL(false))
+
+		if user.Balance.LessThan(price.Mul(decimal.NewFromInt(int64(amount)))) {
+			return ErrBalanceInsufficient
+		}
 
-		affected, err := result.RowsAffected()
+		// update book
+		updated, err := books.UpdateStock(ctx, bookID, amount)
 		if err != nil {
 			return err
 		}
+		statementLogger().Infof("%s%s successful", txnComment, updateStockSQL())
 
-		if affected == 0 {
-			return fmt.Errorf("stock not enough, rollback")
+		if !updated {
+			return ErrStockInsufficient
+		}
+		if err = reachStep(ctx, StepUpdateStock); err != nil {
+			return err
 		}
 
 		// insert order
-		insertOrder := "insert into `orders` (`id`, `book_id`, `user_id`, `quality`) values (?, ?, ?, ?)"
-		if _, err := conn.ExecContext(context.Background(), insertOrder,
-			orderID, bookID, userID, amount); err != nil {
+		order := Order{ID: orderID, BookID: bookID, UserID: userID, Quality: amount, UnitPrice: decimal.NewNullDecimal(price),
+			IdempotencyKey: idempotencyKeyFrom(ctx)}
+		result.OrderID, err = NewOrderRepo(conn).CreateOrder(ctx, order)
+		if err != nil {
+			return err
+		}
+		statementLogger().Infof("%s%s successful (id: %d)", txnComment, insertOrderSQL(), result.OrderID)
+		if err = reachStep(ctx, StepInsertOrder); err != nil {
 			return err
 		}
-		fmt.Println(txnComment + insertOrder + " successful")
 
 		// update user
-		updateUser := "update `users` set `balance` = `balance` - ? where id = ?"
-		if _, err := conn.ExecContext(context.Background(), updateUser,
-			price.Mul(decimal.NewFromInt(int64(amount))), userID); err != nil {
+		result.Cost = price.Mul(decimal.NewFromInt(int64(amount)))
+		debited, err := users.DebitBalance(ctx, userID, result.Cost)
+		if err != nil {
+			return err
+		}
+		statementLogger().Infof("%s%s successful", txnComment, debitBalanceSQL())
+
+		if !debited {
+			return ErrBalanceInsufficient
+		}
+		if err = reachStep(ctx, StepUpdateUser); err != nil {
 			return err
 		}
-		fmt.Println(txnComment + updateUser + " successful")
 
 		return nil
-	})
+	}, append([]TxnOption{WithPurchase(bookID, userID, amount)}, options.txnOptions()...)...)
+	if key := idempotencyKeyFrom(ctx); key != "" && orderExists(err) {
+		return completedPurchase(ctx, db, key)
+	}
+	if errors.Is(err, ErrOrderReplayed) {
+		logger.Infof("order %d was committed meanwhile, the replay is rolled back", orderID)
+		return PurchaseResult{OrderID: orderID, BookID: bookID, UserID: userID, Amount: amount}, nil
+	}
+	if err != nil {
+		return PurchaseResult{}, err
+	}
+	if replayed != nil {
+		return replayedPurchase(*replayed), nil
+	}
+	return result, nil
 }
 
-func createBook(connection *sql.Conn, id int, title, bookType string,
-	publishedAt time.Time, price decimal.Decimal, stock int) error {
-	_, err := connection.ExecContext(context.Background(),
-		"INSERT INTO `books` (`id`, `title`, `type`, `published_at`, `price`, `stock`) values (?, ?, ?, ?, ?, ?)",
-		id, title, bookType, publishedAt, price, stock)
-	return err
-}
+// adjustPricesByType multiplies the price of all books of bookType by factor in one pessimistic transaction,
+// returns the number of changed books. It runs on a *TxnConn, the rows of the prices are closed by the first update
+func adjustPricesByType(ctx context.Context, db *sql.DB, bookType string, factor decimal.Decimal) (int, error) {
+	if !factor.IsPositive() {
+		return 0, fmt.Errorf("price factor must be positive, got %s", factor.String())
+	}
 
-func createUser(connection *sql.Conn, id int, nickname string, balance decimal.Decimal) error {
-	_, err := connection.ExecContext(context.Background(),
-		"INSERT INTO `users` (`id`, `nickname`, `balance`) VALUES (?, ?, ?)",
-		id, nickname, balance)
-	return err
+	changed := 0
+	_, err := RunTxnConn(ctx, db, func(ctx context.Context, conn *TxnConn) error {
+		rows, err := conn.Query(ctx, columnSQL("SELECT `id`, {price} FROM `books` WHERE {type} = ? FOR UPDATE"), bookType)
+		if err != nil {
+			return err
+		}
+
+		prices := make(map[int]decimal.Decimal)
+		for rows.Next() {
+			id, price := 0, decimal.Decimal{}
+			if err = rows.Scan(&id, money(&price)); err != nil {
+				return err
+			}
+			prices[id] = price
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		changed = 0
+		for id, price := range prices {
+			newPrice := roundMoney(price.Mul(factor))
+			if newPrice.Equal(price) {
+				continue
+			}
+
+			if _, err = conn.Exec(ctx, columnSQL("UPDATE `books` SET {price} = ? WHERE `id` = ?"), newPrice, id); err != nil {
+				return err
+			}
+			changed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return changed, nil
 }
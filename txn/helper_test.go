@@ -0,0 +1,1366 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/shopspring/decimal"
+)
+
+// noDelay are the options of a buy without the artificial delay, the tests interleave the buys by the step hooks
+func noDelay() PurchaseOptions {
+	options := defaultPurchaseOptions()
+	options.Delay = 0
+	return options
+}
+
+// noSleep makes the retries of the test run without the backoff, the delays are recorded instead
+func noSleep(tb testing.TB) *[]time.Duration {
+	defaultSleep, delays := sleep, []time.Duration(nil)
+	sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	tb.Cleanup(func() {
+		sleep = defaultSleep
+	})
+	return &delays
+}
+
+// Each optimistic retry issues its own BEGIN OPTIMISTIC on the kept connection, so it gets a new start ts
+func TestRunTxnOptimisticRetryBegins(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT `stock` FROM `books` WHERE `id` = ?").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(10))
+	mock.ExpectExec("COMMIT").WillReturnError(&mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"})
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT `stock` FROM `books` WHERE `id` = ?").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(9))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	var stocks []int
+	_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		stock := 0
+		if err := conn.QueryRowContext(ctx, "SELECT `stock` FROM `books` WHERE `id` = ?", 1).Scan(&stock); err != nil {
+			return err
+		}
+		stocks = append(stocks, stock)
+		return nil
+	}, WithOptimistic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stocks) != 2 || stocks[1] != 9 {
+		t.Errorf("got the stocks %v by the attempts, want [10 9]", stocks)
+	}
+}
+
+// WithConnIDs records the connection id of every attempt, the retry on the kept connection repeats it
+func TestRunTxnRecordsConnIDs(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+
+	for _, commitErr := range []error{&mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}, nil} {
+		mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT CONNECTION_ID()").WillReturnRows(sqlmock.NewRows([]string{"CONNECTION_ID()"}).AddRow(42))
+		commit := mock.ExpectExec("COMMIT")
+		if commitErr != nil {
+			commit.WillReturnError(commitErr)
+		} else {
+			commit.WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+	}
+
+	result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return nil
+	}, WithOptimistic(), WithConnIDs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Attempts != 2 {
+		t.Errorf("got %d attempts, want 2", result.Attempts)
+	}
+	if len(result.ConnIDs) != 2 || result.ConnIDs[0] != 42 || result.ConnIDs[1] != 42 {
+		t.Errorf("got the connection ids %v, want [42 42]", result.ConnIDs)
+	}
+}
+
+// countingConnector opens the connections of a sqlmock by its dsn and counts them
+type countingConnector struct {
+	driver driver.Driver
+	dsn    string
+	opened int32
+}
+
+func (c *countingConnector) Connect(context.Context) (driver.Conn, error) {
+	atomic.AddInt32(&c.opened, 1)
+	return c.driver.Open(c.dsn)
+}
+
+func (c *countingConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// newCountingMock is newMock with a database opening its connections by a countingConnector.
+// All the connections share the expectations of the mock
+func newCountingMock(tb testing.TB) (*sql.DB, sqlmock.Sqlmock, *countingConnector) {
+	tb.Helper()
+	dsn := "counting_" + tb.Name()
+	mockDB, mock, err := sqlmock.NewWithDSN(dsn, sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	connector := &countingConnector{driver: mockDB.Driver(), dsn: dsn}
+	db := sql.OpenDB(connector)
+	tb.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			tb.Error(err)
+		}
+		db.Close()
+		mockDB.Close()
+	})
+	return db, mock, connector
+}
+
+// A write conflict retries on the kept connection, a bad connection retries on a new one
+func TestRunTxnRetryConnection(t *testing.T) {
+	writeConflict := &mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}
+	for _, test := range []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		opened int32
+	}{
+		{"write conflict", func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+			mock.ExpectExec("COMMIT").WillReturnError(writeConflict)
+		}, 1},
+		{"bad connection", func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("SELECT 1").WillReturnError(driver.ErrBadConn)
+		}, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, connector := newCountingMock(t)
+			noSleep(t)
+
+			test.expect(mock)
+			mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+			mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+			result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+				one := 0
+				return conn.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+			}, WithOptimistic())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Attempts != 2 {
+				t.Errorf("got %d attempts, want 2", result.Attempts)
+			}
+			if opened := atomic.LoadInt32(&connector.opened); opened != test.opened {
+				t.Errorf("opened %d connections, want %d", opened, test.opened)
+			}
+		})
+	}
+}
+
+// A pessimistic transaction whose connection broke before COMMIT retries on a new connection,
+// one which broke at COMMIT isn't retried, it may have been committed
+func TestRunTxnPessimisticBadConn(t *testing.T) {
+	t.Run("before commit", func(t *testing.T) {
+		db, mock, connector := newCountingMock(t)
+		noSleep(t)
+		mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT 1").WillReturnError(driver.ErrBadConn)
+		mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+		mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+			one := 0
+			return conn.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Attempts != 2 {
+			t.Errorf("got %d attempts, want 2", result.Attempts)
+		}
+		if opened := atomic.LoadInt32(&connector.opened); opened != 2 {
+			t.Errorf("opened %d connections, want 2", opened)
+		}
+	})
+
+	t.Run("at commit", func(t *testing.T) {
+		db, mock, _ := newCountingMock(t)
+		noSleep(t)
+		mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("COMMIT").WillReturnError(driver.ErrBadConn)
+
+		result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+			return nil
+		})
+		if !errors.Is(err, ErrCommitFailed) || !errors.Is(err, driver.ErrBadConn) {
+			t.Fatalf("got %v, want the bad connection at commit", err)
+		}
+		if result.Attempts != 1 {
+			t.Errorf("got %d attempts, want 1", result.Attempts)
+		}
+	})
+}
+
+// The first attempt reads the stock, then another transaction commits a new stock before it commits.
+// The write conflict retries the transaction and the retry reads the stock committed in between
+func TestRunTxnOptimisticRetrySeesNewData(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, true, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	noSleep(t)
+
+	var stocks []int
+	_, err := RunTxn(ctx, db, func(ctx context.Context, conn *sql.Conn) error {
+		stock := 0
+		if err := conn.QueryRowContext(ctx, "SELECT `stock` FROM `books` WHERE `id` = ?", 1).Scan(&stock); err != nil {
+			return err
+		}
+		stocks = append(stocks, stock)
+		if len(stocks) == 1 {
+			mustExec(t, db, "UPDATE `books` SET `stock` = `stock` - 1 WHERE `id` = ?", 1)
+		}
+
+		_, err := conn.ExecContext(ctx, "UPDATE `books` SET `stock` = ? WHERE `id` = ?", stock-1, 1)
+		return err
+	}, WithOptimistic(), WithMaxRetries(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stocks) != 2 || stocks[0] != initialBookStock || stocks[1] != initialBookStock-1 {
+		t.Errorf("got the stocks %v by the attempts, want [%d %d]", stocks, initialBookStock, initialBookStock-1)
+	}
+	if err = assertCommitted(ctx, db, 1, initialBookStock-2); err != nil {
+		t.Error(err)
+	}
+}
+
+// Two write conflicts retry the transaction twice, each retry sends its event. The third event is dropped
+// by a full channel instead of blocking the transaction
+func TestRunTxnRetryEvents(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+
+	conflict := &mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}
+	for i := 0; i < 3; i++ {
+		mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("COMMIT").WillReturnError(conflict)
+	}
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	events := make(chan RetryEvent, 2)
+	_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return nil
+	}, WithOptimistic(), WithRetryEvents(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(events)
+	var got []RetryEvent
+	for event := range events {
+		got = append(got, event)
+	}
+	want := []RetryEvent{{Attempt: 1, Class: RetryConflict, ErrorCode: ErrWriteConflict}, {Attempt: 2, Class: RetryConflict, ErrorCode: ErrWriteConflict}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got the events %v, want %v", got, want)
+	}
+}
+
+// A deadlock is a lock retry and a bad connection before COMMIT a bad connection one, each event carries the book
+func TestRunTxnRetryEventClasses(t *testing.T) {
+	db, mock, _ := newCountingMock(t)
+	noSleep(t)
+
+	deadlock := &mysql.MySQLError{Number: uint16(ErrLockDeadlock), Message: "deadlock"}
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT 1").WillReturnError(deadlock)
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT 1").WillReturnError(driver.ErrBadConn)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	events := make(chan RetryEvent, 2)
+	_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		one := 0
+		return conn.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+	}, WithRetryEvents(events), WithPurchase(7, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	close(events)
+	var got []RetryEvent
+	for event := range events {
+		got = append(got, event)
+	}
+	want := []RetryEvent{
+		{Attempt: 1, Class: RetryLock, ErrorCode: ErrLockDeadlock, BookID: 7},
+		{Attempt: 2, Class: RetryBadConn, BookID: 7},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got the events %v, want %v", got, want)
+	}
+}
+
+// A failed pre-commit check rolls back the transaction, COMMIT is never sent
+func TestPreCommitCheckFailureRollsBack(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE `books` SET `stock` = `stock` - 11 WHERE `id` = 1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT `stock` FROM `books` WHERE `id` = 1").
+		WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(-1))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	negative := errors.New("negative stock")
+	_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "UPDATE `books` SET `stock` = `stock` - 11 WHERE `id` = 1")
+		return err
+	}, WithPreCommitCheck(func(ctx context.Context, conn *sql.Conn) error {
+		stock := 0
+		if err := conn.QueryRowContext(ctx, "SELECT `stock` FROM `books` WHERE `id` = 1").Scan(&stock); err != nil {
+			return err
+		}
+		if stock < 0 {
+			return negative
+		}
+		return nil
+	}))
+
+	txnErr := &TxnError{}
+	if !errors.As(err, &txnErr) || txnErr.Kind != ErrTxnFuncFailed || !errors.Is(err, negative) {
+		t.Errorf("got %v, want the failure of the pre-commit check", err)
+	}
+}
+
+// The check runs after the TxnFunc and before COMMIT on every attempt, it doesn't run after a failed TxnFunc
+func TestPreCommitCheckOrder(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	writeConflict := &mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	var steps []string
+	attempts := 0
+	_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		attempts++
+		steps = append(steps, "txn")
+		if attempts == 1 {
+			return writeConflict
+		}
+		return nil
+	}, WithOptimistic(), WithPreCommitCheck(func(ctx context.Context, conn *sql.Conn) error {
+		steps = append(steps, "check")
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"txn", "txn", "check"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("got the steps %v, want %v", steps, want)
+	}
+}
+
+func TestRunTxRejectsPreCommitCheck(t *testing.T) {
+	db, _ := newMock(t)
+	_, err := RunTx(context.Background(), db, func(ctx context.Context, tx *sql.Tx) error {
+		t.Error("the TxFunc runs")
+		return nil
+	}, WithPreCommitCheck(func(ctx context.Context, conn *sql.Conn) error { return nil }))
+	if err == nil {
+		t.Error("RunTx accepts a pre-commit check")
+	}
+}
+
+func TestPurchaseOptionsValidate(t *testing.T) {
+	if err := (PurchaseOptions{FailAfter: StepInsertOrder}).validate(); err != nil {
+		t.Errorf("valid step rejected: %v", err)
+	}
+	if err := (PurchaseOptions{FailAfter: StepBegin}).validate(); err == nil {
+		t.Errorf("no buy can fail after %s, but it's accepted", StepBegin)
+	}
+}
+
+// Both optimistic buyers are held after updating the stock until the other one gets there too,
+// so they write the same row and the one committing later conflicts and retries
+func TestBuyOptimisticConflictByStepHook(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, true, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := useBufferLogger(t)
+	useLogMode(t, LogPerStatement)
+	updated, arrivals := make(chan struct{}), int32(0)
+	retries := int32(0)
+	options := noDelay()
+	options.StepHook = func(step string) {
+		if step != StepUpdateStock {
+			return
+		}
+		if atomic.AddInt32(&arrivals, 1) == 2 {
+			close(updated)
+		}
+		<-updated
+	}
+	options.Txn = []TxnOption{WithHooks(TxnHooks{OnRetry: func(attempt int, err error) {
+		atomic.AddInt32(&retries, 1)
+	}})}
+
+	wg, errs := sync.WaitGroup{}, make([]error, 2)
+	for i, amount := range []int{2, 3} {
+		wg.Add(1)
+		go func(i, amount int) {
+			defer wg.Done()
+			_, errs[i] = buyOptimistic(ctx, db, options, i+1, 0, 1, i+1, amount)
+		}(i, amount)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("buyer %d failed: %v", i+1, err)
+		}
+	}
+	if retries != 1 {
+		t.Errorf("got %d retries, want 1 retry of the conflicting buyer", retries)
+	}
+	// the retry of the conflicting buyer commits after its retryable error, the other buyer commits first
+	var events []string
+	for _, line := range buffer.Lines() {
+		switch {
+		case strings.Contains(line, "got a retryable error"):
+			events = append(events, "retry")
+		case strings.Contains(line, "commit success"):
+			events = append(events, "commit")
+		}
+	}
+	if want := []string{"commit", "retry", "commit"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("got the events %v in the log, want %v", events, want)
+	}
+	if err := assertCommitted(ctx, db, 1, initialBookStock-5); err != nil {
+		t.Error(err)
+	}
+}
+
+// The first pessimistic buyer holds the lock of the book at update-stock, the second one must wait for it
+// and update the stock only after the first one is done
+func TestBuyPessimisticWaitsForLockByStepHook(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	mu, steps := sync.Mutex{}, []string(nil)
+	record := func(buyer, step string) {
+		mu.Lock()
+		defer mu.Unlock()
+		steps = append(steps, buyer+" "+step)
+	}
+
+	holding, release := make(chan struct{}), make(chan struct{})
+	first := noDelay()
+	first.StepHook = func(step string) {
+		record("bob", step)
+		if step == StepUpdateStock {
+			close(holding)
+			<-release
+		}
+	}
+	second := noDelay()
+	secondBegun := make(chan struct{})
+	second.StepHook = func(step string) {
+		record("alice", step)
+		if step == StepBegin {
+			close(secondBegun)
+		}
+	}
+
+	wg, errs := sync.WaitGroup{}, make([]error, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, errs[0] = buyPessimistic(ctx, db, first, 1, 0, 1, 1, 2)
+	}()
+	<-holding
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, errs[1] = buyPessimistic(ctx, db, second, 2, 0, 1, 2, 3)
+	}()
+	<-secondBegun
+	// the second buyer is blocked by FOR UPDATE, give it the time to get past it if the lock didn't hold
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	for _, step := range steps {
+		if step == "alice "+StepUpdateStock {
+			t.Error("alice updated the stock while bob held the lock")
+		}
+	}
+	mu.Unlock()
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("buyer %d failed: %v", i+1, err)
+		}
+	}
+	want := []string{"bob " + StepBegin, "bob " + StepUpdateStock, "alice " + StepBegin, "bob " + StepInsertOrder,
+		"bob " + StepUpdateUser, "alice " + StepUpdateStock, "alice " + StepInsertOrder, "alice " + StepUpdateUser}
+	if len(steps) != len(want) {
+		t.Fatalf("got steps %v, want %v", steps, want)
+	}
+	for i := range want {
+		if steps[i] != want[i] {
+			t.Fatalf("got steps %v, want %v", steps, want)
+		}
+	}
+	if err := assertCommitted(ctx, db, 1, initialBookStock-5); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAdjustPricesByTypeRejectsNonPositiveFactor(t *testing.T) {
+	for _, factor := range []string{"0", "-0.5"} {
+		if _, err := adjustPricesByType(context.Background(), nil, "Novel", decimal.RequireFromString(factor)); err == nil {
+			t.Errorf("factor %s is accepted", factor)
+		}
+	}
+}
+
+// The novels get the discounted price rounded to two decimal places, the other books keep theirs
+func TestAdjustPricesByType(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	createTestBooks(t, db, testBook(1, "Novel", "10.00", 1), testBook(2, "Novel", "19.99", 1),
+		testBook(3, "Arts", "10.00", 1))
+
+	changed, err := adjustPricesByType(ctx, db, "Novel", decimal.RequireFromString("0.9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 2 {
+		t.Errorf("got %d changed books, want 2", changed)
+	}
+
+	want := map[int]string{1: "9.00", 2: "17.99", 3: "10.00"}
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		books, err := ListBooks(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, book := range books {
+			if !book.Price.Equal(decimal.RequireFromString(want[book.ID])) {
+				t.Errorf("got the price %s of book %d, want %s", book.Price.String(), book.ID, want[book.ID])
+			}
+		}
+		return nil
+	})
+}
+
+// expectPlanCacheDisabled expects an attempt which turns off the plan cache and reverts it to ON by restoreErr
+func expectPlanCacheDisabled(mock sqlmock.Sqlmock, restoreErr error) {
+	mock.ExpectQuery("SELECT @@SESSION.tidb_enable_prepared_plan_cache").
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow("ON"))
+	mock.ExpectExec("SET @@SESSION.tidb_enable_prepared_plan_cache = OFF").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+	restore := mock.ExpectExec("SET @@SESSION.tidb_enable_prepared_plan_cache = ?").WithArgs("ON")
+	if restoreErr != nil {
+		restore.WillReturnError(restoreErr)
+	} else {
+		restore.WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+}
+
+func TestWithPlanCacheDisabledRestores(t *testing.T) {
+	db, mock := newMock(t)
+	expectPlanCacheDisabled(mock, nil)
+
+	_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return nil
+	}, WithPlanCacheDisabled())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.Stats(); stats.Idle != 1 {
+		t.Errorf("got %d idle connections, want the connection back to the pool", stats.Idle)
+	}
+}
+
+// A connection with the plan cache still off must not go back to the pool
+func TestWithPlanCacheDisabledDiscardsOnFailedRestore(t *testing.T) {
+	db, mock := newMock(t)
+	expectPlanCacheDisabled(mock, errors.New("connection reset"))
+
+	_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return nil
+	}, WithPlanCacheDisabled())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.Stats(); stats.OpenConnections != 0 {
+		t.Errorf("got %d open connections, want the connection discarded", stats.OpenConnections)
+	}
+}
+
+func TestWithPlanCacheDisabledOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	inTxn, after := "", ""
+	_, err := RunTxn(ctx, db, func(ctx context.Context, conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, "SELECT @@SESSION.tidb_enable_prepared_plan_cache").Scan(&inTxn)
+	}, WithPlanCacheDisabled())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRowContext(ctx, "SELECT @@SESSION.tidb_enable_prepared_plan_cache").Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+
+	before := ""
+	if err = db.QueryRowContext(ctx, "SELECT @@GLOBAL.tidb_enable_prepared_plan_cache").Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+	if inTxn != "0" && inTxn != "OFF" {
+		t.Errorf("the plan cache is %s in the transaction, want it off", inTxn)
+	}
+	if after != before {
+		t.Errorf("the plan cache of the session is %s afterwards, want %s", after, before)
+	}
+}
+
+// WithCommitTS reads the commit ts of the committed attempt from @@tidb_last_txn_info
+func TestRunTxnRecordsCommitTS(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT @@tidb_last_txn_info").WillReturnRows(sqlmock.NewRows([]string{"@@tidb_last_txn_info"}).
+		AddRow(`{"txn_scope":"global","start_ts":445623098577453056,"commit_ts":445623098577453057}`))
+
+	result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return nil
+	}, WithCommitTS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CommitTS != 445623098577453057 {
+		t.Errorf("got the commit ts %d, want 445623098577453057", result.CommitTS)
+	}
+}
+
+// A later commit has a larger commit ts, by RunTxn and by RunTx alike
+func TestCommitTSIncreasesOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var commitTSs []uint64
+	for i := 0; i < 3; i++ {
+		result, err := RunTxn(ctx, db, func(ctx context.Context, conn *sql.Conn) error {
+			_, err := conn.ExecContext(ctx, "UPDATE `books` SET `stock` = `stock` - 1 WHERE `id` = 1")
+			return err
+		}, WithCommitTS())
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitTSs = append(commitTSs, result.CommitTS)
+
+		result, err = RunTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, "UPDATE `books` SET `stock` = `stock` + 1 WHERE `id` = 1")
+			return err
+		}, WithCommitTS())
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitTSs = append(commitTSs, result.CommitTS)
+	}
+
+	for i, commitTS := range commitTSs {
+		if commitTS == 0 || (i > 0 && commitTS <= commitTSs[i-1]) {
+			t.Fatalf("got the commit ts %v, want them increasing", commitTSs)
+		}
+	}
+}
+
+// noJitter makes a backoff delay the lower end of its jitter, half the exponential delay
+func noJitter(tb testing.TB) {
+	defaultJitter := jitter
+	jitter = func(n int64) int64 { return 0 }
+	tb.Cleanup(func() {
+		jitter = defaultJitter
+	})
+}
+
+// failingAttempts expects n optimistic attempts whose TxnFunc fails and is rolled back
+func failingAttempts(mock sqlmock.Sqlmock, n int) {
+	for i := 0; i < n; i++ {
+		mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+}
+
+// failFirst returns a TxnFunc failing with the errors in order, then succeeding
+func failFirst(errs ...error) TxnFunc {
+	calls := 0
+	return func(ctx context.Context, conn *sql.Conn) error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}
+}
+
+func TestRunTxnRetrySchedule(t *testing.T) {
+	conflict := &mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}
+	schemaChanged := &mysql.MySQLError{Number: uint16(ErrInfoSchemaChanged), Message: "schema changed"}
+	tests := []struct {
+		name     string
+		errs     []error
+		retries  int
+		attempts int
+		delays   []time.Duration
+		err      error
+	}{
+		{"success after retries", []error{conflict, schemaChanged, conflict}, 5, 4,
+			[]time.Duration{50 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond}, nil},
+		{"capped", []error{conflict, conflict, conflict, conflict, conflict, conflict, conflict}, 10, 8,
+			[]time.Duration{50 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond,
+				400 * time.Millisecond, 800 * time.Millisecond, time.Second}, nil},
+		{"exhausted", []error{conflict, conflict, conflict}, 2, 3,
+			[]time.Duration{50 * time.Millisecond, 50 * time.Millisecond}, ErrRetriesExhausted},
+		{"not retryable", []error{&mysql.MySQLError{Number: 1105, Message: "unknown"}}, 5, 1, nil, ErrTxnFuncFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMock(t)
+			delays := noSleep(t)
+			noJitter(t)
+
+			failingAttempts(mock, len(test.errs))
+			if test.err == nil {
+				mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+
+			result, err := RunTxn(context.Background(), db, failFirst(test.errs...), WithOptimistic(), WithMaxRetries(test.retries))
+			if test.err == nil && err != nil || test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+			if result.Attempts != test.attempts {
+				t.Errorf("got %d attempts, want %d", result.Attempts, test.attempts)
+			}
+			if !reflect.DeepEqual(*delays, test.delays) {
+				t.Errorf("got the delays %v, want %v", *delays, test.delays)
+			}
+		})
+	}
+}
+
+// The jitter spreads a delay over [half, full] of the exponential delay, but never below Base
+func TestBackoffDelayJitter(t *testing.T) {
+	backoff := Backoff{Base: 100 * time.Millisecond, Cap: time.Second, Multiplier: 3}
+	for retry, want := range []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second} {
+		low := want / 2
+		if low < backoff.Base {
+			low = backoff.Base
+		}
+		for i := 0; i < 100; i++ {
+			if delay := backoff.Delay(retry); delay < low || delay > want {
+				t.Fatalf("got the delay %s of retry %d, want it in [%s, %s]", delay, retry, low, want)
+			}
+		}
+	}
+}
+
+// The delays of many retries stay within [WithMinBackoff, WithMaxBackoff] with the jitter,
+// the ones above the floor still vary
+func TestBackoffBounds(t *testing.T) {
+	for _, bounds := range [][2]time.Duration{
+		{10 * time.Millisecond, 500 * time.Millisecond},
+		{100 * time.Millisecond, 100 * time.Millisecond},
+		{time.Millisecond, 3 * time.Millisecond},
+	} {
+		options := newTxnOptions([]TxnOption{WithMinBackoff(bounds[0]), WithMaxBackoff(bounds[1])})
+		seen := map[time.Duration]bool{}
+		for retry := 0; retry < 50; retry++ {
+			for i := 0; i < 20; i++ {
+				delay := options.backoff.Delay(retry)
+				if delay < bounds[0] || delay > bounds[1] {
+					t.Fatalf("got the delay %s of retry %d, want it in [%s, %s]", delay, retry, bounds[0], bounds[1])
+				}
+				seen[delay] = true
+			}
+		}
+		if bounds[0] != bounds[1] && len(seen) < 2 {
+			t.Errorf("got only the delays %v in [%s, %s], want a jitter", seen, bounds[0], bounds[1])
+		}
+	}
+}
+
+// sleepUntilDone is a TxnFunc stuck until its context is done
+func sleepUntilDone(ctx context.Context, conn *sql.Conn) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(5 * time.Second):
+		return errors.New("the context is never done")
+	}
+}
+
+// A transaction cancelled while its TxnFunc runs is rolled back, the error tells a timeout from a shutdown
+func TestRunTxnCancelReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    func() (context.Context, context.CancelFunc)
+		reason CancelReason
+		err    error
+	}{
+		{"timeout", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 20*time.Millisecond)
+		}, CancelReasonTimeout, context.DeadlineExceeded},
+		{"shutdown", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			return ctx, cancel
+		}, CancelReasonShutdown, context.Canceled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMock(t)
+			mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+			ctx, cancel := test.ctx()
+			defer cancel()
+			_, err := RunTxn(ctx, db, sleepUntilDone)
+
+			cancelErr := &CancelError{}
+			if !errors.As(err, &cancelErr) || cancelErr.Reason() != test.reason {
+				t.Errorf("got %v, want a CancelError of %s", err, test.reason)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("got %v, want it wrapping %v", err, test.err)
+			}
+		})
+	}
+}
+
+// prepareData keeps the rows of other books and users and their orders, SeedOptions.Reset deletes them
+func TestPrepareDataResetOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	createTestBooks(t, db, testBook(5, "Novel", "20", 3))
+	createTestUsers(t, db, User{ID: 3, Nickname: "Carol", Balance: initialBalance})
+	if _, err := buyPessimistic(ctx, db, PurchaseOptions{}, 1, 0, 5, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buyPessimistic(ctx, db, PurchaseOptions{}, 1, 0, 1, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reset := range []bool{false, true} {
+		if err := prepareData(ctx, db, false, SeedOptions{Reset: reset}); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := takeDataSnapshot(t, db)
+		books, users, orders := len(snapshot.Books), len(snapshot.Users), len(snapshot.Orders)
+		if reset && (books != 1 || users != 2 || orders != 0) {
+			t.Errorf("got %d books, %d users and %d orders after the reset, want the demo book and users only", books, users, orders)
+		}
+		if !reset && (books != 2 || users != 3 || orders != 1) {
+			t.Errorf("got %d books, %d users and %d orders, want the other book, user and order kept", books, users, orders)
+		}
+		if err := verifyState(ctx, db); err != nil {
+			t.Errorf("reset %v: %v", reset, err)
+		}
+	}
+}
+
+// The update of a transaction cancelled before COMMIT is rolled back
+func TestRunTxnCancelRollsBackOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	if err := prepareData(context.Background(), db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := RunTxn(ctx, db, func(ctx context.Context, conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, "UPDATE `books` SET `stock` = 0 WHERE `id` = 1"); err != nil {
+			return err
+		}
+		return sleepUntilDone(ctx, conn)
+	})
+	cancelErr := &CancelError{}
+	if !errors.As(err, &cancelErr) || cancelErr.Reason() != CancelReasonTimeout {
+		t.Errorf("got %v, want a CancelError of the timeout", err)
+	}
+	if err = assertCommitted(context.Background(), db, 1, initialBookStock); err != nil {
+		t.Error(err)
+	}
+}
+
+// A deadlock and a lock wait timeout are retried from the top of the TxnFunc only in pessimistic mode
+func TestRunTxnPessimisticRetryCodes(t *testing.T) {
+	for _, code := range []TiDBErrorCode{ErrLockDeadlock, ErrLockWaitTimeout} {
+		for _, optimistic := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s optimistic %t", code, optimistic), func(t *testing.T) {
+				db, mock := newMock(t)
+				noSleep(t)
+
+				begin, opts := "BEGIN PESSIMISTIC", []TxnOption{WithMaxRetries(3)}
+				if optimistic {
+					begin, opts = "BEGIN OPTIMISTIC", append(opts, WithOptimistic())
+				}
+				mock.ExpectExec(begin).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+				if !optimistic {
+					mock.ExpectExec(begin).WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+
+				calls := 0
+				fn := failFirst(&mysql.MySQLError{Number: uint16(code), Message: code.String()})
+				result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+					calls++
+					return fn(ctx, conn)
+				}, opts...)
+
+				if optimistic {
+					if !errors.Is(err, ErrTxnFuncFailed) || result.Attempts != 1 {
+						t.Errorf("got %v after %d attempts, want the failure of the only attempt", err, result.Attempts)
+					}
+					return
+				}
+				if err != nil || result.Attempts != 2 || calls != 2 {
+					t.Errorf("got %v after %d attempts and %d calls, want the commit of the second", err, result.Attempts, calls)
+				}
+			})
+		}
+	}
+}
+
+// Two pessimistic transactions locking the users in opposite order deadlock, TiDB rolls one back
+// and its retry commits after the other one
+func TestRunTxnDeadlockRetryOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	firstLocked := sync.WaitGroup{}
+	firstLocked.Add(2)
+	lockUser := "SELECT `balance` FROM `users` WHERE `id` = ? FOR UPDATE"
+	lockBoth := func(first, second int) TxnFunc {
+		attempt := 0
+		return func(ctx context.Context, conn *sql.Conn) error {
+			attempt++
+			if _, err := conn.ExecContext(ctx, lockUser, first); err != nil {
+				return err
+			}
+			if attempt == 1 {
+				firstLocked.Done()
+				firstLocked.Wait()
+			}
+			_, err := conn.ExecContext(ctx, lockUser, second)
+			return err
+		}
+	}
+
+	results, errs := make([]TxnResult, 2), make([]error, 2)
+	done := sync.WaitGroup{}
+	for i, order := range [][2]int{{1, 2}, {2, 1}} {
+		done.Add(1)
+		go func(i int, order [2]int) {
+			defer done.Done()
+			results[i], errs[i] = RunTxn(ctx, db, lockBoth(order[0], order[1]))
+		}(i, order)
+	}
+	done.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("txn %d failed: %v", i+1, err)
+		}
+	}
+	if results[0].Attempts+results[1].Attempts != 3 {
+		t.Errorf("got %d and %d attempts, want the victim of the deadlock retried once", results[0].Attempts, results[1].Attempts)
+	}
+}
+
+// A panicking TxnFunc is rolled back and returned as a *PanicError, COMMIT never runs
+func TestRunTxnPanicRollsBack(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		var user *User
+		_ = user.Balance.String()
+		return nil
+	})
+	panicErr := &PanicError{}
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("got %v, want a *PanicError", err)
+	}
+	if len(panicErr.Stack) == 0 {
+		t.Error("the *PanicError has no stack")
+	}
+	if result.Attempts != 1 {
+		t.Errorf("got %d attempts, want the panic not retried", result.Attempts)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// The changes of a TxnFunc which panics after them are not visible afterwards,
+// and its pessimistic lock is released, so another transaction doesn't wait for it
+func TestRunTxnPanicChangesNotVisibleOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, run := range map[string]func() error{
+		"RunTxn": func() error {
+			_, err := RunTxn(ctx, db, func(ctx context.Context, conn *sql.Conn) error {
+				if _, err := conn.ExecContext(ctx, "UPDATE `books` SET `stock` = 0 WHERE `id` = 1"); err != nil {
+					return err
+				}
+				panic("bad scan target")
+			})
+			return err
+		},
+		"RunTx": func() error {
+			_, err := RunTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, "UPDATE `books` SET `stock` = 0 WHERE `id` = 1"); err != nil {
+					return err
+				}
+				panic("bad scan target")
+			})
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := run(); !errors.As(err, new(*PanicError)) {
+				t.Fatalf("got %v, want a *PanicError", err)
+			}
+
+			lockCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+			defer cancel()
+			stock := 0
+			_, err := RunTxn(lockCtx, db, func(ctx context.Context, conn *sql.Conn) error {
+				return conn.QueryRowContext(ctx, "SELECT `stock` FROM `books` WHERE `id` = 1 FOR UPDATE").Scan(&stock)
+			})
+			if err != nil {
+				t.Fatalf("lock the book after the panic: %v", err)
+			}
+			if stock != initialBookStock {
+				t.Errorf("got the stock %d, want the rolled back %d", stock, initialBookStock)
+			}
+		})
+	}
+}
+
+// Two buyers of the same user begin together, each can pay for its books but not for both,
+// so exactly one of them commits and the balance never goes negative
+func TestBuyCombinedCostExceedsBalance(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		buy  func(ctx context.Context, db *sql.DB, options PurchaseOptions, goroutineID, orderID, bookID, userID, amount int) (PurchaseResult, error)
+	}{
+		{"optimistic", buyOptimistic},
+		{"pessimistic", buyPessimistic},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDB(t)
+			ctx := context.Background()
+			createTestBooks(t, db, testBook(1, "Science & Technology", "100", 10))
+			createTestUsers(t, db, User{ID: 1, Balance: decimal.NewFromInt(150), Nickname: "Bob"})
+
+			begun, arrivals := make(chan struct{}), int32(0)
+			options := noDelay()
+			options.StepHook = func(step string) {
+				if step != StepBegin {
+					return
+				}
+				if atomic.AddInt32(&arrivals, 1) == 2 {
+					close(begun)
+				}
+				<-begun
+			}
+
+			wg, errs := sync.WaitGroup{}, make([]error, 2)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, errs[i] = test.buy(ctx, db, options, i+1, 0, 1, 1, 1)
+				}(i)
+			}
+			wg.Wait()
+
+			committed := 0
+			for _, err := range errs {
+				switch {
+				case err == nil:
+					committed++
+				case !errors.Is(err, ErrBalanceInsufficient):
+					t.Errorf("got %v, want %v", err, ErrBalanceInsufficient)
+				}
+			}
+			if committed != 1 {
+				t.Fatalf("%d buyers committed, want exactly 1: %v", committed, errs)
+			}
+
+			withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+				user, err := GetUser(ctx, conn, 1)
+				if err != nil {
+					return err
+				}
+				if !user.Balance.Equal(decimal.NewFromInt(50)) {
+					t.Errorf("got the balance %s, want 50", user.Balance)
+				}
+				orders, err := ListOrdersByUser(ctx, conn, 1)
+				if err != nil {
+					return err
+				}
+				if len(orders) != 1 {
+					t.Errorf("got %d orders, want 1", len(orders))
+				}
+				return nil
+			})
+			if err := assertCommitted(ctx, db, 1, 9); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Each failure of a buy is its sentinel by errors.Is, it isn't retried and changes nothing
+func TestBuyFailureSentinels(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		bookID, amount int
+		balance        string
+		want           error
+	}{
+		{"book not found", 2, 1, "1000", ErrBookNotFound},
+		{"stock insufficient", 1, 11, "10000", ErrStockInsufficient},
+		{"balance insufficient", 1, 3, "250", ErrBalanceInsufficient},
+		{"invalid amount", 1, 0, "1000", ErrInvalidAmount},
+	} {
+		for _, mode := range []struct {
+			name string
+			buy  func(ctx context.Context, db *sql.DB, options PurchaseOptions, goroutineID, orderID, bookID, userID, amount int) (PurchaseResult, error)
+		}{
+			{"optimistic", buyOptimistic},
+			{"pessimistic", buyPessimistic},
+		} {
+			t.Run(test.name+" "+mode.name, func(t *testing.T) {
+				db := openTestDB(t)
+				ctx := context.Background()
+				createTestBooks(t, db, testBook(1, "Novel", "100", 10))
+				createTestUsers(t, db, User{ID: 1, Balance: decimal.RequireFromString(test.balance), Nickname: "Bob"})
+
+				retries := int32(0)
+				options := noDelay()
+				options.Txn = []TxnOption{WithHooks(TxnHooks{OnRetry: func(attempt int, err error) {
+					atomic.AddInt32(&retries, 1)
+				}})}
+				_, err := mode.buy(ctx, db, options, 1, 0, test.bookID, 1, test.amount)
+				if !errors.Is(err, test.want) {
+					t.Fatalf("got %v, want %v", err, test.want)
+				}
+				if retries != 0 {
+					t.Errorf("got %d retries, want none", retries)
+				}
+				if err := assertCommitted(ctx, db, 1, 10); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+// benchParallelismEnv sets the goroutines per GOMAXPROCS of the contended benchmarks, 1 without it, e.g.
+// TIDB_TEST_DSN='root@tcp(127.0.0.1:4000)/' TIDB_BENCH_PARALLELISM=8 go test -run '^$' -bench Contended
+const benchParallelismEnv = "TIDB_BENCH_PARALLELISM"
+
+// benchBuyers is the number of users the contended benchmarks buy as, they all buy the same book
+const benchBuyers = 64
+
+// benchmarkContendedBuy runs buy in parallel on one book whose stock never runs out, so the buys conflict
+// on the book instead of failing for the stock. It reports the commits per second and the retries per buy
+func benchmarkContendedBuy(b *testing.B, buy func(ctx context.Context, db *sql.DB, options PurchaseOptions,
+	goroutineID, orderID, bookID, userID, amount int) (PurchaseResult, error),
+) {
+	db := openTestDB(b)
+	ctx := context.Background()
+	parallelism := 1
+	if value := os.Getenv(benchParallelismEnv); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			b.Fatalf("invalid %s: %s", benchParallelismEnv, value)
+		}
+		parallelism = n
+	}
+
+	createTestBooks(b, db, testBook(1, "Science & Technology", "1", 1<<30))
+	users := make([]User, 0, benchBuyers)
+	for i := 1; i <= benchBuyers; i++ {
+		users = append(users, User{ID: i, Balance: decimal.NewFromInt(1 << 40), Nickname: fmt.Sprintf("buyer %d", i)})
+	}
+	createTestUsers(b, db, users...)
+
+	commits, retries, buyer := int64(0), int64(0), int64(0)
+	options := noDelay()
+	options.RetryTimes = 1000
+	options.Txn = []TxnOption{
+		WithBackoff(time.Millisecond, 20*time.Millisecond),
+		WithHooks(TxnHooks{
+			OnRetry:  func(attempt int, err error) { atomic.AddInt64(&retries, 1) },
+			OnCommit: func(attempts int, elapsed time.Duration) { atomic.AddInt64(&commits, 1) },
+		}),
+	}
+
+	b.SetParallelism(parallelism)
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		userID := int(atomic.AddInt64(&buyer, 1)-1)%benchBuyers + 1
+		for pb.Next() {
+			if _, err := buy(ctx, db, options, userID, 0, 1, userID, 1); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&commits))/elapsed.Seconds(), "commits/s")
+	b.ReportMetric(float64(atomic.LoadInt64(&retries))/float64(b.N), "retries/op")
+}
+
+func Benchmark_BuyOptimistic_Contended(b *testing.B) {
+	benchmarkContendedBuy(b, buyOptimistic)
+}
+
+func Benchmark_BuyPessimistic_Contended(b *testing.B) {
+	benchmarkContendedBuy(b, buyPessimistic)
+}
+
+// 100 concurrent purchases get the ids TiDB generates, all unique and not a sequence
+func TestConcurrentPurchasesGetUniqueOrderIDsOnTiDB(t *testing.T) {
+	const purchases = 100
+	db := openTestDB(t)
+	ctx := context.Background()
+	createTestBooks(t, db, testBook(1, "Novel", "1", purchases))
+	createTestUsers(t, db, User{ID: 1, Balance: decimal.NewFromInt(purchases), Nickname: "Bob"})
+
+	wg, ids, errs := sync.WaitGroup{}, make([]int, purchases), make([]error, purchases)
+	for i := 0; i < purchases; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var result PurchaseResult
+			result, errs[i] = buyPessimistic(ctx, db, noDelay(), i+1, 0, 1, 1, 1)
+			ids[i] = result.OrderID
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool, purchases)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("purchase %d failed: %v", i+1, err)
+		}
+		if ids[i] <= 0 || seen[ids[i]] {
+			t.Fatalf("purchase %d got the order id %d, want a new positive one", i+1, ids[i])
+		}
+		seen[ids[i]] = true
+	}
+
+	sort.Ints(ids)
+	sequential := true
+	for i := 1; i < purchases; i++ {
+		if ids[i] != ids[i-1]+1 {
+			sequential = false
+			break
+		}
+	}
+	if sequential {
+		t.Errorf("the order ids %d..%d are sequential, want them scattered by AUTO_RANDOM", ids[0], ids[purchases-1])
+	}
+	if err := assertCommitted(ctx, db, 1, 0); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TxnHooks are the optional callbacks of RunTxn, a nil callback is skipped.
+// The buyers run concurrently, so the callbacks must be safe for concurrent use
+type TxnHooks struct {
+	// OnRetry is called before a retry with the failed attempt, which starts from 1, and its error
+	OnRetry func(attempt int, err error)
+	// OnCommit is called after COMMIT succeeded with the attempts it took and the time since RunTxn started
+	OnCommit func(attempts int, elapsed time.Duration)
+	// OnRollback is called when an attempt is rolled back, including a failed COMMIT
+	OnRollback func(err error)
+}
+
+func (h *TxnHooks) retry(attempt int, err error) {
+	if h.OnRetry != nil {
+		h.OnRetry(attempt, err)
+	}
+}
+
+func (h *TxnHooks) commit(attempts int, elapsed time.Duration) {
+	if h.OnCommit != nil {
+		h.OnCommit(attempts, elapsed)
+	}
+}
+
+func (h *TxnHooks) rollback(err error) {
+	if h.OnRollback != nil {
+		h.OnRollback(err)
+	}
+}
+
+// chainHooks returns the hooks calling the callbacks of first and then of second
+func chainHooks(first, second TxnHooks) TxnHooks {
+	return TxnHooks{
+		OnRetry: func(attempt int, err error) {
+			first.retry(attempt, err)
+			second.retry(attempt, err)
+		},
+		OnCommit: func(attempts int, elapsed time.Duration) {
+			first.commit(attempts, elapsed)
+			second.commit(attempts, elapsed)
+		},
+		OnRollback: func(err error) {
+			first.rollback(err)
+			second.rollback(err)
+		},
+	}
+}
+
+// txnHooks are the default hooks of RunTxn
+var txnHooks TxnHooks
+
+// WithHooks adds the callbacks of hooks to the transaction, they're called after the ones of txnHooks
+// and of an earlier WithHooks, so a caller collecting its own data doesn't silence the others
+func WithHooks(hooks TxnHooks) TxnOption {
+	return func(o *txnOptions) {
+		o.hooks = chainHooks(o.hooks, hooks)
+	}
+}
+
+// TxnStats aggregates the data of the hooks, it's safe for concurrent use
+type TxnStats struct {
+	mu        sync.Mutex
+	commits   int
+	attempts  int
+	elapsed   time.Duration
+	rollbacks int
+	retries   map[string]int
+}
+
+// Hooks returns the hooks feeding s
+func (s *TxnStats) Hooks() TxnHooks {
+	return TxnHooks{
+		OnRetry: func(attempt int, err error) {
+			reason := "bad connection"
+			if mysqlErr := (*mysql.MySQLError)(nil); errors.As(err, &mysqlErr) {
+				reason = TiDBErrorCode(mysqlErr.Number).String()
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.retries == nil {
+				s.retries = make(map[string]int)
+			}
+			s.retries[reason]++
+		},
+		OnCommit: func(attempts int, elapsed time.Duration) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.commits++
+			s.attempts += attempts
+			s.elapsed += elapsed
+		},
+		OnRollback: func(err error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.rollbacks++
+		},
+	}
+}
+
+// Summary renders the aggregated data, the retries are listed by the error which triggered them
+func (s *TxnStats) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := fmt.Sprintf("committed: %d, attempts: %d, elapsed: %s, rollbacks: %d",
+		s.commits, s.attempts, s.elapsed, s.rollbacks)
+
+	reasons := make([]string, 0, len(s.retries))
+	for reason := range s.retries {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		summary += fmt.Sprintf("\nretried on %s: %d", reason, s.retries[reason])
+	}
+
+	return summary
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// hookCounts counts the calls of its hooks, it's safe for concurrent use
+type hookCounts struct {
+	mu                          sync.Mutex
+	retries, commits, rollbacks int
+}
+
+func (c *hookCounts) Hooks() TxnHooks {
+	return TxnHooks{
+		OnRetry: func(int, error) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.retries++
+		},
+		OnCommit: func(int, time.Duration) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.commits++
+		},
+		OnRollback: func(error) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.rollbacks++
+		},
+	}
+}
+
+func (c *hookCounts) check(tb testing.TB, name string, retries, commits, rollbacks int) {
+	tb.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.retries != retries || c.commits != commits || c.rollbacks != rollbacks {
+		tb.Errorf("%s got %d retries, %d commits and %d rollbacks, want %d, %d and %d",
+			name, c.retries, c.commits, c.rollbacks, retries, commits, rollbacks)
+	}
+}
+
+// useTxnHooks makes the default hooks count for the test
+func useTxnHooks(tb testing.TB) *hookCounts {
+	defaultHooks, counts := txnHooks, &hookCounts{}
+	txnHooks = counts.Hooks()
+	tb.Cleanup(func() {
+		txnHooks = defaultHooks
+	})
+	return counts
+}
+
+// WithHooks adds to the default hooks and to an earlier WithHooks instead of replacing them
+func TestWithHooksAddsToTheOthers(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	defaults := useTxnHooks(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	first, second := &hookCounts{}, &hookCounts{}
+	_, err := RunTxn(context.Background(), db, failFirst(deadlockErr), WithHooks(first.Hooks()), WithHooks(second.Hooks()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, counts := range map[string]*hookCounts{"the default hooks": defaults, "the first": first, "the second": second} {
+		counts.check(t, name, 1, 1, 1)
+	}
+}
+
+// The load test collects its stats by WithHooks, the default hooks and the hooks of the caller still see every buy
+func TestLoadTestHooksOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults, caller := useTxnHooks(t), &hookCounts{}
+	options := noDelay()
+	options.Txn = []TxnOption{WithHooks(caller.Hooks())}
+	if err := loadTest(ctx, db, options, LoadOptions{Buyers: 2, Purchases: 3}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, counts := range map[string]*hookCounts{"the default hooks": defaults, "the caller": caller} {
+		counts.mu.Lock()
+		commits := counts.commits
+		counts.mu.Unlock()
+		if commits != 6 {
+			t.Errorf("%s got %d commits, want 6", name, commits)
+		}
+	}
+}
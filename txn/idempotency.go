@@ -0,0 +1,100 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// ErrOrderExists is returned by OrderRepo.CreateOrder if an order with the same idempotency key is inserted
+var ErrOrderExists = errors.New("an order with the idempotency key exists")
+
+// idempotencyKeyIndex is the unique index of `orders`.`idempotency_key`
+const idempotencyKeyIndex = "orders_idempotency_key"
+
+// idempotencyKeyCtx is the context key of the idempotency key of a buy
+type idempotencyKeyCtx struct{}
+
+// WithIdempotencyKey makes the buy run with ctx idempotent by key: once an order with key is committed,
+// another buy with key charges nothing and returns that order. A client which lost the result of a COMMIT
+// retries the buy with the same key instead of risking a second charge
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+// idempotencyKeyFrom returns the idempotency key of ctx, empty if there is none
+func idempotencyKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyCtx{}).(string)
+	return key
+}
+
+// isIdempotencyKeyConflict reports whether err is a duplicate entry on idempotencyKeyIndex,
+// rather than on another unique key
+func isIdempotencyKeyConflict(err error) bool {
+	constraintErr, ok := asConstraintError(err)
+	if !ok || constraintErr.Code != ErrDupEntry {
+		return false
+	}
+
+	// the key is 'orders.orders_idempotency_key', or 'orders_idempotency_key' on the older versions
+	return constraintErr.Constraint == idempotencyKeyIndex || strings.HasSuffix(constraintErr.Constraint, "."+idempotencyKeyIndex)
+}
+
+// orderExists reports whether a buy failed because its order is already committed. It's ErrOrderExists if the insert
+// conflicts with a committed order, or a conflict on the COMMIT of an optimistic transaction racing with the same key
+func orderExists(err error) bool {
+	return errors.Is(err, ErrOrderExists) || isIdempotencyKeyConflict(err)
+}
+
+// committedOrder reads the order of the idempotency key of ctx on conn, so a buy replaying a committed order
+// finds it before its checks of the stock and the balance, which the order may have used up.
+// ok is false if ctx has no key or no order of the key is committed
+func committedOrder(ctx context.Context, conn *sql.Conn) (order Order, ok bool, err error) {
+	key := idempotencyKeyFrom(ctx)
+	if key == "" {
+		return Order{}, false, nil
+	}
+
+	order, err = GetOrderByIdempotencyKey(ctx, conn, key)
+	if errors.Is(err, ErrOrderNotFound) {
+		return Order{}, false, nil
+	}
+	return order, err == nil, err
+}
+
+// completedPurchase reads back the order of key committed before. The cost is unknown,
+// the price of the book may have changed after it
+func completedPurchase(ctx context.Context, db *sql.DB, key string) (PurchaseResult, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return PurchaseResult{}, err
+	}
+	defer conn.Close()
+
+	order, err := GetOrderByIdempotencyKey(ctx, conn, key)
+	if err != nil {
+		return PurchaseResult{}, err
+	}
+	return replayedPurchase(order), nil
+}
+
+// replayedPurchase is the result of a buy replaying the committed order
+func replayedPurchase(order Order) PurchaseResult {
+	logger.Infof("order %d with the idempotency key '%s' was committed before, return it", order.ID, order.IdempotencyKey)
+	return PurchaseResult{OrderID: order.ID, BookID: order.BookID, UserID: order.UserID, Amount: order.Quality}
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/shopspring/decimal"
+)
+
+// Only a duplicate entry on the index of the idempotency key is a replay
+func TestIsIdempotencyKeyConflict(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"idempotency key", &mysql.MySQLError{Number: uint16(ErrDupEntry),
+			Message: "Duplicate entry 'k' for key 'orders." + idempotencyKeyIndex + "'"}, true},
+		{"idempotency key of an older version", &mysql.MySQLError{Number: uint16(ErrDupEntry),
+			Message: "Duplicate entry 'k' for key '" + idempotencyKeyIndex + "'"}, true},
+		{"primary key", &mysql.MySQLError{Number: uint16(ErrDupEntry),
+			Message: "Duplicate entry '1' for key 'orders.PRIMARY'"}, false},
+		{"another error", &mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}, false},
+	} {
+		if got := isIdempotencyKeyConflict(test.err); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// buyFuncs are the buys which take an idempotency key
+var buyFuncs = []struct {
+	name string
+	buy  func(ctx context.Context, db *sql.DB, options PurchaseOptions, goroutineID, orderID, bookID, userID, amount int) (PurchaseResult, error)
+}{
+	{"optimistic", buyOptimistic},
+	{"pessimistic", buyPessimistic},
+}
+
+// orderState counts the orders and reads the stock of book 1 and the balance of user 1
+func orderState(t *testing.T, db *sql.DB) (orders, stock int, balance decimal.Decimal) {
+	t.Helper()
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		all, err := ListOrders(ctx, conn)
+		if err != nil {
+			return err
+		}
+		book, err := GetBook(ctx, conn, 1)
+		if err != nil {
+			return err
+		}
+		user, err := GetUser(ctx, conn, 1)
+		if err != nil {
+			return err
+		}
+		orders, stock, balance = len(all), book.Stock, user.Balance
+		return nil
+	})
+	return orders, stock, balance
+}
+
+// A buy replayed with the key of a committed order returns that order, even though the order used up
+// the stock and the balance, and the stock and the balance decrease only once
+func TestBuyReplayWithIdempotencyKeyOnTiDB(t *testing.T) {
+	for _, test := range buyFuncs {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDB(t)
+			createTestBooks(t, db, testBook(1, "Novel", "100", 3))
+			createTestUsers(t, db, User{ID: 1, Balance: decimal.NewFromInt(300), Nickname: "Bob"})
+			ctx := WithIdempotencyKey(context.Background(), "replay-"+test.name)
+
+			first, err := test.buy(ctx, db, noDelay(), 1, 0, 1, 1, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replayed, err := test.buy(ctx, db, noDelay(), 1, 0, 1, 1, 3)
+			if err != nil {
+				t.Fatalf("the replay failed: %v", err)
+			}
+			if replayed.OrderID != first.OrderID || replayed.Amount != 3 {
+				t.Errorf("got the replayed order %+v, want %+v", replayed, first)
+			}
+
+			orders, stock, balance := orderState(t, db)
+			if orders != 1 || stock != 0 || !balance.IsZero() {
+				t.Errorf("got %d orders, the stock %d and the balance %s, want 1 order bought once", orders, stock, balance)
+			}
+		})
+	}
+}
+
+// Two buys with the same key racing past the lookup: the later insert conflicts on the key,
+// and it returns the order of the other one instead of a second charge
+func TestBuyRaceWithIdempotencyKeyOnTiDB(t *testing.T) {
+	for _, test := range buyFuncs {
+		t.Run(test.name, func(t *testing.T) {
+			db := openTestDB(t)
+			createTestBooks(t, db, testBook(1, "Novel", "100", 10))
+			createTestUsers(t, db, User{ID: 1, Balance: decimal.NewFromInt(1000), Nickname: "Bob"})
+			ctx := WithIdempotencyKey(context.Background(), "race-"+test.name)
+
+			begun, arrivals := make(chan struct{}), int32(0)
+			options := noDelay()
+			options.StepHook = func(step string) {
+				if step != StepBegin {
+					return
+				}
+				if atomic.AddInt32(&arrivals, 1) == 2 {
+					close(begun)
+				}
+				<-begun
+			}
+
+			wg, results, errs := sync.WaitGroup{}, make([]PurchaseResult, 2), make([]error, 2)
+			for i := range results {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results[i], errs[i] = test.buy(ctx, db, options, i+1, 0, 1, 1, 1)
+				}(i)
+			}
+			wg.Wait()
+
+			for i, err := range errs {
+				if err != nil {
+					t.Fatalf("buy %d failed: %v", i+1, err)
+				}
+			}
+			if results[0].OrderID != results[1].OrderID {
+				t.Errorf("got the orders %d and %d, want the same one", results[0].OrderID, results[1].OrderID)
+			}
+			orders, stock, balance := orderState(t, db)
+			if orders != 1 || stock != 9 || !balance.Equal(decimal.NewFromInt(900)) {
+				t.Errorf("got %d orders, the stock %d and the balance %s, want 1 order bought once", orders, stock, balance)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BuyerResult is what a buyer of loadTest did
+type BuyerResult struct {
+	Buyer            int
+	Succeeded        int
+	BusinessFailures int // the purchases failed for the stock, the balance or the amount
+	Errors           int // the purchases failed for any other reason
+}
+
+// LoadOptions configure loadTest
+type LoadOptions struct {
+	Buyers    int // concurrent buyers, loadTest runs instead of buy if it is positive
+	Purchases int // purchases of each buyer
+	// PoolWatch polls the connection pool by WatchPoolSaturation at this interval during the run,
+	// the summary tells how many polls found it saturated. Zero disables it
+	PoolWatch time.Duration
+	// Zipf spreads the purchases over all the books by newBuyerGenerator with this Zipf parameter,
+	// the books with the smallest ids are the hottest. Zero buys the demo book only
+	Zipf float64
+	Seed int64 // seed of the generators, buyer n generates by Seed+n
+}
+
+// loadOptions are the options of the load test of the demo, set by the -load-* flags
+var loadOptions = LoadOptions{Purchases: 1, PoolWatch: 100 * time.Millisecond, Seed: 1}
+
+// loadHotBooks is how many of the most bought books the summary of a Zipf load test prints
+const loadHotBooks = 5
+
+// loadOrderIDBase is the first order id of loadTest, far above the fixed ids of the demo
+const loadOrderIDBase = 100000
+
+// isBusinessFailure reports whether err is a failure of the buy itself rather than of the database
+func isBusinessFailure(err error) bool {
+	return errors.Is(err, ErrStockInsufficient) || errors.Is(err, ErrBalanceInsufficient) ||
+		errors.Is(err, ErrInvalidAmount) || errors.Is(err, ErrBookNotFound) || errors.Is(err, ErrUserNotFound)
+}
+
+// loadTest runs load.Buyers goroutines which buy one copy of the demo book load.Purchases times each,
+// the buyers take turns between the demo users. With load.Zipf, each buyer draws its books and users
+// from a BuyerGenerator over all the books instead, and the summary prints the most bought books. The order ids are generated by TiDB, or allocated by an atomic counter
+// with -explicit-order-id, so they never collide across the buyers. It prints a summary of the run with the retries by error code
+func loadTest(ctx context.Context, db *sql.DB, options PurchaseOptions, load LoadOptions, optimistic bool) error {
+	buyers, purchasesPerBuyer := load.Buyers, load.Purchases
+	if buyers <= 0 || purchasesPerBuyer <= 0 {
+		return fmt.Errorf("buyers and purchases per buyer must be positive, got %d and %d", buyers, purchasesPerBuyer)
+	}
+
+	buyFunc := buyOptimistic
+	if !optimistic {
+		buyFunc = buyPessimistic
+	}
+
+	errorSummary, stats := &ErrorSummary{}, &TxnStats{}
+	options.Txn = append(options.Txn[:len(options.Txn):len(options.Txn)], WithErrorSummary(errorSummary), WithHooks(stats.Hooks()))
+
+	saturations, lastStats := int64(0), atomic.Value{}
+	if load.PoolWatch > 0 {
+		watchCtx, stopWatch := context.WithCancel(ctx)
+		watched := make(chan struct{})
+		go func() {
+			defer close(watched)
+			WatchPoolSaturation(watchCtx, db, load.PoolWatch, func(stats sql.DBStats) {
+				lastStats.Store(stats)
+				atomic.AddInt64(&saturations, 1)
+			})
+		}()
+		defer func() {
+			stopWatch()
+			<-watched
+		}()
+	}
+
+	// each buyer holds a connection during its transaction, the buyers beyond the free ones queue for the pool
+	if slots := AvailableSlots(db); slots < buyers {
+		fmt.Printf("[load test] %d buyers share %d free connections of the pool, %d of them wait for a connection\n",
+			buyers, slots, buyers-slots)
+	}
+
+	signalCtx, stopSignal := context.WithCancel(ctx)
+	defer stopSignal()
+	go watchPauseSignal(signalCtx, func(paused bool) {
+		if paused {
+			fmt.Println("[load test] buying paused, send SIGUSR1 again to resume")
+		} else {
+			fmt.Println("[load test] buying resumed")
+		}
+	})
+
+	generators := make([]*BuyerGenerator, buyers+1)
+	if load.Zipf != 0 {
+		books, err := listBookIDs(ctx, db)
+		if err != nil {
+			return err
+		}
+		for buyer := 1; buyer <= buyers; buyer++ {
+			if generators[buyer], err = newBuyerGenerator(load.Seed+int64(buyer), load.Zipf, books, []int{1, 2}, 1); err != nil {
+				return err
+			}
+		}
+	}
+	bought, boughtLock := map[int]int{}, sync.Mutex{}
+
+	nextOrderID := int64(loadOrderIDBase)
+	results := make(chan BuyerResult, buyers)
+	start := time.Now()
+
+	wg := sync.WaitGroup{}
+	for buyer := 1; buyer <= buyers; buyer++ {
+		wg.Add(1)
+		go func(buyer int) {
+			defer wg.Done()
+
+			result := BuyerResult{Buyer: buyer}
+			request := BuyRequest{BookID: 1, UserID: (buyer-1)%2 + 1, Amount: 1}
+			for i := 0; i < purchasesPerBuyer; i++ {
+				if generators[buyer] != nil {
+					request = generators[buyer].Next()
+				}
+				orderID := int(atomic.AddInt64(&nextOrderID, 1))
+				_, err := buyFunc(ctx, db, options, buyer, orderID, request.BookID, request.UserID, request.Amount)
+				switch {
+				case err == nil:
+					result.Succeeded++
+					boughtLock.Lock()
+					bought[request.BookID]++
+					boughtLock.Unlock()
+				case isBusinessFailure(err):
+					result.BusinessFailures++
+				default:
+					result.Errors++
+				}
+			}
+			results <- result
+		}(buyer)
+	}
+	wg.Wait()
+	close(results)
+	elapsed := time.Since(start)
+
+	ordered := 0
+	fmt.Println("\n[load test]")
+	for result := range results {
+		ordered += result.Succeeded
+		fmt.Printf("buyer %d: %d succeeded, %d business failures, %d errors\n",
+			result.Buyer, result.Succeeded, result.BusinessFailures, result.Errors)
+	}
+	fmt.Printf("orders created: %d, elapsed: %s\n%s\n", ordered, elapsed, stats.Summary())
+	if errorsByClass := errorSummary.String(); errorsByClass != "" {
+		fmt.Printf("errors by class: %s\n", errorsByClass)
+	}
+	if load.Zipf != 0 {
+		fmt.Printf("most bought books: %s\n", hotBooks(bought, loadHotBooks))
+	}
+	if n := atomic.LoadInt64(&saturations); n > 0 {
+		poolStats := lastStats.Load().(sql.DBStats)
+		fmt.Printf("connection pool saturated in %d polls, last: %d of max %d in use, %d waits for %s\n",
+			n, poolStats.InUse, poolStats.MaxOpenConnections, poolStats.WaitCount, poolStats.WaitDuration)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	book, err := GetBook(ctx, conn, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("final stock of book %d: %d\n", book.ID, book.Stock)
+	for _, userID := range []int{1, 2} {
+		user, err := GetUser(ctx, conn, userID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("final balance of user %d: %s\n", user.ID, user.Balance.StringFixed(moneyScale))
+	}
+
+	return nil
+}
+
+// listBookIDs returns the ids of all the books in order
+func listBookIDs(ctx context.Context, db *sql.DB) ([]int, error) {
+	rows, err := db.QueryContext(ctx, "SELECT `id` FROM `books` ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		id := 0
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// hotBooks renders the n books of bought with the most orders, the most bought first
+func hotBooks(bought map[int]int, n int) string {
+	ids := make([]int, 0, len(bought))
+	for id := range bought {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if bought[ids[i]] != bought[ids[j]] {
+			return bought[ids[i]] > bought[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+
+	hot := make([]string, 0, len(ids))
+	for _, id := range ids {
+		hot = append(hot, fmt.Sprintf("book %d: %d orders", id, bought[id]))
+	}
+	return strings.Join(hot, ", ")
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// The buyers of the load test share a pool of two connections, the pool is watched while they buy
+// and the stock and the balances are still conserved afterwards
+func TestLoadTestOnTinyPool(t *testing.T) {
+	db := openTestDB(t)
+	db.SetMaxOpenConns(2)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	load := LoadOptions{Buyers: 4, Purchases: 2, PoolWatch: time.Millisecond}
+	if err := loadTest(ctx, db, noDelay(), load, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyState(ctx, db); err != nil {
+		t.Error(err)
+	}
+	if err := assertCommitted(ctx, db, 1, initialBookStock-8); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHotBooks(t *testing.T) {
+	bought := map[int]int{1: 5, 2: 9, 3: 5, 4: 1}
+	if got, want := hotBooks(bought, 3), "book 2: 9 orders, book 1: 5 orders, book 3: 5 orders"; got != want {
+		t.Errorf("got '%s', want '%s'", got, want)
+	}
+	if got := hotBooks(nil, 3); got != "" {
+		t.Errorf("got '%s' without purchases", got)
+	}
+}
+
+// A Zipf load test buys from all the books, the stock and the balances are conserved
+func TestLoadTestZipfOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	createTestBooks(t, db, testBook(2, "Science & Technology", "1.00", 100), testBook(3, "Science & Technology", "1.00", 100))
+
+	load := LoadOptions{Buyers: 2, Purchases: 8, Zipf: 1.5, Seed: 7}
+	if err := loadTest(ctx, db, noDelay(), load, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyState(ctx, db); err != nil {
+		t.Error(err)
+	}
+
+	outside := 0
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM `orders` WHERE `book_id` NOT IN (1, 2, 3)").Scan(&outside); err != nil {
+		t.Fatal(err)
+	}
+	if outside != 0 {
+		t.Errorf("%d orders of books which don't exist", outside)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// seedLoadData makes seedCatalogue load the books by LOAD DATA LOCAL INFILE, set by -seed-load-data
+var seedLoadData = false
+
+// booksReaderName is the reader handler of the books CSV, LOAD DATA reads it as the file 'Reader::seed_books'
+const booksReaderName = "seed_books"
+
+// loadBooksSQL replaces books by the CSV of writeBooksCSV, so loading the same seed again doesn't fail on the ids
+func loadBooksSQL() string {
+	return columnSQL("LOAD DATA LOCAL INFILE 'Reader::" + booksReaderName + "' REPLACE INTO TABLE `books` " +
+		"FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '\"' ESCAPED BY '' LINES TERMINATED BY '\\n' " +
+		"(`id`, {title}, {type}, {published_at}, {price}, {stock})")
+}
+
+// writeBooksCSV writes a line per book in the columns of loadBooksSQL, a quote in a field is doubled
+func writeBooksCSV(w io.Writer, books []Book) error {
+	writer := csv.NewWriter(w)
+	for _, book := range books {
+		if err := writer.Write([]string{
+			strconv.Itoa(book.ID),
+			book.Title,
+			book.Type,
+			book.PublishedAt.Format("2006-01-02 15:04:05"),
+			book.Price.String(),
+			strconv.Itoa(book.Stock),
+		}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// loadBooksLocalInfile loads books by LOAD DATA LOCAL INFILE from a CSV generated in memory
+// and returns the number of rows loaded. The CSV is served by a reader handler registered for this load only,
+// the driver sends a registered reader without allowAllFiles, so the DSN doesn't open the local files
+func loadBooksLocalInfile(ctx context.Context, conn *sql.Conn, books []Book) (int, error) {
+	if len(books) == 0 {
+		return 0, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeBooksCSV(buf, books); err != nil {
+		return 0, fmt.Errorf("generate the books CSV: %w", err)
+	}
+
+	mysql.RegisterReaderHandler(booksReaderName, func() io.Reader { return buf })
+	defer mysql.DeregisterReaderHandler(booksReaderName)
+
+	if _, err := conn.ExecContext(ctx, loadBooksSQL()); err != nil {
+		return 0, err
+	}
+	return len(books), nil
+}
+
+// isLocalInfileRejected reports whether err is the server refusing LOAD DATA LOCAL,
+// because local_infile is off or the command isn't allowed
+func isLocalInfileRejected(err error) bool {
+	mysqlErr := &mysql.MySQLError{}
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	code := TiDBErrorCode(mysqlErr.Number)
+	return code == ErrNotAllowedCommand || code == ErrLocalFileDisabled
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/shopspring/decimal"
+)
+
+// A field with the separator or a quote is quoted, the CSV reads back to the columns of loadBooksSQL
+func TestWriteBooksCSV(t *testing.T) {
+	books := []Book{
+		{ID: 10001, Title: `Data, "Distributed"`, Type: "Science & Technology",
+			PublishedAt: time.Date(2010, 3, 4, 5, 6, 7, 0, time.UTC), Price: decimal.New(1250, -2), Stock: 7},
+		{ID: 10002, Title: "Night", Type: "Novel", PublishedAt: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+			Price: decimal.NewFromInt(3), Stock: 0},
+	}
+	buf := &bytes.Buffer{}
+	if err := writeBooksCSV(buf, books); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), `10001,"Data, ""Distributed""",`) {
+		t.Errorf("the title isn't quoted: %s", buf.String())
+	}
+
+	records, err := csv.NewReader(buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"10001", `Data, "Distributed"`, "Science & Technology", "2010-03-04 05:06:07", "12.5", "7"},
+		{"10002", "Night", "Novel", "2001-01-01 00:00:00", "3", "0"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+}
+
+func TestIsLocalInfileRejected(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&mysql.MySQLError{Number: uint16(ErrNotAllowedCommand), Message: "The used command is not allowed with this MySQL version"}, true},
+		{fmt.Errorf("load: %w", &mysql.MySQLError{Number: uint16(ErrLocalFileDisabled), Message: "local_infile is disabled"}), true},
+		{&mysql.MySQLError{Number: uint16(ErrDupEntry), Message: "Duplicate entry"}, false},
+		{errors.New("connection lost"), false},
+		{nil, false},
+	} {
+		if got := isLocalInfileRejected(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestLoadBooksLocalInfileEmpty(t *testing.T) {
+	conn, _ := newMockConn(t)
+	if loaded, err := loadBooksLocalInfile(context.Background(), conn, nil); err != nil || loaded != 0 {
+		t.Errorf("got %d, %v of no books, want 0", loaded, err)
+	}
+}
+
+// useSeedLoadData sets -seed-load-data for the test
+func useSeedLoadData(tb testing.TB) {
+	seedLoadData = true
+	tb.Cleanup(func() { seedLoadData = false })
+}
+
+func anyArgs(n int) []driver.Value {
+	args := make([]driver.Value, n)
+	for i := range args {
+		args[i] = sqlmock.AnyArg()
+	}
+	return args
+}
+
+// A server rejecting LOAD DATA LOCAL gets a warning and the books are seeded by bulk insert
+func TestSeedCatalogueLocalInfileFallback(t *testing.T) {
+	db, mock := newMock(t)
+	useSeedLoadData(t)
+	buffer := useBufferLogger(t)
+	mock.ExpectExec(loadBooksSQL()).WillReturnError(&mysql.MySQLError{
+		Number: uint16(ErrNotAllowedCommand), Message: "The used command is not allowed with this TiDB version"})
+	mock.ExpectExec(createBooksSQL(3)).WithArgs(anyArgs(18)...).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	if err := seedCatalogue(context.Background(), db, 3); err != nil {
+		t.Fatal(err)
+	}
+	lines := buffer.Lines()
+	if len(lines) != 1 || !strings.Contains(lines[0], "seed by bulk insert") {
+		t.Errorf("got the log %q, want the fallback warning", lines)
+	}
+}
+
+// Another failure of LOAD DATA LOCAL is returned without the fallback
+func TestSeedCatalogueLocalInfileFailure(t *testing.T) {
+	db, mock := newMock(t)
+	useSeedLoadData(t)
+	failed := errors.New("connection lost")
+	mock.ExpectExec(loadBooksSQL()).WillReturnError(failed)
+
+	if err := seedCatalogue(context.Background(), db, 3); !errors.Is(err, failed) {
+		t.Errorf("got %v, want the failed load", err)
+	}
+}
+
+// The books seeded by -seed-load-data are the ones bulk insert seeds, loaded or by the fallback
+func TestSeedCatalogueLocalInfileOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	read := func() []Book {
+		var books []Book
+		withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) (err error) {
+			books, err = ListBooks(ctx, conn)
+			return err
+		})
+		return books
+	}
+
+	if err := seedCatalogue(ctx, db, 200); err != nil {
+		t.Fatal(err)
+	}
+	inserted := read()
+	mustExec(t, db, "DELETE FROM `books`")
+
+	useSeedLoadData(t)
+	if err := seedCatalogue(ctx, db, 200); err != nil {
+		t.Fatal(err)
+	}
+	loaded := read()
+	if len(loaded) != 200 || !reflect.DeepEqual(loaded, inserted) {
+		t.Errorf("loaded %d books, want the %d books of bulk insert", len(loaded), len(inserted))
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// WaitChain is a chain of transactions, each one waits for the lock held by the next one
+type WaitChain struct {
+	TrxIDs []uint64
+	Depth  int  // number of waiting edges in the chain
+	Cycle  bool // the last transaction waits for one in the chain, that's a potential deadlock
+}
+
+// LockWaitChains builds the wait-for graph from INFORMATION_SCHEMA.DATA_LOCK_WAITS and returns its chains
+func LockWaitChains(ctx context.Context, db *sql.DB) ([]WaitChain, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT `TRX_ID`, `CURRENT_HOLDING_TRX_ID` FROM `INFORMATION_SCHEMA`.`DATA_LOCK_WAITS`")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	waitFor, waited := make(map[uint64]uint64), make(map[uint64]bool)
+	for rows.Next() {
+		var waiter, holder uint64
+		if err = rows.Scan(&waiter, &holder); err != nil {
+			return nil, err
+		}
+
+		if _, exist := waitFor[waiter]; !exist {
+			waitFor[waiter] = holder
+			waited[holder] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return buildWaitChains(waitFor, waited), nil
+}
+
+func buildWaitChains(waitFor map[uint64]uint64, waited map[uint64]bool) []WaitChain {
+	var starts []uint64
+	for waiter := range waitFor {
+		if !waited[waiter] {
+			starts = append(starts, waiter)
+		}
+	}
+
+	visited := make(map[uint64]bool)
+	follow := func(start uint64) WaitChain {
+		chain, inChain := WaitChain{}, make(map[uint64]bool)
+		for trxID := start; ; {
+			if inChain[trxID] {
+				chain.Cycle = true
+				break
+			}
+
+			inChain[trxID], visited[trxID] = true, true
+			chain.TrxIDs = append(chain.TrxIDs, trxID)
+
+			holder, waiting := waitFor[trxID]
+			if !waiting {
+				break
+			}
+			trxID = holder
+		}
+		chain.Depth = len(chain.TrxIDs) - 1
+		return chain
+	}
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	var chains []WaitChain
+	for _, start := range starts {
+		chains = append(chains, follow(start))
+	}
+
+	// the transactions in a pure cycle are all waited by someone, so they have no start
+	var rest []uint64
+	for waiter := range waitFor {
+		rest = append(rest, waiter)
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i] < rest[j] })
+	for _, waiter := range rest {
+		if !visited[waiter] {
+			chains = append(chains, follow(waiter))
+		}
+	}
+
+	return chains
+}
+
+// demoLockChains runs demoLockWaitChains instead of buy
+var demoLockChains = false
+
+// lockChainPoll is how often and how long demoLockWaitChains polls for the chain
+const (
+	lockChainPollInterval = 100 * time.Millisecond
+	lockChainPollTimeout  = 10 * time.Second
+)
+
+// demoLockWaitChains builds a wait chain two deep on the demo users and prints the chains LockWaitChains reports:
+// txn 1 locks user 1, txn 2 locks user 2 and waits for user 1, txn 3 waits for user 2.
+// All of them are rolled back afterwards, from txn 1 so each waiter gets its lock before its own rollback
+func demoLockWaitChains(ctx context.Context, db *sql.DB) ([]WaitChain, error) {
+	var conns [3]*sql.Conn
+	txnNames := make(map[uint64]string)
+	for i := range conns {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conns[i] = conn
+
+		startTS := uint64(0)
+		if _, err = conn.ExecContext(ctx, "BEGIN PESSIMISTIC"); err != nil {
+			return nil, err
+		}
+		defer rollback(conn)
+		if err = conn.QueryRowContext(ctx, "SELECT @@tidb_current_ts").Scan(&startTS); err != nil {
+			return nil, err
+		}
+		// the TRX_ID of DATA_LOCK_WAITS is the start ts of the transaction
+		txnNames[startTS] = fmt.Sprintf("txn %d", i+1)
+	}
+
+	lockUser := columnSQL("SELECT {balance} FROM `users` WHERE `id` = ? FOR UPDATE")
+	for i, userID := range []int{1, 2} {
+		if _, err := conns[i].ExecContext(ctx, lockUser, userID); err != nil {
+			return nil, err
+		}
+		fmt.Printf("txn %d locked user %d\n", i+1, userID)
+	}
+
+	var waits [2]chan error
+	for i := range waits {
+		waits[i] = make(chan error, 1)
+		go func(i int) {
+			_, err := conns[i+1].ExecContext(ctx, lockUser, i+1)
+			waits[i] <- err
+		}(i)
+		fmt.Printf("txn %d waits for user %d\n", i+2, i+1)
+	}
+	defer func() {
+		// the rollback of a waiter can't run until its statement returns, so release the chain from its head
+		for i := range waits {
+			rollback(conns[i])
+			<-waits[i]
+		}
+	}()
+
+	pollCtx, cancel := context.WithTimeout(ctx, lockChainPollTimeout)
+	defer cancel()
+	for {
+		chains, err := LockWaitChains(pollCtx, db)
+		if err != nil {
+			return nil, err
+		}
+		deep := false
+		for _, chain := range chains {
+			deep = deep || chain.Depth >= 2
+		}
+		if deep {
+			for _, chain := range chains {
+				names := make([]string, 0, len(chain.TrxIDs))
+				for _, trxID := range chain.TrxIDs {
+					names = append(names, fmt.Sprintf("%s(%d)", txnNames[trxID], trxID))
+				}
+				fmt.Printf("wait chain of depth %d, cycle: %t: %s\n", chain.Depth, chain.Cycle, strings.Join(names, " -> "))
+			}
+			return chains, nil
+		}
+
+		if err = sleepContext(pollCtx, lockChainPollInterval); err != nil {
+			return nil, fmt.Errorf("no wait chain of depth 2 in %s: %w", lockChainPollTimeout, err)
+		}
+	}
+}
+
+// demoDeadlock runs DemoDeadlock instead of buy
+var demoDeadlock = false
+
+// DeadlockReport tells which transaction of DemoDeadlock was rolled back by TiDB
+type DeadlockReport struct {
+	Victim    int // 1 or 2
+	Committed int // the other one
+	Err       *mysql.MySQLError
+}
+
+// DemoDeadlock locks user 1 and user 2 in opposite order on two connections,
+// a barrier makes sure both hold their first lock before asking for the second, so a deadlock is guaranteed
+func DemoDeadlock(db *sql.DB) (DeadlockReport, error) {
+	ctx := context.Background()
+	lockOrders := [2][2]int{{1, 2}, {2, 1}}
+
+	var conns [2]*sql.Conn
+	for i := range conns {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return DeadlockReport{}, err
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	firstLocked, done := sync.WaitGroup{}, sync.WaitGroup{}
+	firstLocked.Add(2)
+	errs := [2]error{}
+	for i := range conns {
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			errs[i] = deadlockTxn(ctx, conns[i], i+1, lockOrders[i], &firstLocked)
+		}(i)
+	}
+	done.Wait()
+
+	report := DeadlockReport{}
+	for i, err := range errs {
+		mysqlErr := &mysql.MySQLError{}
+		if errors.As(err, &mysqlErr) && TiDBErrorCode(mysqlErr.Number) == ErrLockDeadlock {
+			report.Victim, report.Committed, report.Err = i+1, 2-i, mysqlErr
+		} else if err != nil {
+			return DeadlockReport{}, err
+		}
+	}
+
+	if report.Victim == 0 {
+		return DeadlockReport{}, fmt.Errorf("no deadlock occurred")
+	}
+
+	return report, nil
+}
+
+func deadlockTxn(ctx context.Context, conn *sql.Conn, txnID int, userIDs [2]int, firstLocked *sync.WaitGroup) error {
+	txnComment := fmt.Sprintf("/* txn %d */ ", txnID)
+	if txnID != 1 {
+		txnComment = "\t" + txnComment
+	}
+
+	if _, err := conn.ExecContext(ctx, "BEGIN PESSIMISTIC"); err != nil {
+		firstLocked.Done()
+		return err
+	}
+
+	lockUser := columnSQL("select {balance} from users where id = ? for update")
+	_, err := conn.ExecContext(ctx, lockUser, userIDs[0])
+	firstLocked.Done()
+	if err != nil {
+		rollback(conn)
+		return err
+	}
+	fmt.Printf("%s%s successful (id: %d)\n", txnComment, lockUser, userIDs[0])
+
+	firstLocked.Wait()
+	if _, err = conn.ExecContext(ctx, lockUser, userIDs[1]); err != nil {
+		rollback(conn)
+		fmt.Printf("%sgot an error, rollback: %+v\n", txnComment, err)
+		return err
+	}
+	fmt.Printf("%s%s successful (id: %d)\n", txnComment, lockUser, userIDs[1])
+
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestBuildWaitChains(t *testing.T) {
+	tests := []struct {
+		name    string
+		waitFor map[uint64]uint64
+		want    []WaitChain
+	}{
+		{
+			name:    "two deep",
+			waitFor: map[uint64]uint64{3: 2, 2: 1},
+			want:    []WaitChain{{TrxIDs: []uint64{3, 2, 1}, Depth: 2}},
+		},
+		{
+			name:    "two waiters of one holder",
+			waitFor: map[uint64]uint64{2: 1, 3: 1},
+			want:    []WaitChain{{TrxIDs: []uint64{2, 1}, Depth: 1}, {TrxIDs: []uint64{3, 1}, Depth: 1}},
+		},
+		{
+			name:    "a waiter of a cycle",
+			waitFor: map[uint64]uint64{1: 2, 2: 1, 3: 1},
+			want:    []WaitChain{{TrxIDs: []uint64{3, 1, 2}, Depth: 2, Cycle: true}},
+		},
+		{
+			name:    "a pure cycle",
+			waitFor: map[uint64]uint64{1: 2, 2: 3, 3: 1},
+			want:    []WaitChain{{TrxIDs: []uint64{1, 2, 3}, Depth: 2, Cycle: true}},
+		},
+		{
+			name:    "no waits",
+			waitFor: map[uint64]uint64{},
+		},
+	}
+
+	for _, test := range tests {
+		waited := make(map[uint64]bool)
+		for _, holder := range test.waitFor {
+			waited[holder] = true
+		}
+		if got := buildWaitChains(test.waitFor, waited); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDemoLockWaitChains(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	chains, err := demoLockWaitChains(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chain := range chains {
+		if chain.Depth == 2 && !chain.Cycle {
+			return
+		}
+	}
+	t.Errorf("no chain two deep is reported: %+v", chains)
+}
+
+func TestDemoDeadlockOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	if err := prepareData(context.Background(), db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := DemoDeadlock(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Err == nil || TiDBErrorCode(report.Err.Number) != ErrLockDeadlock {
+		t.Errorf("got the error %v of the victim, want the deadlock 1213", report.Err)
+	}
+	if report.Victim+report.Committed != 3 {
+		t.Errorf("got the victim %d and the committed %d, want txn 1 and txn 2", report.Victim, report.Committed)
+	}
+}
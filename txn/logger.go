@@ -0,0 +1,44 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+// Logger receives the diagnostics of the transaction runner and the buys
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdoutLogger prints every line to stdout, it's the output of the tutorial
+type stdoutLogger struct{}
+
+func (stdoutLogger) Infof(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
+func (stdoutLogger) Errorf(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
+// NopLogger drops every line, it silences the output when the demo is driven by another program
+type NopLogger struct{}
+
+func (NopLogger) Infof(format string, args ...interface{}) {}
+
+func (NopLogger) Errorf(format string, args ...interface{}) {}
+
+// logger is the default Logger of RunTxn and the buys
+var logger Logger = stdoutLogger{}
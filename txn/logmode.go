@@ -0,0 +1,106 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LogMode is how a transaction is logged
+type LogMode int
+
+const (
+	LogPerStatement LogMode = iota // a line per statement of the buys and per step of the runner, the tutorial output
+	LogSummary                     // a single line per transaction, see logTxnSummary
+)
+
+func (m LogMode) String() string {
+	switch m {
+	case LogPerStatement:
+		return "statement"
+	case LogSummary:
+		return "summary"
+	default:
+		return fmt.Sprintf("LogMode(%d)", int(m))
+	}
+}
+
+// logMode is the LogMode of runTxn and the buys, set by -log-mode
+var logMode = LogSummary
+
+// logModeFlag is the -log-mode flag, statement or summary
+type logModeFlag struct{}
+
+func (logModeFlag) String() string {
+	return logMode.String()
+}
+
+func (logModeFlag) Set(value string) error {
+	switch value {
+	case "statement":
+		logMode = LogPerStatement
+	case "summary":
+		logMode = LogSummary
+	default:
+		return fmt.Errorf("log mode must be statement or summary, got '%s'", value)
+	}
+	return nil
+}
+
+// purchaseTag is the buy a transaction runs, given by WithPurchase
+type purchaseTag struct {
+	bookID, userID, amount int
+}
+
+// statementLogger is the logger of the per-statement lines of the buys, they're dropped in LogSummary mode
+func statementLogger() Logger {
+	if logMode == LogSummary {
+		return NopLogger{}
+	}
+	return logger
+}
+
+// logTxnSummary logs the single line of a transaction in LogSummary mode to l, like
+//
+//	txn mode=pessimistic attempts=2 outcome=committed duration=12ms book=1 user=1 amount=2
+//
+// A failed transaction is logged by Errorf with its error as the outcome
+func logTxnSummary(l Logger, options *txnOptions, result TxnResult, err error, elapsed time.Duration) {
+	mode := "pessimistic"
+	if options.optimistic {
+		mode = "optimistic"
+	}
+	fields := []string{
+		"mode=" + mode,
+		fmt.Sprintf("attempts=%d", result.Attempts),
+		"outcome=committed",
+		"duration=" + elapsed.Round(time.Microsecond).String(),
+	}
+	if err != nil {
+		fields[2] = fmt.Sprintf("outcome=%q", err.Error())
+	}
+	if purchase := options.purchase; purchase != (purchaseTag{}) {
+		fields = append(fields, fmt.Sprintf("book=%d user=%d amount=%d", purchase.bookID, purchase.userID, purchase.amount))
+	}
+
+	line := "txn " + strings.Join(fields, " ")
+	if err != nil {
+		l.Errorf("%s", line)
+		return
+	}
+	l.Infof("%s", line)
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+// useLogMode sets the -log-mode of the test
+func useLogMode(tb testing.TB, mode LogMode) {
+	defaultMode := logMode
+	logMode = mode
+	tb.Cleanup(func() {
+		logMode = defaultMode
+	})
+}
+
+func TestLogModeFlag(t *testing.T) {
+	useLogMode(t, LogSummary)
+	flag := logModeFlag{}
+	if err := flag.Set("statement"); err != nil || logMode != LogPerStatement || flag.String() != "statement" {
+		t.Errorf("got %s, %v, want statement", logMode, err)
+	}
+	if err := flag.Set("summary"); err != nil || logMode != LogSummary {
+		t.Errorf("got %s, %v, want summary", logMode, err)
+	}
+	if err := flag.Set("verbose"); err == nil {
+		t.Error("an unknown log mode is accepted")
+	}
+}
+
+// expectBuy expects a pessimistic buy of 2 of the book 1 by the user 1 which commits
+func expectBuy(mock sqlmock.Sqlmock) {
+	publishedAt := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(bookSQL(true)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(1, "Book 1", "Novel", publishedAt, "100", 10))
+	mock.ExpectExec(updateStockSQL()).WithArgs(2, 1, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertOrderSQL()).WithArgs(1, 1, 2, "100").WillReturnResult(sqlmock.NewResult(42, 1))
+	mock.ExpectExec(debitBalanceSQL()).WithArgs("200", 1, "200").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// In summary mode each buy logs exactly one line with its mode, attempts, outcome, duration and purchase
+func TestLogSummaryOneLinePerBuy(t *testing.T) {
+	db, mock := newMock(t)
+	buffer := useBufferLogger(t)
+	useLogMode(t, LogSummary)
+
+	for i := 0; i < 3; i++ {
+		expectBuy(mock)
+		if _, err := buyPessimistic(context.Background(), db, noDelay(), 1, 0, 1, 1, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := buffer.Lines()
+	if len(lines) != 3 {
+		t.Fatalf("got the lines %q, want one per buy", lines)
+	}
+	for _, line := range lines {
+		for _, field := range []string{"txn ", "mode=pessimistic", "attempts=1", "outcome=committed", "duration=",
+			"book=1 user=1 amount=2"} {
+			if !strings.Contains(line, field) {
+				t.Errorf("got the line %q, want %q in it", line, field)
+			}
+		}
+	}
+}
+
+// A retried transaction is one line too, a failed one is one error line with the failure as the outcome
+func TestLogSummaryRetriedAndFailed(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	buffer := useBufferLogger(t)
+	useLogMode(t, LogSummary)
+
+	conflict := &mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := runTxn(context.Background(), db, true, retryTimes, failFirst(conflict)); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("failed")
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	err := runTxn(context.Background(), db, false, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v, want %v", err, failed)
+	}
+
+	lines := buffer.Lines()
+	if len(lines) != 2 {
+		t.Fatalf("got the lines %q, want one per transaction", lines)
+	}
+	if !strings.Contains(lines[0], "mode=optimistic attempts=2 outcome=committed") {
+		t.Errorf("got %q, want the retried commit", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "error: ") || !strings.Contains(lines[1], "mode=pessimistic attempts=1 outcome=") ||
+		!strings.Contains(lines[1], "failed") {
+		t.Errorf("got %q, want the failure", lines[1])
+	}
+}
+
+// The per-statement mode keeps the tutorial output, a line per statement of the buy and per step of the runner
+func TestLogPerStatement(t *testing.T) {
+	db, mock := newMock(t)
+	buffer := useBufferLogger(t)
+	useLogMode(t, LogPerStatement)
+
+	expectBuy(mock)
+	if _, err := buyPessimistic(context.Background(), db, noDelay(), 1, 0, 1, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Join(buffer.Lines(), "\n")
+	for _, want := range []string{"try to buy", updateStockSQL() + " successful", "commit success"} {
+		if !strings.Contains(lines, want) {
+			t.Errorf("got the lines %q, want %q", lines, want)
+		}
+	}
+	if strings.Contains(lines, "txn mode=") {
+		t.Errorf("got a summary line in %q", lines)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Book is a row of the `books` table
+type Book struct {
+	ID          int
+	Title       string
+	Type        string
+	PublishedAt time.Time
+	Price       decimal.Decimal
+	Stock       int
+}
+
+// User is a row of the `users` table
+type User struct {
+	ID       int
+	Balance  decimal.Decimal
+	Nickname string
+}
+
+// Order is a row of the `orders` table
+type Order struct {
+	ID        int
+	BookID    int
+	UserID    int
+	Quality   int
+	OrderedAt time.Time
+
+	UnitPrice      decimal.NullDecimal // the price of a book at the buy, invalid for an order of an older table
+	IdempotencyKey string              // empty for an order without a key, only written by OrderRepo.CreateOrder
+}
+
+// PurchaseResult is a committed purchase, OrderID is the id of its order
+type PurchaseResult struct {
+	OrderID int
+	BookID  int
+	UserID  int
+	Amount  int
+	Cost    decimal.Decimal
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+const moneyScale = 2
+
+// RoundingMode is how the money computations round to two decimal places
+type RoundingMode int
+
+const (
+	RoundHalfUp   RoundingMode = iota // 0.125 -> 0.13
+	RoundHalfEven                     // banker's rounding, 0.125 -> 0.12
+)
+
+func (m RoundingMode) String() string {
+	if m == RoundHalfEven {
+		return "half-even"
+	}
+	return "half-up"
+}
+
+// moneyRounding is used by all the money computations, like AverageOrderValue and adjustPricesByType,
+// it's set by -rounding
+var moneyRounding = RoundHalfUp
+
+// roundingFlag is the -rounding flag, half-up or half-even
+type roundingFlag struct{}
+
+func (roundingFlag) String() string {
+	return moneyRounding.String()
+}
+
+func (roundingFlag) Set(value string) error {
+	switch value {
+	case "half-up":
+		moneyRounding = RoundHalfUp
+	case "half-even":
+		moneyRounding = RoundHalfEven
+	default:
+		return fmt.Errorf("rounding must be half-up or half-even, got '%s'", value)
+	}
+	return nil
+}
+
+func roundMoney(value decimal.Decimal) decimal.Decimal {
+	if moneyRounding == RoundHalfEven {
+		return value.RoundBank(moneyScale)
+	}
+
+	return value.Round(moneyScale)
+}
+
+// scanMoney parses src into dest and fails if it has more than two decimal places
+func scanMoney(dest *decimal.Decimal, src interface{}) error {
+	value := decimal.Decimal{}
+	if err := value.Scan(src); err != nil {
+		return err
+	}
+
+	if -value.Exponent() > moneyScale {
+		return fmt.Errorf("money value %s has more than %d decimal places", value.String(), moneyScale)
+	}
+
+	*dest = value
+	return nil
+}
+
+type moneyScanner struct {
+	dest       *decimal.Decimal
+	nullAsZero bool
+}
+
+func (m moneyScanner) Scan(src interface{}) error {
+	if src == nil && m.nullAsZero {
+		*m.dest = decimal.Zero
+		return nil
+	}
+
+	return scanMoney(m.dest, src)
+}
+
+// money wraps dest as a sql.Scanner which validates the scale by scanMoney
+func money(dest *decimal.Decimal) sql.Scanner {
+	return moneyScanner{dest: dest}
+}
+
+// moneyOrZero is money which scans NULL as zero, like the default of a nullable money column
+func moneyOrZero(dest *decimal.Decimal) sql.Scanner {
+	return moneyScanner{dest: dest, nullAsZero: true}
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+func TestScanMoney(t *testing.T) {
+	tests := []struct {
+		src     interface{}
+		want    string
+		wantErr bool
+	}{
+		{src: []byte("100.00"), want: "100"},
+		{src: "12.5", want: "12.5"},
+		{src: int64(7), want: "7"},
+		{src: []byte("0.01"), want: "0.01"},
+		{src: []byte("12.345"), wantErr: true},
+		{src: "0.001", wantErr: true},
+		{src: []byte("not a number"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		value := decimal.Decimal{}
+		err := scanMoney(&value, test.src)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("scanMoney(%v) = %s, want an error", test.src, value.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("scanMoney(%v): %v", test.src, err)
+			continue
+		}
+		if !value.Equal(decimal.RequireFromString(test.want)) {
+			t.Errorf("scanMoney(%v) = %s, want %s", test.src, value.String(), test.want)
+		}
+	}
+}
+
+// A balance with three decimal places is schema drift, GetUser fails instead of returning it
+func TestGetUserRejectsExcessScale(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery(userSQL(false)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "nickname"}).AddRow(1, "9999.999", "Bob"))
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if user, err := GetUser(ctx, conn, 1); err == nil {
+		t.Errorf("got the user %+v, want an error for the excess scale", user)
+	}
+}
+
+// useRounding sets moneyRounding to mode during the test
+func useRounding(tb testing.TB, mode RoundingMode) {
+	defaultRounding := moneyRounding
+	moneyRounding = mode
+	tb.Cleanup(func() {
+		moneyRounding = defaultRounding
+	})
+}
+
+func TestRoundMoneyOnBoundary(t *testing.T) {
+	tests := []struct {
+		value    string
+		halfUp   string
+		halfEven string
+	}{
+		{"0.125", "0.13", "0.12"},
+		{"0.135", "0.14", "0.14"},
+		{"2.665", "2.67", "2.66"},
+		{"-0.125", "-0.13", "-0.12"},
+		{"0.1251", "0.13", "0.13"},
+		{"0.124", "0.12", "0.12"},
+	}
+
+	for _, test := range tests {
+		for mode, want := range map[RoundingMode]string{RoundHalfUp: test.halfUp, RoundHalfEven: test.halfEven} {
+			useRounding(t, mode)
+			if got := roundMoney(decimal.RequireFromString(test.value)); !got.Equal(decimal.RequireFromString(want)) {
+				t.Errorf("%s rounds %s to %s, want %s", mode, test.value, got.String(), want)
+			}
+		}
+	}
+}
+
+// The average order value on the boundary, 0.125, rounds by -rounding
+func TestAverageOrderValueRounding(t *testing.T) {
+	averageSQL := "SELECT o.`user_id`, AVG(o.`quality` * COALESCE(o.`unit_price`, b.`price`)) FROM `orders` o " +
+		"JOIN `books` b ON o.`book_id` = b.`id` GROUP BY o.`user_id`"
+	for _, test := range []struct {
+		rounding string
+		want     string
+	}{{"half-up", "0.13"}, {"half-even", "0.12"}} {
+		useRounding(t, moneyRounding)
+		if err := (roundingFlag{}).Set(test.rounding); err != nil {
+			t.Fatal(err)
+		}
+
+		db, mock := newMock(t)
+		mock.ExpectQuery(averageSQL).WillReturnRows(sqlmock.NewRows([]string{"user_id", "average"}).AddRow(1, "0.125000"))
+		averages, err := AverageOrderValue(context.Background(), db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !averages[1].Equal(decimal.RequireFromString(test.want)) {
+			t.Errorf("-rounding %s: got the average %s, want %s", test.rounding, averages[1].String(), test.want)
+		}
+	}
+
+	if err := (roundingFlag{}).Set("up"); err == nil {
+		t.Error("-rounding up is accepted")
+	}
+}
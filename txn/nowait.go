@@ -0,0 +1,128 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/shopspring/decimal"
+)
+
+// buyPessimisticNoWait is buyPessimistic for an interactive checkout: the book is locked by FOR UPDATE NOWAIT,
+// so a book locked by another buyer fails at once with ErrRowLocked instead of waiting for the lock.
+// The artificial delay comes after the lock here, the buyer holds the book like a checkout page does.
+// ErrRowLocked isn't retried, the user is told to try again
+func buyPessimisticNoWait(ctx context.Context, db *sql.DB, options PurchaseOptions, goroutineID, orderID, bookID, userID, amount int) (PurchaseResult, error) {
+	txnComment := fmt.Sprintf("/* nowait txn %d */ ", goroutineID)
+	if goroutineID != 1 {
+		txnComment = "\t" + txnComment
+	}
+
+	logger.Infof("\nuser %d try to buy %d books(id: %d) without waiting for the lock", userID, amount, bookID)
+	if err := options.checkQuantity(amount); err != nil {
+		logger.Errorf("reject the order: %+v", err)
+		return PurchaseResult{}, err
+	}
+	if err := waitBuying(ctx); err != nil {
+		logger.Errorf("reject the order: %+v", err)
+		return PurchaseResult{}, err
+	}
+	orderID, err := allocOrderID(ctx, db, options.SequenceOrderNo, options.orderIDFor(orderID))
+	if err != nil {
+		logger.Errorf("reject the order: %+v", err)
+		return PurchaseResult{}, err
+	}
+
+	result := PurchaseResult{BookID: bookID, UserID: userID, Amount: amount}
+	err = runTxn(ctx, db, false, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		books, users := NewBookRepo(conn), NewUserRepo(conn)
+
+		book, err := GetBookForUpdateNoWait(ctx, conn, bookID)
+		if err != nil {
+			return err
+		}
+		logger.Infof("%s%s successful", txnComment, bookForUpdateWaitSQL(0))
+
+		if err = artificialDelay(ctx, options.Delay); err != nil {
+			return err
+		}
+
+		updated, err := books.UpdateStock(ctx, bookID, amount)
+		if err != nil {
+			return err
+		}
+		logger.Infof("%s%s successful", txnComment, updateStockSQL())
+		if !updated {
+			return ErrStockInsufficient
+		}
+		if err = reachStep(ctx, StepUpdateStock); err != nil {
+			return err
+		}
+
+		order := Order{ID: orderID, BookID: bookID, UserID: userID, Quality: amount, UnitPrice: decimal.NewNullDecimal(book.Price)}
+		if result.OrderID, err = NewOrderRepo(conn).CreateOrder(ctx, order); err != nil {
+			return err
+		}
+		logger.Infof("%s%s successful (id: %d)", txnComment, insertOrderSQL(), result.OrderID)
+		if err = reachStep(ctx, StepInsertOrder); err != nil {
+			return err
+		}
+
+		result.Cost = book.Price.Mul(decimal.NewFromInt(int64(amount)))
+		debited, err := users.DebitBalance(ctx, userID, result.Cost)
+		if err != nil {
+			return err
+		}
+		logger.Infof("%s%s successful", txnComment, debitBalanceSQL())
+		if !debited {
+			return ErrBalanceInsufficient
+		}
+		return reachStep(ctx, StepUpdateUser)
+	}, append([]TxnOption{WithMaxRetries(0), WithPurchase(bookID, userID, amount)}, options.txnOptions()...)...)
+	if err != nil {
+		return PurchaseResult{}, err
+	}
+	return result, nil
+}
+
+// checkoutsWithoutWaiting runs two buyPessimisticNoWait of the demo book at the same time,
+// the buyer which doesn't get the lock fails fast with ErrRowLocked while the other one holds it
+func checkoutsWithoutWaiting(ctx context.Context, db *sql.DB, options PurchaseOptions, alice, bob int) error {
+	wg, errs := sync.WaitGroup{}, make([]error, 2)
+	for i, amount := range []int{bob, alice} {
+		wg.Add(1)
+		go func(i, amount int) {
+			defer wg.Done()
+			_, errs[i] = buyPessimisticNoWait(ctx, db, options, i+1, 1000+i, 1, i+1, amount)
+		}(i, amount)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			fmt.Printf("checkout of user %d committed\n", i+1)
+		case errors.Is(err, ErrRowLocked):
+			fmt.Printf("checkout of user %d failed fast: %s\n", i+1, describeBuyError(err))
+		default:
+			return err
+		}
+	}
+	return nil
+}
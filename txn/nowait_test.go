@@ -0,0 +1,177 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestBookForUpdateWaitSQL(t *testing.T) {
+	if query := bookForUpdateWaitSQL(0); query != bookSQL(false)+" FOR UPDATE NOWAIT" {
+		t.Errorf("got %s without a wait", query)
+	}
+	if query := bookForUpdateWaitSQL(3); query != bookSQL(false)+" FOR UPDATE WAIT 3" {
+		t.Errorf("got %s of a 3 seconds wait", query)
+	}
+}
+
+// A NOWAIT denial of the server is returned as ErrRowLocked
+func TestGetBookForUpdateNoWaitLocked(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery(bookForUpdateWaitSQL(0)).WithArgs(1).WillReturnError(&mysql.MySQLError{
+		Number: uint16(ErrLockNoWait), Message: "Lock(s) could not be acquired immediately and NOWAIT is set."})
+
+	if _, err := GetBookForUpdateNoWait(context.Background(), conn, 1); !errors.Is(err, ErrRowLocked) {
+		t.Errorf("got %v, want ErrRowLocked", err)
+	}
+}
+
+// A lock wait timeout of FOR UPDATE WAIT n is returned as ErrRowLocked, a wait which isn't positive is rejected
+func TestGetBookForUpdateWait(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery(bookForUpdateWaitSQL(2)).WithArgs(1).WillReturnError(&mysql.MySQLError{
+		Number: uint16(ErrLockWaitTimeout), Message: "Lock wait timeout exceeded; try restarting transaction"})
+
+	if _, err := GetBookForUpdateWait(context.Background(), conn, 1, 2); !errors.Is(err, ErrRowLocked) {
+		t.Errorf("got %v, want ErrRowLocked", err)
+	}
+	if _, err := GetBookForUpdateWait(context.Background(), conn, 1, 0); err == nil || errors.Is(err, ErrRowLocked) {
+		t.Errorf("got %v of a zero wait, want it rejected", err)
+	}
+}
+
+// A locked book fails the NOWAIT buy on the first attempt, it's rolled back and not retried
+func TestBuyPessimisticNoWaitNotRetried(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(bookForUpdateWaitSQL(0)).WithArgs(1).WillReturnError(&mysql.MySQLError{
+		Number: uint16(ErrLockNoWait), Message: "Lock(s) could not be acquired immediately and NOWAIT is set."})
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, err := buyPessimisticNoWait(context.Background(), db, PurchaseOptions{}, 1, 1000, 1, 1, 1)
+	if !errors.Is(err, ErrRowLocked) {
+		t.Errorf("got %v, want ErrRowLocked", err)
+	}
+	if describeBuyError(err) != "the book is being purchased by someone else, try again" {
+		t.Errorf("got the message '%s'", describeBuyError(err))
+	}
+}
+
+// The NOWAIT buy runs the options of the purchase: the steps reach the StepHook and FailAfter rolls it back
+func TestBuyPessimisticNoWaitPurchaseOptions(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(bookForUpdateWaitSQL(0)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(1, "Book 1", "Novel", time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC), "100", 10))
+	mock.ExpectExec(updateStockSQL()).WithArgs(2, 1, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertOrderSQL()).WithArgs(1, 1, 2, "100").WillReturnResult(sqlmock.NewResult(42, 1))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	var steps []string
+	options := PurchaseOptions{FailAfter: StepInsertOrder, StepHook: func(step string) { steps = append(steps, step) }}
+	_, err := buyPessimisticNoWait(context.Background(), db, options, 1, 0, 1, 1, 2)
+	if !errors.Is(err, ErrInjected) {
+		t.Errorf("got %v, want %v", err, ErrInjected)
+	}
+	if len(steps) != 2 || steps[0] != StepUpdateStock || steps[1] != StepInsertOrder {
+		t.Errorf("got the steps %v, want %s and %s", steps, StepUpdateStock, StepInsertOrder)
+	}
+}
+
+// While a transaction holds the book, NOWAIT fails at once and WAIT 1 fails after about a second
+func TestGetBookForUpdateNoWaitOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	holder, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+	if _, err = holder.ExecContext(ctx, "BEGIN PESSIMISTIC"); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.ExecContext(ctx, "ROLLBACK")
+	if _, err = GetBookForUpdate(ctx, holder, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, "BEGIN PESSIMISTIC"); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, "ROLLBACK")
+
+		start := time.Now()
+		if _, err := GetBookForUpdateNoWait(ctx, conn, 1); !errors.Is(err, ErrRowLocked) {
+			t.Errorf("got %v of NOWAIT, want ErrRowLocked", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("NOWAIT took %v", elapsed)
+		}
+
+		start = time.Now()
+		if _, err := GetBookForUpdateWait(ctx, conn, 1, 1); !errors.Is(err, ErrRowLocked) {
+			t.Errorf("got %v of WAIT 1, want ErrRowLocked", err)
+		}
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Errorf("WAIT 1 took %v, want about a second", elapsed)
+		}
+		return nil
+	})
+}
+
+// Of the two checkouts of the demo at the same time, the one which doesn't get the lock fails fast
+// while the other one holds it for the delay, so only one order is created
+func TestCheckoutsWithoutWaitingOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := checkoutsWithoutWaiting(ctx, db, PurchaseOptions{Delay: time.Second}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the checkouts took %v, a buyer waited for the lock", elapsed)
+	}
+
+	orders := 0
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM `orders`").Scan(&orders); err != nil {
+		t.Fatal(err)
+	}
+	book := Book{}
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) (err error) {
+		book, err = GetBook(ctx, conn, 1)
+		return err
+	})
+	if orders != 1 || book.Stock != initialBookStock-1 {
+		t.Errorf("got %d orders and the stock %d, want 1 and %d", orders, book.Stock, initialBookStock-1)
+	}
+}
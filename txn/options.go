@@ -0,0 +1,233 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TxnOption configures a transaction run by RunTxn
+type TxnOption func(*txnOptions)
+
+type txnOptions struct {
+	optimistic bool
+	maxRetries int // a negative value means the default of the mode
+	backoff    Backoff
+	isolation  sql.IsolationLevel
+	logger     Logger
+	hooks      TxnHooks
+	failAfter  *failAfter
+	stepHook   func(step string)
+
+	preCommitCheck TxnFunc
+
+	retryEvents       chan<- RetryEvent
+	purchase          purchaseTag
+	logMode           LogMode
+	errorSummary      *ErrorSummary
+	txnModeVariable   bool
+	planCacheDisabled bool
+	connIDs           bool
+	commitTS          bool
+
+	statementTimeout time.Duration
+	maxExecutionTime time.Duration
+	retryOnTimeout   bool
+	budget           time.Duration
+}
+
+// newTxnOptions applies opts on the defaults: a pessimistic transaction with the default isolation,
+// retried by txnBackoff, logged to the package logger and observed by txnHooks
+func newTxnOptions(opts []TxnOption) *txnOptions {
+	options := &txnOptions{
+		maxRetries: -1,
+		backoff:    txnBackoff,
+		isolation:  sql.LevelDefault,
+		logger:     logger,
+		hooks:      txnHooks,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// retries returns the max retries, retryTimes for an optimistic transaction
+// and pessimisticRetryTimes for a pessimistic one unless WithMaxRetries is given
+func (o *txnOptions) retries() int {
+	switch {
+	case o.maxRetries >= 0:
+		return o.maxRetries
+	case o.optimistic:
+		return retryTimes
+	default:
+		return pessimisticRetryTimes
+	}
+}
+
+// validate rejects the combinations TiDB doesn't run, READ COMMITTED is only for a pessimistic transaction
+func (o *txnOptions) validate() error {
+	if o.optimistic && o.isolation == sql.LevelReadCommitted {
+		return fmt.Errorf("READ COMMITTED isolation requires a pessimistic transaction")
+	}
+	if o.backoff.Cap < o.backoff.Base {
+		return fmt.Errorf("max backoff %s is below the min backoff %s", o.backoff.Cap, o.backoff.Base)
+	}
+	return nil
+}
+
+// WithOptimistic runs the transaction in optimistic mode
+func WithOptimistic() TxnOption {
+	return func(o *txnOptions) {
+		o.optimistic = true
+	}
+}
+
+// WithTxnModeVariable selects the mode by SET SESSION tidb_txn_mode and starts the transaction by a plain BEGIN,
+// as a framework which can't issue BEGIN PESSIMISTIC or BEGIN OPTIMISTIC does. The previous tidb_txn_mode
+// is restored after each attempt, even if the TxnFunc fails
+func WithTxnModeVariable() TxnOption {
+	return func(o *txnOptions) {
+		o.txnModeVariable = true
+	}
+}
+
+// WithPlanCacheDisabled turns off the prepared plan cache of the session for each attempt and reverts it afterwards,
+// it isolates a bug of a stale plan, like after a schema change. A connection which fails to revert is discarded
+func WithPlanCacheDisabled() TxnOption {
+	return func(o *txnOptions) {
+		o.planCacheDisabled = true
+	}
+}
+
+// WithMaxRetries sets the max retries on the retryable errors of the mode, zero disables the retry
+func WithMaxRetries(n int) TxnOption {
+	return func(o *txnOptions) {
+		o.maxRetries = n
+	}
+}
+
+// WithBackoff sets the base and the cap of the delay between retries, every delay is within [min, max]
+func WithBackoff(min, max time.Duration) TxnOption {
+	return func(o *txnOptions) {
+		o.backoff.Base = min
+		o.backoff.Cap = max
+	}
+}
+
+// WithMinBackoff sets the floor of the delay between retries, the first retry waits min and no jitter goes below it
+func WithMinBackoff(min time.Duration) TxnOption {
+	return func(o *txnOptions) {
+		o.backoff.Base = min
+	}
+}
+
+// WithMaxBackoff sets the ceiling of the delay between retries, the exponential growth and the jitter stop at max
+func WithMaxBackoff(max time.Duration) TxnOption {
+	return func(o *txnOptions) {
+		o.backoff.Cap = max
+	}
+}
+
+// WithPreCommitCheck runs check on the connection of the transaction after the TxnFunc succeeded, right before COMMIT,
+// like an invariant of the caller which must hold for the transaction to commit. An error or a panic of check
+// rolls back the attempt as one of the TxnFunc does, a retryable one is retried. RunTx rejects it,
+// its TxFunc runs in a *sql.Tx rather than on the connection
+func WithPreCommitCheck(check TxnFunc) TxnOption {
+	return func(o *txnOptions) {
+		o.preCommitCheck = check
+	}
+}
+
+// WithIsolation sets the isolation level of the transaction, TiDB supports sql.LevelReadCommitted
+// for a pessimistic transaction and sql.LevelRepeatableRead. It's set by SET TRANSACTION, which only applies
+// to the next transaction, so the session isolation of the pooled connection stays the same
+func WithIsolation(level sql.IsolationLevel) TxnOption {
+	return func(o *txnOptions) {
+		o.isolation = level
+	}
+}
+
+// WithLogger sends the diagnostics of the runner to l
+func WithLogger(l Logger) TxnOption {
+	return func(o *txnOptions) {
+		o.logger = l
+	}
+}
+
+// WithRetryEvents sends a RetryEvent to events on each retry, on a retryable TiDB error, a bad connection
+// or a statement timeout retried by WithRetryOnTimeout. The send never blocks,
+// the event is dropped when events is full, so a slow consumer like a live dashboard can't stall the transaction
+func WithRetryEvents(events chan<- RetryEvent) TxnOption {
+	return func(o *txnOptions) {
+		o.retryEvents = events
+	}
+}
+
+// WithPurchase tags the transaction with the buy it runs, its RetryEvents carry the book
+// and its summary line of LogSummary the book, the user and the amount. The buys set it
+func WithPurchase(bookID, userID, amount int) TxnOption {
+	return func(o *txnOptions) {
+		o.purchase = purchaseTag{bookID: bookID, userID: userID, amount: amount}
+	}
+}
+
+// WithLogMode sets how the runner logs the transaction, LogPerStatement by default
+func WithLogMode(mode LogMode) TxnOption {
+	return func(o *txnOptions) {
+		o.logMode = mode
+	}
+}
+
+// WithErrorSummary counts the error of every failed attempt and failed COMMIT in summary by ClassifyError,
+// summary may be shared by concurrent transactions
+func WithErrorSummary(summary *ErrorSummary) TxnOption {
+	return func(o *txnOptions) {
+		o.errorSummary = summary
+	}
+}
+
+// WithConnIDs records the TiDB connection id of each attempt in TxnResult.ConnIDs, it costs an extra round-trip
+// per attempt. A retry on the same connection repeats its id, a retry after a bad connection has a new one
+func WithConnIDs() TxnOption {
+	return func(o *txnOptions) {
+		o.connIDs = true
+	}
+}
+
+// WithCommitTS records the commit ts of the committed attempt in TxnResult.CommitTS, read from @@tidb_last_txn_info
+// right after COMMIT, it costs an extra round-trip. It's zero if the read fails, the transaction is committed anyway
+func WithCommitTS() TxnOption {
+	return func(o *txnOptions) {
+		o.commitTS = true
+	}
+}
+
+// isolationSQL returns the statement setting the isolation of the next transaction,
+// it's empty for sql.LevelDefault
+func isolationSQL(level sql.IsolationLevel) (string, error) {
+	switch level {
+	case sql.LevelDefault:
+		return "", nil
+	case sql.LevelReadCommitted:
+		return "SET TRANSACTION ISOLATION LEVEL READ COMMITTED", nil
+	case sql.LevelRepeatableRead:
+		return "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ", nil
+	default:
+		return "", fmt.Errorf("unsupported isolation level: %s", level)
+	}
+}
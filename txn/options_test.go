@@ -0,0 +1,240 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+var deadlockErr = &mysql.MySQLError{Number: uint16(ErrLockDeadlock), Message: "deadlock"}
+
+// The defaults run a pessimistic transaction retried pessimisticRetryTimes by txnBackoff
+func TestTxnOptionsDefaults(t *testing.T) {
+	options := newTxnOptions(nil)
+	if options.optimistic || options.isolation != sql.LevelDefault || options.retries() != pessimisticRetryTimes {
+		t.Errorf("got optimistic %t, isolation %s and %d retries, want a pessimistic one at the default isolation with %d",
+			options.optimistic, options.isolation, options.retries(), pessimisticRetryTimes)
+	}
+	if options.backoff != txnBackoff {
+		t.Errorf("got the backoff %+v, want %+v", options.backoff, txnBackoff)
+	}
+	if optimistic := newTxnOptions([]TxnOption{WithOptimistic()}); optimistic.retries() != retryTimes {
+		t.Errorf("got %d retries of an optimistic one, want %d", optimistic.retries(), retryTimes)
+	}
+}
+
+func TestRunTxnDefaultRetries(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	errs := make([]error, pessimisticRetryTimes+1)
+	for i := range errs {
+		errs[i] = deadlockErr
+		mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	result, err := RunTxn(context.Background(), db, failFirst(errs...))
+	if !errors.Is(err, ErrRetriesExhausted) || result.Attempts != pessimisticRetryTimes+1 {
+		t.Errorf("got %v after %d attempts, want the retries exhausted after %d", err, result.Attempts, pessimisticRetryTimes+1)
+	}
+}
+
+func TestWithMaxRetries(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	result, err := RunTxn(context.Background(), db, failFirst(deadlockErr), WithMaxRetries(0))
+	if !errors.Is(err, ErrRetriesExhausted) || result.Attempts != 1 {
+		t.Errorf("got %v after %d attempts, want no retry", err, result.Attempts)
+	}
+}
+
+func TestWithBackoff(t *testing.T) {
+	db, mock := newMock(t)
+	delays := noSleep(t)
+	noJitter(t)
+	failingAttempts(mock, 3)
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	conflict := &mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}
+	_, err := RunTxn(context.Background(), db, failFirst(conflict, conflict, conflict),
+		WithOptimistic(), WithBackoff(10*time.Millisecond, 30*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the floor 10ms, half of 20ms and of the cap 30ms without the jitter
+	if want := []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 15 * time.Millisecond}; !reflect.DeepEqual(*delays, want) {
+		t.Errorf("got the delays %v, want %v", *delays, want)
+	}
+}
+
+// The jitter never takes the first delay below the min of WithBackoff, whatever the max
+func TestWithBackoffFirstDelayAtLeastMin(t *testing.T) {
+	for _, max := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, time.Second} {
+		options := newTxnOptions([]TxnOption{WithBackoff(10*time.Millisecond, max)})
+		for i := 0; i < 100; i++ {
+			if delay := options.backoff.Delay(0); delay < 10*time.Millisecond {
+				t.Fatalf("got the first delay %s with the max %s, want at least the min 10ms", delay, max)
+			}
+		}
+	}
+}
+
+func TestWithBackoffRejectsMaxBelowMin(t *testing.T) {
+	db, _ := newMock(t)
+	_, err := RunTxn(context.Background(), db, failFirst(), WithBackoff(time.Second, time.Millisecond))
+	if err == nil || !strings.Contains(err.Error(), "below the min backoff") {
+		t.Errorf("got %v, want the max below the min rejected", err)
+	}
+}
+
+func TestWithIsolation(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("SET TRANSACTION ISOLATION LEVEL READ COMMITTED").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if _, err := RunTxn(context.Background(), db, failFirst(), WithIsolation(sql.LevelReadCommitted)); err != nil {
+		t.Fatal(err)
+	}
+
+	// an optimistic one can't run at READ COMMITTED, it's rejected without any statement
+	_, err := RunTxn(context.Background(), db, failFirst(), WithIsolation(sql.LevelReadCommitted), WithOptimistic())
+	if err == nil || !strings.Contains(err.Error(), "requires a pessimistic transaction") {
+		t.Errorf("got %v, want READ COMMITTED of an optimistic transaction rejected", err)
+	}
+	if _, err = RunTxn(context.Background(), db, failFirst(), WithIsolation(sql.LevelSerializable)); err == nil {
+		t.Error("SERIALIZABLE accepted")
+	}
+}
+
+// WithLogger sends the lines of the runner to its own logger instead of the package logger
+func TestWithLogger(t *testing.T) {
+	db, mock := newMock(t)
+	packageLogger := useBufferLogger(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	txnLogger := &bufferLogger{}
+	if _, err := RunTxn(context.Background(), db, failFirst(), WithLogger(txnLogger)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"begin a txn with 'BEGIN PESSIMISTIC'", "[runTxn] commit success"}; !reflect.DeepEqual(txnLogger.Lines(), want) {
+		t.Errorf("got the lines %q, want %q", txnLogger.Lines(), want)
+	}
+	if lines := packageLogger.Lines(); len(lines) != 0 {
+		t.Errorf("the package logger got %q", lines)
+	}
+}
+
+// flagTxnOptions applies -backoff, -backoff-max and -quiet-txn by WithBackoff and WithLogger,
+// runTxn only applies them when they're given
+func TestRunTxnFlagOptions(t *testing.T) {
+	db, mock := newMock(t)
+	delays := noSleep(t)
+	noJitter(t)
+	buffer := useBufferLogger(t)
+	defaultMin, defaultMax := backoffMin, backoffMax
+	backoffMin, backoffMax, quietTxn = 100*time.Millisecond, 100*time.Millisecond, true
+	defer func() {
+		backoffMin, backoffMax, quietTxn = defaultMin, defaultMax, false
+	}()
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	if err := runTxn(context.Background(), db, false, retryTimes, failFirst(deadlockErr), flagTxnOptions()...); err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Duration{100 * time.Millisecond}; !reflect.DeepEqual(*delays, want) {
+		t.Errorf("got the delays %v, want %v", *delays, want)
+	}
+	if lines := buffer.Lines(); len(lines) != 0 {
+		t.Errorf("got the lines %q with -quiet-txn, want none", lines)
+	}
+
+	*delays = nil
+	if err := runTxn(context.Background(), db, false, retryTimes, failFirst(deadlockErr)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Duration{txnBackoff.Base}; !reflect.DeepEqual(*delays, want) {
+		t.Errorf("got the delays %v without the flag options, want %v", *delays, want)
+	}
+}
+
+// flagTxnOptions turns each transaction flag into its TxnOption
+func TestFlagTxnOptions(t *testing.T) {
+	defer func() {
+		logConnectionID, logCommitTS, txnModeVariable, planCacheDisabled = false, false, false, false
+	}()
+
+	if options := newTxnOptions(flagTxnOptions()); options.connIDs || options.commitTS ||
+		options.txnModeVariable || options.planCacheDisabled {
+		t.Errorf("got %+v without any flag, want the defaults", options)
+	}
+
+	logConnectionID, logCommitTS, txnModeVariable, planCacheDisabled = true, true, true, true
+	if options := newTxnOptions(flagTxnOptions()); !options.connIDs || !options.commitTS ||
+		!options.txnModeVariable || !options.planCacheDisabled {
+		t.Errorf("got %+v with -conn-id, -commit-ts, -txn-mode-variable and -no-plan-cache, want all of them", options)
+	}
+}
+
+// The runner logs the retryable error of the first attempt before the commit of the retry
+func TestRunTxnLogsRetryBeforeCommit(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	buffer := useBufferLogger(t)
+	useLogMode(t, LogPerStatement)
+
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN OPTIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	conflict := &mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}
+	if err := runTxn(context.Background(), db, true, retryTimes, failFirst(conflict)); err != nil {
+		t.Fatal(err)
+	}
+
+	retried, committed := -1, -1
+	for i, line := range buffer.Lines() {
+		switch {
+		case strings.Contains(line, "got a retryable error"):
+			retried = i
+		case strings.Contains(line, "commit success"):
+			committed = i
+		}
+	}
+	if retried < 0 || committed < retried {
+		t.Errorf("got the lines %q, want the retryable error before the commit success", buffer.Lines())
+	}
+}
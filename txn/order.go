@@ -0,0 +1,75 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// cancelOrder cancels an order in a pessimistic transaction of opts: it puts the books back to the stock,
+// refunds the unit price paid at the buy times the quality to the user and deletes the order.
+// An order without a unit price, inserted before the column existed, is refunded at the current price.
+// A missing order, including one already cancelled, returns ErrOrderNotFound before touching the stock or the balance
+func cancelOrder(ctx context.Context, db *sql.DB, orderID int, opts ...TxnOption) error {
+	logger.Infof("\ncancel order %d", orderID)
+
+	return runTxn(ctx, db, false, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		books, users, orders := NewBookRepo(conn), NewUserRepo(conn), NewOrderRepo(conn)
+
+		// lock the order first, a concurrent cancel of the same order waits here and then finds it deleted
+		order, err := orders.GetForUpdate(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		logger.Infof("%s successful", orderForUpdateSQL())
+
+		book, err := books.GetForUpdate(ctx, order.BookID)
+		if err != nil {
+			return err
+		}
+		logger.Infof("%s successful", bookSQL(true))
+
+		if _, err = books.AddStock(ctx, order.BookID, order.Quality); err != nil {
+			return err
+		}
+		logger.Infof("%s successful", addStockSQL())
+
+		unitPrice := book.Price
+		if order.UnitPrice.Valid {
+			unitPrice = order.UnitPrice.Decimal
+		}
+		refund := unitPrice.Mul(decimal.NewFromInt(int64(order.Quality)))
+		credited, err := users.CreditBalance(ctx, order.UserID, refund)
+		if err != nil {
+			return err
+		}
+		logger.Infof("%s successful", creditBalanceSQL())
+
+		if !credited {
+			return fmt.Errorf("refund order %d: user %d: %w", orderID, order.UserID, ErrUserNotFound)
+		}
+
+		if err = orders.Delete(ctx, orderID); err != nil {
+			return err
+		}
+		logger.Infof("%s successful", deleteOrderSQL())
+
+		return nil
+	}, opts...)
+}
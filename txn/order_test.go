@@ -0,0 +1,121 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+// A missing order is rejected before the stock or the balance is touched, the transaction is rolled back
+func TestCancelOrderNotFound(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(orderForUpdateSQL()).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "book_id", "user_id", "quality", "ordered_at", "unit_price"}))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := cancelOrder(context.Background(), db, 7); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("got %v, want %v", err, ErrOrderNotFound)
+	}
+}
+
+// cancelOrder locks the order and the book, puts the books back, refunds the unit price of the order,
+// or the current price of an order without one, and deletes the order
+func TestCancelOrderRefund(t *testing.T) {
+	orderedAt := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name      string
+		unitPrice interface{}
+		refund    string
+	}{
+		{"unit price", "80", "160"},
+		{"no unit price", nil, "200"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMock(t)
+			mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(orderForUpdateSQL()).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "book_id", "user_id", "quality", "ordered_at", "unit_price"}).
+					AddRow(7, 1, 2, 2, orderedAt, test.unitPrice))
+			mock.ExpectQuery(bookSQL(true)).WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+					AddRow(1, "Book 1", "Novel", orderedAt, "100", 8))
+			mock.ExpectExec(addStockSQL()).WithArgs(2, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(creditBalanceSQL()).WithArgs(test.refund, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(deleteOrderSQL()).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+			if err := cancelOrder(context.Background(), db, 7); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// A price change after the buy doesn't change the refund, cancelOrder credits the unit price stored on the order.
+// Cancelling the order of 2 at 100 leaves the order of 1 at 100 debited
+func TestCancelOrderRefundsUnitPriceOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []int{2, 1} {
+		if _, err := buyPessimistic(ctx, db, PurchaseOptions{}, 0, 0, 1, 1, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustExec(t, db, columnSQL("UPDATE `books` SET {price} = 150 WHERE `id` = 1"))
+	if err := verifyState(ctx, db); err != nil {
+		t.Fatalf("after the price change: %v", err)
+	}
+
+	var orders []Order
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		var err error
+		orders, err = ListOrdersByUser(ctx, conn, 1)
+		return err
+	})
+	if len(orders) != 2 {
+		t.Fatalf("got %d orders, want 2", len(orders))
+	}
+	cancelled := orders[0]
+	if cancelled.Quality != 2 {
+		cancelled = orders[1]
+	}
+	if err := cancelOrder(ctx, db, cancelled.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{}
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		var err error
+		user, err = NewUserRepo(conn).Get(ctx, 1)
+		return err
+	})
+	if want := initialBalance.Sub(decimal.NewFromInt(100)); !user.Balance.Equal(want) {
+		t.Errorf("got the balance %s after the refund, want %s", user.Balance, want)
+	}
+	if err := verifyState(ctx, db); err != nil {
+		t.Error(err)
+	}
+}
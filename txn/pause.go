@@ -0,0 +1,97 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrBuyingPaused is returned by the buys while paused if failFastWhenPaused is set
+var ErrBuyingPaused = errors.New("buying is paused")
+
+var (
+	pauseMu   sync.Mutex
+	pauseCond = sync.NewCond(&pauseMu)
+	paused    bool
+
+	// failFastWhenPaused makes the buys fail with ErrBuyingPaused instead of blocking until resumed
+	failFastWhenPaused = false
+)
+
+// PauseBuying pauses all the buys of this process, the running transactions are not affected
+func PauseBuying() {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	paused = true
+}
+
+// ResumeBuying resumes the buys, wakes up all the blocked ones
+func ResumeBuying() {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	paused = false
+	pauseCond.Broadcast()
+}
+
+// togglePause pauses the buys if they run, otherwise resumes them, and returns whether they are paused now
+func togglePause() bool {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	paused = !paused
+	if !paused {
+		pauseCond.Broadcast()
+	}
+	return paused
+}
+
+// waitBuying blocks while buying is paused, until it's resumed or ctx is done
+func waitBuying(ctx context.Context) error {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+
+	if !paused {
+		return nil
+	}
+	if failFastWhenPaused {
+		return &CancelError{reason: CancelReasonPaused, err: ErrBuyingPaused}
+	}
+
+	// wake up the waiting below when ctx is done, sync.Cond can't wait on a channel
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pauseMu.Lock()
+			pauseCond.Broadcast()
+			pauseMu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	for paused {
+		if err := ctx.Err(); err != nil {
+			return contextCancelError(err)
+		}
+		pauseCond.Wait()
+	}
+
+	return nil
+}
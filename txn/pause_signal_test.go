@@ -0,0 +1,63 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Each SIGUSR1 toggles the buys, the first one pauses and the second one resumes
+func TestWatchPauseSignal(t *testing.T) {
+	defer ResumeBuying()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a SIGUSR1 nobody is notified of kills the process, this keeps the test alive until the watcher is notified
+	caught := make(chan os.Signal, 2)
+	signal.Notify(caught, syscall.SIGUSR1)
+	defer signal.Stop(caught)
+
+	toggled := make(chan bool)
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		watchPauseSignal(ctx, func(paused bool) { toggled <- paused })
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	for _, want := range []bool{true, false} {
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case paused := <-toggled:
+			if paused != want {
+				t.Errorf("got paused %t by the signal, want %t", paused, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the signal toggled nothing")
+		}
+	}
+
+	cancel()
+	<-watching
+}
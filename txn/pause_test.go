@@ -0,0 +1,120 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// pauseForTest pauses the buys and resumes them when the test ends
+func pauseForTest(tb testing.TB) {
+	PauseBuying()
+	tb.Cleanup(ResumeBuying)
+}
+
+func TestWaitBuyingBlocksUntilResumed(t *testing.T) {
+	pauseForTest(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- waitBuying(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("got %v while paused, want it blocked", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ResumeBuying()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got %v after resumed, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still blocked after resumed")
+	}
+}
+
+func TestWaitBuyingRespectsContext(t *testing.T) {
+	pauseForTest(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := waitBuying(ctx)
+	var cancelErr *CancelError
+	if !errors.As(err, &cancelErr) || cancelErr.Reason() != CancelReasonTimeout {
+		t.Errorf("got %v, want a CancelError of the timeout", err)
+	}
+}
+
+func TestWaitBuyingFailsFast(t *testing.T) {
+	pauseForTest(t)
+	failFastWhenPaused = true
+	defer func() {
+		failFastWhenPaused = false
+	}()
+
+	if err := waitBuying(context.Background()); !errors.Is(err, ErrBuyingPaused) {
+		t.Errorf("got %v, want ErrBuyingPaused", err)
+	}
+}
+
+func TestTogglePause(t *testing.T) {
+	defer ResumeBuying()
+	if !togglePause() {
+		t.Error("the first toggle didn't pause")
+	}
+	if togglePause() {
+		t.Error("the second toggle didn't resume")
+	}
+}
+
+// A buy started while paused waits, then completes after the resume
+func TestPausedBuyCompletesAfterResumeOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	pauseForTest(t)
+	done := make(chan error, 1)
+	go func() {
+		_, err := buyPessimistic(ctx, db, noDelay(), 1, 0, 1, 2, 1)
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := assertCommitted(ctx, db, 1, initialBookStock); err != nil {
+		t.Fatalf("the buy ran while paused: %v", err)
+	}
+
+	ResumeBuying()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the buy is still blocked after resumed")
+	}
+	if err := assertCommitted(ctx, db, 1, initialBookStock-1); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+)
+
+// WatchPoolSaturation polls db.Stats() every interval and calls onSaturated when
+// the pool had to wait for a connection or all the connections are in use
+func WatchPoolSaturation(ctx context.Context, db *sql.DB, interval time.Duration, onSaturated func(sql.DBStats)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastWaitCount := db.Stats().WaitCount
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := db.Stats()
+			waited := stats.WaitCount > lastWaitCount
+			full := stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections
+			lastWaitCount = stats.WaitCount
+
+			if waited || full {
+				onSaturated(stats)
+			}
+		}
+	}
+}
+
+// AvailableSlots returns how many more connections can be in use before the pool is exhausted,
+// math.MaxInt32 if the pool is unlimited
+func AvailableSlots(db *sql.DB) int {
+	stats := db.Stats()
+	if stats.MaxOpenConnections <= 0 {
+		return math.MaxInt32
+	}
+
+	if available := stats.MaxOpenConnections - stats.InUse; available > 0 {
+		return available
+	}
+	return 0
+}
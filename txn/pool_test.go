@@ -0,0 +1,103 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"testing"
+	"time"
+)
+
+// A pool of one connection held by the test is saturated, the watcher must call back until it's canceled
+func TestWatchPoolSaturationFiresOnTinyPool(t *testing.T) {
+	db, _ := newMock(t)
+	db.SetMaxOpenConns(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	saturated, done := make(chan sql.DBStats, 1), make(chan struct{})
+	go func() {
+		defer close(done)
+		WatchPoolSaturation(ctx, db, time.Millisecond, func(stats sql.DBStats) {
+			select {
+			case saturated <- stats:
+			default:
+			}
+		})
+	}()
+
+	select {
+	case stats := <-saturated:
+		if stats.InUse != 1 || stats.MaxOpenConnections != 1 {
+			t.Errorf("got %d of max %d in use, want 1 of max 1", stats.InUse, stats.MaxOpenConnections)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the saturated pool isn't reported")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the watcher doesn't stop on cancel")
+	}
+}
+
+// A pool with a free connection and no waits isn't saturated
+func TestWatchPoolSaturationQuietOnIdlePool(t *testing.T) {
+	db, _ := newMock(t)
+	db.SetMaxOpenConns(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	WatchPoolSaturation(ctx, db, time.Millisecond, func(sql.DBStats) {
+		calls++
+	})
+	if calls != 0 {
+		t.Errorf("the idle pool is reported saturated %d times", calls)
+	}
+}
+
+func TestAvailableSlots(t *testing.T) {
+	db, _ := newMock(t)
+	if slots := AvailableSlots(db); slots != math.MaxInt32 {
+		t.Errorf("got %d slots of an unlimited pool, want math.MaxInt32", slots)
+	}
+
+	db.SetMaxOpenConns(3)
+	ctx := context.Background()
+	for inUse, want := range []int{3, 2, 1, 0} {
+		if slots := AvailableSlots(db); slots != want {
+			t.Errorf("got %d slots with %d of 3 in use, want %d", slots, inUse, want)
+		}
+		if inUse == 3 {
+			break
+		}
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// PurchaseOptions configure a buy, defaultPurchaseOptions are the ones of the tutorial
+type PurchaseOptions struct {
+	// Delay is the artificial delay at the start of the transaction, it makes the concurrent buyers overlap
+	// so the tutorial shows the lock waits and the conflicts. Zero removes it for a deterministic or a throughput run
+	Delay time.Duration
+	// StepHook is called each time the transaction reaches a step, see WithStepHook. Nil disables it
+	StepHook func(step string)
+	// FailAfter makes the transaction fail right after a step, see WithFailAfter. Empty disables it
+	FailAfter string
+	FailPanic bool // FailAfter panics instead of returning ErrInjected
+
+	// ExplicitOrderID inserts the order ids given by the callers, as the old tutorial does,
+	// instead of the AUTO_RANDOM ones generated by TiDB
+	ExplicitOrderID bool
+	// SequenceOrderNo takes the order ids from orderNoSequence, it wins over ExplicitOrderID
+	SequenceOrderNo bool
+	MaxQuantity     int // caps the amount of one order, zero means no cap
+	RetryTimes      int // max retries of an optimistic buy
+
+	Txn []TxnOption // more options of the transaction, applied after the ones above
+}
+
+func defaultPurchaseOptions() PurchaseOptions {
+	return PurchaseOptions{Delay: time.Second, RetryTimes: retryTimes}
+}
+
+// validate rejects the options no buy can run with
+func (o PurchaseOptions) validate() error {
+	return validateFailStep(o.FailAfter)
+}
+
+// orderIDFor returns the order id a buy inserts, zero for a generated one unless ExplicitOrderID is set
+func (o PurchaseOptions) orderIDFor(orderID int) int {
+	if o.ExplicitOrderID {
+		return orderID
+	}
+	return 0
+}
+
+// checkQuantity rejects a non-positive amount or amount above MaxQuantity before any lock is taken
+func (o PurchaseOptions) checkQuantity(amount int) error {
+	if amount <= 0 {
+		return fmt.Errorf("%w, got %d", ErrInvalidAmount, amount)
+	}
+	if o.MaxQuantity > 0 && amount > o.MaxQuantity {
+		return &QuantityExceededError{Amount: amount, Max: o.MaxQuantity}
+	}
+
+	return nil
+}
+
+// txnOptions returns the options of the transaction of a buy
+func (o PurchaseOptions) txnOptions() []TxnOption {
+	var opts []TxnOption
+	if o.FailAfter != "" {
+		opts = append(opts, WithFailAfter(o.FailAfter, o.FailPanic))
+	}
+	if o.StepHook != nil {
+		opts = append(opts, WithStepHook(o.StepHook))
+	}
+	return append(opts, o.Txn...)
+}
+
+// registerPurchaseFlags registers the flags of options on fs, the values of options are the defaults
+func registerPurchaseFlags(fs *flag.FlagSet, options *PurchaseOptions) {
+	fs.DurationVar(&options.Delay, "delay", options.Delay, "artificial delay at the start of a buy to overlap the buyers, 0 disables it")
+	fs.StringVar(&options.FailAfter, "fail-after", options.FailAfter,
+		"fail the buys after update-stock, insert-order or update-user to show the rollback, empty disables it")
+	fs.BoolVar(&options.FailPanic, "fail-panic", options.FailPanic, "make -fail-after panic instead of returning an error")
+	fs.BoolVar(&options.ExplicitOrderID, "explicit-order-id", options.ExplicitOrderID,
+		"insert the order ids given by the caller as the old tutorial instead of the generated ones")
+	fs.BoolVar(&options.SequenceOrderNo, "sequence-order-id", options.SequenceOrderNo,
+		"take the order ids of the buys from the sequence seq_order_no, created if missing")
+	fs.IntVar(&options.MaxQuantity, "max-quantity", options.MaxQuantity, "max amount of books per order, 0 means no cap")
+	fs.IntVar(&options.RetryTimes, "retry-times", options.RetryTimes, "max retries of an optimistic buy")
+}
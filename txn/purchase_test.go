@@ -0,0 +1,91 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// An amount above MaxQuantity is rejected by every buy path before any statement, the mock expects none
+func TestMaxQuantityRejectsWithoutSQL(t *testing.T) {
+	options := noDelay()
+	options.MaxQuantity = 3
+
+	buys := map[string]func(ctx context.Context, db *sql.DB) error{
+		"optimistic": func(ctx context.Context, db *sql.DB) error {
+			_, err := buyOptimistic(ctx, db, options, 1, 0, 1, 2, 4)
+			return err
+		},
+		"pessimistic": func(ctx context.Context, db *sql.DB) error {
+			_, err := buyPessimistic(ctx, db, options, 1, 0, 1, 2, 4)
+			return err
+		},
+		"nowait": func(ctx context.Context, db *sql.DB) error {
+			_, err := buyPessimisticNoWait(ctx, db, options, 1, 0, 1, 2, 4)
+			return err
+		},
+		// two items of one book add up above the cap
+		"cart": func(ctx context.Context, db *sql.DB) error {
+			return buyCart(ctx, db, options, 0, 2, []CartItem{{BookID: 1, Amount: 2}, {BookID: 1, Amount: 2}})
+		},
+	}
+	for name, buy := range buys {
+		t.Run(name, func(t *testing.T) {
+			db, _ := newMock(t)
+			err := buy(context.Background(), db)
+			quantityErr := &QuantityExceededError{}
+			if !errors.As(err, &quantityErr) || quantityErr.Amount != 4 || quantityErr.Max != 3 {
+				t.Errorf("got %v, want a QuantityExceededError of 4 over 3", err)
+			}
+		})
+	}
+}
+
+func TestMaxQuantityAllowsTheCap(t *testing.T) {
+	options := PurchaseOptions{MaxQuantity: 3}
+	if err := options.checkQuantity(3); err != nil {
+		t.Errorf("got %v at the cap, want it allowed", err)
+	}
+	if err := (PurchaseOptions{}).checkQuantity(1000); err != nil {
+		t.Errorf("got %v without a cap, want it allowed", err)
+	}
+	if err := options.checkQuantity(0); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("got %v of a zero amount, want ErrInvalidAmount", err)
+	}
+}
+
+func TestMaxQuantityOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	options := noDelay()
+	options.MaxQuantity = 3
+	quantityErr := &QuantityExceededError{}
+	if _, err := buyPessimistic(ctx, db, options, 1, 0, 1, 2, 4); !errors.As(err, &quantityErr) {
+		t.Fatalf("got %v, want a QuantityExceededError", err)
+	}
+	if err := assertCommitted(ctx, db, 1, initialBookStock); err != nil {
+		t.Error(err)
+	}
+	if err := CheckUserConsistency(ctx, db, 2); err != nil {
+		t.Error(err)
+	}
+}
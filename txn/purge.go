@@ -0,0 +1,90 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PurgeResult is the outcome of purgeOrders
+type PurgeResult struct {
+	Deleted int
+	Batches int
+}
+
+// purgeOrdersSQL deletes a batch of the orders ordered before a cutoff, found by `orders_ordered_at_idx`
+func purgeOrdersSQL() string {
+	return "DELETE FROM `orders` WHERE `ordered_at` < ? LIMIT ?"
+}
+
+// purgeCutoff returns the time the given days ago by the clock of TiDB, the one `ordered_at` defaults to,
+// so a skewed client clock can't purge recent orders
+func purgeCutoff(ctx context.Context, db *sql.DB, days int) (time.Time, error) {
+	if days < 0 {
+		return time.Time{}, fmt.Errorf("days must not be negative, got %d", days)
+	}
+
+	cutoff := time.Time{}
+	err := db.QueryRowContext(ctx, "SELECT NOW() - INTERVAL ? DAY", days).Scan(&cutoff)
+	return cutoff, err
+}
+
+// purgeOrders deletes the orders ordered earlier than before batchSize rows at a time, each batch in its own transaction
+// of opts, so no transaction grows beyond the size limit of TiDB. It stops after a batch deleting
+// fewer rows than batchSize, and pauses between the batches to limit the write pressure if pause is positive.
+// The result counts the batches committed, it's returned with the error of a failed batch or of ctx
+func purgeOrders(ctx context.Context, db *sql.DB, before time.Time, batchSize int, pause time.Duration, opts ...TxnOption) (PurgeResult, error) {
+	if batchSize <= 0 {
+		return PurgeResult{}, fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+	if before.IsZero() {
+		return PurgeResult{}, fmt.Errorf("the cutoff of the purge is missing")
+	}
+
+	result := PurgeResult{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, contextCancelError(err)
+		}
+
+		deleted := 0
+		err := runTxn(ctx, db, false, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+			res, err := execResult(ctx, conn, purgeOrdersSQL(), before, batchSize)
+			if err != nil {
+				return err
+			}
+			affected, err := res.RowsAffected()
+			deleted = int(affected)
+			return err
+		}, opts...)
+		if err != nil {
+			return result, err
+		}
+
+		result.Deleted += deleted
+		result.Batches++
+		logger.Infof("purge batch %d deleted %d orders, %d in total", result.Batches, deleted, result.Deleted)
+
+		if deleted < batchSize {
+			return result, nil
+		}
+		if err = artificialDelay(ctx, pause); err != nil {
+			return result, err
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// purgeBefore is the cutoff of the sqlmock purges
+var purgeBefore = time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// expectPurgeBatch expects a purge batch of batchSize orders ordered before the cutoff deleting affected of them
+func expectPurgeBatch(mock sqlmock.Sqlmock, before time.Time, batchSize int, affected int64) {
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(purgeOrdersSQL()).WithArgs(before, batchSize).WillReturnResult(sqlmock.NewResult(0, affected))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// The purge stops after the first batch deleting fewer orders than the batch size
+func TestPurgeOrdersBatches(t *testing.T) {
+	db, mock := newMock(t)
+	expectPurgeBatch(mock, purgeBefore, 2, 2)
+	expectPurgeBatch(mock, purgeBefore, 2, 2)
+	expectPurgeBatch(mock, purgeBefore, 2, 1)
+
+	result, err := purgeOrders(context.Background(), db, purgeBefore, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (PurgeResult{Deleted: 5, Batches: 3}) {
+		t.Errorf("got %+v, want 5 orders in 3 batches", result)
+	}
+}
+
+func TestPurgeOrdersInvalidOptions(t *testing.T) {
+	db, _ := newMock(t)
+	for _, test := range []struct {
+		before    time.Time
+		batchSize int
+	}{{purgeBefore, 0}, {purgeBefore, -1}, {time.Time{}, 10}} {
+		if _, err := purgeOrders(context.Background(), db, test.before, test.batchSize, 0); err == nil {
+			t.Errorf("the cutoff %s in batches of %d is accepted", test.before, test.batchSize)
+		}
+	}
+	if _, err := purgeCutoff(context.Background(), db, -1); err == nil {
+		t.Error("-1 days accepted")
+	}
+}
+
+// The cutoff is taken from the clock of TiDB
+func TestPurgeCutoff(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery("SELECT NOW() - INTERVAL ? DAY").WithArgs(30).
+		WillReturnRows(sqlmock.NewRows([]string{"cutoff"}).AddRow(purgeBefore))
+
+	cutoff, err := purgeCutoff(context.Background(), db, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cutoff.Equal(purgeBefore) {
+		t.Errorf("got the cutoff %s, want %s", cutoff, purgeBefore)
+	}
+}
+
+// A context canceled during the pause stops the purge before the next batch, the committed one is counted
+func TestPurgeOrdersCanceledBetweenBatches(t *testing.T) {
+	db, mock := newMock(t)
+	expectPurgeBatch(mock, purgeBefore, 2, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	result, err := purgeOrders(ctx, db, purgeBefore, 2, time.Hour)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the cancellation", err)
+	}
+	if result != (PurgeResult{Deleted: 2, Batches: 1}) {
+		t.Errorf("got %+v, want 2 orders in 1 batch", result)
+	}
+}
+
+// Of 3000 orders ordered 0 to 9 days and an hour ago, the purge of the ones older than 5 days
+// deletes exactly the 1500 ordered 5 days ago or earlier, in batches of 500
+func TestPurgeOrdersOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	const orders, days, batchSize = 3000, 5, 500
+	kept := []string{}
+	for start := 0; start < orders; start += batchSize {
+		values, args := []string{}, []interface{}{}
+		for i := start; i < start+batchSize; i++ {
+			key, hours := fmt.Sprintf("purge-%d", i), i%10*24+1
+			values = append(values, "(1, 1, 1, NOW() - INTERVAL ? HOUR, ?)")
+			args = append(args, hours, key)
+			if i%10 < days {
+				kept = append(kept, key)
+			}
+		}
+		mustExec(t, db, "INSERT INTO `orders` (`book_id`, `user_id`, `quality`, `ordered_at`, `idempotency_key`) VALUES "+
+			strings.Join(values, ", "), args...)
+	}
+
+	before, err := purgeCutoff(ctx, db, days)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := purgeOrders(ctx, db, before, batchSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last batch deletes nothing, the ones before it are full
+	if result != (PurgeResult{Deleted: orders - len(kept), Batches: (orders-len(kept))/batchSize + 1}) {
+		t.Errorf("got %+v, want %d orders in %d batches", result, orders-len(kept), (orders-len(kept))/batchSize+1)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT `idempotency_key` FROM `orders` ORDER BY `idempotency_key`")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	remaining := []string{}
+	for rows.Next() {
+		key := ""
+		if err := rows.Scan(&key); err != nil {
+			t.Fatal(err)
+		}
+		remaining = append(remaining, key)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(kept)
+	if strings.Join(remaining, ",") != strings.Join(kept, ",") {
+		t.Errorf("%d orders remain, want the %d ordered less than %d days ago", len(remaining), len(kept), days)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// bookSQL selects a book by id, FOR UPDATE locks it in a pessimistic transaction
+func bookSQL(forUpdate bool) string {
+	query := columnSQL("SELECT `id`, {title}, {type}, {published_at}, {price}, {stock} FROM `books` WHERE `id` = ?")
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	return query
+}
+
+func getBook(ctx context.Context, conn *sql.Conn, id int, forUpdate bool) (Book, error) {
+	book, stock := Book{}, sql.NullInt64{}
+	stmtCtx, cancel := statementContext(ctx)
+	defer cancel()
+	err := conn.QueryRowContext(stmtCtx, limitedSQL(ctx, bookSQL(forUpdate)), id).Scan(
+		&book.ID, &book.Title, &book.Type, &book.PublishedAt, moneyOrZero(&book.Price), &stock)
+	if err == sql.ErrNoRows {
+		return Book{}, fmt.Errorf("book %d: %w", id, ErrBookNotFound)
+	}
+	if err != nil {
+		return Book{}, err
+	}
+
+	// stock and price are nullable, NULL is read as their default zero
+	book.Stock = int(stock.Int64)
+	return book, nil
+}
+
+// GetBook reads a book, it returns ErrBookNotFound if the book doesn't exist
+func GetBook(ctx context.Context, conn *sql.Conn, id int) (Book, error) {
+	return getBook(ctx, conn, id, false)
+}
+
+// GetBookForUpdate is GetBook which locks the book until the transaction ends
+func GetBookForUpdate(ctx context.Context, conn *sql.Conn, id int) (Book, error) {
+	return getBook(ctx, conn, id, true)
+}
+
+// bookForUpdateWaitSQL locks a book by id waiting at most wait seconds for the lock, zero fails at once by NOWAIT
+func bookForUpdateWaitSQL(wait int) string {
+	if wait == 0 {
+		return bookSQL(false) + " FOR UPDATE NOWAIT"
+	}
+	return fmt.Sprintf("%s FOR UPDATE WAIT %d", bookSQL(false), wait)
+}
+
+func getBookForUpdateWait(ctx context.Context, conn *sql.Conn, id, wait int) (Book, error) {
+	book, stock := Book{}, sql.NullInt64{}
+	stmtCtx, cancel := statementContext(ctx)
+	defer cancel()
+	err := conn.QueryRowContext(stmtCtx, limitedSQL(ctx, bookForUpdateWaitSQL(wait)), id).Scan(
+		&book.ID, &book.Title, &book.Type, &book.PublishedAt, moneyOrZero(&book.Price), &stock)
+	if err == sql.ErrNoRows {
+		return Book{}, fmt.Errorf("book %d: %w", id, ErrBookNotFound)
+	}
+	if err != nil {
+		return Book{}, rowLockedError(err)
+	}
+
+	book.Stock = int(stock.Int64)
+	return book, nil
+}
+
+// GetBookForUpdateNoWait is GetBookForUpdate which fails with ErrRowLocked at once if the book is locked
+func GetBookForUpdateNoWait(ctx context.Context, conn *sql.Conn, id int) (Book, error) {
+	return getBookForUpdateWait(ctx, conn, id, 0)
+}
+
+// GetBookForUpdateWait is GetBookForUpdate which fails with ErrRowLocked if the book is still locked
+// after seconds, instead of the innodb_lock_wait_timeout of the session
+func GetBookForUpdateWait(ctx context.Context, conn *sql.Conn, id, seconds int) (Book, error) {
+	if seconds <= 0 {
+		return Book{}, fmt.Errorf("lock wait must be positive seconds, got %d", seconds)
+	}
+	return getBookForUpdateWait(ctx, conn, id, seconds)
+}
+
+// userSQL selects a user by id, FOR UPDATE locks it in a pessimistic transaction
+func userSQL(forUpdate bool) string {
+	query := columnSQL("SELECT `id`, {balance}, {nickname} FROM `users` WHERE `id` = ?")
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	return query
+}
+
+func getUser(ctx context.Context, conn *sql.Conn, id int, forUpdate bool) (User, error) {
+	user := User{}
+	stmtCtx, cancel := statementContext(ctx)
+	defer cancel()
+	err := conn.QueryRowContext(stmtCtx, limitedSQL(ctx, userSQL(forUpdate)), id).Scan(
+		&user.ID, moneyOrZero(&user.Balance), &user.Nickname)
+	if err == sql.ErrNoRows {
+		return User{}, fmt.Errorf("user %d: %w", id, ErrUserNotFound)
+	}
+
+	return user, err
+}
+
+// GetUser reads a user, it returns ErrUserNotFound if the user doesn't exist
+func GetUser(ctx context.Context, conn *sql.Conn, id int) (User, error) {
+	return getUser(ctx, conn, id, false)
+}
+
+// GetUserForUpdate is GetUser which locks the user until the transaction ends
+func GetUserForUpdate(ctx context.Context, conn *sql.Conn, id int) (User, error) {
+	return getUser(ctx, conn, id, true)
+}
+
+// ListBooks lists all the books by id
+func ListBooks(ctx context.Context, conn *sql.Conn) ([]Book, error) {
+	rows, err := conn.QueryContext(ctx, columnSQL("SELECT `id`, {title}, {type}, {published_at}, {price}, {stock} "+
+		"FROM `books` ORDER BY `id`"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []Book{}
+	for rows.Next() {
+		book, stock := Book{}, sql.NullInt64{}
+		if err = rows.Scan(&book.ID, &book.Title, &book.Type, &book.PublishedAt, moneyOrZero(&book.Price), &stock); err != nil {
+			return nil, err
+		}
+		book.Stock = int(stock.Int64)
+		books = append(books, book)
+	}
+
+	return books, rows.Err()
+}
+
+// ListUsers lists all the users by id
+func ListUsers(ctx context.Context, conn *sql.Conn) ([]User, error) {
+	rows, err := conn.QueryContext(ctx, columnSQL("SELECT `id`, {balance}, {nickname} FROM `users` ORDER BY `id`"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user := User{}
+		if err = rows.Scan(&user.ID, moneyOrZero(&user.Balance), &user.Nickname); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func listOrders(ctx context.Context, conn *sql.Conn, where string, args ...interface{}) ([]Order, error) {
+	rows, err := conn.QueryContext(ctx, columnSQL("SELECT `id`, `book_id`, `user_id`, {quality}, `ordered_at` "+
+		"FROM `orders` "+where+" ORDER BY `ordered_at`, `id`"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		order := Order{}
+		if err = rows.Scan(&order.ID, &order.BookID, &order.UserID, &order.Quality, &order.OrderedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, rows.Err()
+}
+
+// ListOrdersByUser lists the orders of a user from the oldest, a user without any order gets an empty list
+func ListOrdersByUser(ctx context.Context, conn *sql.Conn, userID int) ([]Order, error) {
+	return listOrders(ctx, conn, "WHERE `user_id` = ?", userID)
+}
+
+// GetOrderByIdempotencyKey reads the order of an idempotency key, it returns ErrOrderNotFound if there is none
+func GetOrderByIdempotencyKey(ctx context.Context, conn *sql.Conn, key string) (Order, error) {
+	orders, err := listOrders(ctx, conn, "WHERE `idempotency_key` = ?", key)
+	if err != nil {
+		return Order{}, err
+	}
+	if len(orders) == 0 {
+		return Order{}, fmt.Errorf("idempotency key '%s': %w", key, ErrOrderNotFound)
+	}
+
+	order := orders[0]
+	order.IdempotencyKey = key
+	return order, nil
+}
+
+// ListOrders lists all the orders from the oldest
+func ListOrders(ctx context.Context, conn *sql.Conn) ([]Order, error) {
+	return listOrders(ctx, conn, "")
+}
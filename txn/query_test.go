@@ -0,0 +1,115 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+func TestGetBookNotFound(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery(bookSQL(false)).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}))
+
+	if _, err := GetBook(context.Background(), conn, 2); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("got %v, want %v", err, ErrBookNotFound)
+	}
+}
+
+// A NULL price and stock are read as zero
+func TestGetBookNullColumns(t *testing.T) {
+	conn, mock := newMockConn(t)
+	publishedAt := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(bookSQL(true)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(1, "Designing Data-Intensive Application", "Science & Technology", publishedAt, nil, nil))
+
+	book, err := GetBookForUpdate(context.Background(), conn, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !book.Price.IsZero() || book.Stock != 0 || !book.PublishedAt.Equal(publishedAt) {
+		t.Errorf("unexpected book %+v", book)
+	}
+}
+
+func TestGetUserNotFoundAndNullBalance(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery(userSQL(false)).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "nickname"}))
+	mock.ExpectQuery(userSQL(false)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "nickname"}).AddRow(1, nil, "Bob"))
+
+	ctx := context.Background()
+	if _, err := GetUser(ctx, conn, 3); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("got %v, want %v", err, ErrUserNotFound)
+	}
+	user, err := GetUser(ctx, conn, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Balance.IsZero() || user.Nickname != "Bob" {
+		t.Errorf("unexpected user %+v", user)
+	}
+}
+
+// The read helpers on TiDB: the missing rows are the sentinels,
+// the NULL columns are zero and a user without orders has an empty list
+func TestReadHelpersOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, "INSERT INTO `books` (`id`, `title`, `type`, `published_at`, `stock`, `price`) "+
+		"VALUES (1, 'Book 1', 'Novel', '2020-01-01 00:00:00', NULL, NULL)")
+	mustExec(t, db, "INSERT INTO `users` (`id`, `balance`, `nickname`) VALUES (1, NULL, 'Bob')")
+
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		book, err := GetBook(ctx, conn, 1)
+		if err != nil {
+			return err
+		}
+		if book.Stock != 0 || !book.Price.IsZero() || book.Title != "Book 1" {
+			t.Errorf("unexpected book %+v", book)
+		}
+		if _, err = GetBook(ctx, conn, 2); !errors.Is(err, ErrBookNotFound) {
+			t.Errorf("got %v, want %v", err, ErrBookNotFound)
+		}
+
+		user, err := GetUser(ctx, conn, 1)
+		if err != nil {
+			return err
+		}
+		if !user.Balance.Equal(decimal.Zero) || user.Nickname != "Bob" {
+			t.Errorf("unexpected user %+v", user)
+		}
+		if _, err = GetUser(ctx, conn, 2); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("got %v, want %v", err, ErrUserNotFound)
+		}
+
+		orders, err := ListOrdersByUser(ctx, conn, 1)
+		if err != nil {
+			return err
+		}
+		if orders == nil || len(orders) != 0 {
+			t.Errorf("got the orders %v, want an empty list", orders)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,158 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func snapshotSQL(startTS uint64) string {
+	return fmt.Sprintf("SET @@tidb_snapshot = '%d'", startTS)
+}
+
+// runSnapshotRead runs readFunc on conn reading the historical data at startTS. TiDB rejects any write statement
+// while tidb_snapshot is set, so readFunc is read-only. tidb_snapshot is reset afterwards, conn is discarded if it can't be
+func runSnapshotRead(ctx context.Context, conn *sql.Conn, startTS uint64, readFunc TxnFunc) error {
+	if startTS == 0 {
+		return fmt.Errorf("start ts of snapshot read must not be zero")
+	}
+
+	if _, err := conn.ExecContext(ctx, snapshotSQL(startTS)); err != nil {
+		return err
+	}
+	defer restoreSession(conn, logger, "SET @@tidb_snapshot = ''")
+
+	return readFunc(ctx, conn)
+}
+
+// boundedStalenessSQL selects a book from the freshest replica which is no older than boundSeconds.
+// The bound is rendered into the statement, TiDB evaluates AS OF TIMESTAMP when it prepares the statement,
+// a placeholder is still NULL then
+func boundedStalenessSQL(boundSeconds int64) string {
+	return columnSQL(fmt.Sprintf("SELECT `id`, {title}, {type}, {published_at}, {price}, {stock} FROM `books` "+
+		"AS OF TIMESTAMP TIDB_BOUNDED_STALENESS(NOW() - INTERVAL %d SECOND, NOW()) WHERE `id` = ?", boundSeconds))
+}
+
+// readBookBoundedStaleness reads a book as fresh as possible, but no older than maxStaleness
+func readBookBoundedStaleness(ctx context.Context, db *sql.DB, bookID int, maxStaleness time.Duration) (Book, error) {
+	if maxStaleness < time.Second || maxStaleness%time.Second != 0 {
+		return Book{}, fmt.Errorf("staleness bound must be whole seconds and at least 1s, got %s", maxStaleness)
+	}
+
+	book := Book{}
+	err := db.QueryRowContext(ctx, boundedStalenessSQL(int64(maxStaleness/time.Second)), bookID).Scan(
+		&book.ID, &book.Title, &book.Type, &book.PublishedAt, money(&book.Price), &book.Stock)
+	if err == sql.ErrNoRows {
+		return Book{}, fmt.Errorf("book %d: %w", bookID, ErrBookNotFound)
+	}
+
+	return book, err
+}
+
+// staleReadSQL selects a book as it was the given seconds ago, they're rendered into the statement
+// as in boundedStalenessSQL
+func staleReadSQL(seconds int64) string {
+	return columnSQL(fmt.Sprintf("SELECT `id`, {title}, {type}, {published_at}, {price}, {stock} FROM `books` "+
+		"AS OF TIMESTAMP NOW() - INTERVAL %d SECOND WHERE `id` = ?", seconds))
+}
+
+// readBookStaleRead reads a book as it was staleness ago, from any replica without waiting for the leader.
+// A staleness reaching before the GC safe point is halved and retried down to 1s, the returned staleness
+// is the one in effect
+func readBookStaleRead(ctx context.Context, db *sql.DB, bookID int, staleness time.Duration) (Book, time.Duration, error) {
+	if staleness < time.Second || staleness%time.Second != 0 {
+		return Book{}, 0, fmt.Errorf("staleness must be whole seconds and at least 1s, got %s", staleness)
+	}
+
+	for {
+		book := Book{}
+		err := db.QueryRowContext(ctx, staleReadSQL(int64(staleness/time.Second)), bookID).Scan(
+			&book.ID, &book.Title, &book.Type, &book.PublishedAt, money(&book.Price), &book.Stock)
+		if err == sql.ErrNoRows {
+			return Book{}, staleness, fmt.Errorf("book %d %s ago: %w", bookID, staleness, ErrBookNotFound)
+		}
+
+		mysqlErr := &mysql.MySQLError{}
+		if !errors.As(err, &mysqlErr) || TiDBErrorCode(mysqlErr.Number) != ErrGCTooEarly {
+			return book, staleness, err
+		}
+		if staleness <= time.Second {
+			return Book{}, staleness, fmt.Errorf("%s ago is before the GC safe point, the history is collected, "+
+				"raise tidb_gc_life_time to read further back: %w", staleness, err)
+		}
+
+		logger.Infof("%s ago is before the GC safe point, retry with a smaller staleness", staleness)
+		staleness = (staleness / 2).Truncate(time.Second)
+		if staleness < time.Second {
+			staleness = time.Second
+		}
+	}
+}
+
+// ErrWriteInReadOnlyTxn is returned by runReadOnlyTxn if the function tried to write
+var ErrWriteInReadOnlyTxn = errors.New("write statement in a read-only transaction")
+
+// runReadOnlyTxn runs readFunc in a read-only transaction on a connection of its own, see runReadOnlyTxnOn
+func runReadOnlyTxn(ctx context.Context, db *sql.DB, readFunc TxnFunc) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return runReadOnlyTxnOn(ctx, conn, readFunc)
+}
+
+// readOnlyTxnSQL starts the transaction of runReadOnlyTxnOn. TiDB rejects START TRANSACTION READ ONLY
+// unless tidb_enable_noop_functions is on, and even then it doesn't reject a write, so the snapshot is started
+// by WITH CONSISTENT SNAPSHOT and runReadOnlyTxnOn checks the written keys itself
+const readOnlyTxnSQL = "START TRANSACTION WITH CONSISTENT SNAPSHOT"
+
+// txnWrittenKeysSQL counts the keys the transaction of the session has written, they're buffered until COMMIT
+const txnWrittenKeysSQL = "SELECT `MEM_BUFFER_KEYS` FROM `INFORMATION_SCHEMA`.`TIDB_TRX` WHERE `SESSION_ID` = CONNECTION_ID()"
+
+// runReadOnlyTxnOn runs readFunc in a read-only transaction on conn, all its reads see the same snapshot
+// however many statements it runs. If readFunc wrote anything, the transaction is rolled back
+// and fails with ErrWriteInReadOnlyTxn, nothing of it is committed
+func runReadOnlyTxnOn(ctx context.Context, conn *sql.Conn, readFunc TxnFunc) error {
+	if _, err := conn.ExecContext(ctx, readOnlyTxnSQL); err != nil {
+		return fmt.Errorf("begin read-only transaction: %w", err)
+	}
+
+	err := readFunc(ctx, conn)
+	writtenKeys := 0
+	if err == nil {
+		if err = conn.QueryRowContext(ctx, txnWrittenKeysSQL).Scan(&writtenKeys); err != nil {
+			err = fmt.Errorf("check the written keys: %w", err)
+		} else if writtenKeys > 0 {
+			err = fmt.Errorf("%w: %d keys written", ErrWriteInReadOnlyTxn, writtenKeys)
+		}
+	}
+	if err != nil {
+		if rollbackErr := rollback(conn); rollbackErr != nil {
+			logger.Errorf("[runReadOnlyTxn] rollback failed: %+v", rollbackErr)
+		}
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
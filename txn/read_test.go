@@ -0,0 +1,181 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSnapshotSQL(t *testing.T) {
+	if got, want := snapshotSQL(445623098577453057), "SET @@tidb_snapshot = '445623098577453057'"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestRunSnapshotReadRejectsZeroTS(t *testing.T) {
+	if err := runSnapshotRead(context.Background(), nil, 0, nil); err == nil {
+		t.Error("zero start ts is accepted")
+	}
+}
+
+func TestRunSnapshotReadResetsSnapshot(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("SET @@tidb_snapshot = '42'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	mock.ExpectExec("SET @@tidb_snapshot = ''").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = runSnapshotRead(ctx, conn, 42, func(ctx context.Context, conn *sql.Conn) error {
+		one := 0
+		return conn.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A connection whose tidb_snapshot can't be reset would read the history forever, it must not go back to the pool
+func TestRunSnapshotReadDiscardsConnOnFailedReset(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("SET @@tidb_snapshot = '42'").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET @@tidb_snapshot = ''").WillReturnError(errors.New("connection reset"))
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runSnapshotRead(ctx, conn, 42, func(ctx context.Context, conn *sql.Conn) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if stats := db.Stats(); stats.OpenConnections != 0 {
+		t.Errorf("got %d open connections, want the connection discarded", stats.OpenConnections)
+	}
+}
+
+// The snapshot read at the ts captured before a buy still sees the old stock, and the pooled connection
+// reads the latest data afterwards. The report at that ts prints the old stock too
+func TestRunSnapshotReadOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var startTS uint64
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		return runReadOnlyTxnOn(ctx, conn, func(ctx context.Context, conn *sql.Conn) error {
+			return conn.QueryRowContext(ctx, "SELECT @@tidb_current_ts").Scan(&startTS)
+		})
+	})
+	mustExec(t, db, "UPDATE `books` SET `stock` = 3 WHERE `id` = 1")
+
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		return runSnapshotRead(ctx, conn, startTS, func(ctx context.Context, conn *sql.Conn) error {
+			book, err := GetBook(ctx, conn, 1)
+			if err == nil && book.Stock != initialBookStock {
+				t.Errorf("got the stock %d at ts %d, want %d", book.Stock, startTS, initialBookStock)
+			}
+			return err
+		})
+	})
+	if err := assertCommitted(ctx, db, 1, 3); err != nil {
+		t.Error(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := runReport(ctx, db, ReportOptions{StartTS: startTS}, out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "stock 10") {
+		t.Errorf("the report at ts %d doesn't have the old stock:\n%s", startTS, out.String())
+	}
+}
+
+func TestRunReadOnlyTxnOn(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		writtenKeys int
+		end         string
+		err         error
+	}{
+		{"read", 0, "COMMIT", nil},
+		{"write", 2, "ROLLBACK", ErrWriteInReadOnlyTxn},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock := newMock(t)
+			mock.ExpectExec(readOnlyTxnSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(txnWrittenKeysSQL).
+				WillReturnRows(sqlmock.NewRows([]string{"MEM_BUFFER_KEYS"}).AddRow(test.writtenKeys))
+			mock.ExpectExec(test.end).WillReturnResult(sqlmock.NewResult(0, 0))
+
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			err = runReadOnlyTxnOn(context.Background(), conn, func(ctx context.Context, conn *sql.Conn) error {
+				return nil
+			})
+			if !errors.Is(err, test.err) {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// A write in the read-only transaction fails it, and nothing of the write is committed
+func TestRunReadOnlyTxnRejectsWriteOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		err = runReadOnlyTxnOn(ctx, conn, func(ctx context.Context, conn *sql.Conn) error {
+			_, err := conn.ExecContext(ctx, "UPDATE `books` SET `stock` = 3 WHERE `id` = 1")
+			return err
+		})
+		return nil
+	})
+	if !errors.Is(err, ErrWriteInReadOnlyTxn) {
+		t.Errorf("got %v, want ErrWriteInReadOnlyTxn", err)
+	}
+	if err = assertCommitted(ctx, db, 1, initialBookStock); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// ReplayGuard remembers the order ids recently committed by this process in a bounded LRU,
+// so a buy can skip an obvious replay before touching the database, see skipReplay.
+// It's a process-local optimization, not a correctness guarantee, the unique index of `orders` is authoritative
+type ReplayGuard struct {
+	mu        sync.Mutex
+	capacity  int
+	committed *list.List
+	index     map[int]*list.Element
+	pending   map[*sql.Conn][]int
+}
+
+func newReplayGuard(capacity int) *ReplayGuard {
+	return &ReplayGuard{
+		capacity:  capacity,
+		committed: list.New(),
+		index:     make(map[int]*list.Element),
+		pending:   make(map[*sql.Conn][]int),
+	}
+}
+
+// Seen reports whether orderID was committed recently
+func (g *ReplayGuard) Seen(orderID int) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	element, ok := g.index[orderID]
+	if ok {
+		g.committed.MoveToFront(element)
+	}
+
+	return ok
+}
+
+// stage records orderID inserted by the transaction on conn, it's remembered once the transaction commits
+func (g *ReplayGuard) stage(conn *sql.Conn, orderID int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.pending[conn] = append(g.pending[conn], orderID)
+}
+
+func (g *ReplayGuard) commit(conn *sql.Conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, orderID := range g.pending[conn] {
+		if element, ok := g.index[orderID]; ok {
+			g.committed.MoveToFront(element)
+			continue
+		}
+
+		g.index[orderID] = g.committed.PushFront(orderID)
+		if g.committed.Len() > g.capacity {
+			oldest := g.committed.Back()
+			g.committed.Remove(oldest)
+			delete(g.index, oldest.Value.(int))
+		}
+	}
+	delete(g.pending, conn)
+}
+
+func (g *ReplayGuard) discard(conn *sql.Conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.pending, conn)
+}
+
+// ErrOrderReplayed is returned by OrderRepo.CreateOrder for an order orderReplayGuard knows was committed recently,
+// it rolls back the transaction inserting it, so the replay writes nothing
+var ErrOrderReplayed = errors.New("the order was committed recently")
+
+// skipReplay reports whether a buy of orderID replays an order committed recently by this process, then the buy
+// is skipped as a whole and replay is the committed order. The buys and Router.Buy check it before any statement
+func skipReplay(options PurchaseOptions, orderID, bookID, userID, amount int) (replay PurchaseResult, ok bool) {
+	orderID = options.orderIDFor(orderID)
+	if orderID == 0 || orderReplayGuard == nil || !orderReplayGuard.Seen(orderID) {
+		return PurchaseResult{}, false
+	}
+	logger.Infof("order %d was committed recently, skip the replay", orderID)
+	return PurchaseResult{OrderID: orderID, BookID: bookID, UserID: userID, Amount: amount}, true
+}
+
+// orderReplayGuard is used by OrderRepo.CreateOrder and runTxn if it is not nil, it's created by -replay-guard
+var orderReplayGuard *ReplayGuard
+
+// replayGuardFlag is the -replay-guard flag, the capacity of orderReplayGuard. Zero disables the guard
+type replayGuardFlag struct{}
+
+func (replayGuardFlag) String() string {
+	if orderReplayGuard == nil {
+		return "0"
+	}
+	return strconv.Itoa(orderReplayGuard.capacity)
+}
+
+func (replayGuardFlag) Set(value string) error {
+	capacity, err := strconv.Atoi(value)
+	if err != nil || capacity < 0 {
+		return fmt.Errorf("replay guard capacity must be a non-negative integer, got '%s'", value)
+	}
+
+	orderReplayGuard = nil
+	if capacity > 0 {
+		orderReplayGuard = newReplayGuard(capacity)
+	}
+	return nil
+}
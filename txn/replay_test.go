@@ -0,0 +1,187 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// useReplayGuard sets orderReplayGuard to a guard of capacity during the test
+func useReplayGuard(tb testing.TB, capacity int) *ReplayGuard {
+	defaultGuard := orderReplayGuard
+	orderReplayGuard = newReplayGuard(capacity)
+	tb.Cleanup(func() {
+		orderReplayGuard = defaultGuard
+	})
+	return orderReplayGuard
+}
+
+func TestReplayGuardRemembersCommitted(t *testing.T) {
+	guard := newReplayGuard(2)
+	committed, rolledBack := &sql.Conn{}, &sql.Conn{}
+
+	guard.stage(rolledBack, 9)
+	guard.discard(rolledBack)
+	for _, orderID := range []int{1, 2, 3} {
+		guard.stage(committed, orderID)
+	}
+	guard.commit(committed)
+
+	for orderID, want := range map[int]bool{1: false, 2: true, 3: true, 9: false} {
+		if got := guard.Seen(orderID); got != want {
+			t.Errorf("order %d seen: %v, want %v", orderID, got, want)
+		}
+	}
+}
+
+func TestReplayGuardFlag(t *testing.T) {
+	useReplayGuard(t, 1)
+	flagValue := replayGuardFlag{}
+
+	if err := flagValue.Set("100"); err != nil {
+		t.Fatal(err)
+	}
+	if orderReplayGuard == nil || flagValue.String() != "100" {
+		t.Errorf("got the guard of %s, want 100", flagValue.String())
+	}
+	if err := flagValue.Set("0"); err != nil || orderReplayGuard != nil {
+		t.Errorf("-replay-guard 0 doesn't disable the guard: %v", err)
+	}
+	for _, value := range []string{"-1", "many"} {
+		if err := flagValue.Set(value); err == nil {
+			t.Errorf("-replay-guard %s is accepted", value)
+		}
+	}
+}
+
+// A buy replaying an order committed recently returns at once, the mock fails any statement
+func TestBuyReplayIsShortCircuited(t *testing.T) {
+	db, _ := newMock(t)
+	guard := useReplayGuard(t, 10)
+	conn := &sql.Conn{}
+	guard.stage(conn, 5000)
+	guard.commit(conn)
+
+	options := noDelay()
+	options.ExplicitOrderID = true
+	for _, buyFunc := range []func(context.Context, *sql.DB, PurchaseOptions, int, int, int, int, int) (PurchaseResult, error){
+		buyPessimistic, buyOptimistic,
+	} {
+		result, err := buyFunc(context.Background(), db, options, 1, 5000, 1, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.OrderID != 5000 {
+			t.Errorf("got the order %d, want 5000", result.OrderID)
+		}
+	}
+}
+
+// The repo rejects an order the guard knows by ErrOrderReplayed before any statement, so its transaction rolls back
+func TestCreateOrderReplayed(t *testing.T) {
+	conn, _ := newMockConn(t)
+	guard := useReplayGuard(t, 10)
+	committed := &sql.Conn{}
+	guard.stage(committed, 5000)
+	guard.commit(committed)
+
+	id, err := NewOrderRepo(conn).CreateOrder(context.Background(), Order{ID: 5000, BookID: 1, UserID: 1, Quality: 2})
+	if !errors.Is(err, ErrOrderReplayed) || id != 0 {
+		t.Errorf("got the order %d, %v, want %v", id, err, ErrOrderReplayed)
+	}
+}
+
+// Router.Buy skips a replay before the admission and the database, the mock fails any statement
+func TestRouterBuyReplayIsShortCircuited(t *testing.T) {
+	db, _ := newMock(t)
+	guard := useReplayGuard(t, 10)
+	conn := &sql.Conn{}
+	guard.stage(conn, 5000)
+	guard.commit(conn)
+
+	options := noDelay()
+	options.ExplicitOrderID = true
+	router := NewRouter(db, db).WithPurchaseOptions(options)
+	result, err := router.Buy(context.Background(), false, 1, 5000, 1, 1, 2)
+	if err != nil || result.OrderID != 5000 {
+		t.Errorf("got the order %d, %v, want the replayed 5000", result.OrderID, err)
+	}
+}
+
+// A replay skipped by the buy, or rolled back by the repo because the order committed after the buy checked,
+// leaves the stock, the balances and the orders as they are
+func TestBuyReplayLeavesDataOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	guard := useReplayGuard(t, 10)
+
+	options := noDelay()
+	options.ExplicitOrderID = true
+	if _, err := buyPessimistic(ctx, db, options, 1, 5000, 1, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	before := takeDataSnapshot(t, db)
+
+	if _, err := NewRouter(db, db).WithPurchaseOptions(options).Buy(ctx, false, 1, 5000, 1, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	// the order is committed by someone else once the buy passed the check and updated the stock
+	for i, buyFunc := range buyFuncs {
+		orderID := 6000 + i
+		options.StepHook = func(step string) {
+			if step == StepUpdateStock {
+				committed := &sql.Conn{}
+				guard.stage(committed, orderID)
+				guard.commit(committed)
+			}
+		}
+		result, err := buyFunc.buy(ctx, db, options, 1, orderID, 1, 1, 2)
+		if err != nil || result.OrderID != orderID {
+			t.Errorf("%s: got the order %d, %v, want the replayed %d", buyFunc.name, result.OrderID, err, orderID)
+		}
+	}
+
+	if after := takeDataSnapshot(t, db); !reflect.DeepEqual(after, before) {
+		t.Errorf("the replays changed the data from %+v to %+v", before, after)
+	}
+}
+
+// Buying the same order id twice charges once, the second buy never reaches TiDB
+func TestBuyReplayOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	useReplayGuard(t, 10)
+
+	options := noDelay()
+	options.ExplicitOrderID = true
+	for i := 0; i < 2; i++ {
+		if _, err := buyPessimistic(ctx, db, options, 1, 5000, 1, 1, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := assertCommitted(ctx, db, 1, initialBookStock-2); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// replicaReadModes are the values of tidb_replica_read a read can be routed by
+var replicaReadModes = map[string]interface{}{
+	"leader":              nil,
+	"follower":            nil,
+	"leader-and-follower": nil,
+	"closest-replicas":    nil,
+	"closest-adaptive":    nil,
+}
+
+// validateReplicaRead rejects a mode tidb_replica_read doesn't have, empty means the session default
+func validateReplicaRead(mode string) error {
+	if _, ok := replicaReadModes[mode]; mode != "" && !ok {
+		return fmt.Errorf("unknown replica read '%s', want leader, follower, leader-and-follower, "+
+			"closest-replicas or closest-adaptive", mode)
+	}
+	return nil
+}
+
+// withReplicaRead routes the reads on conn by mode until the returned restore is called, which sets the previous
+// value back. If that fails, conn is discarded and restore returns the error. An empty mode changes nothing.
+// A server without tidb_replica_read, an older TiDB or MySQL, gets a warning and the reads go to the leader
+func withReplicaRead(ctx context.Context, conn *sql.Conn, mode string) (restore func() error, err error) {
+	restore = func() error { return nil }
+	if mode == "" {
+		return restore, nil
+	}
+
+	previous := ""
+	err = conn.QueryRowContext(ctx, "SELECT @@SESSION.tidb_replica_read").Scan(&previous)
+	mysqlErr := &mysql.MySQLError{}
+	if errors.As(err, &mysqlErr) && TiDBErrorCode(mysqlErr.Number) == ErrUnknownSysVar {
+		logger.Errorf("tidb_replica_read isn't supported by the server, read from the leader: %v", err)
+		return restore, nil
+	}
+	if err != nil {
+		return restore, err
+	}
+
+	if _, err = conn.ExecContext(ctx, "SET @@SESSION.tidb_replica_read = ?", mode); err != nil {
+		return restore, fmt.Errorf("set tidb_replica_read to %s: %w", mode, err)
+	}
+
+	restore = func() error {
+		return restoreSession(conn, logger, "SET @@SESSION.tidb_replica_read = ?", previous)
+	}
+
+	inEffect := ""
+	if err = conn.QueryRowContext(ctx, "SELECT @@SESSION.tidb_replica_read").Scan(&inEffect); err != nil {
+		restore()
+		return func() error { return nil }, err
+	}
+	logger.Infof("tidb_replica_read in effect: %s, it was %s", inEffect, previous)
+
+	return restore, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+const replicaReadSelect = "SELECT @@SESSION.tidb_replica_read"
+
+func replicaReadRows(value string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"@@SESSION.tidb_replica_read"}).AddRow(value)
+}
+
+func TestValidateReplicaRead(t *testing.T) {
+	for _, mode := range []string{"", "leader", "follower", "leader-and-follower", "closest-replicas", "closest-adaptive"} {
+		if err := validateReplicaRead(mode); err != nil {
+			t.Errorf("%s: %v", mode, err)
+		}
+	}
+	if err := validateReplicaRead("nearest"); err == nil {
+		t.Error("nearest is accepted")
+	}
+}
+
+// The mode is set on the connection and the previous value is set back by restore
+func TestWithReplicaReadSetsAndRestores(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery(replicaReadSelect).WillReturnRows(replicaReadRows("leader"))
+	mock.ExpectExec("SET @@SESSION.tidb_replica_read = ?").WithArgs("closest-replicas").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(replicaReadSelect).WillReturnRows(replicaReadRows("closest-replicas"))
+	mock.ExpectExec("SET @@SESSION.tidb_replica_read = ?").WithArgs("leader").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	restore, err := withReplicaRead(context.Background(), conn, "closest-replicas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(); err != nil {
+		t.Error(err)
+	}
+	if connDone(conn) {
+		t.Error("the connection is discarded")
+	}
+}
+
+// An empty mode doesn't touch the session
+func TestWithReplicaReadEmptyMode(t *testing.T) {
+	conn, _ := newMockConn(t)
+	restore, err := withReplicaRead(context.Background(), conn, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A server without tidb_replica_read gets a warning, nothing is set and the reads go on
+func TestWithReplicaReadUnsupported(t *testing.T) {
+	conn, mock := newMockConn(t)
+	buffer := useBufferLogger(t)
+	mock.ExpectQuery(replicaReadSelect).WillReturnError(&mysql.MySQLError{
+		Number: uint16(ErrUnknownSysVar), Message: "Unknown system variable 'tidb_replica_read'"})
+
+	restore, err := withReplicaRead(context.Background(), conn, "follower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(); err != nil {
+		t.Error(err)
+	}
+	lines := buffer.Lines()
+	if len(lines) != 1 || !strings.Contains(lines[0], "read from the leader") {
+		t.Errorf("got the log %q, want the warning", lines)
+	}
+}
+
+// A session which can't be set back fails restore and its connection is discarded
+func TestWithReplicaReadDiscardsOnFailedRestore(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery(replicaReadSelect).WillReturnRows(replicaReadRows("leader"))
+	mock.ExpectExec("SET @@SESSION.tidb_replica_read = ?").WithArgs("follower").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(replicaReadSelect).WillReturnRows(replicaReadRows("follower"))
+	mock.ExpectExec("SET @@SESSION.tidb_replica_read = ?").WithArgs("leader").WillReturnError(errors.New("connection lost"))
+
+	restore, err := withReplicaRead(context.Background(), conn, "follower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(); err == nil {
+		t.Error("restore succeeds")
+	}
+	if !connDone(conn) {
+		t.Error("the connection is not discarded")
+	}
+}
+
+// When the mode in effect can't be read, the session is set back before the error is returned
+func TestWithReplicaReadRestoresOnFailedCheck(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery(replicaReadSelect).WillReturnRows(replicaReadRows("leader"))
+	mock.ExpectExec("SET @@SESSION.tidb_replica_read = ?").WithArgs("follower").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(replicaReadSelect).WillReturnError(errors.New("read timeout"))
+	mock.ExpectExec("SET @@SESSION.tidb_replica_read = ?").WithArgs("leader").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if _, err := withReplicaRead(context.Background(), conn, "follower"); err == nil {
+		t.Error("the failed check is not returned")
+	}
+}
+
+// The report reads by closest-replicas and its pooled session is set back afterwards. A single TiKV
+// serves the reads as the leader, on a multi-replica cluster they are served by the closest replica
+func TestReportReplicaReadOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := ""
+	if err := db.QueryRowContext(ctx, replicaReadSelect).Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+	if err := runReport(ctx, db, ReportOptions{ReplicaRead: "closest-replicas"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	after := ""
+	if err := db.QueryRowContext(ctx, replicaReadSelect).Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("tidb_replica_read is %s after the report, want %s", after, before)
+	}
+}
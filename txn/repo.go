@@ -0,0 +1,270 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// The repositories are the only place the buys write with, so a column name is fixed in one place.
+// They hold the connection of the transaction, the transaction itself is left to the caller
+
+// BookRepo writes the `books` table
+type BookRepo struct {
+	conn *sql.Conn
+}
+
+func NewBookRepo(conn *sql.Conn) BookRepo {
+	return BookRepo{conn: conn}
+}
+
+func createBookSQL() string {
+	return createBooksSQL(1)
+}
+
+// createBooksSQL upserts rows books in one statement
+func createBooksSQL(rows int) string {
+	return columnSQL("INSERT INTO `books` (`id`, {title}, {type}, {published_at}, {price}, {stock}) values " +
+		placeholderRows(6, rows) + " " +
+		"ON DUPLICATE KEY UPDATE {title} = VALUES({title}), {type} = VALUES({type}), " +
+		"{published_at} = VALUES({published_at}), {price} = VALUES({price}), {stock} = VALUES({stock})")
+}
+
+// CreateBook inserts book, or resets it to book if it exists
+func (r BookRepo) CreateBook(ctx context.Context, book Book) error {
+	return execLogged(ctx, r.conn, createBookSQL(), book.ID, book.Title, book.Type, book.PublishedAt, book.Price, book.Stock)
+}
+
+// GetForUpdate reads and locks a book, see GetBookForUpdate
+func (r BookRepo) GetForUpdate(ctx context.Context, id int) (Book, error) {
+	return GetBookForUpdate(ctx, r.conn, id)
+}
+
+func updateStockSQL() string {
+	return columnSQL("update `books` set {stock} = {stock} - ? where id = ? and {stock} - ? >= 0")
+}
+
+// UpdateStock takes amount from the stock of a book, it reports false if the stock is not enough
+func (r BookRepo) UpdateStock(ctx context.Context, bookID, amount int) (bool, error) {
+	return execAffectingRow(ctx, r.conn, updateStockSQL(), amount, bookID, amount)
+}
+
+func addStockSQL() string {
+	return columnSQL("update `books` set {stock} = {stock} + ? where id = ?")
+}
+
+// AddStock puts amount back to the stock of a book, it reports false if the book doesn't exist
+func (r BookRepo) AddStock(ctx context.Context, bookID, amount int) (bool, error) {
+	return execAffectingRow(ctx, r.conn, addStockSQL(), amount, bookID)
+}
+
+// UserRepo writes the `users` table
+type UserRepo struct {
+	conn *sql.Conn
+}
+
+func NewUserRepo(conn *sql.Conn) UserRepo {
+	return UserRepo{conn: conn}
+}
+
+func createUserSQL() string {
+	return createUsersSQL(1)
+}
+
+// createUsersSQL upserts rows users in one statement
+func createUsersSQL(rows int) string {
+	return columnSQL("INSERT INTO `users` (`id`, {nickname}, {balance}) VALUES " + placeholderRows(3, rows) + " " +
+		"ON DUPLICATE KEY UPDATE {nickname} = VALUES({nickname}), {balance} = VALUES({balance})")
+}
+
+// CreateUser inserts user, or resets it to user if it exists
+func (r UserRepo) CreateUser(ctx context.Context, user User) error {
+	return execLogged(ctx, r.conn, createUserSQL(), user.ID, user.Nickname, user.Balance)
+}
+
+// Get reads a user, see GetUser
+func (r UserRepo) Get(ctx context.Context, id int) (User, error) {
+	return GetUser(ctx, r.conn, id)
+}
+
+// GetForUpdate reads and locks a user, see GetUserForUpdate
+func (r UserRepo) GetForUpdate(ctx context.Context, id int) (User, error) {
+	return GetUserForUpdate(ctx, r.conn, id)
+}
+
+func debitBalanceSQL() string {
+	return columnSQL("update `users` set {balance} = {balance} - ? where id = ? and {balance} >= ?")
+}
+
+// DebitBalance takes amount from the balance of a user, it reports false if the balance is not enough
+func (r UserRepo) DebitBalance(ctx context.Context, userID int, amount decimal.Decimal) (bool, error) {
+	return execAffectingRow(ctx, r.conn, debitBalanceSQL(), amount, userID, amount)
+}
+
+func creditBalanceSQL() string {
+	return columnSQL("update `users` set {balance} = {balance} + ? where id = ?")
+}
+
+// CreditBalance adds amount to the balance of a user, it reports false if the user doesn't exist
+func (r UserRepo) CreditBalance(ctx context.Context, userID int, amount decimal.Decimal) (bool, error) {
+	return execAffectingRow(ctx, r.conn, creditBalanceSQL(), amount, userID)
+}
+
+// OrderRepo writes the `orders` table
+type OrderRepo struct {
+	conn *sql.Conn
+}
+
+func NewOrderRepo(conn *sql.Conn) OrderRepo {
+	return OrderRepo{conn: conn}
+}
+
+func insertOrderSQL() string {
+	return orderInsertSQL(false, false)
+}
+
+// createOrdersSQL inserts rows orders with their order time in a single statement
+func createOrdersSQL(rows int) string {
+	return columnSQL("INSERT INTO `orders` (`book_id`, `user_id`, {quality}, `ordered_at`) VALUES " + placeholderRows(4, rows))
+}
+
+// orderInsertSQL inserts an order with or without the id and the idempotency key,
+// an order without a key doesn't need the column, so it can be inserted into an older table
+func orderInsertSQL(withID, withKey bool) string {
+	columns, values := "`book_id`, `user_id`, {quality}, `unit_price`", "?, ?, ?, ?"
+	if withID {
+		columns, values = "`id`, "+columns, "?, "+values
+	}
+	if withKey {
+		columns, values = columns+", `idempotency_key`", values+", ?"
+	}
+	return columnSQL("insert into `orders` (" + columns + ") values (" + values + ")")
+}
+
+// CreateOrder inserts an order with its unit price and returns its id. A zero order.ID lets TiDB generate the AUTO_RANDOM id,
+// otherwise order.ID is inserted as is. It returns ErrOrderReplayed if orderReplayGuard knows
+// the order was committed recently, and ErrOrderExists if an order with order.IdempotencyKey exists
+func (r OrderRepo) CreateOrder(ctx context.Context, order Order) (int, error) {
+	args := []interface{}{order.BookID, order.UserID, order.Quality, order.UnitPrice}
+	withKey := order.IdempotencyKey != ""
+	if withKey {
+		args = append(args, order.IdempotencyKey)
+	}
+
+	if order.ID == 0 {
+		result, err := execResult(ctx, r.conn, orderInsertSQL(false, withKey), args...)
+		if err != nil {
+			return 0, orderInsertError(order, err)
+		}
+		id, err := result.LastInsertId()
+		return int(id), err
+	}
+
+	if orderReplayGuard != nil && orderReplayGuard.Seen(order.ID) {
+		return 0, ErrOrderReplayed
+	}
+
+	// an explicit value of an AUTO_RANDOM column is rejected unless the session allows it,
+	// the previous value is restored so the pooled session doesn't keep allowing it
+	previous := ""
+	if err := r.conn.QueryRowContext(ctx, "SELECT @@SESSION.allow_auto_random_explicit_insert").Scan(&previous); err != nil {
+		return 0, err
+	}
+	if _, err := r.conn.ExecContext(ctx, "SET @@SESSION.allow_auto_random_explicit_insert = ON"); err != nil {
+		return 0, err
+	}
+	err := execLogged(ctx, r.conn, orderInsertSQL(true, withKey), append([]interface{}{order.ID}, args...)...)
+	if restoreErr := restoreSession(r.conn, logger, "SET @@SESSION.allow_auto_random_explicit_insert = ?", previous); restoreErr != nil && err == nil {
+		err = fmt.Errorf("restore allow_auto_random_explicit_insert: %w", restoreErr)
+	}
+	if err != nil {
+		return 0, orderInsertError(order, err)
+	}
+
+	if orderReplayGuard != nil {
+		orderReplayGuard.stage(r.conn, order.ID)
+	}
+	return order.ID, nil
+}
+
+// orderInsertError turns a conflict on the idempotency key of order into ErrOrderExists
+func orderInsertError(order Order, err error) error {
+	if order.IdempotencyKey != "" && isIdempotencyKeyConflict(err) {
+		return fmt.Errorf("idempotency key '%s': %w", order.IdempotencyKey, ErrOrderExists)
+	}
+	return err
+}
+
+func orderForUpdateSQL() string {
+	return columnSQL("select `id`, `book_id`, `user_id`, {quality}, `ordered_at`, `unit_price` from `orders` where `id` = ? for update")
+}
+
+// GetForUpdate reads and locks an order, it returns ErrOrderNotFound if the order doesn't exist
+func (r OrderRepo) GetForUpdate(ctx context.Context, id int) (Order, error) {
+	order := Order{}
+	stmtCtx, cancel := statementContext(ctx)
+	defer cancel()
+	err := r.conn.QueryRowContext(stmtCtx, limitedSQL(ctx, orderForUpdateSQL()), id).Scan(
+		&order.ID, &order.BookID, &order.UserID, &order.Quality, &order.OrderedAt, &order.UnitPrice)
+	if err == sql.ErrNoRows {
+		return Order{}, fmt.Errorf("order %d: %w", id, ErrOrderNotFound)
+	}
+
+	return order, err
+}
+
+func deleteOrderSQL() string {
+	return "delete from `orders` where `id` = ?"
+}
+
+// Delete removes an order
+func (r OrderRepo) Delete(ctx context.Context, id int) error {
+	return execLogged(ctx, r.conn, deleteOrderSQL(), id)
+}
+
+// execLogged runs a statement and logs it if it failed
+func execLogged(ctx context.Context, conn *sql.Conn, query string, args ...interface{}) error {
+	_, err := execResult(ctx, conn, query, args...)
+	return err
+}
+
+func execResult(ctx context.Context, conn *sql.Conn, query string, args ...interface{}) (sql.Result, error) {
+	stmtCtx, cancel := statementContext(ctx)
+	defer cancel()
+
+	result, err := conn.ExecContext(stmtCtx, query, args...)
+	if err != nil {
+		logFailedStatement(query, args, err)
+	}
+	return result, err
+}
+
+// execAffectingRow runs a conditional update, it reports whether the condition matched any row
+func execAffectingRow(ctx context.Context, conn *sql.Conn, query string, args ...interface{}) (bool, error) {
+	result, err := execResult(ctx, conn, query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
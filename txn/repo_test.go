@@ -0,0 +1,241 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/shopspring/decimal"
+)
+
+func TestBookRepoUpdateStock(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectExec(updateStockSQL()).WithArgs(2, 1, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(updateStockSQL()).WithArgs(20, 1, 20).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	books, ctx := NewBookRepo(conn), context.Background()
+	if updated, err := books.UpdateStock(ctx, 1, 2); err != nil || !updated {
+		t.Errorf("got %v, %v for an enough stock, want true", updated, err)
+	}
+	if updated, err := books.UpdateStock(ctx, 1, 20); err != nil || updated {
+		t.Errorf("got %v, %v for a short stock, want false", updated, err)
+	}
+}
+
+func TestBookRepoCreateBook(t *testing.T) {
+	conn, mock := newMockConn(t)
+	book := testBook(1, "Novel", "12.50", 3)
+	mock.ExpectExec(createBookSQL()).WithArgs(1, "Book 1", "Novel", book.PublishedAt, "12.5", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := NewBookRepo(conn).CreateBook(context.Background(), book); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUserRepoBalance(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectExec(debitBalanceSQL()).WithArgs("30.5", 1, "30.5").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(debitBalanceSQL()).WithArgs("1000", 1, "1000").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(creditBalanceSQL()).WithArgs("30.5", 3).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	users, ctx := NewUserRepo(conn), context.Background()
+	if debited, err := users.DebitBalance(ctx, 1, decimal.RequireFromString("30.5")); err != nil || !debited {
+		t.Errorf("got %v, %v for an enough balance, want true", debited, err)
+	}
+	if debited, err := users.DebitBalance(ctx, 1, decimal.NewFromInt(1000)); err != nil || debited {
+		t.Errorf("got %v, %v for a short balance, want false", debited, err)
+	}
+	if credited, err := users.CreditBalance(ctx, 3, decimal.RequireFromString("30.5")); err != nil || credited {
+		t.Errorf("got %v, %v for a missing user, want false", credited, err)
+	}
+}
+
+func TestOrderRepoCreateOrder(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectExec(orderInsertSQL(false, false)).WithArgs(1, 2, 3, nil).WillReturnResult(sqlmock.NewResult(42, 1))
+	mock.ExpectExec(orderInsertSQL(false, true)).WithArgs(1, 2, 3, nil, "key").
+		WillReturnError(&mysql.MySQLError{Number: uint16(ErrDupEntry),
+			Message: "Duplicate entry 'key' for key 'orders." + idempotencyKeyIndex + "'"})
+
+	orders, ctx := NewOrderRepo(conn), context.Background()
+	id, err := orders.CreateOrder(ctx, Order{BookID: 1, UserID: 2, Quality: 3})
+	if err != nil || id != 42 {
+		t.Errorf("got the order %d, %v, want the generated id 42", id, err)
+	}
+	if _, err = orders.CreateOrder(ctx, Order{BookID: 1, UserID: 2, Quality: 3, IdempotencyKey: "key"}); !errors.Is(err, ErrOrderExists) {
+		t.Errorf("got %v, want %v", err, ErrOrderExists)
+	}
+}
+
+// AddStock of an unknown book affects no row, it's not an error of the statement
+func TestBookRepoAddStockNotFound(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectExec(addStockSQL()).WithArgs(3, 9).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	added, err := NewBookRepo(conn).AddStock(context.Background(), 9, 3)
+	if err != nil || added {
+		t.Errorf("got %v and %v, want no row added and no error", added, err)
+	}
+}
+
+func TestOrderRepoGetForUpdateNotFound(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery(orderForUpdateSQL()).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "book_id", "user_id", "quality", "ordered_at", "unit_price"}))
+
+	if _, err := NewOrderRepo(conn).GetForUpdate(context.Background(), 7); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("got %v, want %v", err, ErrOrderNotFound)
+	}
+}
+
+// The pessimistic buy composed of the repositories, sent statement by statement
+func TestBuyPessimisticByRepos(t *testing.T) {
+	db, mock := newMock(t)
+	publishedAt := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(bookSQL(true)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(1, "Book 1", "Novel", publishedAt, "100", 10))
+	mock.ExpectExec(updateStockSQL()).WithArgs(2, 1, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertOrderSQL()).WithArgs(1, 1, 2, "100").WillReturnResult(sqlmock.NewResult(42, 1))
+	mock.ExpectExec(debitBalanceSQL()).WithArgs("200", 1, "200").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	result, err := buyPessimistic(context.Background(), db, noDelay(), 1, 0, 1, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PurchaseResult{OrderID: 42, BookID: 1, UserID: 1, Amount: 2, Cost: decimal.NewFromInt(200)}
+	if result.OrderID != want.OrderID || result.Amount != want.Amount || !result.Cost.Equal(want.Cost) {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+}
+
+// The retry events of a buy carry its book
+func TestBuyPessimisticRetryEventBookID(t *testing.T) {
+	db, mock := newMock(t)
+	noSleep(t)
+	publishedAt := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	deadlock := &mysql.MySQLError{Number: uint16(ErrLockDeadlock), Message: "deadlock"}
+	for _, stockErr := range []error{deadlock, nil} {
+		mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(bookSQL(true)).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+				AddRow(3, "Book 3", "Novel", publishedAt, "100", 10))
+		if stockErr != nil {
+			mock.ExpectExec(updateStockSQL()).WithArgs(2, 3, 2).WillReturnError(stockErr)
+			mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+			continue
+		}
+		mock.ExpectExec(updateStockSQL()).WithArgs(2, 3, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(insertOrderSQL()).WithArgs(3, 1, 2, "100").WillReturnResult(sqlmock.NewResult(42, 1))
+		mock.ExpectExec(debitBalanceSQL()).WithArgs("200", 1, "200").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	events := make(chan RetryEvent, 1)
+	options := noDelay()
+	options.Txn = []TxnOption{WithRetryEvents(events)}
+	if _, err := buyPessimistic(context.Background(), db, options, 1, 0, 3, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event.BookID != 3 || event.Class != RetryLock {
+		t.Errorf("got the event %+v, want a lock retry of the book 3", event)
+	}
+}
+
+// A short balance rolls the buy back after the stock and the order are written
+func TestBuyPessimisticByReposBalanceInsufficient(t *testing.T) {
+	db, mock := newMock(t)
+	publishedAt := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(bookSQL(true)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(1, "Book 1", "Novel", publishedAt, "100", 10))
+	mock.ExpectExec(updateStockSQL()).WithArgs(2, 1, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertOrderSQL()).WithArgs(1, 1, 2, "100").WillReturnResult(sqlmock.NewResult(42, 1))
+	mock.ExpectExec(debitBalanceSQL()).WithArgs("200", 1, "200").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if _, err := buyPessimistic(context.Background(), db, noDelay(), 1, 0, 1, 1, 2); !errors.Is(err, ErrBalanceInsufficient) {
+		t.Errorf("got %v, want %v", err, ErrBalanceInsufficient)
+	}
+}
+
+// An explicit order id is inserted with allow_auto_random_explicit_insert, which is set back afterwards
+func TestOrderRepoCreateOrderExplicitIDRestoresSession(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery("SELECT @@SESSION.allow_auto_random_explicit_insert").
+		WillReturnRows(sqlmock.NewRows([]string{"@@SESSION.allow_auto_random_explicit_insert"}).AddRow("0"))
+	mock.ExpectExec("SET @@SESSION.allow_auto_random_explicit_insert = ON").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(orderInsertSQL(true, false)).WithArgs(1000, 1, 2, 3, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SET @@SESSION.allow_auto_random_explicit_insert = ?").WithArgs("0").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	id, err := NewOrderRepo(conn).CreateOrder(context.Background(), Order{ID: 1000, BookID: 1, UserID: 2, Quality: 3})
+	if err != nil || id != 1000 {
+		t.Errorf("got the order %d, %v, want 1000", id, err)
+	}
+}
+
+// A session which can't be set back fails the insert and its connection is discarded
+func TestOrderRepoCreateOrderDiscardsOnFailedRestore(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery("SELECT @@SESSION.allow_auto_random_explicit_insert").
+		WillReturnRows(sqlmock.NewRows([]string{"@@SESSION.allow_auto_random_explicit_insert"}).AddRow("0"))
+	mock.ExpectExec("SET @@SESSION.allow_auto_random_explicit_insert = ON").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(orderInsertSQL(true, false)).WithArgs(1000, 1, 2, 3, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SET @@SESSION.allow_auto_random_explicit_insert = ?").WithArgs("0").WillReturnError(errors.New("connection lost"))
+
+	if _, err := NewOrderRepo(conn).CreateOrder(context.Background(), Order{ID: 1000, BookID: 1, UserID: 2, Quality: 3}); err == nil {
+		t.Error("the order is created on a session which is not set back")
+	}
+	if !connDone(conn) {
+		t.Error("the connection is not discarded")
+	}
+}
+
+// After an explicit order id the session on TiDB doesn't allow an explicit AUTO_RANDOM value anymore
+func TestOrderRepoCreateOrderExplicitIDOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	if err := prepareData(context.Background(), db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		id, err := NewOrderRepo(conn).CreateOrder(ctx, Order{ID: 1000, BookID: 1, UserID: 1, Quality: 1})
+		if err != nil {
+			return err
+		}
+		if id != 1000 {
+			t.Errorf("got the order id %d, want 1000", id)
+		}
+
+		allowed := ""
+		if err = conn.QueryRowContext(ctx, "SELECT @@SESSION.allow_auto_random_explicit_insert").Scan(&allowed); err != nil {
+			return err
+		}
+		if allowed != "0" {
+			t.Errorf("got allow_auto_random_explicit_insert %s after the insert, want it set back to 0", allowed)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,227 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// InventoryValuation returns the total value of the remaining stock, zero for an empty catalog
+func InventoryValuation(ctx context.Context, db *sql.DB) (decimal.Decimal, error) {
+	var total decimal.NullDecimal
+	err := db.QueryRowContext(ctx, columnSQL("SELECT SUM({stock} * {price}) FROM `books`")).Scan(&total)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	if !total.Valid {
+		return decimal.NewFromInt(0), nil
+	}
+
+	return roundMoney(total.Decimal), nil
+}
+
+// catalogSnapshot reads all the books in one transaction started by readOnlyTxnSQL
+// and returns them with the start ts of the transaction, it's the freshness of the snapshot
+func catalogSnapshot(ctx context.Context, db *sql.DB) ([]Book, uint64, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, readOnlyTxnSQL); err != nil {
+		return nil, 0, err
+	}
+	defer conn.ExecContext(context.Background(), "COMMIT")
+
+	var startTS uint64
+	if err = conn.QueryRowContext(ctx, "SELECT @@tidb_current_ts").Scan(&startTS); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := conn.QueryContext(ctx, columnSQL("SELECT `id`, {title}, {type}, {published_at}, {price}, {stock} "+
+		"FROM `books` ORDER BY `id`"))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var books []Book
+	for rows.Next() {
+		book := Book{}
+		if err = rows.Scan(&book.ID, &book.Title, &book.Type, &book.PublishedAt,
+			money(&book.Price), &book.Stock); err != nil {
+			return nil, 0, err
+		}
+		books = append(books, book)
+	}
+
+	return books, startTS, rows.Err()
+}
+
+// AverageOrderValue returns the average cost of the orders of each user
+func AverageOrderValue(ctx context.Context, db *sql.DB) (map[int]decimal.Decimal, error) {
+	rows, err := db.QueryContext(ctx, columnSQL("SELECT o.`user_id`, AVG(o.{quality} * COALESCE(o.`unit_price`, b.{price})) FROM `orders` o "+
+		"JOIN `books` b ON o.`book_id` = b.`id` GROUP BY o.`user_id`"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	averages := make(map[int]decimal.Decimal)
+	for rows.Next() {
+		userID, average := 0, decimal.Decimal{}
+		if err = rows.Scan(&userID, &average); err != nil {
+			return nil, err
+		}
+		averages[userID] = roundMoney(average)
+	}
+
+	return averages, rows.Err()
+}
+
+// BookDiff is the stock and price change of a book between two snapshots
+type BookDiff struct {
+	BookID      int
+	Added       bool // only in the after snapshot
+	Removed     bool // only in the before snapshot
+	StockBefore int
+	StockAfter  int
+	PriceBefore decimal.Decimal
+	PriceAfter  decimal.Decimal
+}
+
+// DiffSnapshots compares two catalog snapshots, the unchanged books are ignored
+func DiffSnapshots(before, after []Book) []BookDiff {
+	beforeBooks := make(map[int]Book, len(before))
+	for _, book := range before {
+		beforeBooks[book.ID] = book
+	}
+
+	var diffs []BookDiff
+	for _, book := range after {
+		old, exist := beforeBooks[book.ID]
+		delete(beforeBooks, book.ID)
+
+		if !exist {
+			diffs = append(diffs, BookDiff{BookID: book.ID, Added: true,
+				StockAfter: book.Stock, PriceAfter: book.Price})
+			continue
+		}
+
+		if old.Stock != book.Stock || !old.Price.Equal(book.Price) {
+			diffs = append(diffs, BookDiff{BookID: book.ID, StockBefore: old.Stock, StockAfter: book.Stock,
+				PriceBefore: old.Price, PriceAfter: book.Price})
+		}
+	}
+
+	for _, book := range beforeBooks {
+		diffs = append(diffs, BookDiff{BookID: book.ID, Removed: true,
+			StockBefore: book.Stock, PriceBefore: book.Price})
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].BookID < diffs[j].BookID
+	})
+
+	return diffs
+}
+
+// diffCatalog makes the demo buy print the DiffSnapshots of the catalog before and after it
+var diffCatalog = false
+
+// printCatalogDiff prints a line per changed book of diffs, or that nothing changed
+func printCatalogDiff(w io.Writer, diffs []BookDiff) {
+	if len(diffs) == 0 {
+		fmt.Fprintln(w, "the catalog is unchanged")
+		return
+	}
+
+	for _, diff := range diffs {
+		switch {
+		case diff.Added:
+			fmt.Fprintf(w, "book %d: added, stock %d, price %s\n", diff.BookID, diff.StockAfter, diff.PriceAfter.StringFixed(moneyScale))
+		case diff.Removed:
+			fmt.Fprintf(w, "book %d: removed, stock %d, price %s\n", diff.BookID, diff.StockBefore, diff.PriceBefore.StringFixed(moneyScale))
+		default:
+			fmt.Fprintf(w, "book %d: stock %d -> %d, price %s -> %s\n", diff.BookID, diff.StockBefore, diff.StockAfter,
+				diff.PriceBefore.StringFixed(moneyScale), diff.PriceAfter.StringFixed(moneyScale))
+		}
+	}
+}
+
+const maxOrderDetailsLimit = 1000
+
+// OrderDetail is an order with the nickname of its user and the title of its book,
+// they are empty if the user or the book doesn't exist
+type OrderDetail struct {
+	OrderID  int64
+	BookID   int64
+	UserID   int64
+	Quality  int
+	Nickname string
+	Title    string
+}
+
+// queryer runs a query, a *sql.DB, a *sql.Conn and a *sql.Tx all do
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// validateOrderDetailsLimit rejects a limit of listOrderDetails out of [1, maxOrderDetailsLimit]
+func validateOrderDetailsLimit(limit int) error {
+	if limit <= 0 || limit > maxOrderDetailsLimit {
+		return fmt.Errorf("limit must be in [1, %d], got %d", maxOrderDetailsLimit, limit)
+	}
+	return nil
+}
+
+// listOrderDetails lists at most limit orders joined with the users and the books by q,
+// run it on the connection of a read-only transaction so the three tables are read at one snapshot
+func listOrderDetails(ctx context.Context, q queryer, limit int) ([]OrderDetail, error) {
+	if err := validateOrderDetailsLimit(limit); err != nil {
+		return nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, columnSQL("SELECT o.`id`, o.`book_id`, o.`user_id`, o.{quality}, "+
+		"u.{nickname}, b.{title} FROM `orders` o "+
+		"LEFT JOIN `users` u ON o.`user_id` = u.`id` "+
+		"LEFT JOIN `books` b ON o.`book_id` = b.`id` ORDER BY o.`id` LIMIT ?"), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var details []OrderDetail
+	for rows.Next() {
+		detail, nickname, title := OrderDetail{}, sql.NullString{}, sql.NullString{}
+		if err = rows.Scan(&detail.OrderID, &detail.BookID, &detail.UserID, &detail.Quality,
+			&nickname, &title); err != nil {
+			return nil, err
+		}
+
+		detail.Nickname, detail.Title = nickname.String, title.String
+		details = append(details, detail)
+	}
+
+	return details, rows.Err()
+}
@@ -0,0 +1,299 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+)
+
+func TestInventoryValuationRoundsTheSum(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery("SELECT SUM(`stock` * `price`) FROM `books`").
+		WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow("1234.565"))
+
+	total, err := InventoryValuation(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !total.Equal(decimal.RequireFromString("1234.57")) {
+		t.Errorf("got the valuation %s, want 1234.57", total.String())
+	}
+}
+
+// SUM of no rows is NULL, an empty catalog is worth zero
+func TestInventoryValuationEmptyCatalog(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery("SELECT SUM(`stock` * `price`) FROM `books`").
+		WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow(nil))
+
+	total, err := InventoryValuation(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !total.IsZero() {
+		t.Errorf("got the valuation %s of an empty catalog, want 0", total.String())
+	}
+}
+
+func TestInventoryValuationOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	total, err := InventoryValuation(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !total.IsZero() {
+		t.Errorf("got the valuation %s of an empty catalog, want 0", total.String())
+	}
+
+	createTestBooks(t, db, testBook(1, "Novel", "12.50", 4), testBook(2, "Arts", "99.99", 3), testBook(3, "Life", "7.00", 0))
+	if total, err = InventoryValuation(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if want := decimal.RequireFromString("349.97"); !total.Equal(want) {
+		t.Errorf("got the valuation %s, want %s", total.String(), want.String())
+	}
+}
+
+func TestCatalogSnapshot(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec(readOnlyTxnSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT @@tidb_current_ts").
+		WillReturnRows(sqlmock.NewRows([]string{"ts"}).AddRow(uint64(445623098577453057)))
+	mock.ExpectQuery("SELECT `id`, `title`, `type`, `published_at`, `price`, `stock` FROM `books` ORDER BY `id`").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(1, "Book 1", "Novel", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "10.00", 3).
+			AddRow(2, "Book 2", "Arts", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "5.50", 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	books, startTS, err := catalogSnapshot(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startTS != 445623098577453057 {
+		t.Errorf("got the start ts %d, want 445623098577453057", startTS)
+	}
+	if len(books) != 2 || books[0].Stock != 3 || !books[1].Price.Equal(decimal.RequireFromString("5.5")) {
+		t.Errorf("got the books %+v", books)
+	}
+}
+
+func TestCatalogSnapshotOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	createTestBooks(t, db, testBook(1, "Novel", "10.00", 3), testBook(2, "Arts", "5.50", 0))
+
+	books, startTS, err := catalogSnapshot(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if startTS == 0 {
+		t.Error("got a zero start ts")
+	}
+	if len(books) != 2 || books[0].ID != 1 || books[1].ID != 2 {
+		t.Errorf("got the books %+v, want books 1 and 2", books)
+	}
+}
+
+func TestAverageOrderValue(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery("SELECT o.`user_id`, AVG(o.`quality` * COALESCE(o.`unit_price`, b.`price`)) FROM `orders` o " +
+		"JOIN `books` b ON o.`book_id` = b.`id` GROUP BY o.`user_id`").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "average"}).AddRow(1, "33.333333").AddRow(2, "150.0000"))
+
+	averages, err := AverageOrderValue(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(averages) != 2 || !averages[1].Equal(decimal.RequireFromString("33.33")) ||
+		!averages[2].Equal(decimal.RequireFromString("150")) {
+		t.Errorf("got the averages %v, want 1: 33.33 and 2: 150", averages)
+	}
+}
+
+// Bob buys 1 and 2 copies of a book at 10.00 plus 1 at 5.55, Alice buys none
+func TestAverageOrderValueOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	averages, err := AverageOrderValue(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(averages) != 0 {
+		t.Errorf("got the averages %v without any order, want none", averages)
+	}
+
+	createTestBooks(t, db, testBook(1, "Novel", "10.00", 10), testBook(2, "Arts", "5.55", 10))
+	createTestUsers(t, db, User{ID: 1, Nickname: "Bob", Balance: initialBalance},
+		User{ID: 2, Nickname: "Alice", Balance: initialBalance})
+	mustExec(t, db, "INSERT INTO `orders` (`book_id`, `user_id`, `quality`) VALUES (1, 1, 1), (1, 1, 2), (2, 1, 1)")
+
+	if averages, err = AverageOrderValue(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	// (10.00 + 20.00 + 5.55) / 3 = 11.85
+	if want := decimal.RequireFromString("11.85"); len(averages) != 1 || !averages[1].Equal(want) {
+		t.Errorf("got the averages %v, want 1: %s", averages, want.String())
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	before := []Book{
+		testBook(1, "Magazine", "10.00", 10), // changed stock
+		testBook(2, "Novel", "20.00", 5),     // changed price
+		testBook(3, "Novel", "30.00", 1),     // unchanged
+		testBook(4, "Science", "40.00", 2),   // removed
+	}
+	after := []Book{
+		testBook(5, "Science", "50.00", 3), // added
+		testBook(3, "Novel", "30.00", 1),
+		testBook(2, "Novel", "22.00", 5),
+		testBook(1, "Magazine", "10.00", 7),
+	}
+
+	price := decimal.RequireFromString
+	want := []BookDiff{
+		{BookID: 1, StockBefore: 10, StockAfter: 7, PriceBefore: price("10.00"), PriceAfter: price("10.00")},
+		{BookID: 2, StockBefore: 5, StockAfter: 5, PriceBefore: price("20.00"), PriceAfter: price("22.00")},
+		{BookID: 4, Removed: true, StockBefore: 2, PriceBefore: price("40.00")},
+		{BookID: 5, Added: true, StockAfter: 3, PriceAfter: price("50.00")},
+	}
+	if got := DiffSnapshots(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the diff %+v, want %+v", got, want)
+	}
+	if got := DiffSnapshots(before, before); len(got) != 0 {
+		t.Errorf("got the diff %+v of the same snapshot, want none", got)
+	}
+}
+
+func TestPrintCatalogDiff(t *testing.T) {
+	price := decimal.RequireFromString
+	out := &strings.Builder{}
+	printCatalogDiff(out, []BookDiff{
+		{BookID: 1, StockBefore: 10, StockAfter: 7, PriceBefore: price("10"), PriceAfter: price("10")},
+		{BookID: 4, Removed: true, StockBefore: 2, PriceBefore: price("40")},
+		{BookID: 5, Added: true, StockAfter: 3, PriceAfter: price("50.5")},
+	})
+
+	want := "book 1: stock 10 -> 7, price 10.00 -> 10.00\n" +
+		"book 4: removed, stock 2, price 40.00\n" +
+		"book 5: added, stock 3, price 50.50\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+const orderDetailsSQL = "SELECT o.`id`, o.`book_id`, o.`user_id`, o.`quality`, u.`nickname`, b.`title` FROM `orders` o " +
+	"LEFT JOIN `users` u ON o.`user_id` = u.`id` LEFT JOIN `books` b ON o.`book_id` = b.`id` ORDER BY o.`id` LIMIT ?"
+
+// The NULLs of a user or a book the left joins don't find become empty names
+func TestListOrderDetailsNulls(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery(orderDetailsSQL).WithArgs(10).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "book_id", "user_id", "quality", "nickname", "title"}).
+			AddRow(1, 1, 1, 2, "Bob", "Book 1").
+			AddRow(2, 9, 1, 1, "Bob", nil).
+			AddRow(3, 1, 8, 3, nil, "Book 1"))
+
+	details, err := listOrderDetails(context.Background(), db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []OrderDetail{
+		{OrderID: 1, BookID: 1, UserID: 1, Quality: 2, Nickname: "Bob", Title: "Book 1"},
+		{OrderID: 2, BookID: 9, UserID: 1, Quality: 1, Nickname: "Bob"},
+		{OrderID: 3, BookID: 1, UserID: 8, Quality: 3, Title: "Book 1"},
+	}
+	if !reflect.DeepEqual(details, want) {
+		t.Errorf("got %+v, want %+v", details, want)
+	}
+}
+
+func TestListOrderDetailsRejectsLimit(t *testing.T) {
+	db, _ := newMock(t)
+	for _, limit := range []int{0, -1, maxOrderDetailsLimit + 1} {
+		if _, err := listOrderDetails(context.Background(), db, limit); err == nil {
+			t.Errorf("limit %d accepted", limit)
+		}
+	}
+}
+
+// The report joins the orders with their users and books, an order of a deleted book still shows up
+func TestRunReportOrderDetailsOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	createTestBooks(t, db, testBook(2, "Novel", "20.00", 5))
+	mustExec(t, db, "INSERT INTO `orders` (`book_id`, `user_id`, `quality`) VALUES (1, 1, 2), (2, 2, 1)")
+	mustExec(t, db, "DELETE FROM `books` WHERE `id` = 2")
+
+	var bobOrder, aliceOrder int64
+	if err := db.QueryRowContext(ctx, "SELECT `id` FROM `orders` WHERE `user_id` = 1").Scan(&bobOrder); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRowContext(ctx, "SELECT `id` FROM `orders` WHERE `user_id` = 2").Scan(&aliceOrder); err != nil {
+		t.Fatal(err)
+	}
+	want := []OrderDetail{
+		{OrderID: bobOrder, BookID: 1, UserID: 1, Quality: 2, Nickname: "Bob", Title: "Designing Data-Intensive Application"},
+		{OrderID: aliceOrder, BookID: 2, UserID: 2, Quality: 1, Nickname: "Alice"},
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].OrderID < want[j].OrderID })
+
+	withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+		details, err := listOrderDetails(ctx, conn, 10)
+		if err == nil && !reflect.DeepEqual(details, want) {
+			t.Errorf("got %+v, want %+v", details, want)
+		}
+		return err
+	})
+
+	out := &bytes.Buffer{}
+	if err := runReport(ctx, db, ReportOptions{Details: 2}, out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"order details (2):\n",
+		fmt.Sprintf("  %d\tBob bought 2 of Designing Data-Intensive Application\n", bobOrder),
+		fmt.Sprintf("  %d\tAlice bought 1 of deleted book 2\n", aliceOrder),
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("no line %q in the report\n%s", line, out)
+		}
+	}
+}
+
+func TestOrDeleted(t *testing.T) {
+	if got := orDeleted("", "book", 2); got != "deleted book 2" {
+		t.Errorf("got %s of a missing book", got)
+	}
+	if got := orDeleted("Bob", "user", 1); got != "Bob" {
+		t.Errorf("got %s of Bob", got)
+	}
+}
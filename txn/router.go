@@ -0,0 +1,143 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Router sends the writes to the primary and the reads to a read-only endpoint.
+// A replica may lag behind, so a read right after a write may not see it unless WithReadYourWrites is set
+type Router struct {
+	writeDB   *sql.DB
+	readDB    *sql.DB
+	admission *AdmissionController
+	purchase  PurchaseOptions
+
+	// the reads within ryWindow after the last write go to the primary
+	ryWindow  time.Duration
+	mu        sync.Mutex
+	lastWrite time.Time
+}
+
+func NewRouter(writeDB, readDB *sql.DB) *Router {
+	return &Router{writeDB: writeDB, readDB: readDB, purchase: defaultPurchaseOptions()}
+}
+
+// WithPurchaseOptions makes Buy run with options instead of defaultPurchaseOptions
+func (r *Router) WithPurchaseOptions(options PurchaseOptions) *Router {
+	r.purchase = options
+	return r
+}
+
+// WithAdmission makes Buy consult admission before starting, and feeds it the latency of the transaction of the buy
+func (r *Router) WithAdmission(admission *AdmissionController) *Router {
+	r.admission = admission
+	return r
+}
+
+// WithReadYourWrites routes the reads to the primary for window after each write,
+// window should cover the replication lag of the read-only endpoint
+func (r *Router) WithReadYourWrites(window time.Duration) *Router {
+	r.ryWindow = window
+	return r
+}
+
+// wrote marks a write, it's marked even if the write failed since a failed COMMIT may still be applied
+func (r *Router) wrote() {
+	if r.ryWindow <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	r.lastWrite = time.Now()
+	r.mu.Unlock()
+}
+
+// reader returns the primary within the read-your-writes window, otherwise the read-only endpoint
+func (r *Router) reader() *sql.DB {
+	if r.ryWindow <= 0 {
+		return r.readDB
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.lastWrite.IsZero() && time.Since(r.lastWrite) < r.ryWindow {
+		return r.writeDB
+	}
+	return r.readDB
+}
+
+// Buy runs the buy on the primary with the retry semantics of runTxn,
+// it returns a *QuantityExceededError, ErrBuyingPaused or ErrOverloaded without starting if the order is rejected,
+// otherwise the error of runTxn. A replay of an order committed recently returns that order without starting, see skipReplay
+func (r *Router) Buy(ctx context.Context, optimistic bool, goroutineID, orderID, bookID, userID, amount int) (PurchaseResult, error) {
+	if err := r.purchase.checkQuantity(amount); err != nil {
+		return PurchaseResult{}, err
+	}
+	if replay, ok := skipReplay(r.purchase, orderID, bookID, userID, amount); ok {
+		return replay, nil
+	}
+	if err := waitBuying(ctx); err != nil {
+		return PurchaseResult{}, err
+	}
+
+	purchase := r.purchase
+	if r.admission != nil {
+		done, err := r.admission.Admit()
+		if err != nil {
+			return PurchaseResult{}, err
+		}
+		defer done()
+		purchase.Txn = append(purchase.Txn[:len(purchase.Txn):len(purchase.Txn)], WithHooks(r.admission.Hooks()))
+	}
+
+	defer r.wrote()
+	if optimistic {
+		return buyOptimistic(ctx, r.writeDB, purchase, goroutineID, orderID, bookID, userID, amount)
+	}
+
+	return buyPessimistic(ctx, r.writeDB, purchase, goroutineID, orderID, bookID, userID, amount)
+}
+
+func (r *Router) AdjustPricesByType(ctx context.Context, bookType string, factor decimal.Decimal) (int, error) {
+	defer r.wrote()
+	return adjustPricesByType(ctx, r.writeDB, bookType, factor)
+}
+
+func (r *Router) Query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return r.reader().QueryContext(ctx, query, args...)
+}
+
+func (r *Router) QueryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return r.reader().QueryRowContext(ctx, query, args...)
+}
+
+func (r *Router) InventoryValuation(ctx context.Context) (decimal.Decimal, error) {
+	return InventoryValuation(ctx, r.reader())
+}
+
+func (r *Router) AverageOrderValue(ctx context.Context) (map[int]decimal.Decimal, error) {
+	return AverageOrderValue(ctx, r.reader())
+}
+
+func (r *Router) CatalogSnapshot(ctx context.Context) ([]Book, uint64, error) {
+	return catalogSnapshot(ctx, r.reader())
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const routerStockSQL = "SELECT `stock` FROM `books` WHERE `id` = ?"
+
+// A buy runs on the primary, the reads go to the read-only endpoint
+func TestRouterRoutesWritesAndReads(t *testing.T) {
+	writeDB, writeMock := newMock(t)
+	readDB, readMock := newMock(t)
+	boom := errors.New("boom")
+
+	writeMock.ExpectExec("BEGIN PESSIMISTIC").WillReturnError(boom)
+	readMock.ExpectQuery(routerStockSQL).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(7))
+	readMock.ExpectQuery("SELECT SUM(`stock` * `price`) FROM `books`").
+		WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow("12.50"))
+
+	ctx := context.Background()
+	router := NewRouter(writeDB, readDB).WithPurchaseOptions(noDelay())
+	if _, err := router.Buy(ctx, false, 1, 0, 1, 2, 1); !errors.Is(err, boom) {
+		t.Fatalf("got %v by the buy, want the error of the primary", err)
+	}
+
+	stock := 0
+	if err := router.QueryRow(ctx, routerStockSQL, 1).Scan(&stock); err != nil || stock != 7 {
+		t.Errorf("got the stock %d, %v from the read endpoint, want 7", stock, err)
+	}
+	total, err := router.InventoryValuation(ctx)
+	if err != nil || total.StringFixed(moneyScale) != "12.50" {
+		t.Errorf("got the valuation %s, %v from the read endpoint, want 12.50", total, err)
+	}
+}
+
+// Within the read-your-writes window a read goes to the primary, after it back to the read-only endpoint
+func TestRouterReadYourWrites(t *testing.T) {
+	writeDB, writeMock := newMock(t)
+	readDB, readMock := newMock(t)
+
+	writeMock.ExpectExec("BEGIN PESSIMISTIC").WillReturnError(errors.New("boom"))
+	writeMock.ExpectQuery(routerStockSQL).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(9))
+	readMock.ExpectQuery(routerStockSQL).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(10))
+
+	ctx := context.Background()
+	window := 50 * time.Millisecond
+	router := NewRouter(writeDB, readDB).WithPurchaseOptions(noDelay()).WithReadYourWrites(window)
+	router.Buy(ctx, false, 1, 0, 1, 2, 1)
+
+	stock := 0
+	if err := router.QueryRow(ctx, routerStockSQL, 1).Scan(&stock); err != nil || stock != 9 {
+		t.Errorf("got the stock %d, %v right after the buy, want 9 from the primary", stock, err)
+	}
+
+	time.Sleep(window)
+	if err := router.QueryRow(ctx, routerStockSQL, 1).Scan(&stock); err != nil || stock != 10 {
+		t.Errorf("got the stock %d, %v after the window, want 10 from the read endpoint", stock, err)
+	}
+}
+
+// runBuyOn reports a shed purchase and goes on, the shed one runs no SQL
+func TestRunBuyOnShedsOverloaded(t *testing.T) {
+	writeDB, _ := newMock(t)
+	readDB, readMock := newMock(t)
+	readMock.ExpectQuery(routerStockSQL).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"stock"}).AddRow(10))
+
+	options := BuyOptions{BookID: 1, UserID: 2, Amount: 1, Concurrency: 1, MaxInFlight: 1, Purchase: noDelay()}
+	router := newBuyRouter(writeDB, readDB, options)
+	done, err := router.admission.Admit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	if err := runBuyOn(context.Background(), router, options); err != nil {
+		t.Errorf("a shed purchase failed the buy: %v", err)
+	}
+}
+
+func TestRunBuyThroughReadEndpointOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the primary doubles as the read endpoint here, the buys must still land on the primary
+	options := BuyOptions{BookID: 1, UserID: 2, Amount: 1, Concurrency: 2, ReadYourWrites: time.Second, Purchase: noDelay()}
+	if err := runBuyOn(ctx, newBuyRouter(db, db, options), options); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertCommitted(ctx, db, 1, initialBookStock-2); err != nil {
+		t.Error(err)
+	}
+}
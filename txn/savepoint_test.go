@@ -0,0 +1,114 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// The savepoint statements quote the name
+func TestSavepointStatements(t *testing.T) {
+	conn, mock := newMockConn(t)
+	mock.ExpectExec("SAVEPOINT `item_0`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT `item_0`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("RELEASE SAVEPOINT `item_0`").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ctx := context.Background()
+	if err := Savepoint(ctx, conn, "item_0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RollbackTo(ctx, conn, "item_0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseSavepoint(ctx, conn, "item_0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A failed savepoint statement tells the savepoint and wraps the error of the driver
+func TestSavepointErrors(t *testing.T) {
+	unknown := errors.New("SAVEPOINT item_0 does not exist")
+	for _, test := range []struct {
+		statement string
+		run       func(ctx context.Context, conn *sql.Conn, name string) error
+		want      string
+	}{
+		{"SAVEPOINT `item_0`", Savepoint, "savepoint item_0"},
+		{"ROLLBACK TO SAVEPOINT `item_0`", RollbackTo, "rollback to savepoint item_0"},
+		{"RELEASE SAVEPOINT `item_0`", ReleaseSavepoint, "release savepoint item_0"},
+	} {
+		conn, mock := newMockConn(t)
+		mock.ExpectExec(test.statement).WillReturnError(unknown)
+
+		err := test.run(context.Background(), conn, "item_0")
+		if !errors.Is(err, unknown) || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("got %v of %s, want it starting with '%s' and wrapping the driver error", err, test.statement, test.want)
+		}
+	}
+}
+
+// expectCartItem expects the statements of buyCartItem for a book in stock and the release of its savepoint
+func expectCartItem(mock sqlmock.Sqlmock, savepoint string, bookID, amount int, price, cost string, orderID int64) {
+	publishedAt := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("SAVEPOINT `" + savepoint + "`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(bookSQL(true)).WithArgs(bookID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(bookID, "Book", "Novel", publishedAt, price, 10))
+	mock.ExpectExec(updateStockSQL()).WithArgs(amount, bookID, amount).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertOrderSQL()).WithArgs(bookID, 1, amount, price).WillReturnResult(sqlmock.NewResult(orderID, 1))
+	mock.ExpectExec(debitBalanceSQL()).WithArgs(cost, 1, cost).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("RELEASE SAVEPOINT `" + savepoint + "`").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// The sold out item of three is rolled back to its savepoint, the other two commit in the same transaction
+func TestBuyCartBestEffortOneOutOfStock(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectCartItem(mock, "item_0", 1, 2, "100", "200", 41)
+	expectCartItem(mock, "item_1", 2, 1, "80", "80", 42)
+	mock.ExpectExec("SAVEPOINT `item_2`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(bookSQL(true)).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(3, "Book", "Novel", time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC), "60", 0))
+	mock.ExpectExec(updateStockSQL()).WithArgs(1, 3, 1).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT `item_2`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	results, err := buyCartBestEffort(context.Background(), db, noDelay(), 1,
+		[]CartItem{{BookID: 3, Amount: 1}, {BookID: 1, Amount: 2}, {BookID: 2, Amount: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || !errors.Is(results[2].Err, ErrStockInsufficient) {
+		t.Fatalf("got %+v, want the third item out of stock", results)
+	}
+	results[2].Err = nil
+	want := []CartItemResult{
+		{Item: CartItem{BookID: 1, Amount: 2}, OrderID: 41},
+		{Item: CartItem{BookID: 2, Amount: 1}, OrderID: 42},
+		{Item: CartItem{BookID: 3, Amount: 1}},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got %+v, want %+v", results, want)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// skipDDL skips ensureSchema for the users who manage the schema themselves
+var skipDDL = false
+
+// quoteIdentifier quotes a database or table name
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// schemaSQL returns the statements creating the bookshop schema the helpers use,
+// the columns follow `tiup demo bookshop prepare` with the names in columnNames. The order ids are AUTO_RANDOM,
+// so the concurrent inserts scatter across the regions instead of writing to the tail one
+func schemaSQL(database string) []string {
+	types := make([]string, 0, len(bookTypes))
+	for _, bookType := range bookTypes {
+		types = append(types, quoteSQLString(bookType))
+	}
+	schema := quoteIdentifier(database)
+
+	return []string{
+		"CREATE DATABASE IF NOT EXISTS " + schema,
+		columnSQL("CREATE TABLE IF NOT EXISTS " + schema + ".`books` (" +
+			"`id` bigint NOT NULL, " +
+			"{title} varchar(100) NOT NULL, " +
+			"{type} enum(" + strings.Join(types, ", ") + ") NOT NULL, " +
+			"{published_at} datetime NOT NULL, " +
+			"{stock} int DEFAULT '0', " +
+			"{price} decimal(15,2) DEFAULT '0.0', " +
+			"PRIMARY KEY (`id`) CLUSTERED)"),
+		columnSQL("CREATE TABLE IF NOT EXISTS " + schema + ".`users` (" +
+			"`id` bigint NOT NULL, " +
+			"{balance} decimal(15,2) DEFAULT '0.0', " +
+			"{nickname} varchar(100) NOT NULL, " +
+			"PRIMARY KEY (`id`) CLUSTERED, " +
+			"UNIQUE KEY `nickname` ({nickname}))"),
+		columnSQL("CREATE TABLE IF NOT EXISTS " + schema + ".`orders` (" +
+			"`id` bigint NOT NULL AUTO_RANDOM, " +
+			"`book_id` bigint NOT NULL, " +
+			"`user_id` bigint NOT NULL, " +
+			"{quality} tinyint NOT NULL, " +
+			"`ordered_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+			"`unit_price` decimal(15,2) DEFAULT NULL, " +
+			"`idempotency_key` varchar(64) DEFAULT NULL, " +
+			"PRIMARY KEY (`id`) CLUSTERED, " +
+			"KEY `orders_book_id_idx` (`book_id`), " +
+			"KEY `orders_ordered_at_idx` (`ordered_at`), " +
+			"UNIQUE KEY `" + idempotencyKeyIndex + "` (`idempotency_key`))"),
+		// an `orders` table created before, like by `tiup demo bookshop prepare`, gets the unit price too.
+		// Its existing orders have none, they're refunded and checked at the current price
+		"ALTER TABLE " + schema + ".`orders` ADD COLUMN IF NOT EXISTS `unit_price` decimal(15,2) DEFAULT NULL",
+		// and the index of the purge, which deletes the old orders batch by batch without a full table scan
+		"ALTER TABLE " + schema + ".`orders` ADD INDEX IF NOT EXISTS `orders_ordered_at_idx` (`ordered_at`)",
+	}
+}
+
+// ensureSchema creates the database and the tables if they don't exist, it's idempotent.
+// db must not select the database, it may not exist yet
+func ensureSchema(ctx context.Context, db *sql.DB, database string) error {
+	for _, ddl := range schemaSQL(database) {
+		if _, err := db.ExecContext(ctx, ddl); err != nil {
+			return fmt.Errorf("ensure schema: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// openTestServer connects to TiDB of the test without a database, database is dropped before and after the test
+func openTestServer(t *testing.T, database string) *sql.DB {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("invalid %s: %v", testDSNEnv, err)
+	}
+	config.DBName = ""
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "DROP DATABASE IF EXISTS "+quoteIdentifier(database))
+	t.Cleanup(func() {
+		mustExec(t, db, "DROP DATABASE IF EXISTS "+quoteIdentifier(database))
+		db.Close()
+	})
+	return db
+}
+
+// ensureSchema creates a fresh database, a second run changes nothing,
+// and the columns have the types the helpers expect
+func TestEnsureSchemaTwiceOnTiDB(t *testing.T) {
+	const database = "bookshop_schema_test"
+	db := openTestServer(t, database)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := ensureSchema(ctx, db, database); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+	}
+
+	for _, test := range []struct {
+		table, column, dataType string
+		precision, scale        int
+	}{
+		{"books", "id", "bigint", 0, 0},
+		{"books", "title", "varchar", 0, 0},
+		{"books", "type", "enum", 0, 0},
+		{"books", "published_at", "datetime", 0, 0},
+		{"books", "stock", "int", 0, 0},
+		{"books", "price", "decimal", 15, 2},
+		{"users", "id", "bigint", 0, 0},
+		{"users", "balance", "decimal", 15, 2},
+		{"users", "nickname", "varchar", 0, 0},
+		{"orders", "id", "bigint", 0, 0},
+		{"orders", "book_id", "bigint", 0, 0},
+		{"orders", "user_id", "bigint", 0, 0},
+		{"orders", "quality", "tinyint", 0, 0},
+		{"orders", "ordered_at", "datetime", 0, 0},
+		{"orders", "unit_price", "decimal", 15, 2},
+		{"orders", "idempotency_key", "varchar", 0, 0},
+	} {
+		dataType, precision, scale := "", sql.NullInt64{}, sql.NullInt64{}
+		err := db.QueryRowContext(ctx, "SELECT `DATA_TYPE`, `NUMERIC_PRECISION`, `NUMERIC_SCALE` FROM INFORMATION_SCHEMA.COLUMNS "+
+			"WHERE `TABLE_SCHEMA` = ? AND `TABLE_NAME` = ? AND `COLUMN_NAME` = ?", database, test.table, test.column).
+			Scan(&dataType, &precision, &scale)
+		if err == sql.ErrNoRows {
+			t.Errorf("%s.%s doesn't exist", test.table, test.column)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dataType != test.dataType {
+			t.Errorf("%s.%s is %s, want %s", test.table, test.column, dataType, test.dataType)
+		}
+		if test.dataType == "decimal" && (precision.Int64 != int64(test.precision) || scale.Int64 != int64(test.scale)) {
+			t.Errorf("%s.%s is decimal(%d,%d), want decimal(%d,%d)",
+				test.table, test.column, precision.Int64, scale.Int64, test.precision, test.scale)
+		}
+	}
+}
+
+// The statements of schemaSQL are all idempotent
+func TestSchemaSQLIfNotExists(t *testing.T) {
+	for _, ddl := range schemaSQL("bookshop") {
+		if !strings.HasPrefix(ddl, "CREATE DATABASE IF NOT EXISTS ") && !strings.HasPrefix(ddl, "CREATE TABLE IF NOT EXISTS ") &&
+			!strings.Contains(ddl, " ADD COLUMN IF NOT EXISTS ") && !strings.Contains(ddl, " ADD INDEX IF NOT EXISTS ") {
+			t.Errorf("%s is not idempotent", ddl)
+		}
+	}
+}
+
+// An `orders` table of `tiup demo bookshop prepare`, without the unit price and the index of the purge,
+// gets both and keeps its orders
+func TestEnsureSchemaUpgradesOrdersOnTiDB(t *testing.T) {
+	const database = "bookshop_tiup_test"
+	db := openTestServer(t, database)
+	ctx := context.Background()
+	mustExec(t, db, "CREATE DATABASE "+quoteIdentifier(database))
+	mustExec(t, db, "CREATE TABLE "+quoteIdentifier(database)+".`orders` (`id` bigint NOT NULL, `book_id` bigint NOT NULL, "+
+		"`user_id` bigint NOT NULL, `quality` tinyint NOT NULL, `ordered_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP, "+
+		"PRIMARY KEY (`id`) CLUSTERED, KEY `orders_book_id_idx` (`book_id`))")
+	mustExec(t, db, "INSERT INTO "+quoteIdentifier(database)+".`orders` (`id`, `book_id`, `user_id`, `quality`) VALUES (1, 1, 1, 2)")
+
+	if err := ensureSchema(ctx, db, database); err != nil {
+		t.Fatal(err)
+	}
+	unitPrice := sql.NullString{}
+	if err := db.QueryRowContext(ctx, "SELECT `unit_price` FROM "+quoteIdentifier(database)+".`orders` WHERE `id` = 1").
+		Scan(&unitPrice); err != nil {
+		t.Fatal(err)
+	}
+	if unitPrice.Valid {
+		t.Errorf("got the unit price %s of an existing order, want NULL", unitPrice.String)
+	}
+
+	indexes := 0
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.statistics "+
+		"WHERE table_schema = ? AND table_name = 'orders' AND index_name = 'orders_ordered_at_idx'", database).
+		Scan(&indexes); err != nil {
+		t.Fatal(err)
+	}
+	if indexes != 1 {
+		t.Errorf("got %d columns of orders_ordered_at_idx, want 1", indexes)
+	}
+}
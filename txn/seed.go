@@ -0,0 +1,88 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+var bookTypes = []string{"Magazine", "Novel", "Life", "Arts", "Comics", "Education & Reference",
+	"Humanities & Social Sciences", "Science & Technology", "Kids", "Sports"}
+
+var titleWords = []string{"Data", "Distributed", "Systems", "Golang", "Transaction", "Database",
+	"Design", "Art", "Practice", "Guide", "Story", "Night", "River", "Mountain", "City", "Garden"}
+
+// randomSeedIDBase is the id before the first book and user of SeedRandom,
+// far above the demo rows and the books of -seed-books
+const randomSeedIDBase = 1000000
+
+// SeedRandom upserts n books and n users generated from seed after randomSeedIDBase, the same seed always
+// writes the same rows. They're written by the bulk inserts, every statement commits on its own,
+// so a failed seed can simply run again
+func SeedRandom(ctx context.Context, db *sql.DB, n int, seed int64) error {
+	if n <= 0 {
+		return fmt.Errorf("number of random rows must be positive, got %d", n)
+	}
+	books, users := randomRows(n, seed)
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = createBooksBulk(ctx, conn, books, 1000); err != nil {
+		return err
+	}
+	_, err = createUsersBulk(ctx, conn, users, 1000)
+	return err
+}
+
+// randomBook generates the book id from random, published in the 20 years since 2000
+func randomBook(random *rand.Rand, id int) Book {
+	baseTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	title := fmt.Sprintf("%s %s %s", titleWords[random.Intn(len(titleWords))],
+		titleWords[random.Intn(len(titleWords))], titleWords[random.Intn(len(titleWords))])
+	bookType := bookTypes[random.Intn(len(bookTypes))]
+	publishedAt := baseTime.Add(time.Duration(random.Int63n(int64(20 * 365 * 24 * time.Hour)))).Truncate(time.Second)
+	price := decimal.New(random.Int63n(100000)+100, -2)
+	stock := random.Intn(100)
+
+	return Book{ID: id, Title: title, Type: bookType, PublishedAt: publishedAt, Price: price, Stock: stock}
+}
+
+// randomRows generates the n books and n users of SeedRandom from seed
+func randomRows(n int, seed int64) ([]Book, []User) {
+	random := rand.New(rand.NewSource(seed))
+	books, users := make([]Book, 0, n), make([]User, 0, n)
+	for i := 1; i <= n; i++ {
+		books = append(books, randomBook(random, randomSeedIDBase+i))
+	}
+
+	for i := 1; i <= n; i++ {
+		id := randomSeedIDBase + i
+		balance := decimal.New(random.Int63n(10000000), -2)
+		users = append(users, User{ID: id, Nickname: fmt.Sprintf("user-%d", id), Balance: balance})
+	}
+
+	return books, users
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestRandomRowsSameSeed(t *testing.T) {
+	books, users := randomRows(50, 42)
+	sameBooks, sameUsers := randomRows(50, 42)
+	if !reflect.DeepEqual(books, sameBooks) || !reflect.DeepEqual(users, sameUsers) {
+		t.Error("the same seed generates different rows")
+	}
+
+	otherBooks, _ := randomRows(50, 43)
+	if reflect.DeepEqual(books, otherBooks) {
+		t.Error("another seed generates the same books")
+	}
+
+	if books[0].ID != randomSeedIDBase+1 || users[49].ID != randomSeedIDBase+50 {
+		t.Errorf("got the ids %d and %d, want them from %d", books[0].ID, users[49].ID, randomSeedIDBase+1)
+	}
+	for _, book := range books {
+		if -book.Price.Exponent() > moneyScale || !book.Price.IsPositive() || book.Stock < 0 {
+			t.Errorf("invalid book %+v", book)
+		}
+	}
+}
+
+func TestSeedRandomRejectsNonPositive(t *testing.T) {
+	if err := SeedRandom(context.Background(), nil, 0, 1); err == nil {
+		t.Error("zero rows are accepted")
+	}
+}
+
+// The rows of two seeds by the same seed, with the rows deleted in between, are the same
+func TestSeedRandomSameSeedOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	read := func() ([]Book, []User) {
+		var books []Book
+		var users []User
+		withTestConn(t, db, func(ctx context.Context, conn *sql.Conn) error {
+			var err error
+			if books, err = ListBooks(ctx, conn); err != nil {
+				return err
+			}
+			users, err = ListUsers(ctx, conn)
+			return err
+		})
+		return books, users
+	}
+
+	if err := SeedRandom(ctx, db, 100, 7); err != nil {
+		t.Fatal(err)
+	}
+	books, users := read()
+	if len(books) != 100 || len(users) != 100 {
+		t.Fatalf("got %d books and %d users, want 100 each", len(books), len(users))
+	}
+
+	mustExec(t, db, "DELETE FROM `books`")
+	mustExec(t, db, "DELETE FROM `users`")
+	if err := SeedRandom(ctx, db, 100, 7); err != nil {
+		t.Fatal(err)
+	}
+	sameBooks, sameUsers := read()
+	if !reflect.DeepEqual(books, sameBooks) || !reflect.DeepEqual(users, sameUsers) {
+		t.Error("the same seed writes different rows")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// orderNoSequence is the sequence of the human-readable order numbers
+const orderNoSequence = "seq_order_no"
+
+// orderNoCache is the CACHE of orderNoSequence, a TiDB instance allocates this many numbers at once
+// so most NEXTVAL calls of a load test don't need a round trip to the storage
+var orderNoCache = 1000
+
+func createOrderNoSequenceSQL(cache int) string {
+	return fmt.Sprintf("CREATE SEQUENCE IF NOT EXISTS %s START WITH 1 INCREMENT BY 1 CACHE %d",
+		quoteIdentifier(orderNoSequence), cache)
+}
+
+// NextOrderNo allocates the next order number from orderNoSequence. The sequence is created on conn
+// if it doesn't exist, on the first buy or after it was dropped, unless skipDDL. A DDL commits the transaction
+// it runs in, so conn must not be in one. The numbers are unique, and increasing on a connection,
+// but the numbers of different TiDB instances interleave by CACHE
+func NextOrderNo(ctx context.Context, conn *sql.Conn) (int, error) {
+	orderNo, err := nextOrderNo(ctx, conn)
+	mysqlErr := &mysql.MySQLError{}
+	if !errors.As(err, &mysqlErr) || TiDBErrorCode(mysqlErr.Number) != ErrNoSuchTable {
+		return orderNo, err
+	}
+	if skipDDL {
+		return 0, fmt.Errorf("sequence %s doesn't exist, create it or run without -skip-ddl: %w", orderNoSequence, err)
+	}
+
+	if _, err = conn.ExecContext(ctx, createOrderNoSequenceSQL(orderNoCache)); err != nil {
+		return 0, fmt.Errorf("create sequence %s: %w", orderNoSequence, err)
+	}
+	return nextOrderNo(ctx, conn)
+}
+
+func nextOrderNo(ctx context.Context, conn *sql.Conn) (int, error) {
+	orderNo := 0
+	err := conn.QueryRowContext(ctx, "SELECT NEXTVAL("+quoteIdentifier(orderNoSequence)+")").Scan(&orderNo)
+	return orderNo, err
+}
+
+// allocOrderID returns the order id of a buy, the next order number if sequence is set, otherwise orderID,
+// which is zero unless PurchaseOptions.ExplicitOrderID is set. The number is allocated out of the transaction
+// of the buy on a connection of its own, so the sequence can be created and the retries insert the same number
+func allocOrderID(ctx context.Context, db *sql.DB, sequence bool, orderID int) (int, error) {
+	if !sequence {
+		return orderID, nil
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return NextOrderNo(ctx, conn)
+}
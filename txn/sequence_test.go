@@ -0,0 +1,129 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+var nextOrderNoSQL = "SELECT NEXTVAL(`" + orderNoSequence + "`)"
+
+// A missing sequence is created on the connection and the number is allocated again
+func TestNextOrderNoCreatesMissingSequence(t *testing.T) {
+	conn, mock := newMockConn(t)
+	noSuchTable := &mysql.MySQLError{Number: uint16(ErrNoSuchTable), Message: "Table 'bookshop.seq_order_no' doesn't exist"}
+	mock.ExpectQuery(nextOrderNoSQL).WillReturnError(noSuchTable)
+	mock.ExpectExec(createOrderNoSequenceSQL(orderNoCache)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(nextOrderNoSQL).WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(1))
+
+	orderNo, err := NextOrderNo(context.Background(), conn)
+	if err != nil || orderNo != 1 {
+		t.Errorf("got the order number %d, %v, want 1", orderNo, err)
+	}
+}
+
+// With -skip-ddl a missing sequence fails the allocation without a DDL
+func TestNextOrderNoSkipDDL(t *testing.T) {
+	defaultSkipDDL := skipDDL
+	skipDDL = true
+	t.Cleanup(func() { skipDDL = defaultSkipDDL })
+
+	conn, mock := newMockConn(t)
+	mock.ExpectQuery(nextOrderNoSQL).WillReturnError(&mysql.MySQLError{Number: uint16(ErrNoSuchTable), Message: "doesn't exist"})
+
+	_, err := NextOrderNo(context.Background(), conn)
+	mysqlErr := &mysql.MySQLError{}
+	if !errors.As(err, &mysqlErr) || TiDBErrorCode(mysqlErr.Number) != ErrNoSuchTable {
+		t.Errorf("got %v, want the missing sequence", err)
+	}
+}
+
+// The numbers allocated by concurrent connections are unique, and increasing on each connection
+func TestNextOrderNoUniqueAndMonotonicOnTiDB(t *testing.T) {
+	const connections, perConnection = 8, 50
+	db := openTestDB(t)
+	ctx := context.Background()
+	mustExec(t, db, "DROP SEQUENCE IF EXISTS "+quoteIdentifier(orderNoSequence))
+
+	wg, numbers, errs := sync.WaitGroup{}, make([][]int, connections), make([]error, connections)
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer conn.Close()
+
+			for j := 0; j < perConnection; j++ {
+				orderNo, err := NextOrderNo(ctx, conn)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				numbers[i] = append(numbers[i], orderNo)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int]bool{}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		for j, orderNo := range numbers[i] {
+			if seen[orderNo] {
+				t.Fatalf("order number %d is allocated twice", orderNo)
+			}
+			seen[orderNo] = true
+			if j > 0 && orderNo <= numbers[i][j-1] {
+				t.Errorf("connection %d got %d after %d, want increasing", i, orderNo, numbers[i][j-1])
+			}
+		}
+	}
+}
+
+// A buy numbering its order by the sequence creates it if it's missing
+func TestBuyBySequenceCreatesItOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "DROP SEQUENCE IF EXISTS "+quoteIdentifier(orderNoSequence))
+
+	options := noDelay()
+	options.SequenceOrderNo = true
+	first, err := buyPessimistic(ctx, db, options, 1, 0, 1, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := buyOptimistic(ctx, db, options, 1, 0, 1, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.OrderID <= 0 || second.OrderID <= first.OrderID {
+		t.Errorf("got the order numbers %d and %d, want them positive and increasing", first.OrderID, second.OrderID)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestBoundedStalenessSQL(t *testing.T) {
+	want := "SELECT `id`, `title`, `type`, `published_at`, `price`, `stock` FROM `books` " +
+		"AS OF TIMESTAMP TIDB_BOUNDED_STALENESS(NOW() - INTERVAL 5 SECOND, NOW()) WHERE `id` = ?"
+	if got := boundedStalenessSQL(5); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestReadBookBoundedStaleness(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery(boundedStalenessSQL(5)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(1, "Book 1", "Novel", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "100.00", 7))
+	mock.ExpectQuery(boundedStalenessSQL(5)).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}))
+
+	ctx := context.Background()
+	book, err := readBookBoundedStaleness(ctx, db, 1, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Stock != 7 {
+		t.Errorf("got the stock %d, want 7", book.Stock)
+	}
+	if _, err = readBookBoundedStaleness(ctx, db, 2, 5*time.Second); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("got %v, want ErrBookNotFound", err)
+	}
+
+	for _, bound := range []time.Duration{0, 500 * time.Millisecond, 1500 * time.Millisecond, -time.Second} {
+		if _, err = readBookBoundedStaleness(ctx, db, 1, bound); err == nil {
+			t.Errorf("the bound %s is accepted", bound)
+		}
+	}
+}
+
+// The bounded stale read after a buy returns the stock before or after it, never the one of an earlier test
+func TestReadBookBoundedStalenessOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * time.Second)
+	if _, err := buyPessimistic(ctx, db, noDelay(), 1, 1001, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	book, err := readBookBoundedStaleness(ctx, db, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Stock != initialBookStock && book.Stock != initialBookStock-3 {
+		t.Errorf("got the stock %d, want %d or %d", book.Stock, initialBookStock, initialBookStock-3)
+	}
+}
+
+// A stale read before the GC safe point is retried with half the staleness
+func TestReadBookStaleReadHalvesBeforeGCSafePoint(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery(staleReadSQL(4)).WithArgs(1).
+		WillReturnError(&mysql.MySQLError{Number: uint16(ErrGCTooEarly), Message: "GC life time is shorter than transaction duration"})
+	mock.ExpectQuery(staleReadSQL(2)).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "title", "type", "published_at", "price", "stock"}).
+			AddRow(1, "Book 1", "Novel", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "100.00", 7))
+
+	book, inEffect, err := readBookStaleRead(context.Background(), db, 1, 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Stock != 7 || inEffect != 2*time.Second {
+		t.Errorf("got the stock %d %s ago, want 7 2s ago", book.Stock, inEffect)
+	}
+}
+
+// The stale read a second after a buy still sees the seeded stock
+func TestReadBookStaleReadOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * time.Second)
+	if _, err := buyPessimistic(ctx, db, noDelay(), 1, 1001, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	book, _, err := readBookStaleRead(ctx, db, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Stock != initialBookStock {
+		t.Errorf("got the stock %d a second ago, want %d", book.Stock, initialBookStock)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// restock adds amount to the stock of a book in a transaction of the given mode and opts.
+// Like the buys it waits delay inside the transaction, so it overlaps with the concurrent buys,
+// an optimistic one then fails to commit with a write conflict and retries, a pessimistic one waits for the lock
+func restock(ctx context.Context, db *sql.DB, optimistic bool, delay time.Duration, bookID, amount int, opts ...TxnOption) error {
+	if amount <= 0 {
+		return fmt.Errorf("%w, got %d", ErrInvalidAmount, amount)
+	}
+
+	logger.Infof("\nrestock %d books(id: %d)", amount, bookID)
+
+	return runTxn(ctx, db, optimistic, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		if err := artificialDelay(ctx, delay); err != nil {
+			return err
+		}
+		books := NewBookRepo(conn)
+
+		added, err := books.AddStock(ctx, bookID, amount)
+		if err != nil {
+			return err
+		}
+		logger.Infof("/* restock */ %s successful", addStockSQL())
+
+		if !added {
+			return fmt.Errorf("restock book %d: %w", bookID, ErrBookNotFound)
+		}
+		return nil
+	}, opts...)
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// A non-positive amount is rejected without any statement
+func TestRestockRejectsAmount(t *testing.T) {
+	db, _ := newMock(t)
+	for _, amount := range []int{0, -1} {
+		if err := restock(context.Background(), db, false, 0, 1, amount); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("got %v for the amount %d, want %v", err, amount, ErrInvalidAmount)
+		}
+	}
+}
+
+// An unknown book updates no row, the restock is rolled back with ErrBookNotFound
+func TestRestockBookNotFound(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(addStockSQL()).WithArgs(3, 9).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := restock(context.Background(), db, false, 0, 9, 3); !errors.Is(err, ErrBookNotFound) {
+		t.Errorf("got %v, want %v", err, ErrBookNotFound)
+	}
+}
+
+func TestRestock(t *testing.T) {
+	for _, optimistic := range []bool{false, true} {
+		db, mock := newMock(t)
+		begin := "BEGIN PESSIMISTIC"
+		if optimistic {
+			begin = "BEGIN OPTIMISTIC"
+		}
+		mock.ExpectExec(begin).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(addStockSQL()).WithArgs(3, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		if err := restock(context.Background(), db, optimistic, 0, 1, 3); err != nil {
+			t.Errorf("optimistic %v: %v", optimistic, err)
+		}
+	}
+}
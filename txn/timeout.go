@@ -0,0 +1,118 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// statementTimeout, maxExecutionTime and retryOnTimeout are the statement limits runTxn applies,
+// set by -statement-timeout, -max-execution-time and -retry-on-timeout
+var (
+	statementTimeout = time.Duration(0)
+	maxExecutionTime = time.Duration(0)
+	retryOnTimeout   = false
+)
+
+// statementKey is the context key of the statement limits of a TxnFunc
+type statementKey struct{}
+
+type statementLimits struct {
+	timeout          time.Duration
+	maxExecutionTime time.Duration
+}
+
+// WithStatementTimeout cancels each statement of the repo helpers run by the TxnFunc after d on the client,
+// so a statement stuck on the storage can't hang the transaction. A canceled statement breaks its connection
+func WithStatementTimeout(d time.Duration) TxnOption {
+	return func(o *txnOptions) {
+		o.statementTimeout = d
+	}
+}
+
+// WithMaxExecutionTime is the server side WithStatementTimeout, the SELECT statements of the repo helpers
+// get a MAX_EXECUTION_TIME hint and TiDB interrupts them after d. Only SELECT takes the hint
+func WithMaxExecutionTime(d time.Duration) TxnOption {
+	return func(o *txnOptions) {
+		o.maxExecutionTime = d
+	}
+}
+
+// WithRetryOnTimeout retries the transaction if a statement timed out by WithStatementTimeout
+// or WithMaxExecutionTime, a timeout isn't retried by default
+func WithRetryOnTimeout() TxnOption {
+	return func(o *txnOptions) {
+		o.retryOnTimeout = true
+	}
+}
+
+// statementTxnOptions returns the statement limits of the flags
+func statementTxnOptions() []TxnOption {
+	var opts []TxnOption
+	if statementTimeout > 0 {
+		opts = append(opts, WithStatementTimeout(statementTimeout))
+	}
+	if maxExecutionTime > 0 {
+		opts = append(opts, WithMaxExecutionTime(maxExecutionTime))
+	}
+	if retryOnTimeout {
+		opts = append(opts, WithRetryOnTimeout())
+	}
+	return opts
+}
+
+// withStatementLimits passes the statement limits of options to the repo helpers run with ctx
+func withStatementLimits(ctx context.Context, options *txnOptions) context.Context {
+	if options.statementTimeout <= 0 && options.maxExecutionTime <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, statementKey{},
+		statementLimits{timeout: options.statementTimeout, maxExecutionTime: options.maxExecutionTime})
+}
+
+// statementContext returns the context of a statement, which times out by WithStatementTimeout
+func statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	limits, ok := ctx.Value(statementKey{}).(statementLimits)
+	if !ok || limits.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, limits.timeout)
+}
+
+// limitedSQL adds the MAX_EXECUTION_TIME hint of WithMaxExecutionTime to a SELECT statement
+func limitedSQL(ctx context.Context, query string) string {
+	limits, ok := ctx.Value(statementKey{}).(statementLimits)
+	if !ok || limits.maxExecutionTime <= 0 || len(query) < 7 || !strings.EqualFold(query[:7], "SELECT ") {
+		return query
+	}
+	return fmt.Sprintf("%s /*+ MAX_EXECUTION_TIME(%d) */%s",
+		query[:6], limits.maxExecutionTime.Milliseconds(), query[6:])
+}
+
+// isStatementTimeout reports whether err is a statement timed out on the client or interrupted by the server
+func isStatementTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	mysqlErr := &mysql.MySQLError{}
+	return errors.As(err, &mysqlErr) && TiDBErrorCode(mysqlErr.Number) == ErrMaxExecutionTime
+}
@@ -0,0 +1,158 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestLimitedSQL(t *testing.T) {
+	limited := withStatementLimits(context.Background(), &txnOptions{maxExecutionTime: 1500 * time.Millisecond})
+	for _, test := range []struct {
+		ctx   context.Context
+		query string
+		want  string
+	}{
+		{limited, "SELECT SLEEP(2)", "SELECT /*+ MAX_EXECUTION_TIME(1500) */ SLEEP(2)"},
+		{limited, "select 1", "select /*+ MAX_EXECUTION_TIME(1500) */ 1"},
+		{limited, "UPDATE `books` SET `stock` = 0", "UPDATE `books` SET `stock` = 0"},
+		{context.Background(), "SELECT 1", "SELECT 1"},
+	} {
+		if query := limitedSQL(test.ctx, test.query); query != test.want {
+			t.Errorf("got %s, want %s", query, test.want)
+		}
+	}
+}
+
+func TestStatementContext(t *testing.T) {
+	ctx, cancel := statementContext(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("a statement without WithStatementTimeout has a deadline")
+	}
+
+	limited := withStatementLimits(context.Background(), &txnOptions{statementTimeout: time.Minute})
+	ctx, cancel = statementContext(limited)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("got the deadline %v, %v, want in a minute", deadline, ok)
+	}
+}
+
+func TestIsStatementTimeout(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("get book: %w", context.DeadlineExceeded), true},
+		{&mysql.MySQLError{Number: uint16(ErrMaxExecutionTime), Message: "Query execution was interrupted, maximum statement execution time exceeded"}, true},
+		{context.Canceled, false},
+		{&mysql.MySQLError{Number: uint16(ErrLockWaitTimeout), Message: "Lock wait timeout exceeded"}, false},
+	} {
+		if got := isStatementTimeout(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// A statement interrupted by MAX_EXECUTION_TIME isn't retried by default, WithRetryOnTimeout retries it
+func TestRunTxnStatementTimeoutRetry(t *testing.T) {
+	interrupted := &mysql.MySQLError{Number: uint16(ErrMaxExecutionTime),
+		Message: "Query execution was interrupted, maximum statement execution time exceeded"}
+	for _, test := range []struct {
+		opts     []TxnOption
+		attempts int
+	}{
+		{nil, 1},
+		{[]TxnOption{WithRetryOnTimeout()}, 2},
+	} {
+		t.Run(fmt.Sprintf("%d attempts", test.attempts), func(t *testing.T) {
+			db, mock := newMock(t)
+			noSleep(t)
+			for i := 0; i < test.attempts; i++ {
+				mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT SLEEP(2)").WillReturnError(interrupted)
+				mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+
+			opts := append([]TxnOption{WithMaxRetries(1)}, test.opts...)
+			result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+				slept := 0
+				return conn.QueryRowContext(ctx, "SELECT SLEEP(2)").Scan(&slept)
+			}, opts...)
+			if !isStatementTimeout(err) {
+				t.Errorf("got %v, want the timeout", err)
+			}
+			if result.Attempts != test.attempts {
+				t.Errorf("got %d attempts, want %d", result.Attempts, test.attempts)
+			}
+		})
+	}
+}
+
+// A SELECT SLEEP above the client timeout or the MAX_EXECUTION_TIME of TiDB fails the transaction quickly.
+// It runs once by default and once more with WithRetryOnTimeout and a retry left
+func TestStatementTimeoutsOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	for _, limit := range []struct {
+		name string
+		opt  TxnOption
+	}{
+		{"client", WithStatementTimeout(200 * time.Millisecond)},
+		{"server", WithMaxExecutionTime(200 * time.Millisecond)},
+	} {
+		for _, retry := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s retry %v", limit.name, retry), func(t *testing.T) {
+				opts, want := []TxnOption{limit.opt, WithMaxRetries(1), WithBackoff(time.Millisecond, time.Millisecond)}, 1
+				if retry {
+					opts, want = append(opts, WithRetryOnTimeout()), 2
+				}
+
+				attempts, start := 0, time.Now()
+				_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+					attempts++
+					stmtCtx, cancel := statementContext(ctx)
+					defer cancel()
+					slept := 0
+					if err := conn.QueryRowContext(stmtCtx, limitedSQL(ctx, "SELECT SLEEP(2)")).Scan(&slept); err != nil {
+						return err
+					}
+					if slept == 1 {
+						// TiDB's SLEEP returns 1 instead of failing when MAX_EXECUTION_TIME interrupts it
+						return &mysql.MySQLError{Number: uint16(ErrMaxExecutionTime), Message: "SLEEP interrupted"}
+					}
+					return nil
+				}, opts...)
+				if !isStatementTimeout(err) {
+					t.Errorf("got %v, want the timeout", err)
+				}
+				if attempts != want {
+					t.Errorf("ran %d attempts, want %d", attempts, want)
+				}
+				if elapsed := time.Since(start); elapsed > time.Duration(want)*time.Second {
+					t.Errorf("took %v, the statement wasn't interrupted", elapsed)
+				}
+			})
+		}
+	}
+}
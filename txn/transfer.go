@@ -0,0 +1,127 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// transfer moves amount from the balance of fromID to toID in a pessimistic transaction.
+// Both users are locked in ascending id order, so two opposite transfers wait for each other instead of deadlocking.
+// opts configure the transaction
+func transfer(ctx context.Context, db *sql.DB, fromID, toID int, amount decimal.Decimal, opts ...TxnOption) error {
+	if err := checkTransfer(fromID, toID, amount); err != nil {
+		return err
+	}
+
+	logger.Infof("\nuser %d try to transfer %s to user %d", fromID, amount.String(), toID)
+
+	return runTxn(ctx, db, false, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		users := NewUserRepo(conn)
+
+		locked := make(map[int]User, 2)
+		for _, userID := range lockOrder(fromID, toID) {
+			user, err := users.GetForUpdate(ctx, userID)
+			if err != nil {
+				return err
+			}
+			logger.Infof("%s successful (id: %d)", userSQL(true), userID)
+			locked[userID] = user
+		}
+
+		if locked[fromID].Balance.LessThan(amount) {
+			return ErrBalanceInsufficient
+		}
+
+		if _, err := users.DebitBalance(ctx, fromID, amount); err != nil {
+			return err
+		}
+		logger.Infof("%s successful (id: %d)", debitBalanceSQL(), fromID)
+
+		if _, err := users.CreditBalance(ctx, toID, amount); err != nil {
+			return err
+		}
+		logger.Infof("%s successful (id: %d)", creditBalanceSQL(), toID)
+
+		return nil
+	}, opts...)
+}
+
+// transferTx is transfer built on RunTx: the statements run in a *sql.Tx, so the tutorial shows
+// the idiomatic database/sql transaction next to the BEGIN/COMMIT strings of runTxn
+func transferTx(ctx context.Context, db *sql.DB, fromID, toID int, amount decimal.Decimal, opts ...TxnOption) error {
+	if err := checkTransfer(fromID, toID, amount); err != nil {
+		return err
+	}
+
+	logger.Infof("\nuser %d try to transfer %s to user %d by RunTx", fromID, amount.String(), toID)
+
+	_, err := RunTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		balances := make(map[int]decimal.Decimal, 2)
+		for _, userID := range lockOrder(fromID, toID) {
+			user := User{}
+			err := tx.QueryRowContext(ctx, userSQL(true), userID).Scan(&user.ID, moneyOrZero(&user.Balance), &user.Nickname)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("user %d: %w", userID, ErrUserNotFound)
+			}
+			if err != nil {
+				return err
+			}
+			logger.Infof("%s successful (id: %d)", userSQL(true), userID)
+			balances[userID] = user.Balance
+		}
+
+		if balances[fromID].LessThan(amount) {
+			return ErrBalanceInsufficient
+		}
+
+		if _, err := tx.ExecContext(ctx, debitBalanceSQL(), amount, fromID, amount); err != nil {
+			return err
+		}
+		logger.Infof("%s successful (id: %d)", debitBalanceSQL(), fromID)
+
+		if _, err := tx.ExecContext(ctx, creditBalanceSQL(), amount, toID); err != nil {
+			return err
+		}
+		logger.Infof("%s successful (id: %d)", creditBalanceSQL(), toID)
+
+		return nil
+	}, opts...)
+	return err
+}
+
+// checkTransfer rejects a transfer which moves nothing or moves to the same user
+func checkTransfer(fromID, toID int, amount decimal.Decimal) error {
+	if !amount.IsPositive() {
+		return fmt.Errorf("%w, got %s", ErrInvalidAmount, amount.String())
+	}
+	if fromID == toID {
+		return fmt.Errorf("transfer from user %d to itself", fromID)
+	}
+	return nil
+}
+
+// lockOrder returns the two users in ascending id order, the order both transfers lock them in
+func lockOrder(fromID, toID int) []int {
+	if fromID > toID {
+		return []int{toID, fromID}
+	}
+	return []int{fromID, toID}
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TxFunc runs in a *sql.Tx started by RunTx
+type TxFunc func(ctx context.Context, tx *sql.Tx) error
+
+// txnModeSQL sets the mode of the transactions on the session, BeginTx has no option for it
+func txnModeSQL(optimistic bool) string {
+	if optimistic {
+		return "SET SESSION tidb_txn_mode = 'optimistic'"
+	}
+	return "SET SESSION tidb_txn_mode = 'pessimistic'"
+}
+
+// setTxnMode sets tidb_txn_mode of conn to the mode of options, the returned restore sets the previous mode back
+// before the connection is returned to the pool, or discards conn if it can't.
+// A server without the variable, like MySQL, fails descriptively
+func setTxnMode(ctx context.Context, conn *sql.Conn, options *txnOptions) (restore func(), err error) {
+	txnMode := ""
+	err = conn.QueryRowContext(ctx, "SELECT @@SESSION.tidb_txn_mode").Scan(&txnMode)
+	mysqlErr := &mysql.MySQLError{}
+	if errors.As(err, &mysqlErr) && TiDBErrorCode(mysqlErr.Number) == ErrUnknownSysVar {
+		return nil, fmt.Errorf("the server doesn't know tidb_txn_mode, it is not TiDB: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get transaction mode: %w", err)
+	}
+
+	if _, err = conn.ExecContext(ctx, txnModeSQL(options.optimistic)); err != nil {
+		return nil, fmt.Errorf("set transaction mode: %w", err)
+	}
+	return func() {
+		restoreSession(conn, options.logger, "SET SESSION tidb_txn_mode = ?", txnMode)
+	}, nil
+}
+
+// RunTx is RunTxn built on database/sql transactions: the mode is selected by tidb_txn_mode,
+// the transaction is started by BeginTx with the isolation of opts and ends by tx.Commit or tx.Rollback,
+// so a statement of fn can't escape the transaction. The tidb_txn_mode of the pooled connection is restored afterwards
+func RunTx(ctx context.Context, db *sql.DB, fn TxFunc, opts ...TxnOption) (TxnResult, error) {
+	options := newTxnOptions(opts)
+	if options.preCommitCheck != nil {
+		return TxnResult{}, fmt.Errorf("RunTx doesn't run WithPreCommitCheck, check in the TxFunc instead")
+	}
+	return retryTxn(ctx, db, options, func(ctx context.Context, conn *sql.Conn, result *TxnResult) error {
+		return runTxOnce(ctx, conn, options, result, fn)
+	})
+}
+
+// runTxOnce runs fn in a *sql.Tx on conn once and records the attempt in result, its failure is a *TxnError.
+// If ctx is done before COMMIT, the transaction is rolled back and the error of ctx is returned
+func runTxOnce(ctx context.Context, conn *sql.Conn, options *txnOptions, result *TxnResult, fn TxFunc) error {
+	restore, err := setTxnMode(ctx, conn, options)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: options.isolation})
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	if options.connIDs {
+		connectionID := uint64(0)
+		if err = tx.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&connectionID); err != nil {
+			txRollback(tx, options)
+			return fmt.Errorf("get connection id: %w", err)
+		}
+		result.ConnIDs = append(result.ConnIDs, connectionID)
+	}
+	options.logger.Infof("begin a txn with '%s'", txnModeSQL(options.optimistic))
+
+	err = recoverTxnFunc(options, func() error { return fn(txnFuncContext(ctx, options), tx) })
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// database/sql rolls back the transaction itself when ctx is done
+		txRollback(tx, options)
+		options.logger.Errorf("[runTx] context done, rollback: %+v", ctxErr)
+		options.hooks.rollback(ctxErr)
+		return contextCancelError(ctxErr)
+	}
+
+	if err != nil {
+		options.recordError(err)
+		options.hooks.rollback(err)
+		if rollbackErr := txRollback(tx, options); rollbackErr != nil {
+			return &TxnError{
+				Kind:       ErrTxnFuncFailed,
+				Err:        fmt.Errorf("%w, rollback also failed: %v", classifyTxnError(err), rollbackErr),
+				connBroken: isBadConn(rollbackErr),
+			}
+		}
+		return &TxnError{Kind: ErrTxnFuncFailed, Err: classifyTxnError(err)}
+	}
+
+	err = tx.Commit()
+	options.recordError(err)
+	if err != nil {
+		options.hooks.rollback(err)
+		return &TxnError{Kind: ErrCommitFailed, Err: classifyTxnError(err)}
+	}
+
+	if options.commitTS {
+		commitTS, err := lastCommitTS(ctx, conn)
+		if err != nil {
+			options.logger.Errorf("[runTx] commit success, but failed to read the commit ts: %+v", err)
+			return nil
+		}
+		result.CommitTS = commitTS
+		options.logger.Infof("[runTx] commit success, commit ts: %d", commitTS)
+	} else {
+		options.logger.Infof("[runTx] commit success")
+	}
+
+	return nil
+}
+
+// txRollback rolls back tx and logs the failure, a transaction which is already done isn't a failure
+func txRollback(tx *sql.Tx, options *txnOptions) error {
+	err := tx.Rollback()
+	if err == nil || errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+
+	options.logger.Errorf("[runTx] rollback failed: %+v", err)
+	return err
+}
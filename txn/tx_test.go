@@ -0,0 +1,252 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/shopspring/decimal"
+)
+
+// A failed TxFunc is rolled back by tx.Rollback and the tidb_txn_mode of the session is restored
+func TestRunTxFailedTxFuncRollsBack(t *testing.T) {
+	db, mock := newMock(t)
+	failed := errors.New("failed")
+	mock.ExpectQuery("SELECT @@SESSION.tidb_txn_mode").
+		WillReturnRows(sqlmock.NewRows([]string{"@@SESSION.tidb_txn_mode"}).AddRow("optimistic"))
+	mock.ExpectExec(txnModeSQL(false)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE `books` SET `stock` = 0").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+	mock.ExpectExec("SET SESSION tidb_txn_mode = ?").WithArgs("optimistic").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	_, err := RunTx(context.Background(), db, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE `books` SET `stock` = 0"); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) || !errors.Is(err, ErrTxnFuncFailed) {
+		t.Fatalf("got %v, want the error of the TxFunc", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// After a failed TxFunc the only pooled connection has no open transaction:
+// the change is not visible on it and TiDB lists no transaction of the session
+func TestRunTxFailedTxFuncLeavesNoOpenTxnOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("failed")
+	_, err := RunTx(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE `books` SET `stock` = 0 WHERE `id` = 1"); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v, want the error of the TxFunc", err)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	openTxns := 0
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM INFORMATION_SCHEMA.TIDB_TRX WHERE `SESSION_ID` = CONNECTION_ID()").
+		Scan(&openTxns); err != nil {
+		t.Fatal(err)
+	}
+	if openTxns != 0 {
+		t.Errorf("got %d open transactions on the pooled connection, want 0", openTxns)
+	}
+
+	book, err := GetBook(ctx, conn, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Stock != initialBookStock {
+		t.Errorf("got the stock %d, want the rolled back %d", book.Stock, initialBookStock)
+	}
+
+	txnMode := ""
+	if err := conn.QueryRowContext(ctx, "SELECT @@SESSION.tidb_txn_mode").Scan(&txnMode); err != nil {
+		t.Fatal(err)
+	}
+	if txnMode != "pessimistic" {
+		t.Errorf("got tidb_txn_mode '%s', want the default 'pessimistic' restored", txnMode)
+	}
+}
+
+func txnModeRows(txnMode string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"@@SESSION.tidb_txn_mode"}).AddRow(txnMode)
+}
+
+// WithTxnModeVariable sets tidb_txn_mode before a plain BEGIN and sets it back after the transaction,
+// whether the TxnFunc succeeds or fails
+func TestRunTxnTxnModeVariablePairing(t *testing.T) {
+	failed := errors.New("failed")
+	for _, optimistic := range []bool{false, true} {
+		for _, fnErr := range []error{nil, failed} {
+			t.Run(fmt.Sprintf("optimistic %v error %v", optimistic, fnErr), func(t *testing.T) {
+				db, mock := newMock(t)
+				mock.ExpectQuery("SELECT @@SESSION.tidb_txn_mode").WillReturnRows(txnModeRows("pessimistic"))
+				mock.ExpectExec(txnModeSQL(optimistic)).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("BEGIN").WillReturnResult(sqlmock.NewResult(0, 0))
+				if fnErr == nil {
+					mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+				} else {
+					mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+				mock.ExpectExec("SET SESSION tidb_txn_mode = ?").WithArgs("pessimistic").WillReturnResult(sqlmock.NewResult(0, 0))
+
+				opts := []TxnOption{WithTxnModeVariable()}
+				if optimistic {
+					opts = append(opts, WithOptimistic())
+				}
+				_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+					return fnErr
+				}, opts...)
+				if !errors.Is(err, fnErr) {
+					t.Errorf("got %v, want %v", err, fnErr)
+				}
+			})
+		}
+	}
+}
+
+// A tidb_txn_mode which can't be set back discards the connection, the retry runs on a new one
+func TestRunTxnTxnModeVariableDiscardsOnFailedRestore(t *testing.T) {
+	db, mock, connector := newCountingMock(t)
+	noSleep(t)
+	writeConflict := &mysql.MySQLError{Number: uint16(ErrWriteConflict), Message: "write conflict"}
+	mock.ExpectQuery("SELECT @@SESSION.tidb_txn_mode").WillReturnRows(txnModeRows("pessimistic"))
+	mock.ExpectExec(txnModeSQL(true)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnError(writeConflict)
+	mock.ExpectExec("SET SESSION tidb_txn_mode = ?").WithArgs("pessimistic").WillReturnError(errors.New("connection lost"))
+	mock.ExpectQuery("SELECT @@SESSION.tidb_txn_mode").WillReturnRows(txnModeRows("pessimistic"))
+	mock.ExpectExec(txnModeSQL(true)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("BEGIN").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SET SESSION tidb_txn_mode = ?").WithArgs("pessimistic").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	result, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		return nil
+	}, WithTxnModeVariable(), WithOptimistic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Attempts != 2 {
+		t.Errorf("got %d attempts, want 2", result.Attempts)
+	}
+	if opened := atomic.LoadInt32(&connector.opened); opened != 2 {
+		t.Errorf("opened %d connections, want 2", opened)
+	}
+}
+
+// A server without tidb_txn_mode, like MySQL, fails before the transaction begins
+func TestRunTxnTxnModeVariableUnsupported(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectQuery("SELECT @@SESSION.tidb_txn_mode").WillReturnError(&mysql.MySQLError{
+		Number: uint16(ErrUnknownSysVar), Message: "Unknown system variable 'tidb_txn_mode'"})
+
+	_, err := RunTxn(context.Background(), db, func(ctx context.Context, conn *sql.Conn) error {
+		t.Error("the TxnFunc runs")
+		return nil
+	}, WithTxnModeVariable())
+	if err == nil || !strings.Contains(err.Error(), "it is not TiDB") {
+		t.Errorf("got %v, want the server is not TiDB", err)
+	}
+}
+
+// A failed optimistic transaction by tidb_txn_mode leaves the pooled session in its default mode
+func TestRunTxnTxnModeVariableRestoredOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	failed := errors.New("failed")
+	txnMode := ""
+	_, err := RunTxn(ctx, db, func(ctx context.Context, conn *sql.Conn) error {
+		if err := conn.QueryRowContext(ctx, "SELECT @@SESSION.tidb_txn_mode").Scan(&txnMode); err != nil {
+			return err
+		}
+		return failed
+	}, WithTxnModeVariable(), WithOptimistic())
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v, want the error of the TxnFunc", err)
+	}
+	if txnMode != "optimistic" {
+		t.Errorf("the transaction ran with tidb_txn_mode '%s', want 'optimistic'", txnMode)
+	}
+
+	if err := db.QueryRowContext(ctx, "SELECT @@SESSION.tidb_txn_mode").Scan(&txnMode); err != nil {
+		t.Fatal(err)
+	}
+	if txnMode != "pessimistic" {
+		t.Errorf("got tidb_txn_mode '%s', want the default 'pessimistic' restored", txnMode)
+	}
+}
+
+// The transfers of -sql-tx in opposite directions conserve the total balance,
+// and an insufficient balance transfers nothing
+func TestTransferBothWaysByTxOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := prepareData(ctx, db, false, SeedOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	transferByTx = true
+	t.Cleanup(func() { transferByTx = false })
+
+	if err := transferBothWays(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	balanceOf := func(userID int) decimal.Decimal {
+		balance := decimal.Zero
+		if err := db.QueryRowContext(ctx, "SELECT `balance` FROM `users` WHERE `id` = ?", userID).Scan(&balance); err != nil {
+			t.Fatal(err)
+		}
+		return balance
+	}
+	bob, alice := balanceOf(1), balanceOf(2)
+
+	err := transferTx(ctx, db, 1, 2, bob.Add(decimal.NewFromInt(1)))
+	if !errors.Is(err, ErrBalanceInsufficient) {
+		t.Fatalf("got %v, want %v", err, ErrBalanceInsufficient)
+	}
+	if !balanceOf(1).Equal(bob) || !balanceOf(2).Equal(alice) {
+		t.Errorf("a failed transfer changed the balances")
+	}
+}
@@ -15,58 +15,810 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
 )
 
 func main() {
-	optimistic, alice, bob := parseParams()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(context.Background(), os.Args[1], os.Args[2:]))
+	}
+
+	optimistic, alice, bob, purchase, seed := parseParams()
+
+	stats := &TxnStats{}
+	txnHooks = stats.Hooks()
+
+	var err error
+	code := connectBookshop(func(db *sql.DB) {
+		ctx := context.Background()
+		if err = prepareData(ctx, db, optimistic, seed); err != nil {
+			err = fmt.Errorf("prepare data: %w", err)
+			return
+		}
+		if demoTransfer {
+			err = transferBothWays(ctx, db, purchase.Txn...)
+			return
+		}
+		if loadOptions.Buyers > 0 {
+			if err = loadTest(ctx, db, purchase, loadOptions, optimistic); err == nil {
+				err = verifyState(ctx, db)
+			}
+			return
+		}
+		if demoCart {
+			err = competingCarts(ctx, db, purchase)
+			return
+		}
+		if staleReadAfter > 0 {
+			err = staleReadAfterBuy(ctx, db, purchase, optimistic, alice, staleReadAfter)
+			return
+		}
+		if demoBestEffortCart {
+			err = bestEffortCart(ctx, db, purchase)
+			return
+		}
+		if demoNoWait {
+			err = checkoutsWithoutWaiting(ctx, db, purchase, alice, bob)
+			return
+		}
+		if demoIsolation {
+			err = compareIsolation(ctx, db, purchase)
+			return
+		}
+		if demoLockChains {
+			_, err = demoLockWaitChains(ctx, db)
+			return
+		}
+		if demoDeadlock {
+			var report DeadlockReport
+			if report, err = DemoDeadlock(db); err == nil {
+				fmt.Printf("txn %d was rolled back by TiDB to break the deadlock: %s, txn %d committed\n",
+					report.Victim, report.Err.Message, report.Committed)
+			}
+			return
+		}
+		if demoRestock {
+			err = restockWhileBuying(ctx, db, purchase, optimistic, alice, bob)
+			return
+		}
+		if demoCompensation {
+			err = buyWithFailedPayment(ctx, db, purchase, optimistic, bob)
+			return
+		}
+
+		var before []Book
+		if diffCatalog {
+			if before, _, err = catalogSnapshot(ctx, db); err != nil {
+				return
+			}
+		}
 
-	openDB("mysql", "root:@tcp(127.0.0.1:4000)/bookshop?charset=utf8mb4", func(db *sql.DB) {
-		prepareData(db, optimistic)
-		buy(db, optimistic, alice, bob)
+		var results []PurchaseResult
+		results, err = buy(ctx, db, purchase, optimistic, alice, bob)
+		if err == nil {
+			// the buys are committed, so a new connection out of their transactions sees them
+			if err = assertCommitted(ctx, db, 1, initialBookStock-alice-bob); err == nil {
+				fmt.Println("the committed stock is visible on a new connection")
+			}
+		}
+		if err == nil && demoCancel {
+			err = cancelAll(ctx, db, results, purchase.Txn...)
+		}
+		if diffCatalog {
+			if after, _, snapshotErr := catalogSnapshot(ctx, db); snapshotErr != nil {
+				fmt.Println(snapshotErr)
+			} else {
+				printCatalogDiff(os.Stdout, DiffSnapshots(before, after))
+			}
+		}
+		if purchase.FailAfter != "" {
+			if printErr := printStockAndBalances(ctx, db, purchase.FailAfter); printErr != nil {
+				fmt.Println(printErr)
+			}
+		}
+
+		// the state must hold even if a buy failed, a failed buy must not leave anything behind
+		if verifyErr := verifyState(ctx, db); verifyErr != nil {
+			fmt.Println(verifyErr)
+			if err == nil {
+				err = verifyErr
+			}
+		} else {
+			fmt.Println("state verified: stock and balances are conserved")
+		}
 	})
+	if code != 0 {
+		os.Exit(code)
+	}
+	fmt.Printf("\n[summary] %s\n", stats.Summary())
+
+	if err != nil {
+		fmt.Printf("purchase failed: %s\n", describeBuyError(err))
+		os.Exit(1)
+	}
 }
 
-func buy(db *sql.DB, optimistic bool, alice, bob int) {
+func buy(ctx context.Context, db *sql.DB, options PurchaseOptions, optimistic bool, alice, bob int) ([]PurchaseResult, error) {
 	buyFunc := buyOptimistic
 	if !optimistic {
 		buyFunc = buyPessimistic
 	}
 
 	wg := sync.WaitGroup{}
+	results, errs := make([]PurchaseResult, 2), make([]error, 2)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		buyFunc(db, 1, 1000, 1, 1, bob)
+		results[0], errs[0] = buyFunc(ctx, db, options, 1, 1000, 1, 1, bob)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		buyFunc(db, 2, 1001, 1, 2, alice)
+		results[1], errs[1] = buyFunc(ctx, db, options, 2, 1001, 1, 2, alice)
+	}()
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, result := range results {
+		fmt.Printf("user %d ordered %d books(id: %d), order id: %d\n", result.UserID, result.Amount, result.BookID, result.OrderID)
+	}
+	return results, nil
+}
+
+// printStockAndBalances prints the stock of the book and the balances of the users,
+// after a failure injected after step they are still the seeded ones
+func printStockAndBalances(ctx context.Context, db *sql.DB, step string) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	book, err := GetBook(ctx, conn, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("book %d stock after the failure after %s: %d\n", book.ID, step, book.Stock)
+
+	for _, userID := range []int{1, 2} {
+		user, err := GetUser(ctx, conn, userID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("user %d (%s) balance after the failure after %s: %s\n",
+			user.ID, user.Nickname, step, user.Balance.StringFixed(moneyScale))
+	}
+	return nil
+}
+
+// demoCancel cancels the orders of buy after it and prints the balances, which are back to the initial balance
+var demoCancel = false
+
+// cancelAll cancels the orders made by buy in transactions of opts and prints the balances of the users afterwards
+func cancelAll(ctx context.Context, db *sql.DB, results []PurchaseResult, opts ...TxnOption) error {
+	for _, result := range results {
+		if err := cancelOrder(ctx, db, result.OrderID, opts...); err != nil {
+			return err
+		}
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, userID := range []int{1, 2} {
+		user, err := GetUser(ctx, conn, userID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("user %d (%s) balance after cancel: %s\n", user.ID, user.Nickname, user.Balance.StringFixed(moneyScale))
+	}
+	return nil
+}
+
+// demoTransfer runs transferBothWays instead of buy
+var demoTransfer = false
+
+// transferByTx makes transferBothWays transfer by transferTx, the RunTx variant of transfer
+var transferByTx = false
+
+// transferBothWays transfers between Bob and Alice in opposite directions at the same time in transactions of opts,
+// and checks that the total balance is conserved
+func transferBothWays(ctx context.Context, db *sql.DB, opts ...TxnOption) error {
+	totalBalance := func() (decimal.Decimal, error) {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		defer conn.Close()
+
+		total := decimal.Zero
+		for _, userID := range []int{1, 2} {
+			user, err := GetUser(ctx, conn, userID)
+			if err != nil {
+				return decimal.Zero, err
+			}
+			total = total.Add(user.Balance)
+		}
+		return total, nil
+	}
+
+	before, err := totalBalance()
+	if err != nil {
+		return err
+	}
+
+	transferFunc := transfer
+	if transferByTx {
+		transferFunc = transferTx
+	}
+
+	wg, errs := sync.WaitGroup{}, make([]error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = transferFunc(ctx, db, 1, 2, decimal.NewFromInt(100), opts...)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = transferFunc(ctx, db, 2, 1, decimal.NewFromInt(200), opts...)
+	}()
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	after, err := totalBalance()
+	if err != nil {
+		return err
+	}
+	if !before.Equal(after) {
+		return fmt.Errorf("total balance is not conserved: %s before, %s after", before.String(), after.String())
+	}
+	fmt.Printf("total balance is conserved: %s\n", after.StringFixed(moneyScale))
+	return nil
+}
+
+// demoRestock runs restockWhileBuying instead of buy
+var demoRestock = false
+
+// restockWhileBuying runs a restocker against the two buyers of buy on the same book,
+// then reconciles the stock: initial + restocked - sold == final
+func restockWhileBuying(ctx context.Context, db *sql.DB, options PurchaseOptions, optimistic bool, alice, bob int) error {
+	const bookID, restocked = 1, 5
+
+	stockOf := func() (int, error) {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+
+		book, err := GetBook(ctx, conn, bookID)
+		return book.Stock, err
+	}
+
+	initial, err := stockOf()
+	if err != nil {
+		return err
+	}
+
+	buyFunc := buyOptimistic
+	if !optimistic {
+		buyFunc = buyPessimistic
+	}
+
+	wg, errs := sync.WaitGroup{}, make([]error, 3)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		errs[0] = restock(ctx, db, optimistic, options.Delay/2, bookID, restocked, options.Txn...)
+	}()
+	go func() {
+		defer wg.Done()
+		_, errs[1] = buyFunc(ctx, db, options, 1, 1000, bookID, 1, bob)
+	}()
+	go func() {
+		defer wg.Done()
+		_, errs[2] = buyFunc(ctx, db, options, 2, 1001, bookID, 2, alice)
 	}()
+	wg.Wait()
+
+	if errs[0] != nil {
+		return errs[0]
+	}
+
+	// a buy may fail for the stock, only the committed ones are sold
+	sold := 0
+	for i, amount := range []int{bob, alice} {
+		if errs[i+1] == nil {
+			sold += amount
+		} else if !errors.Is(errs[i+1], ErrStockInsufficient) {
+			return errs[i+1]
+		}
+	}
+
+	final, err := stockOf()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("stock reconciliation: initial %d + restocked %d - sold %d = %d, final %d\n",
+		initial, restocked, sold, initial+restocked-sold, final)
+	if initial+restocked-sold != final {
+		return fmt.Errorf("stock of book %d doesn't reconcile", bookID)
+	}
+	return nil
+}
+
+// demoCart runs competingCarts instead of buy
+var demoCart = false
+
+// competingCarts buys two carts at the same time which compete for the last copies of the demo book,
+// the cart losing the race must leave no order behind
+func competingCarts(ctx context.Context, db *sql.DB, options PurchaseOptions) error {
+	publishedAt := time.Date(2017, 3, 16, 0, 0, 0, 0, time.UTC)
+	err := runTxn(ctx, db, false, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		return NewBookRepo(conn).CreateBook(ctx, Book{ID: 2, Title: "Database Internals", Type: "Science & Technology",
+			PublishedAt: publishedAt, Price: decimal.NewFromInt(80), Stock: 10})
+	}, options.Txn...)
+	if err != nil {
+		return err
+	}
 
+	carts := [][]CartItem{
+		{{BookID: 1, Amount: 6}, {BookID: 2, Amount: 1}},
+		{{BookID: 2, Amount: 1}, {BookID: 1, Amount: 5}},
+	}
+	wg, errs := sync.WaitGroup{}, make([]error, len(carts))
+	for i := range carts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = buyCart(ctx, db, options, 1000+10*i, i+1, carts[i])
+		}(i)
+	}
 	wg.Wait()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for i, cartErr := range errs {
+		orders, err := ListOrdersByUser(ctx, conn, i+1)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case cartErr == nil:
+			fmt.Printf("cart of user %d committed with %d orders\n", i+1, len(orders))
+		case errors.Is(cartErr, ErrStockInsufficient):
+			fmt.Printf("cart of user %d rolled back: %v, %d orders left\n", i+1, cartErr, len(orders))
+			if len(orders) != 0 {
+				return fmt.Errorf("cart of user %d is partially ordered", i+1)
+			}
+		default:
+			return cartErr
+		}
+	}
+	return nil
+}
+
+// staleReadAfter runs staleReadAfterBuy with this staleness instead of buy if it is positive
+var staleReadAfter time.Duration
+
+// staleReadBounded makes staleReadAfterBuy read by readBookBoundedStaleness with staleReadAfter as the bound
+var staleReadBounded = false
+
+// staleReadAfterBuy buys books for Alice, then reads the stock of the book as it was staleness ago and as it is now.
+// It waits a little longer than staleness before buying, so the stale read sees the seeded stock rather than
+// the one before the seeding. With staleReadBounded, it reads as fresh as possible but no older than staleness instead
+func staleReadAfterBuy(ctx context.Context, db *sql.DB, options PurchaseOptions, optimistic bool, amount int, staleness time.Duration) error {
+	fmt.Printf("wait %s before buying, so the seeded stock is older than the staleness\n", staleness+time.Second)
+	if err := sleepContext(ctx, staleness+time.Second); err != nil {
+		return err
+	}
+
+	buyFunc := buyOptimistic
+	if !optimistic {
+		buyFunc = buyPessimistic
+	}
+	if _, err := buyFunc(ctx, db, options, 1, 1001, 1, 2, amount); err != nil {
+		return err
+	}
+
+	var (
+		stale    Book
+		inEffect = staleness
+		err      error
+	)
+	if staleReadBounded {
+		stale, err = readBookBoundedStaleness(ctx, db, 1, staleness)
+	} else {
+		stale, inEffect, err = readBookStaleRead(ctx, db, 1, staleness)
+	}
+	if err != nil {
+		return err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	current, err := GetBook(ctx, conn, 1)
+	if err != nil {
+		return err
+	}
+
+	if staleReadBounded {
+		fmt.Printf("stock of book %d no older than %s: %d, now: %d\n", current.ID, staleness, stale.Stock, current.Stock)
+		return nil
+	}
+	fmt.Printf("stock of book %d %s ago: %d, now: %d\n", current.ID, inEffect, stale.Stock, current.Stock)
+	if stale.Stock == current.Stock {
+		fmt.Println("the stale read sees the buy, it committed earlier than the staleness")
+	}
+	return nil
+}
+
+// demoNoWait runs checkoutsWithoutWaiting instead of buy
+var demoNoWait = false
+
+// demoIsolation runs compareIsolation instead of buy
+var demoIsolation = false
+
+// compareIsolation runs readTwiceWhileBuying at REPEATABLE READ and at READ COMMITTED
+func compareIsolation(ctx context.Context, db *sql.DB, options PurchaseOptions) error {
+	for i, level := range []sql.IsolationLevel{sql.LevelRepeatableRead, sql.LevelReadCommitted} {
+		first, second, err := readTwiceWhileBuying(ctx, db, options, level, 1000+i)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: the first read sees stock %d, the second read after the buy sees %d\n", level, first, second)
+	}
+	return nil
+}
+
+// readTwiceWhileBuying reads the stock of the demo book twice in a pessimistic transaction at level,
+// and Bob buys a book in between. At REPEATABLE READ the second read still sees the snapshot of the first one,
+// at READ COMMITTED it sees the buy committed by Bob
+func readTwiceWhileBuying(ctx context.Context, db *sql.DB, options PurchaseOptions, level sql.IsolationLevel, orderID int) (first, second int, err error) {
+	firstRead, bought := make(chan struct{}), make(chan struct{})
+	readOnce := sync.Once{}
+	signalRead := func() {
+		readOnce.Do(func() { close(firstRead) })
+	}
+	buyErr := make(chan error, 1)
+	go func() {
+		defer close(bought)
+		<-firstRead
+		_, err := buyPessimistic(ctx, db, options, 2, orderID, 1, 1, 1)
+		buyErr <- err
+	}()
+
+	_, err = RunTxn(ctx, db, func(ctx context.Context, conn *sql.Conn) error {
+		defer signalRead()
+		book, err := GetBook(ctx, conn, 1)
+		if err != nil {
+			return err
+		}
+		first = book.Stock
+		signalRead()
+
+		<-bought
+		if book, err = GetBook(ctx, conn, 1); err != nil {
+			return err
+		}
+		second = book.Stock
+		return nil
+	}, WithIsolation(level), WithMaxRetries(0))
+	signalRead()
+	<-bought
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, second, <-buyErr
+}
+
+// demoBestEffortCart runs bestEffortCart instead of buy
+var demoBestEffortCart = false
+
+// bestEffortCart buys a cart of three books for Bob, one of them is out of stock.
+// The sold out item is rolled back to its savepoint, the other two still commit
+func bestEffortCart(ctx context.Context, db *sql.DB, options PurchaseOptions) error {
+	publishedAt := time.Date(2017, 3, 16, 0, 0, 0, 0, time.UTC)
+	err := runTxn(ctx, db, false, retryTimes, func(ctx context.Context, conn *sql.Conn) error {
+		books := NewBookRepo(conn)
+		if err := books.CreateBook(ctx, Book{ID: 2, Title: "Database Internals", Type: "Science & Technology",
+			PublishedAt: publishedAt, Price: decimal.NewFromInt(80), Stock: 10}); err != nil {
+			return err
+		}
+		return books.CreateBook(ctx, Book{ID: 3, Title: "Streaming Systems", Type: "Science & Technology",
+			PublishedAt: publishedAt, Price: decimal.NewFromInt(60), Stock: 0})
+	}, options.Txn...)
+	if err != nil {
+		return err
+	}
+
+	cart := []CartItem{{BookID: 1, Amount: 2}, {BookID: 2, Amount: 1}, {BookID: 3, Amount: 1}}
+	results, err := buyCartBestEffort(ctx, db, options, 1, cart)
+	if err != nil {
+		return err
+	}
+
+	ordered := 0
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Printf("book %d x %d failed and rolled back: %v\n", result.Item.BookID, result.Item.Amount, result.Err)
+			continue
+		}
+		ordered++
+		fmt.Printf("book %d x %d ordered, order id: %d\n", result.Item.BookID, result.Item.Amount, result.OrderID)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	orders, err := ListOrdersByUser(ctx, conn, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("cart of user 1 committed %d of %d items, %d orders in the table\n", ordered, len(cart), len(orders))
+	if len(orders) != ordered {
+		return fmt.Errorf("user 1 has %d orders, but %d items are ordered", len(orders), ordered)
+	}
+	return nil
+}
+
+// describeBuyError explains the business failures of a buy, other errors are printed as is
+func describeBuyError(err error) string {
+	switch {
+	case errors.Is(err, ErrBookNotFound):
+		return "the book doesn't exist"
+	case errors.Is(err, ErrUserNotFound):
+		return "the user doesn't exist"
+	case errors.Is(err, ErrOrderNotFound):
+		return "the order doesn't exist or is already cancelled"
+	case errors.Is(err, ErrStockInsufficient):
+		return "the books are sold out, not enough stock left for the order"
+	case errors.Is(err, ErrBalanceInsufficient):
+		return "the user can't afford the order"
+	case isStatementTimeout(err):
+		return fmt.Sprintf("a statement timed out, the transaction is rolled back: %v", err)
+	case errors.Is(err, ErrRowLocked):
+		return "the book is being purchased by someone else, try again"
+	case errors.Is(err, ErrConstraintViolated):
+		return fmt.Sprintf("a constraint is violated, the transaction is rolled back without a retry: %v", err)
+	case errors.Is(err, ErrInjected):
+		return fmt.Sprintf("the failure is injected by -fail-after and rolled back: %v", err)
+	case errors.As(err, new(*PanicError)):
+		return fmt.Sprintf("the transaction panicked and rolled back: %v", err)
+	case errors.Is(err, ErrInvalidAmount):
+		return fmt.Sprintf("the order amount is invalid: %v", err)
+	default:
+		return fmt.Sprintf("%+v", err)
+	}
 }
 
-func openDB(driverName, dataSourceName string, runnable func(db *sql.DB)) {
+// openDB opens the database and runs runnable on it if it can be connected
+func openDB(driverName, dataSourceName string, runnable func(db *sql.DB)) error {
 	db, err := sql.Open(driverName, dataSourceName)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer db.Close()
 
+	if err = db.Ping(); err != nil {
+		return err
+	}
+
 	runnable(db)
+	return nil
 }
 
-func parseParams() (optimistic bool, alice, bob int) {
+func parseParams() (optimistic bool, alice, bob int, purchase PurchaseOptions, seed SeedOptions) {
+	registerSharedFlags(flag.CommandLine)
+	aliasFlag(flag.CommandLine, "user", "db-user")
+	purchase = defaultPurchaseOptions()
+	registerPurchaseFlags(flag.CommandLine, &purchase)
 	flag.BoolVar(&optimistic, "o", false, "transaction is optimistic")
 	flag.IntVar(&alice, "a", 4, "Alice bought num")
 	flag.IntVar(&bob, "b", 6, "Bob bought num")
+	flag.BoolVar(&demoTransfer, "transfer", false, "transfer between the users in opposite directions instead of buying")
+	flag.BoolVar(&transferByTx, "sql-tx", false, "run the transfers of -transfer in a *sql.Tx by RunTx instead of BEGIN/COMMIT statements")
+	flag.IntVar(&loadOptions.Buyers, "load-buyers", loadOptions.Buyers,
+		"run a load test with this many concurrent buyers instead of buying, 0 disables it")
+	flag.IntVar(&loadOptions.Purchases, "load-purchases", loadOptions.Purchases, "purchases per buyer of the load test")
+	flag.DurationVar(&loadOptions.PoolWatch, "load-pool-watch", loadOptions.PoolWatch,
+		"poll the connection pool at this interval during the load test and report its saturation, 0 disables it")
+	flag.Float64Var(&loadOptions.Zipf, "load-zipf", 0,
+		"spread the purchases of the load test over all the books by a Zipf distribution of this parameter, greater than 1, 0 buys the demo book only")
+	flag.Int64Var(&loadOptions.Seed, "load-seed", loadOptions.Seed, "seed of the books and users of -load-zipf, the same seed buys the same books")
+	flag.BoolVar(&failFastWhenPaused, "load-pause-fail-fast", false,
+		"fail the buys while the load test is paused by SIGUSR1 instead of blocking them until resumed")
+	flag.BoolVar(&demoCart, "cart", false, "buy two carts competing for the last copies of a book instead of buying")
+	flag.DurationVar(&staleReadAfter, "stale-read", 0,
+		"buy, then read the stock as of this staleness ago with AS OF TIMESTAMP instead of buying, 0 disables it")
+	flag.BoolVar(&staleReadBounded, "stale-read-bounded", false,
+		"read the stock of -stale-read by TIDB_BOUNDED_STALENESS, as fresh as possible but no older than -stale-read")
+	flag.BoolVar(&demoNoWait, "nowait", false,
+		"buy by FOR UPDATE NOWAIT at the same time, the buyer without the lock fails fast, instead of buying")
+	flag.BoolVar(&demoIsolation, "isolation", false,
+		"read the stock twice while a buy commits in between, at REPEATABLE READ and at READ COMMITTED, instead of buying")
+	flag.BoolVar(&demoBestEffortCart, "cart-best-effort", false,
+		"buy a cart of three books, one sold out, with a savepoint per item instead of buying")
+	flag.BoolVar(&demoRestock, "restock", false, "restock the book while buying it and reconcile the stock afterwards")
+	flag.BoolVar(&demoLockChains, "lock-chains", false,
+		"make three pessimistic transactions wait for each other in a chain and print the chain instead of buying")
+	flag.BoolVar(&demoDeadlock, "deadlock", false,
+		"lock the demo users in opposite order on two pessimistic transactions and print which one TiDB rolls back")
+	flag.BoolVar(&diffCatalog, "diff-catalog", false, "print the stock and price changes of the books made by the buys")
+	flag.BoolVar(&demoCancel, "cancel", false, "cancel the orders after buying and print the refunded balances")
+	flag.BoolVar(&demoCompensation, "fail-payment", false,
+		"buy for Bob with a payment failing after the commit, the order is reversed by cancelling it")
+	flag.BoolVar(&seed.Reset, "reset", false, "delete all the books, users and orders before seeding")
+	flag.IntVar(&seed.Books, "seed-books", 0, "seed this many random books by bulk insert after the demo book, 0 disables it")
+	flag.BoolVar(&seedLoadData, "seed-load-data", false,
+		"seed the books of -seed-books by LOAD DATA LOCAL INFILE, falling back to bulk insert if the server rejects it")
 
 	flag.Parse()
+	if err := loadConfigFile(flag.CommandLine); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if err := purchase.validate(); err != nil {
+		fmt.Printf("invalid -fail-after: %v\n", err)
+		os.Exit(2)
+	}
+	if seed.Books < 0 {
+		fmt.Printf("invalid -seed-books: must not be negative, got %d\n", seed.Books)
+		os.Exit(2)
+	}
+	if staleReadBounded && staleReadAfter == 0 {
+		fmt.Println("invalid -stale-read-bounded: requires -stale-read")
+		os.Exit(2)
+	}
+	if staleReadAfter%time.Second != 0 {
+		fmt.Printf("invalid -stale-read: must be whole seconds, got %s\n", staleReadAfter)
+		os.Exit(2)
+	}
 
-	return optimistic, alice, bob
+	purchase.Txn = flagTxnOptions()
+	seed.Txn = purchase.Txn
+	return optimistic, alice, bob, purchase, seed
+}
+
+// logConnectionID records the TiDB connection id of each attempt by WithConnIDs, it costs an extra round-trip
+var logConnectionID = false
+
+// logCommitTS records the commit ts of each committed transaction by WithCommitTS, it costs an extra round-trip
+var logCommitTS = false
+
+// txnModeVariable selects the mode by tidb_txn_mode instead of BEGIN PESSIMISTIC or BEGIN OPTIMISTIC by WithTxnModeVariable
+var txnModeVariable = false
+
+// planCacheDisabled turns off the prepared plan cache of the transactions by WithPlanCacheDisabled, set by -no-plan-cache
+var planCacheDisabled = false
+
+// backoffMin and backoffMax bound the delay between the retries by WithBackoff
+var backoffMin, backoffMax = txnBackoff.Base, txnBackoff.Cap
+
+// quietTxn drops the diagnostics of the transaction runner by WithLogger, the buys still print their own
+var quietTxn = false
+
+// flagTxnOptions returns the options of the transaction flags shared by the demo and the subcommands,
+// they're passed to the transactions of the demo and of a subcommand by PurchaseOptions.Txn and the like
+func flagTxnOptions() []TxnOption {
+	opts := append(statementTxnOptions(), WithBackoff(backoffMin, backoffMax))
+	if txnModeVariable {
+		opts = append(opts, WithTxnModeVariable())
+	}
+	if planCacheDisabled {
+		opts = append(opts, WithPlanCacheDisabled())
+	}
+	if logConnectionID {
+		opts = append(opts, WithConnIDs())
+	}
+	if logCommitTS {
+		opts = append(opts, WithCommitTS())
+	}
+	if quietTxn {
+		opts = append(opts, WithLogger(NopLogger{}))
+	}
+	return opts
+}
+
+// registerSharedFlags registers the flags shared by the demo and all the subcommands on fs
+func registerSharedFlags(fs *flag.FlagSet) {
+	fs.StringVar(&connConfig.Host, "host", envOr("TIDB_HOST", "127.0.0.1"), "TiDB host, or env TIDB_HOST")
+	fs.StringVar(&connConfig.Port, "port", envOr("TIDB_PORT", "4000"), "TiDB port, or env TIDB_PORT")
+	fs.StringVar(&connConfig.User, "db-user", envOr("TIDB_USER", "root"), "TiDB user, or env TIDB_USER")
+	fs.StringVar(&connConfig.Password, "password", envOr("TIDB_PASSWORD", ""), "TiDB password, or env TIDB_PASSWORD")
+	fs.StringVar(&connConfig.Database, "db", envOr("TIDB_DB_NAME", "bookshop"), "database name, or env TIDB_DB_NAME")
+	fs.StringVar(&connConfig.TLS, "tls", envOr("TIDB_TLS", ""),
+		"TLS mode: false, true (verify by the system CA pool), skip-verify or custom (verify by -ssl-ca), or env TIDB_TLS")
+	fs.StringVar(&connConfig.SSLCA, "ssl-ca", envOr("TIDB_SSL_CA", ""), "CA file to verify the server, implies -tls custom, or env TIDB_SSL_CA")
+	fs.BoolVar(&skipDDL, "skip-ddl", false, "don't create the database and the tables if they don't exist")
+	fs.BoolVar(&logConnectionID, "conn-id", false, "log the connection id of each attempt")
+	fs.BoolVar(&logCommitTS, "commit-ts", false, "record and log the commit ts of each committed transaction")
+	fs.Var(roundingFlag{}, "rounding", "rounding of the money computations like the averages and the price adjustments, half-up or half-even")
+	fs.Var(replayGuardFlag{}, "replay-guard",
+		"remember this many order ids committed by the process and skip a buy replaying one, 0 disables it")
+	fs.IntVar(&orderNoCache, "sequence-cache", orderNoCache, "CACHE of the sequence seq_order_no when it's created")
+	fs.BoolVar(&txnModeVariable, "txn-mode-variable", false, "select the transaction mode by tidb_txn_mode and start by a plain BEGIN")
+	fs.BoolVar(&planCacheDisabled, "no-plan-cache", false, "turn off the prepared plan cache for each transaction to rule out a stale plan")
+	fs.DurationVar(&statementTimeout, "statement-timeout", 0, "cancel a statement of a transaction after this long on the client, 0 disables it")
+	fs.DurationVar(&maxExecutionTime, "max-execution-time", 0,
+		"let TiDB interrupt a SELECT of a transaction after this long by MAX_EXECUTION_TIME, 0 disables it")
+	fs.BoolVar(&retryOnTimeout, "retry-on-timeout", false, "retry a transaction whose statement timed out")
+	fs.DurationVar(&backoffMin, "backoff", backoffMin, "base delay between the retries, doubled on each retry")
+	fs.DurationVar(&backoffMax, "backoff-max", backoffMax, "max delay between the retries, must not be below -backoff")
+	fs.BoolVar(&quietTxn, "quiet-txn", false, "drop the diagnostics of the transaction runner, like the retries and the commits")
+	fs.Var(logModeFlag{}, "log-mode", "summary logs one line per transaction, statement logs each statement of the buys and each step of the runner")
+	fs.StringVar(&configFile, "config", "", "TOML config file, the flags given on the command line override it")
+}
+
+// connectBookshop validates connConfig, creates the schema unless skipDDL and runs runnable on the database.
+// It prints the failure and returns the exit code, which is zero if runnable ran
+func connectBookshop(runnable func(db *sql.DB)) int {
+	if err := connConfig.Validate(); err != nil {
+		fmt.Printf("invalid connection config: %v\n", err)
+		return 2
+	}
+	if err := connConfig.RegisterTLS(); err != nil {
+		fmt.Printf("invalid TLS config: %v\n", err)
+		return 2
+	}
+
+	if !skipDDL {
+		// connect without the database, ensureSchema creates it
+		bootstrapConfig := connConfig
+		bootstrapConfig.Database = ""
+
+		var err error
+		openErr := openDB("mysql", bootstrapConfig.DSN(), func(db *sql.DB) {
+			err = ensureSchema(context.Background(), db, connConfig.Database)
+		})
+		if openErr != nil {
+			err = openErr
+		}
+		if err != nil {
+			fmt.Printf("failed to create the schema, run with -skip-ddl if it is managed separately: %v\n", err)
+			return 1
+		}
+	}
+
+	if err := openDB("mysql", connConfig.DSN(), runnable); err != nil {
+		fmt.Printf("failed to connect to TiDB at %s as %s: %v\n",
+			net.JoinHostPort(connConfig.Host, connConfig.Port), connConfig.User, err)
+		return 1
+	}
+	return 0
 }
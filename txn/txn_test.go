@@ -0,0 +1,38 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// A wrapped sentinel is still described by its business failure
+func TestDescribeBuyError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("book 2: %w", ErrBookNotFound), "the book doesn't exist"},
+		{fmt.Errorf("user 3: %w", ErrUserNotFound), "the user doesn't exist"},
+		{&TxnError{Kind: ErrTxnFuncFailed, Err: ErrStockInsufficient}, "the books are sold out, not enough stock left for the order"},
+		{&TxnError{Kind: ErrTxnFuncFailed, Err: ErrBalanceInsufficient}, "the user can't afford the order"},
+		{fmt.Errorf("%w, got 0", ErrInvalidAmount), "the order amount is invalid: amount must be positive, got 0"},
+	} {
+		if got := describeBuyError(test.err); got != test.want {
+			t.Errorf("got '%s' for %v, want '%s'", got, test.err, test.want)
+		}
+	}
+}
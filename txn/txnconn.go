@@ -0,0 +1,86 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// TxnConn is a thin wrapper of *sql.Conn which closes the rows of the previous query
+// before issuing a new statement, TiDB can't run a statement on a connection with unread rows
+type TxnConn struct {
+	conn *sql.Conn
+	rows *sql.Rows
+}
+
+// TxnConnFunc is a TxnFunc which runs its statements on a *TxnConn
+type TxnConnFunc func(ctx context.Context, conn *TxnConn) error
+
+// RunTxnConn is RunTxn running fn on a *TxnConn, so fn doesn't need to close its rows:
+// they're closed by its next statement, and the ones left open are closed before COMMIT
+func RunTxnConn(ctx context.Context, db *sql.DB, fn TxnConnFunc, opts ...TxnOption) (TxnResult, error) {
+	return RunTxn(ctx, db, func(ctx context.Context, conn *sql.Conn) error {
+		txnConn := newTxnConn(conn)
+		defer txnConn.Close()
+
+		return fn(ctx, txnConn)
+	}, opts...)
+}
+
+func newTxnConn(conn *sql.Conn) *TxnConn {
+	return &TxnConn{conn: conn}
+}
+
+func (c *TxnConn) closeRows() {
+	if c.rows != nil {
+		c.rows.Close()
+		c.rows = nil
+	}
+}
+
+// Query closes the previous rows and runs query, the returned rows are closed by the next statement or Close
+func (c *TxnConn) Query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	c.closeRows()
+
+	rows, err := c.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		logFailedStatement(query, args, err)
+		return nil, err
+	}
+
+	c.rows = rows
+	return rows, nil
+}
+
+// Exec closes the previous rows and runs query
+func (c *TxnConn) Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	c.closeRows()
+
+	result, err := c.conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		logFailedStatement(query, args, err)
+	}
+	return result, err
+}
+
+func logFailedStatement(query string, args []interface{}, err error) {
+	logger.Errorf("[debug] statement failed: %v, interpolated for debugging only: %s", err, interpolateSQL(query, args...))
+}
+
+// Close closes the rows still open, the connection is left to its owner
+func (c *TxnConn) Close() {
+	c.closeRows()
+}
@@ -0,0 +1,93 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// twoQueries reads two rows by two queries without closing the rows of either
+func twoQueries(got *[]int) TxnConnFunc {
+	return func(ctx context.Context, conn *TxnConn) error {
+		for _, id := range []int{1, 2} {
+			rows, err := conn.Query(ctx, "SELECT `id` FROM `books` WHERE `id` = ?", id)
+			if err != nil {
+				return err
+			}
+			if rows.Next() {
+				value := 0
+				if err = rows.Scan(&value); err != nil {
+					return err
+				}
+				*got = append(*got, value)
+			}
+		}
+		return nil
+	}
+}
+
+// The rows of the first query are closed by the second one, and the rows of the second one before COMMIT
+func TestRunTxnConnClosesRows(t *testing.T) {
+	db, mock := newMock(t)
+	mock.ExpectExec("BEGIN PESSIMISTIC").WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, id := range []int{1, 2} {
+		mock.ExpectQuery("SELECT `id` FROM `books` WHERE `id` = ?").WithArgs(id).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id)).RowsWillBeClosed()
+	}
+	mock.ExpectExec("COMMIT").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	var got []int
+	if _, err := RunTxnConn(context.Background(), db, twoQueries(&got)); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("got the ids %v, want [1 2]", got)
+	}
+}
+
+// TiDB can't run a statement on a connection with unread rows, the second query only succeeds
+// if the rows of the first one are closed
+func TestRunTxnConnOnTiDB(t *testing.T) {
+	db := openTestDB(t)
+	createTestBooks(t, db, testBook(1, "Novel", "10.00", 1), testBook(2, "Arts", "10.00", 1),
+		testBook(3, "Life", "10.00", 1))
+
+	var got []int
+	if _, err := RunTxnConn(context.Background(), db, func(ctx context.Context, conn *TxnConn) error {
+		// both queries have more rows than they read
+		for i := 0; i < 2; i++ {
+			rows, err := conn.Query(ctx, "SELECT `id` FROM `books` ORDER BY `id`")
+			if err != nil {
+				return err
+			}
+			value := 0
+			if rows.Next() {
+				if err = rows.Scan(&value); err != nil {
+					return err
+				}
+			}
+			got = append(got, value)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 1 {
+		t.Errorf("got the ids %v, want [1 1]", got)
+	}
+}
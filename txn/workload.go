@@ -0,0 +1,68 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// BuyRequest is a user buying amount books
+type BuyRequest struct {
+	BookID int
+	UserID int
+	Amount int
+}
+
+// BuyerGenerator generates buy requests concentrated on the popular books by the Zipf distribution
+type BuyerGenerator struct {
+	random    *rand.Rand
+	zipf      *rand.Zipf
+	books     []int
+	users     []int
+	maxAmount int
+}
+
+// newBuyerGenerator creates a generator from seed, books are ordered from the most popular one.
+// The Zipf parameter s must be greater than 1, the larger it is the hotter the first books are
+func newBuyerGenerator(seed int64, s float64, books, users []int, maxAmount int) (*BuyerGenerator, error) {
+	if s <= 1 {
+		return nil, fmt.Errorf("zipf parameter must be greater than 1, got %v", s)
+	}
+	if len(books) == 0 || len(users) == 0 {
+		return nil, fmt.Errorf("books and users must not be empty")
+	}
+	if maxAmount <= 0 {
+		return nil, fmt.Errorf("max amount must be positive, got %d", maxAmount)
+	}
+
+	random := rand.New(rand.NewSource(seed))
+	return &BuyerGenerator{
+		random:    random,
+		zipf:      rand.NewZipf(random, s, 1, uint64(len(books)-1)),
+		books:     books,
+		users:     users,
+		maxAmount: maxAmount,
+	}, nil
+}
+
+// Next returns the next buy request
+func (g *BuyerGenerator) Next() BuyRequest {
+	return BuyRequest{
+		BookID: g.books[g.zipf.Uint64()],
+		UserID: g.users[g.random.Intn(len(g.users))],
+		Amount: g.random.Intn(g.maxAmount) + 1,
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The purchases concentrate on the first books, each book is bought less often than the one before it
+func TestBuyerGeneratorSkewsToHotBooks(t *testing.T) {
+	books := []int{11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	generator, err := newBuyerGenerator(1, 1.5, books, []int{1, 2}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const draws = 10000
+	bought := map[int]int{}
+	for i := 0; i < draws; i++ {
+		request := generator.Next()
+		if request.Amount < 1 || request.Amount > 3 {
+			t.Fatalf("got the amount %d, want 1 to 3", request.Amount)
+		}
+		bought[request.BookID]++
+	}
+
+	if hot := bought[books[0]] + bought[books[1]]; hot < draws/2 {
+		t.Errorf("the two hot books got %d of %d purchases, want at least half", hot, draws)
+	}
+	for i := 1; i < 4; i++ {
+		if bought[books[i]] >= bought[books[i-1]] {
+			t.Errorf("book %d got %d purchases, not fewer than the %d of book %d",
+				books[i], bought[books[i]], bought[books[i-1]], books[i-1])
+		}
+	}
+}
+
+func TestBuyerGeneratorSameSeed(t *testing.T) {
+	draw := func(seed int64) []BuyRequest {
+		generator, err := newBuyerGenerator(seed, 1.2, []int{1, 2, 3}, []int{1, 2}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests := make([]BuyRequest, 100)
+		for i := range requests {
+			requests[i] = generator.Next()
+		}
+		return requests
+	}
+
+	if !reflect.DeepEqual(draw(42), draw(42)) {
+		t.Error("the same seed generated different requests")
+	}
+	if reflect.DeepEqual(draw(42), draw(43)) {
+		t.Error("different seeds generated the same requests")
+	}
+}
+
+func TestNewBuyerGeneratorRejectsBadParameters(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		s         float64
+		books     []int
+		maxAmount int
+	}{
+		{"uniform", 1, []int{1}, 1},
+		{"no books", 1.2, nil, 1},
+		{"no amount", 1.2, []int{1}, 0},
+	} {
+		if _, err := newBuyerGenerator(1, test.s, test.books, []int{1}, test.maxAmount); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}